@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+	"github.com/uso/uso/internal/payouts"
+	"github.com/uso/uso/internal/points"
+	"github.com/uso/uso/internal/referrals"
+	"github.com/uso/uso/internal/services"
+)
+
+// expirePendingBookings moves pending bookings that were not answered within
+// models.BookingResponseWindow of being confirmed to expired, releases the authorization hold on
+// the guest's card and notifies both sides. email may be nil, in which case
+// no notifications are sent.
+func expirePendingBookings(db *database.DB, pay payments.Provider, email *services.EmailService) func(ctx context.Context) error {
+	machine := booking.NewMachine(db)
+
+	return func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT b.id, b.stripe_payment_intent_id, b.starts_at,
+			       b.location, b.amount, b.currency,
+			       g.email, g.name, c.email, c.name
+			FROM bookings b
+			JOIN users g ON b.guest_id = g.id
+			JOIN users c ON b.cast_id = c.id
+			WHERE b.status = $1 AND b.confirmed_at < $2
+			ORDER BY b.confirmed_at
+			LIMIT 100
+		`, models.BookingStatusPending, time.Now().Add(-models.BookingResponseWindow))
+		if err != nil {
+			return fmt.Errorf("error querying pending bookings: %w", err)
+		}
+
+		type expiredBooking struct {
+			id                    int
+			paymentIntentID       sql.NullString
+			startsAt              time.Time
+			location              string
+			amount                models.Money
+			guestEmail, guestName string
+			castEmail, castName   string
+		}
+
+		var bookings []expiredBooking
+		for rows.Next() {
+			var b expiredBooking
+			if err := rows.Scan(&b.id, &b.paymentIntentID, &b.startsAt,
+				&b.location, &b.amount.Amount, &b.amount.Currency, &b.guestEmail, &b.guestName,
+				&b.castEmail, &b.castName); err != nil {
+				log.Printf("Error scanning pending booking: %v", err)
+				continue
+			}
+			bookings = append(bookings, b)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading pending bookings: %w", err)
+		}
+
+		for _, b := range bookings {
+			// Claim the booking first so a late response from the cast and the
+			// expiry can't both succeed.
+			err := machine.Transition(booking.Transition{
+				BookingID: b.id,
+				From:      models.BookingStatusPending,
+				To:        models.BookingStatusExpired,
+				Actor:     booking.System,
+				Reason:    "cast did not respond in time",
+			})
+			if errors.Is(err, booking.ErrStatusChanged) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error expiring booking %d: %v", b.id, err)
+				continue
+			}
+
+			if b.paymentIntentID.Valid {
+				paymentStatus := models.PaymentStatusCanceled
+				err := pay.Cancel(b.paymentIntentID.String)
+				if err != nil {
+					log.Printf("Error cancelling payment intent %s: %v", b.paymentIntentID.String, err)
+					paymentStatus = models.PaymentStatusAuthorized
+				}
+				if err := machine.SetPaymentStatus(b.id, booking.System, paymentStatus, err); err != nil {
+					log.Printf("Error recording payment status for booking %d: %v", b.id, err)
+				}
+			}
+			if err := booking.CancelExtraPayments(db, pay, b.id); err != nil {
+				log.Printf("Error cancelling extra payments for booking %d: %v", b.id, err)
+			}
+
+			log.Printf("Expired booking %d", b.id)
+
+			if email == nil {
+				continue
+			}
+
+			details := services.BookingDetails{
+				ID:       strconv.Itoa(b.id),
+				DateTime: b.startsAt.In(booking.Tokyo).Format("2006-01-02 15:04"),
+				Location: b.location,
+				Amount:   b.amount.String(),
+			}
+			if err := email.SendBookingExpiredToGuest(b.guestEmail, b.guestName, b.castName, details); err != nil {
+				log.Printf("Error sending expiry email to guest for booking %d: %v", b.id, err)
+			}
+			if err := email.SendBookingExpiredToCast(b.castEmail, b.castName, b.guestName, details); err != nil {
+				log.Printf("Error sending expiry email to cast for booking %d: %v", b.id, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// expireHeldBookings releases slots held by guests who never finished paying.
+// The PaymentIntent is cancelled so a late confirmation can't authorize it.
+// Nobody is notified, the cast never saw the hold.
+func expireHeldBookings(db *database.DB, pay payments.Provider) func(ctx context.Context) error {
+	machine := booking.NewMachine(db)
+
+	return func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, stripe_payment_intent_id
+			FROM bookings
+			WHERE status = $1 AND hold_expires_at < $2
+			ORDER BY hold_expires_at
+			LIMIT 100
+		`, models.BookingStatusHeld, time.Now())
+		if err != nil {
+			return fmt.Errorf("error querying held bookings: %w", err)
+		}
+
+		type heldBooking struct {
+			id              int
+			paymentIntentID sql.NullString
+		}
+
+		var bookings []heldBooking
+		for rows.Next() {
+			var b heldBooking
+			if err := rows.Scan(&b.id, &b.paymentIntentID); err != nil {
+				log.Printf("Error scanning held booking: %v", err)
+				continue
+			}
+			bookings = append(bookings, b)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading held bookings: %w", err)
+		}
+
+		for _, b := range bookings {
+			// Claim first so a confirmation racing the sweep can't also win
+			err := machine.Transition(booking.Transition{
+				BookingID: b.id,
+				From:      models.BookingStatusHeld,
+				To:        models.BookingStatusExpired,
+				Actor:     booking.System,
+				Reason:    "hold expired before payment",
+			})
+			if errors.Is(err, booking.ErrStatusChanged) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error expiring hold %d: %v", b.id, err)
+				continue
+			}
+
+			if b.paymentIntentID.Valid {
+				paymentStatus := models.PaymentStatusCanceled
+				err := pay.Cancel(b.paymentIntentID.String)
+				if err != nil {
+					log.Printf("Error cancelling payment intent %s: %v", b.paymentIntentID.String, err)
+					paymentStatus = models.PaymentStatusRequiresPayment
+				}
+				if err := machine.SetPaymentStatus(b.id, booking.System, paymentStatus, err); err != nil {
+					log.Printf("Error recording payment status for booking %d: %v", b.id, err)
+				}
+			}
+
+			log.Printf("Released hold %d", b.id)
+		}
+
+		return nil
+	}
+}
+
+// purgeIdempotencyKeys forgets stored responses older than ttl, after which
+// clients may reuse the key.
+func purgeIdempotencyKeys(db *database.DB, ttl time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		result, err := db.ExecContext(ctx, `
+			DELETE FROM idempotency_keys WHERE created_at < $1
+		`, time.Now().Add(-ttl))
+		if err != nil {
+			return fmt.Errorf("error purging idempotency keys: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Purged %d idempotency keys", n)
+		}
+		return nil
+	}
+}
+
+const (
+	// A webhook event that keeps failing is retried with exponential backoff
+	// and given up on after maxStripeEventAttempts.
+	maxStripeEventAttempts = 10
+	maxStripeEventBackoff  = time.Hour
+)
+
+// processStripeEvents applies queued webhook events in the order Stripe sent
+// them. A failed event is retried later without holding up the rest.
+func processStripeEvents(db *database.DB, pay payments.Provider) func(ctx context.Context) error {
+	machine := booking.NewMachine(db)
+	payer := payouts.New(db, pay)
+
+	return func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, payload, attempts
+			FROM stripe_events
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY received_at
+			LIMIT 100
+		`, time.Now())
+		if err != nil {
+			return fmt.Errorf("error querying stripe events: %w", err)
+		}
+
+		type queuedEvent struct {
+			id       string
+			payload  []byte
+			attempts int
+		}
+
+		var events []queuedEvent
+		for rows.Next() {
+			var e queuedEvent
+			if err := rows.Scan(&e.id, &e.payload, &e.attempts); err != nil {
+				log.Printf("Error scanning stripe event: %v", err)
+				continue
+			}
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading stripe events: %w", err)
+		}
+
+		for _, e := range events {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			event, err := pay.DecodeEvent(e.payload)
+			if err == nil {
+				err = machine.HandlePaymentEvent(event)
+			}
+			if err == nil {
+				err = payer.HandleEvent(event)
+			}
+
+			if err == nil {
+				_, err = db.Exec(`
+					UPDATE stripe_events
+					SET status = 'processed', attempts = attempts + 1, last_error = NULL, processed_at = $1
+					WHERE id = $2
+				`, time.Now(), e.id)
+				if err != nil {
+					log.Printf("Error marking stripe event %s processed: %v", e.id, err)
+				}
+				continue
+			}
+
+			log.Printf("Error processing stripe event %s: %v", e.id, err)
+			status := "pending"
+			if e.attempts+1 >= maxStripeEventAttempts {
+				status = "failed"
+			}
+			backoff := time.Duration(1<<e.attempts) * time.Minute
+			if backoff > maxStripeEventBackoff {
+				backoff = maxStripeEventBackoff
+			}
+			if _, err := db.Exec(`
+				UPDATE stripe_events
+				SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+				WHERE id = $4
+			`, status, err.Error(), time.Now().Add(backoff), e.id); err != nil {
+				log.Printf("Error recording failure of stripe event %s: %v", e.id, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// payCasts runs the weekly payout batch, transferring what every cast is owed
+// to their connected account. It runs more often than weekly so a batch that
+// failed is retried, but pays out once a week after day starts in Tokyo.
+func payCasts(db *database.DB, pay payments.Provider, day time.Weekday) func(ctx context.Context) error {
+	payer := payouts.New(db, pay)
+
+	return func(ctx context.Context) error {
+		week := payouts.BatchWeek(time.Now(), day)
+
+		var done bool
+		err := db.QueryRowContext(ctx, `
+			SELECT EXISTS(SELECT 1 FROM payout_batches WHERE week_of = $1 AND finished_at IS NOT NULL)
+		`, week).Scan(&done)
+		if err != nil {
+			return fmt.Errorf("error checking payout batch: %w", err)
+		}
+		if done {
+			return nil
+		}
+
+		if err := payer.PayAll(ctx); err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO payout_batches (week_of, finished_at) VALUES ($1, $2)
+			ON CONFLICT (week_of) DO UPDATE SET finished_at = EXCLUDED.finished_at
+		`, week, time.Now())
+		if err != nil {
+			return fmt.Errorf("error recording payout batch: %w", err)
+		}
+		log.Printf("Payout batch for the week of %s finished", week.Format("2006-01-02"))
+		return nil
+	}
+}
+
+// expirePoints writes off guests' points that have lapsed unspent.
+func expirePoints(db *database.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		n, err := points.Expire(db, time.Now())
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Expired %d points", n)
+		}
+		return nil
+	}
+}
+
+// rewardCatchUp is how far back rewardCompletedBookings looks for completed
+// bookings whose points were never credited.
+const rewardCatchUp = 7 * 24 * time.Hour
+
+// rewardCompletedBookings credits the points for recently completed bookings
+// and grants the referral rewards of qualified users that weren't given when
+// the booking completed or the cast was approved, such as after an error.
+// Each is only ever given once, so it is safe to retry.
+func rewardCompletedBookings(db *database.DB, program points.Program, referral referrals.Program) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		now := time.Now()
+		if err := creditMissingPoints(ctx, db, program, now); err != nil {
+			return err
+		}
+		return grantMissingReferralRewards(ctx, db, referral, now)
+	}
+}
+
+func creditMissingPoints(ctx context.Context, db *database.DB, program points.Program, now time.Time) error {
+	if program.Rate <= 0 {
+		return nil
+	}
+	// Only bookings whose payment is worth at least a point, as Earned rounds
+	// it, so ones that earn nothing aren't picked up again every run
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.id FROM bookings b
+		WHERE b.status = $1 AND b.completed_at > $2 AND b.currency = $3
+		AND NOT EXISTS (SELECT 1 FROM guest_points gp WHERE gp.booking_id = b.id AND gp.kind = $4)
+		AND (
+			SELECT COALESCE(SUM(e.amount), 0) FROM ledger_entries e
+			JOIN ledger_accounts a ON e.account_id = a.id
+			WHERE e.booking_id = b.id AND a.code = $5 AND e.currency = b.currency
+		) * $6 >= 100
+		ORDER BY b.completed_at DESC
+		LIMIT 100
+	`, models.BookingStatusCompleted, now.Add(-rewardCatchUp), points.Currency, models.PointsEarned,
+		ledger.StripeClearing.Code, program.Rate)
+	if err != nil {
+		return fmt.Errorf("error querying completed bookings: %w", err)
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return fmt.Errorf("error reading completed bookings: %w", err)
+	}
+
+	for _, id := range ids {
+		n, err := program.Earn(db, id, now)
+		if err != nil {
+			log.Printf("Error crediting points for booking %d: %v", id, err)
+		} else if n > 0 {
+			log.Printf("Credited %d points for booking %d", n, id)
+		}
+	}
+	return nil
+}
+
+// grantMissingReferralRewards rewards the referrals still pending whose
+// referee has qualified: a guest with a completed booking or an approved cast.
+func grantMissingReferralRewards(ctx context.Context, db *database.DB, referral referrals.Program, now time.Time) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.referee_id FROM referrals r
+		JOIN users u ON r.referee_id = u.id
+		WHERE r.status = $1 AND (
+			(u.user_type = $2 AND EXISTS (
+				SELECT 1 FROM bookings b WHERE b.guest_id = u.id AND b.status = $3))
+			OR (u.user_type = $4 AND EXISTS (
+				SELECT 1 FROM cast_profiles cp WHERE cp.user_id = u.id AND cp.approval_status = $5))
+		)
+		ORDER BY r.id
+		LIMIT 100
+	`, models.ReferralPending, models.UserTypeGuest, models.BookingStatusCompleted, models.UserTypeCast, models.ApprovalStatusApproved)
+	if err != nil {
+		return fmt.Errorf("error querying pending referrals: %w", err)
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return fmt.Errorf("error reading pending referrals: %w", err)
+	}
+
+	for _, id := range ids {
+		rewarded, err := referral.Reward(db, id, now)
+		if err != nil {
+			log.Printf("Error rewarding referral of user %d: %v", id, err)
+		} else if rewarded {
+			log.Printf("Rewarded referral of user %d", id)
+		}
+	}
+	return nil
+}
+
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
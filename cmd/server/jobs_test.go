@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// retryAt matches a time backoff from when the test ran.
+type retryAt struct {
+	backoff time.Duration
+}
+
+func (m retryAt) Match(v driver.Value) bool {
+	at, ok := v.(time.Time)
+	want := time.Now().Add(m.backoff)
+	return ok && at.After(want.Add(-time.Minute/2)) && at.Before(want.Add(time.Second))
+}
+
+func newJobDB(t *testing.T) (*database.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return &database.DB{DB: db}, mock
+}
+
+// intentEvent returns the payload of an event about a PaymentIntent no
+// booking uses, which applies without changing anything.
+func intentEvent(t *testing.T, fake *payments.Fake) []byte {
+	t.Helper()
+	pi, err := fake.Authorize(payments.AuthorizeParams{Amount: models.JPY(12000), ManualCapture: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := fake.Event(payments.EventIntentCanceled, pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func expectQueued(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM stripe_events")).WillReturnRows(rows)
+}
+
+// expectUnknownIntent expects the booking machine to look the event's
+// PaymentIntent up and find nothing, or fail with err.
+func expectUnknownIntent(mock sqlmock.Sqlmock, err error) {
+	if err != nil {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM bookings WHERE stripe_payment_intent_id")).WillReturnError(err)
+		return
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM bookings WHERE stripe_payment_intent_id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "payment_status"}))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM booking_payments bp")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "status", "payment_status"}))
+}
+
+func expectProcessed(mock sqlmock.Sqlmock, id string) {
+	mock.ExpectExec(regexp.QuoteMeta("SET status = 'processed'")).
+		WithArgs(sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestProcessStripeEventsRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		status   string
+		backoff  time.Duration
+	}{
+		{"first failure", 0, "pending", time.Minute},
+		{"second failure", 1, "pending", 2 * time.Minute},
+		{"fourth failure", 3, "pending", 8 * time.Minute},
+		{"backoff capped", 6, "pending", time.Hour},
+		{"last retry", maxStripeEventAttempts - 2, "pending", time.Hour},
+		{"given up", maxStripeEventAttempts - 1, "failed", time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newJobDB(t)
+			fake := payments.NewFake()
+
+			expectQueued(mock, sqlmock.NewRows([]string{"id", "payload", "attempts"}).
+				AddRow("evt_1", intentEvent(t, fake), tt.attempts))
+			expectUnknownIntent(mock, errors.New("connection reset"))
+			mock.ExpectExec(regexp.QuoteMeta("SET status = $1, attempts = attempts + 1, last_error = $2")).
+				WithArgs(tt.status, sqlmock.AnyArg(), retryAt{tt.backoff}, "evt_1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			if err := processStripeEvents(db, fake)(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// A failed event, here one that can't be decoded, is put back without
+// holding up the events queued after it.
+func TestProcessStripeEventsSkipsFailures(t *testing.T) {
+	db, mock := newJobDB(t)
+	fake := payments.NewFake()
+
+	expectQueued(mock, sqlmock.NewRows([]string{"id", "payload", "attempts"}).
+		AddRow("evt_1", []byte("{"), 0).
+		AddRow("evt_2", intentEvent(t, fake), 2))
+	mock.ExpectExec(regexp.QuoteMeta("SET status = $1, attempts = attempts + 1, last_error = $2")).
+		WithArgs("pending", sqlmock.AnyArg(), retryAt{time.Minute}, "evt_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUnknownIntent(mock, nil)
+	expectProcessed(mock, "evt_2")
+
+	if err := processStripeEvents(db, fake)(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
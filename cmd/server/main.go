@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uso/uso/config"
 	"github.com/uso/uso/internal/database"
 	"github.com/uso/uso/internal/handlers"
 	"github.com/uso/uso/internal/middleware"
-	"github.com/stripe/stripe-go/v76"
+	"github.com/uso/uso/internal/payments"
+	"github.com/uso/uso/internal/payouts"
+	"github.com/uso/uso/internal/services"
 )
 
 func main() {
@@ -16,7 +20,7 @@ func main() {
 	cfg := config.Load()
 
 	// Initialize Stripe
-	stripe.Key = cfg.StripeSecretKey
+	pay := payments.NewStripe(cfg.StripeSecretKey, cfg.StripeWebhookSecret)
 
 	// Connect to database
 	db, err := database.NewConnection(cfg.DatabaseURL)
@@ -30,6 +34,67 @@ func main() {
 		log.Printf("Migration check failed: %v", err)
 	}
 
+	// Email notifications are disabled when no Resend key is configured
+	var emailService *services.EmailService
+	if cfg.ResendAPIKey != "" {
+		emailService = services.NewEmailService(cfg.ResendAPIKey, cfg.FromEmail)
+	}
+
+	// Start background jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sched := newScheduler(db)
+	sched.add(job{
+		name:     "expire-pending-bookings",
+		lockKey:  lockKeyExpirePendingBookings,
+		interval: cfg.BookingExpiryInterval,
+		run:      expirePendingBookings(db, pay, emailService),
+	})
+	sched.add(job{
+		name:     "expire-held-bookings",
+		lockKey:  lockKeyExpireHeldBookings,
+		interval: cfg.BookingHoldSweepInterval,
+		run:      expireHeldBookings(db, pay),
+	})
+	sched.add(job{
+		name:     "purge-idempotency-keys",
+		lockKey:  lockKeyPurgeIdempotencyKeys,
+		interval: time.Hour,
+		run:      purgeIdempotencyKeys(db, cfg.IdempotencyKeyTTL),
+	})
+	sched.add(job{
+		name:     "process-stripe-events",
+		lockKey:  lockKeyProcessStripeEvents,
+		interval: cfg.StripeEventInterval,
+		run:      processStripeEvents(db, pay),
+	})
+	payoutDay, err := payouts.ParseWeekday(cfg.PayoutDay)
+	if err != nil {
+		log.Printf("Invalid PAYOUT_DAY, using Monday: %v", err)
+		payoutDay = time.Monday
+	}
+	sched.add(job{
+		name:     "pay-casts",
+		lockKey:  lockKeyPayCasts,
+		interval: time.Hour,
+		run:      payCasts(db, pay, payoutDay),
+	})
+	sched.add(job{
+		name:     "expire-points",
+		lockKey:  lockKeyExpirePoints,
+		interval: time.Hour,
+		run:      expirePoints(db),
+	})
+	program := handlers.PointsProgram(cfg)
+	sched.add(job{
+		name:     "reward-completed-bookings",
+		lockKey:  lockKeyRewardCompleted,
+		interval: time.Hour,
+		run:      rewardCompletedBookings(db, program, handlers.ReferralProgram(cfg, program, handlers.WithholdingRate(cfg))),
+	})
+	sched.start(ctx)
+
 	// Initialize Gin router
 	router := gin.Default()
 	router.Use(middleware.CORS())
@@ -40,10 +105,10 @@ func main() {
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(db, cfg)
-	castHandler := handlers.NewCastHandler(db, cfg)
-	bookingHandler := handlers.NewBookingHandler(db, cfg)
-	searchHandler := handlers.NewSearchHandler(db)
-	adminHandler := handlers.NewAdminHandler(db, cfg)
+	castHandler := handlers.NewCastHandler(db, cfg, pay)
+	bookingHandler := handlers.NewBookingHandler(db, cfg, pay)
+	searchHandler := handlers.NewSearchHandler(db, cfg)
+	adminHandler := handlers.NewAdminHandler(db, cfg, pay)
 
 	// Public routes
 	router.GET("/", func(c *gin.Context) {
@@ -60,11 +125,12 @@ func main() {
 		// Search routes (public)
 		api.GET("/casts/search", searchHandler.SearchCasts)
 		api.GET("/casts/:id", searchHandler.GetCastProfile)
+		api.GET("/casts/:id/availability", searchHandler.GetCastAvailability)
 		api.GET("/service-areas", searchHandler.GetServiceAreas)
 
 		// Protected routes
 		protected := api.Group("/")
-		protected.Use(middleware.AuthRequired(cfg))
+		protected.Use(middleware.AuthRequired(cfg), middleware.Idempotency(db))
 		{
 			// User profile
 			protected.GET("/profile", authHandler.GetProfile)
@@ -80,21 +146,42 @@ func main() {
 				castRoutes.DELETE("/gallery/:id", castHandler.DeleteGalleryImage)
 				castRoutes.GET("/bookings", castHandler.GetCastBookings)
 				castRoutes.POST("/bookings/:id/respond", castHandler.RespondToBooking)
+				castRoutes.POST("/bookings/:id/cancel", castHandler.CancelBooking)
+				castRoutes.POST("/bookings/:id/extensions/:extensionId/respond", castHandler.RespondToExtension)
 				castRoutes.GET("/earnings", castHandler.GetEarnings)
+				castRoutes.GET("/earnings/statements", castHandler.GetStatement)
+				castRoutes.POST("/payouts/onboarding", castHandler.StartPayoutOnboarding)
+				castRoutes.GET("/availability", castHandler.GetAvailability)
+				castRoutes.PUT("/availability", castHandler.UpdateWeeklyHours)
+				castRoutes.POST("/availability/blackouts", castHandler.AddBlackoutDate)
+				castRoutes.DELETE("/availability/blackouts/:id", castHandler.DeleteBlackoutDate)
 			}
 
 			// Guest routes
 			guestRoutes := protected.Group("/guest")
 			guestRoutes.Use(middleware.GuestOnly())
 			{
-				guestRoutes.POST("/bookings", bookingHandler.CreateBooking)
+				guestRoutes.POST("/bookings/hold", bookingHandler.HoldBooking)
+				guestRoutes.POST("/bookings", bookingHandler.HoldBooking) // older clients
+				guestRoutes.POST("/bookings/:id/confirm", bookingHandler.ConfirmBooking)
 				guestRoutes.GET("/bookings", bookingHandler.GetGuestBookings)
+				guestRoutes.GET("/bookings/:id/cancellation-quote", bookingHandler.GetCancellationQuote)
 				guestRoutes.POST("/bookings/:id/cancel", bookingHandler.CancelBooking)
+				guestRoutes.GET("/bookings/:id/payments", bookingHandler.GetExtraPayments)
+				guestRoutes.POST("/bookings/:id/extensions", bookingHandler.RequestExtension)
+				guestRoutes.POST("/bookings/:id/tip", bookingHandler.TipBooking)
+				guestRoutes.GET("/points", bookingHandler.GetPoints)
 			}
 
 			// Shared booking routes
 			protected.GET("/bookings/:id", bookingHandler.GetBooking)
+			protected.GET("/bookings/:id/timeline", bookingHandler.GetBookingTimeline)
+			protected.GET("/bookings/:id/receipt", bookingHandler.GetReceipt)
 			protected.POST("/bookings/:id/complete", bookingHandler.CompleteBooking)
+			protected.GET("/bookings/:id/reschedule", bookingHandler.GetRescheduleRequests)
+			protected.POST("/bookings/:id/reschedule", bookingHandler.ProposeReschedule)
+			protected.POST("/bookings/:id/reschedule/:requestId/respond", bookingHandler.RespondToReschedule)
+			protected.GET("/bookings/:id/extensions", bookingHandler.GetExtensions)
 
 			// Messages (only for accepted bookings)
 			protected.GET("/bookings/:id/messages", bookingHandler.GetMessages)
@@ -107,13 +194,25 @@ func main() {
 
 		// Admin routes
 		admin := api.Group("/admin")
-		admin.Use(middleware.AdminOnly(cfg))
+		admin.Use(middleware.AdminOnly(cfg), middleware.Idempotency(db))
 		{
 			admin.GET("/dashboard", adminHandler.GetDashboard)
 			admin.GET("/casts/pending", adminHandler.GetPendingCasts)
 			admin.POST("/casts/:id/approve", adminHandler.ApproveCast)
 			admin.POST("/casts/:id/reject", adminHandler.RejectCast)
+			admin.GET("/casts/:id/penalties", adminHandler.GetCastPenalties)
+			admin.POST("/casts/:id/reinstate", adminHandler.ReinstateCast)
+			admin.GET("/penalties", adminHandler.GetPenalties)
 			admin.GET("/bookings", adminHandler.GetAllBookings)
+			admin.GET("/bookings/:id/timeline", adminHandler.GetBookingTimeline)
+			admin.POST("/bookings/:id/refunds", adminHandler.RefundBooking)
+			admin.GET("/disputes", adminHandler.GetDisputes)
+			admin.GET("/disputes/:id", adminHandler.GetDispute)
+			admin.PUT("/disputes/:id/evidence", adminHandler.SaveDisputeEvidence)
+			admin.GET("/promo-codes", adminHandler.GetPromoCodes)
+			admin.POST("/promo-codes", adminHandler.CreatePromoCode)
+			admin.PUT("/promo-codes/:id", adminHandler.UpdatePromoCode)
+			admin.GET("/referrals", adminHandler.GetReferrals)
 			admin.GET("/analytics", adminHandler.GetAnalytics)
 		}
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/uso/uso/internal/database"
+)
+
+// Advisory lock keys for background jobs. Every replica runs the scheduler,
+// but a job only executes on whichever replica currently holds its lock.
+const (
+	lockKeyExpirePendingBookings int64 = 7_001
+	lockKeyExpireHeldBookings    int64 = 7_002
+	lockKeyPurgeIdempotencyKeys  int64 = 7_003
+	lockKeyProcessStripeEvents   int64 = 7_004
+	lockKeyPayCasts              int64 = 7_005
+	lockKeyExpirePoints          int64 = 7_006
+	lockKeyRewardCompleted       int64 = 7_007
+)
+
+type job struct {
+	name     string
+	lockKey  int64
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+type scheduler struct {
+	db   *database.DB
+	jobs []job
+}
+
+func newScheduler(db *database.DB) *scheduler {
+	return &scheduler{db: db}
+}
+
+func (s *scheduler) add(j job) {
+	s.jobs = append(s.jobs, j)
+}
+
+// start launches every registered job in its own goroutine. Jobs stop when
+// ctx is cancelled.
+func (s *scheduler) start(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, j job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		s.runOnce(ctx, j)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce executes the job if no other replica is running it. Session-level
+// advisory locks belong to a single connection, so the lock is taken and
+// released on a dedicated connection held for the whole run.
+func (s *scheduler) runOnce(ctx context.Context, j job) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		log.Printf("Job %s: error getting connection: %v", j.name, err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", j.lockKey).Scan(&locked); err != nil {
+		log.Printf("Job %s: error acquiring lock: %v", j.name, err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", j.lockKey); err != nil {
+			log.Printf("Job %s: error releasing lock: %v", j.name, err)
+		}
+	}()
+
+	if err := j.run(ctx); err != nil {
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,8 +16,63 @@ type Config struct {
 	StripeSecretKey     string
 	StripeWebhookSecret string
 	ResendAPIKey        string
+	FromEmail           string
 	AdminPassword       string
 	BaseURL             string
+
+	// Bookings
+	CancellationPolicy string
+	BookingBuffer      time.Duration
+	BookingHoldTTL     time.Duration
+
+	// Platform commission by cast rank, such as "standard:30,premium:25,vip:20"
+	CommissionRates string
+	// Income tax withheld from casts' earnings in percent, such as "10.21"
+	WithholdingRate string
+	// Share of guests' tips that goes to the cast, in percent
+	TipCastPercent int
+
+	// Guests earn PointsRate percent of what they paid for a completed
+	// booking as points, PointsVIPMultiplier times that with a VIP cast.
+	// Points are worth ¥1 off a later booking until they expire
+	PointsRate          int
+	PointsVIPMultiplier int
+	PointsExpiryMonths  int
+
+	// Once a referred user qualifies, each side gets ReferralGuestPoints if
+	// they are a guest or a ReferralCastBonus in yen if they are a cast
+	ReferralGuestPoints int
+	ReferralCastBonus   int
+
+	// The platform operator, as printed on statements
+	CompanyName    string
+	CompanyAddress string
+	CompanyPhone   string
+	// CompanyNumber is the 13-digit corporate number (法人番号)
+	CompanyNumber string
+	// InvoiceRegistrationNumber is the qualified invoice issuer number
+	// (適格請求書発行事業者登録番号), "T" and 13 digits, printed on receipts
+	InvoiceRegistrationNumber string
+
+	// Cast payouts go out in a weekly batch on PayoutDay, such as "monday",
+	// and also as soon as a booking completes if PayoutOnCompletion is set
+	PayoutDay          string
+	PayoutOnCompletion bool
+
+	// Cast cancellation penalties
+	CastLateCancelNotice    time.Duration
+	CastStrikeWindow        time.Duration
+	CastDemoteAfterStrikes  int
+	CastSuspendAfterStrikes int
+	CastSuspensionPeriod    time.Duration
+
+	// Stored responses to Idempotency-Key requests are kept this long
+	IdempotencyKeyTTL time.Duration
+
+	// Background jobs
+	BookingExpiryInterval    time.Duration
+	BookingHoldSweepInterval time.Duration
+	StripeEventInterval      time.Duration
 }
 
 func Load() *Config {
@@ -30,8 +87,46 @@ func Load() *Config {
 		StripeSecretKey:     getEnv("STRIPE_SECRET_KEY", ""),
 		StripeWebhookSecret: getEnv("STRIPE_WEBHOOK_SECRET", ""),
 		ResendAPIKey:        getEnv("RESEND_API_KEY", ""),
+		FromEmail:           getEnv("FROM_EMAIL", "noreply@uso.app"),
 		AdminPassword:       getEnv("ADMIN_PASSWORD", "admin123"),
 		BaseURL:             getEnv("BASE_URL", "http://localhost:8080"),
+
+		CancellationPolicy: getEnv("CANCELLATION_POLICY", "48h:50,24h:100"),
+		BookingBuffer:      getEnvDuration("BOOKING_BUFFER", 30*time.Minute),
+		BookingHoldTTL:     getEnvDuration("BOOKING_HOLD_TTL", 10*time.Minute),
+
+		CommissionRates: getEnv("COMMISSION_RATES", "standard:30,premium:25,vip:20"),
+		WithholdingRate: getEnv("WITHHOLDING_RATE", "10.21"),
+		TipCastPercent:  getEnvInt("TIP_CAST_PERCENT", 100),
+
+		PointsRate:          getEnvInt("POINTS_RATE", 1),
+		PointsVIPMultiplier: getEnvInt("POINTS_VIP_MULTIPLIER", 2),
+		PointsExpiryMonths:  getEnvInt("POINTS_EXPIRY_MONTHS", 12),
+
+		ReferralGuestPoints: getEnvInt("REFERRAL_GUEST_POINTS", 1000),
+		ReferralCastBonus:   getEnvInt("REFERRAL_CAST_BONUS", 3000),
+
+		CompanyName:    getEnv("COMPANY_NAME", "Uso"),
+		CompanyAddress: getEnv("COMPANY_ADDRESS", ""),
+		CompanyPhone:   getEnv("COMPANY_PHONE", ""),
+		CompanyNumber:  getEnv("COMPANY_NUMBER", ""),
+
+		InvoiceRegistrationNumber: getEnv("INVOICE_REGISTRATION_NUMBER", ""),
+
+		PayoutDay:          getEnv("PAYOUT_DAY", "monday"),
+		PayoutOnCompletion: getEnvBool("PAYOUT_ON_COMPLETION", false),
+
+		CastLateCancelNotice:    getEnvDuration("CAST_LATE_CANCEL_NOTICE", 48*time.Hour),
+		CastStrikeWindow:        getEnvDuration("CAST_STRIKE_WINDOW", 90*24*time.Hour),
+		CastDemoteAfterStrikes:  getEnvInt("CAST_DEMOTE_AFTER_STRIKES", 2),
+		CastSuspendAfterStrikes: getEnvInt("CAST_SUSPEND_AFTER_STRIKES", 3),
+		CastSuspensionPeriod:    getEnvDuration("CAST_SUSPENSION_PERIOD", 30*24*time.Hour),
+
+		IdempotencyKeyTTL: getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+
+		BookingExpiryInterval:    getEnvInterval("BOOKING_EXPIRY_INTERVAL", 5*time.Minute),
+		BookingHoldSweepInterval: getEnvInterval("BOOKING_HOLD_SWEEP_INTERVAL", time.Minute),
+		StripeEventInterval:      getEnvInterval("STRIPE_EVENT_INTERVAL", 5*time.Second),
 	}
 
 	return config
@@ -42,4 +137,51 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid integer for %s: %v, using default %d", key, err, defaultValue)
+			return defaultValue
+		}
+		return n
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Invalid boolean for %s: %v, using default %t", key, err, defaultValue)
+			return defaultValue
+		}
+		return b
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Printf("Invalid duration for %s: %v, using default %s", key, err, defaultValue)
+			return defaultValue
+		}
+		return d
+	}
+	return defaultValue
+}
+
+// getEnvInterval is getEnvDuration for how often a background job runs, which
+// has to be positive.
+func getEnvInterval(key string, defaultValue time.Duration) time.Duration {
+	d := getEnvDuration(key, defaultValue)
+	if d <= 0 {
+		log.Printf("Invalid interval for %s: %s, using default %s", key, d, defaultValue)
+		return defaultValue
+	}
+	return d
+}
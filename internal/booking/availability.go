@@ -0,0 +1,233 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/uso/uso/internal/database"
+)
+
+// Window is a weekly working window, as offsets from midnight in Tokyo.
+type Window struct {
+	Weekday time.Weekday
+	Start   time.Duration
+	End     time.Duration
+}
+
+// Availability is a cast's weekly working hours and days off. A cast with no
+// weekly windows can be booked at any time outside their blackout dates.
+type Availability struct {
+	Weekly    []Window
+	Blackouts map[string]bool
+}
+
+// ParseClock reads a "15:04" or "15:04:05" time of day as an offset from
+// midnight. "24:00" is allowed to end a window at midnight.
+func ParseClock(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	var h, m, sec int
+	if _, err := fmt.Sscanf(parts[0]+" "+parts[1], "%d %d", &h, &m); err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	if len(parts) == 3 {
+		if _, err := fmt.Sscanf(parts[2], "%d", &sec); err != nil {
+			return 0, fmt.Errorf("invalid time of day %q", s)
+		}
+	}
+	if h < 0 || m < 0 || m > 59 || sec < 0 || sec > 59 || h > 24 || (h == 24 && (m != 0 || sec != 0)) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
+// FormatClock is the inverse of ParseClock, always as "15:04".
+func FormatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// Covers reports whether a booking starting at start and lasting d falls
+// entirely within working hours and avoids every blackout date. Adjacent
+// windows, including ones meeting at midnight, count as continuous.
+func (a Availability) Covers(start time.Time, d time.Duration) bool {
+	start = start.In(Tokyo)
+	end := start.Add(d)
+
+	for day := midnight(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		if a.Blackouts[day.Format("2006-01-02")] {
+			return false
+		}
+	}
+
+	if len(a.Weekly) == 0 {
+		return true
+	}
+
+	t := start
+	for t.Before(end) {
+		day := midnight(t)
+		offset := t.Sub(day)
+
+		next := time.Time{}
+		for _, w := range a.Weekly {
+			if w.Weekday == t.Weekday() && w.Start <= offset && offset < w.End {
+				if windowEnd := day.Add(w.End); windowEnd.After(next) {
+					next = windowEnd
+				}
+			}
+		}
+		if next.IsZero() {
+			return false
+		}
+		t = next
+	}
+	return true
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// LoadAvailability reads a cast's weekly hours and blackout dates from the
+// given date onward.
+func LoadAvailability(db *database.DB, castID int, from time.Time) (Availability, error) {
+	a := Availability{Blackouts: map[string]bool{}}
+
+	rows, err := db.Query(`
+		SELECT weekday, start_time, end_time FROM cast_weekly_hours WHERE cast_id = $1
+	`, castID)
+	if err != nil {
+		return a, fmt.Errorf("error querying weekly hours: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var weekday int
+		var start, end string
+		if err := rows.Scan(&weekday, &start, &end); err != nil {
+			return a, fmt.Errorf("error scanning weekly hours: %w", err)
+		}
+		w := Window{Weekday: time.Weekday(weekday)}
+		if w.Start, err = ParseClock(start); err != nil {
+			return a, err
+		}
+		if w.End, err = ParseClock(end); err != nil {
+			return a, err
+		}
+		a.Weekly = append(a.Weekly, w)
+	}
+	if err := rows.Err(); err != nil {
+		return a, err
+	}
+
+	blackouts, err := db.Query(`
+		SELECT blackout_date FROM cast_blackout_dates WHERE cast_id = $1 AND blackout_date >= $2
+	`, castID, from.Format("2006-01-02"))
+	if err != nil {
+		return a, fmt.Errorf("error querying blackout dates: %w", err)
+	}
+	defer blackouts.Close()
+
+	for blackouts.Next() {
+		var date sql.NullTime
+		if err := blackouts.Scan(&date); err != nil {
+			return a, fmt.Errorf("error scanning blackout date: %w", err)
+		}
+		a.Blackouts[date.Time.Format("2006-01-02")] = true
+	}
+	return a, blackouts.Err()
+}
+
+// Unavailable returns the casts whose working hours or days off rule out a
+// booking from start to end, judged as Covers would for each of them.
+func Unavailable(db *database.DB, start, end time.Time) ([]int, error) {
+	start, end = start.In(Tokyo), end.In(Tokyo)
+	var weekdays []int
+	var dates []string
+	for day := midnight(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		weekdays = append(weekdays, int(day.Weekday()))
+		dates = append(dates, day.Format("2006-01-02"))
+	}
+
+	// Every cast with working hours, with their windows on the days the
+	// booking touches. One without any on those days can't take it at all.
+	rows, err := db.Query(`
+		SELECT c.cast_id, wh.weekday, wh.start_time, wh.end_time
+		FROM (SELECT DISTINCT cast_id FROM cast_weekly_hours) c
+		LEFT JOIN cast_weekly_hours wh ON wh.cast_id = c.cast_id AND wh.weekday = ANY($1)
+	`, pq.Array(weekdays))
+	if err != nil {
+		return nil, fmt.Errorf("error querying weekly hours: %w", err)
+	}
+	defer rows.Close()
+
+	casts := map[int]*Availability{}
+	for rows.Next() {
+		var castID int
+		var weekday sql.NullInt64
+		var startTime, endTime sql.NullString
+		if err := rows.Scan(&castID, &weekday, &startTime, &endTime); err != nil {
+			return nil, fmt.Errorf("error scanning weekly hours: %w", err)
+		}
+		a := casts[castID]
+		if a == nil {
+			a = &Availability{Blackouts: map[string]bool{}}
+			casts[castID] = a
+		}
+		if !weekday.Valid {
+			continue
+		}
+		w := Window{Weekday: time.Weekday(weekday.Int64)}
+		if w.Start, err = ParseClock(startTime.String); err != nil {
+			return nil, err
+		}
+		if w.End, err = ParseClock(endTime.String); err != nil {
+			return nil, err
+		}
+		a.Weekly = append(a.Weekly, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	blackouts, err := db.Query(`
+		SELECT cast_id, blackout_date FROM cast_blackout_dates WHERE blackout_date = ANY($1::date[])
+	`, pq.Array(dates))
+	if err != nil {
+		return nil, fmt.Errorf("error querying blackout dates: %w", err)
+	}
+	defer blackouts.Close()
+
+	var unavailable []int
+	off := map[int]bool{}
+	for blackouts.Next() {
+		var castID int
+		var date time.Time
+		if err := blackouts.Scan(&castID, &date); err != nil {
+			return nil, fmt.Errorf("error scanning blackout date: %w", err)
+		}
+		if a := casts[castID]; a != nil {
+			a.Blackouts[date.Format("2006-01-02")] = true
+		} else if !off[castID] {
+			// Off that day, with no working hours to check
+			off[castID] = true
+			unavailable = append(unavailable, castID)
+		}
+	}
+	if err := blackouts.Err(); err != nil {
+		return nil, err
+	}
+
+	for castID, a := range casts {
+		if len(a.Weekly) == 0 || !a.Covers(start, end.Sub(start)) {
+			unavailable = append(unavailable, castID)
+		}
+	}
+	return unavailable, nil
+}
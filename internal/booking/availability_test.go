@@ -0,0 +1,213 @@
+package booking
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/internal/database"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"00:00", 0},
+		{"09:30", 9*time.Hour + 30*time.Minute},
+		{"18:00:00", 18 * time.Hour},
+		{"24:00", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		got, err := ParseClock(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseClock(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "9", "24:01", "12:60", "-1:00", "ab:cd", "1:2:3:4"} {
+		if _, err := ParseClock(bad); err == nil {
+			t.Errorf("ParseClock(%q) succeeded", bad)
+		}
+	}
+}
+
+// 2024-01-05 is a Friday
+func friday(hour, min int) time.Time {
+	return time.Date(2024, 1, 5, hour, min, 0, 0, Tokyo)
+}
+
+func TestCovers(t *testing.T) {
+	evenings := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 18 * time.Hour, End: 24 * time.Hour},
+		{Weekday: time.Saturday, Start: 0, End: 3 * time.Hour},
+	}}
+	allWeekend := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 0, End: 24 * time.Hour},
+		{Weekday: time.Saturday, Start: 0, End: 24 * time.Hour},
+		{Weekday: time.Sunday, Start: 0, End: 24 * time.Hour},
+	}}
+	split := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 12 * time.Hour, End: 15 * time.Hour},
+		{Weekday: time.Friday, Start: 16 * time.Hour, End: 20 * time.Hour},
+	}}
+	overlapping := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 12 * time.Hour, End: 18 * time.Hour},
+		{Weekday: time.Friday, Start: 14 * time.Hour, End: 22 * time.Hour},
+	}}
+	anyTime := Availability{Blackouts: map[string]bool{"2024-01-06": true}}
+
+	tests := []struct {
+		name  string
+		a     Availability
+		start time.Time
+		d     time.Duration
+		want  bool
+	}{
+		{"inside a window", evenings, friday(19, 0), 2 * time.Hour, true},
+		{"ending as the window does", evenings, friday(22, 0), 2 * time.Hour, true},
+		{"starting before the window", evenings, friday(17, 0), 2 * time.Hour, false},
+		{"across midnight into the next day's window", evenings, friday(23, 0), 3 * time.Hour, true},
+		{"past the next day's window", evenings, friday(23, 0), 5 * time.Hour, false},
+		{"on a day without hours", evenings, friday(19, 0).AddDate(0, 0, 2), time.Hour, false},
+		{"across a gap between windows", split, friday(14, 0), 3 * time.Hour, false},
+		{"in the second of two windows", split, friday(16, 0), 4 * time.Hour, true},
+		{"across overlapping windows", overlapping, friday(13, 0), 8 * time.Hour, true},
+		{"longer than a day", allWeekend, friday(20, 0), 30 * time.Hour, true},
+		{"longer than a day, past the last window", allWeekend, friday(20, 0), 53 * time.Hour, false},
+		{"given in another zone", evenings, friday(19, 0).UTC(), time.Hour, true},
+		{"no hours", Availability{}, friday(3, 0), 48 * time.Hour, true},
+		{"no hours, before a blackout", anyTime, friday(20, 0), 4 * time.Hour, true},
+		{"no hours, across midnight into a blackout", anyTime, friday(22, 0), 3 * time.Hour, false},
+		{"no hours, over a blackout in the middle", anyTime, friday(12, 0), 50 * time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Covers(tt.start, tt.d); got != tt.want {
+				t.Errorf("Covers(%v, %v) = %v, want %v", tt.start, tt.d, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("blackout on a working day", func(t *testing.T) {
+		a := evenings
+		a.Blackouts = map[string]bool{"2024-01-06": true}
+		if a.Covers(friday(23, 0), 3*time.Hour) {
+			t.Error("covers a booking running into a blackout date")
+		}
+		if !a.Covers(friday(19, 0), 2*time.Hour) {
+			t.Error("doesn't cover a booking ending before the blackout date")
+		}
+	})
+}
+
+func TestUnavailable(t *testing.T) {
+	hours := []string{"cast_id", "weekday", "start_time", "end_time"}
+	blackouts := []string{"cast_id", "blackout_date"}
+	saturday := time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		start     time.Time
+		d         time.Duration
+		weekdays  string
+		dates     string
+		hours     *sqlmock.Rows
+		blackouts *sqlmock.Rows
+		want      []int
+	}{
+		{
+			name:     "within a day",
+			start:    friday(19, 0),
+			d:        2 * time.Hour,
+			weekdays: "{5}",
+			dates:    `{"2024-01-05"}`,
+			hours: sqlmock.NewRows(hours).
+				AddRow(1, 5, "18:00:00", "24:00:00").
+				AddRow(2, 5, "10:00:00", "18:00:00").
+				AddRow(3, nil, nil, nil),
+			blackouts: sqlmock.NewRows(blackouts),
+			// 2 has finished by then and 3 doesn't work Fridays
+			want: []int{2, 3},
+		},
+		{
+			name:     "spanning midnight",
+			start:    friday(23, 0),
+			d:        3 * time.Hour,
+			weekdays: "{5,6}",
+			dates:    `{"2024-01-05","2024-01-06"}`,
+			hours: sqlmock.NewRows(hours).
+				AddRow(1, 5, "18:00:00", "24:00:00").
+				AddRow(1, 6, "00:00:00", "03:00:00").
+				AddRow(2, 5, "18:00:00", "24:00:00").
+				AddRow(3, 5, "18:00:00", "24:00:00").
+				AddRow(3, 6, "00:00:00", "01:00:00"),
+			blackouts: sqlmock.NewRows(blackouts),
+			// 2 stops at midnight and 3 an hour after
+			want: []int{2, 3},
+		},
+		{
+			name:     "blackout dates",
+			start:    friday(23, 0),
+			d:        3 * time.Hour,
+			weekdays: "{5,6}",
+			dates:    `{"2024-01-05","2024-01-06"}`,
+			hours: sqlmock.NewRows(hours).
+				AddRow(1, 5, "18:00:00", "24:00:00").
+				AddRow(1, 6, "00:00:00", "03:00:00").
+				AddRow(2, 5, "18:00:00", "24:00:00").
+				AddRow(2, 6, "00:00:00", "03:00:00"),
+			// 2 is off on Saturday, and 4 has no hours but is off too; 5
+			// has no hours and no days off
+			blackouts: sqlmock.NewRows(blackouts).
+				AddRow(2, saturday).
+				AddRow(4, saturday),
+			want: []int{2, 4},
+		},
+		{
+			name:     "longer than a day",
+			start:    friday(20, 0),
+			d:        30 * time.Hour,
+			weekdays: "{5,6,0}",
+			dates:    `{"2024-01-05","2024-01-06","2024-01-07"}`,
+			hours: sqlmock.NewRows(hours).
+				AddRow(1, 5, "00:00:00", "24:00:00").
+				AddRow(1, 6, "00:00:00", "24:00:00").
+				AddRow(1, 0, "00:00:00", "24:00:00").
+				AddRow(2, 5, "18:00:00", "24:00:00").
+				AddRow(2, 6, "00:00:00", "22:00:00").
+				AddRow(2, 0, "00:00:00", "24:00:00"),
+			blackouts: sqlmock.NewRows(blackouts),
+			// 2 takes a break on Saturday
+			want: []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sqlDB.Close()
+
+			mock.ExpectQuery("FROM cast_weekly_hours").WithArgs(tt.weekdays).WillReturnRows(tt.hours)
+			mock.ExpectQuery("FROM cast_blackout_dates").WithArgs(tt.dates).WillReturnRows(tt.blackouts)
+
+			got, err := Unavailable(&database.DB{DB: sqlDB}, tt.start, tt.start.Add(tt.d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Ints(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unavailable = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package booking
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// Tokyo is the timezone booking dates and start times are expressed in.
+var Tokyo = mustLoadLocation("Asia/Tokyo")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.FixedZone("JST", 9*60*60)
+	}
+	return loc
+}
+
+// StartsAt combines a date and a Tokyo time of day, such as the date and
+// start_time filters of a cast search, into an instant.
+func StartsAt(bookingDate time.Time, startTime string) (time.Time, error) {
+	t, err := time.Parse("15:04:05", startTime)
+	if err != nil {
+		if t, err = time.Parse("15:04", startTime); err != nil {
+			return time.Time{}, fmt.Errorf("invalid start time %q: %w", startTime, err)
+		}
+	}
+	return time.Date(bookingDate.Year(), bookingDate.Month(), bookingDate.Day(),
+		t.Hour(), t.Minute(), t.Second(), 0, Tokyo), nil
+}
+
+// CancellationTier charges FeePercent of the booking amount when the booking
+// is cancelled less than Before ahead of its start.
+type CancellationTier struct {
+	Before     time.Duration
+	FeePercent int
+}
+
+// CancellationPolicy decides the fee for cancelling a booking based on how
+// close to the start time it is cancelled. Tiers are ordered from the longest
+// notice to the shortest; cancelling earlier than every tier is free.
+type CancellationPolicy struct {
+	Tiers []CancellationTier
+}
+
+// DefaultCancellationPolicy is free until 48h before, 50% up to 24h before and
+// 100% after that.
+var DefaultCancellationPolicy = CancellationPolicy{Tiers: []CancellationTier{
+	{Before: 48 * time.Hour, FeePercent: 50},
+	{Before: 24 * time.Hour, FeePercent: 100},
+}}
+
+// ParseCancellationPolicy reads a policy such as "48h:50,24h:100", meaning a
+// 50% fee inside 48 hours of the start and 100% inside 24 hours.
+func ParseCancellationPolicy(s string) (CancellationPolicy, error) {
+	var p CancellationPolicy
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		before, percent, ok := strings.Cut(part, ":")
+		if !ok {
+			return CancellationPolicy{}, fmt.Errorf("invalid cancellation tier %q", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(before))
+		if err != nil {
+			return CancellationPolicy{}, fmt.Errorf("invalid cancellation tier %q: %w", part, err)
+		}
+		pct, err := strconv.Atoi(strings.TrimSpace(percent))
+		if err != nil || pct < 0 || pct > 100 {
+			return CancellationPolicy{}, fmt.Errorf("invalid fee percent in cancellation tier %q", part)
+		}
+		p.Tiers = append(p.Tiers, CancellationTier{Before: d, FeePercent: pct})
+	}
+
+	sort.Slice(p.Tiers, func(i, j int) bool { return p.Tiers[i].Before > p.Tiers[j].Before })
+	return p, nil
+}
+
+// FeePercent returns the fee for cancelling with the given notice. Negative
+// notice means the booking has already started.
+func (p CancellationPolicy) FeePercent(notice time.Duration) int {
+	fee := 0
+	for _, tier := range p.Tiers {
+		if notice < tier.Before {
+			fee = tier.FeePercent
+		}
+	}
+	return fee
+}
+
+// CancellationQuote is what a guest pays and gets back when cancelling.
+type CancellationQuote struct {
+	Amount          models.Money `json:"amount"`
+	FeePercent      int          `json:"fee_percent"`
+	Fee             models.Money `json:"fee"`
+	Refund          models.Money `json:"refund"`
+	StartsAt        time.Time    `json:"starts_at"`
+	HoursUntilStart float64      `json:"hours_until_start"`
+}
+
+// Quote computes the cancellation fee for a booking of amount starting at
+// startsAt if it is cancelled at now.
+func (p CancellationPolicy) Quote(amount models.Money, startsAt, now time.Time) CancellationQuote {
+	notice := startsAt.Sub(now)
+	pct := p.FeePercent(notice)
+	fee := amount.Percent(pct)
+
+	return CancellationQuote{
+		Amount:          amount,
+		FeePercent:      pct,
+		Fee:             fee,
+		Refund:          amount.Sub(fee),
+		StartsAt:        startsAt,
+		HoursUntilStart: math.Round(notice.Hours()*10) / 10,
+	}
+}
@@ -0,0 +1,65 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestParseCancellationPolicy(t *testing.T) {
+	p, err := ParseCancellationPolicy("24h:100, 48h:50")
+	if err != nil {
+		t.Fatalf("ParseCancellationPolicy: %v", err)
+	}
+	if len(p.Tiers) != 2 || p.Tiers[0].Before != 48*time.Hour || p.Tiers[1].FeePercent != 100 {
+		t.Fatalf("tiers not sorted by notice: %+v", p.Tiers)
+	}
+
+	for _, bad := range []string{"48h", "2d:50", "48h:150", "48h:x"} {
+		if _, err := ParseCancellationPolicy(bad); err == nil {
+			t.Errorf("ParseCancellationPolicy(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCancellationQuote(t *testing.T) {
+	start := time.Date(2024, 6, 1, 20, 0, 0, 0, Tokyo)
+
+	tests := []struct {
+		name    string
+		notice  time.Duration
+		percent int
+		fee     int64
+		refund  int64
+	}{
+		{"a week ahead", 7 * 24 * time.Hour, 0, 0, 20001},
+		{"exactly 48h ahead", 48 * time.Hour, 0, 0, 20001},
+		{"inside 48h", 47 * time.Hour, 50, 10001, 10000},
+		{"exactly 24h ahead", 24 * time.Hour, 50, 10001, 10000},
+		{"inside 24h", time.Hour, 100, 20001, 0},
+		{"already started", -time.Hour, 100, 20001, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := DefaultCancellationPolicy.Quote(models.JPY(20001), start, start.Add(-tt.notice))
+			if q.FeePercent != tt.percent || q.Fee != models.JPY(tt.fee) || q.Refund != models.JPY(tt.refund) {
+				t.Errorf("got %d%% fee %v refund %v, want %d%% fee %d refund %d",
+					q.FeePercent, q.Fee, q.Refund, tt.percent, tt.fee, tt.refund)
+			}
+		})
+	}
+}
+
+func TestStartsAt(t *testing.T) {
+	date := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	got, err := StartsAt(date, "23:30:00")
+	if err != nil {
+		t.Fatalf("StartsAt: %v", err)
+	}
+	want := time.Date(2024, 6, 1, 14, 30, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("StartsAt = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Querier is satisfied by *sql.DB, *sql.Tx and *database.DB.
+type Querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// HasConflict reports whether the cast already has a held, pending or
+// accepted booking overlapping [startsAt, endsAt). excludeBookingID, if non-zero, is
+// left out so a booking being moved doesn't conflict with itself.
+//
+// The bookings_no_overlap constraint is what actually prevents double
+// booking; this check only lets handlers answer before writing. Use
+// IsOverlap on the write's error to catch the race.
+func HasConflict(q Querier, castID int, startsAt, endsAt time.Time, excludeBookingID int) (bool, error) {
+	var conflict bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM bookings
+			WHERE cast_id = $1
+			AND status IN ('held', 'pending', 'accepted')
+			AND id <> $4
+			AND tstzrange(starts_at, ends_at) && tstzrange($2, $3)
+		)
+	`, castID, startsAt, endsAt, excludeBookingID).Scan(&conflict)
+	return conflict, err
+}
+
+// IsOverlap reports whether err is the database rejecting a booking that
+// overlaps another of the cast's bookings.
+func IsOverlap(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23P01" && pqErr.Constraint == "bookings_no_overlap"
+}
@@ -0,0 +1,235 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+var (
+	// ErrDisputeNotFound is returned for a dispute ID we have no record of.
+	ErrDisputeNotFound = errors.New("dispute not found")
+	// ErrDisputeClosed is returned when evidence is sent for a dispute that
+	// has been decided or whose evidence was already submitted.
+	ErrDisputeClosed = errors.New("dispute no longer accepts evidence")
+)
+
+// recordDispute saves the dispute as the webhook reported it and returns the
+// status it had before, empty if it is new. Once a dispute is closed, late
+// updates don't reopen it.
+func recordDispute(tx *sql.Tx, bookingID int, intentID string, d *payments.Dispute) (models.DisputeStatus, error) {
+	var previous models.DisputeStatus
+	err := tx.QueryRow(`
+		SELECT status FROM disputes WHERE stripe_dispute_id = $1 FOR UPDATE
+	`, d.ID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("error getting dispute %s: %w", d.ID, err)
+	}
+
+	status := models.DisputeStatus(d.Status)
+	var closedAt *time.Time
+	if status.Closed() {
+		now := time.Now()
+		closedAt = &now
+	}
+	_, err = tx.Exec(`
+		INSERT INTO disputes (stripe_dispute_id, booking_id, stripe_payment_intent_id, amount, currency,
+		                      reason, status, evidence_due_by, closed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (stripe_dispute_id) DO UPDATE
+		SET status = CASE WHEN disputes.closed_at IS NULL THEN EXCLUDED.status ELSE disputes.status END,
+		    amount = EXCLUDED.amount,
+		    evidence_due_by = COALESCE(EXCLUDED.evidence_due_by, disputes.evidence_due_by),
+		    closed_at = COALESCE(disputes.closed_at, EXCLUDED.closed_at),
+		    updated_at = NOW()
+	`, d.ID, bookingID, intentID, d.Amount.Amount, d.Amount.Currency, d.Reason, status, d.EvidenceDueBy, closedAt)
+	if err != nil {
+		return "", fmt.Errorf("error saving dispute %s: %w", d.ID, err)
+	}
+	return previous, nil
+}
+
+// handleDisputeClosed applies the bank's decision. A lost dispute took the
+// money back, so it is booked as a refund; a won one, or an inquiry that
+// never became a chargeback, returns the payment to where it was.
+func (m *Machine) handleDisputeClosed(tx *sql.Tx, o *intentOwner, d *payments.Dispute) error {
+	status := models.DisputeStatus(d.Status)
+	if status == models.DisputeStatusLost {
+		if o.extra != nil {
+			_, err := tx.Exec(`
+				UPDATE booking_payments SET refunded_amount = LEAST(amount, refunded_amount + $1), status = $2
+				WHERE id = $3
+			`, d.Amount.Amount, models.PaymentStatusRefunded, o.extra.ID)
+			if err != nil {
+				return fmt.Errorf("error recording lost dispute on booking payment %d: %w", o.extra.ID, err)
+			}
+		}
+		if err := recordRefund(tx, o.bookingID, System, d.Amount, d.ID, "dispute lost"); err != nil {
+			return err
+		}
+	} else {
+		restored := `CASE WHEN refunded_amount > 0 THEN 'partially_refunded'::payment_status ELSE 'captured'::payment_status END`
+		var err error
+		if o.extra != nil {
+			_, err = tx.Exec(`UPDATE booking_payments SET status = `+restored+` WHERE id = $1 AND status = $2`,
+				o.extra.ID, models.PaymentStatusDisputed)
+		} else {
+			_, err = tx.Exec(`UPDATE bookings SET payment_status = `+restored+`, updated_at = $1 WHERE id = $2 AND payment_status = $3`,
+				time.Now(), o.bookingID, models.PaymentStatusDisputed)
+		}
+		if err != nil {
+			return fmt.Errorf("error restoring payment status for booking %d: %w", o.bookingID, err)
+		}
+	}
+
+	return RecordEvent(tx, Event{
+		BookingID: o.bookingID,
+		Type:      EventDisputeClosed,
+		Actor:     System,
+		Reason:    string(status),
+		Metadata: map[string]interface{}{
+			"dispute_id": d.ID,
+			"amount":     d.Amount,
+			"status":     status,
+		},
+	})
+}
+
+const disputeColumns = `
+	id, stripe_dispute_id, booking_id, stripe_payment_intent_id, amount, currency, reason, status,
+	evidence_due_by, evidence, evidence_submitted_at, created_at, updated_at, closed_at`
+
+func scanDispute(row interface{ Scan(...interface{}) error }) (models.Dispute, error) {
+	var d models.Dispute
+	err := row.Scan(&d.ID, &d.StripeDisputeID, &d.BookingID, &d.StripePaymentIntentID,
+		&d.Amount.Amount, &d.Amount.Currency, &d.Reason, &d.Status,
+		&d.EvidenceDueBy, &d.Evidence, &d.EvidenceSubmittedAt, &d.CreatedAt, &d.UpdatedAt, &d.ClosedAt)
+	return d, err
+}
+
+// ListDisputes returns disputes, those still open first by how soon their
+// evidence is due, then closed ones newest first. open limits it to one or
+// the other.
+func ListDisputes(db *database.DB, open *bool) ([]models.Dispute, error) {
+	query := `SELECT ` + disputeColumns + ` FROM disputes`
+	if open != nil && *open {
+		query += ` WHERE closed_at IS NULL`
+	} else if open != nil {
+		query += ` WHERE closed_at IS NOT NULL`
+	}
+	query += ` ORDER BY closed_at DESC NULLS FIRST, evidence_due_by NULLS LAST, id DESC LIMIT 200`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying disputes: %w", err)
+	}
+	defer rows.Close()
+
+	disputes := []models.Dispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning dispute: %w", err)
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+// GetDispute returns a dispute by its ID.
+func GetDispute(db *database.DB, id int) (models.Dispute, error) {
+	d, err := scanDispute(db.QueryRow(`SELECT `+disputeColumns+` FROM disputes WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return d, ErrDisputeNotFound
+	}
+	if err != nil {
+		return d, fmt.Errorf("error getting dispute %d: %w", id, err)
+	}
+	return d, nil
+}
+
+// MessageHistory returns the booking's messages as a transcript, oldest
+// first, to use as dispute evidence.
+func MessageHistory(db *database.DB, bookingID int) (string, error) {
+	rows, err := db.Query(`
+		SELECT m.created_at, u.name, u.user_type, m.message
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.booking_id = $1
+		ORDER BY m.created_at, m.id
+	`, bookingID)
+	if err != nil {
+		return "", fmt.Errorf("error querying messages for booking %d: %w", bookingID, err)
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	for rows.Next() {
+		var sentAt time.Time
+		var name, userType, message string
+		if err := rows.Scan(&sentAt, &name, &userType, &message); err != nil {
+			return "", fmt.Errorf("error scanning message: %w", err)
+		}
+		fmt.Fprintf(&b, "[%s] %s (%s): %s\n", sentAt.In(Tokyo).Format("2006-01-02 15:04"), name, userType, message)
+	}
+	return b.String(), rows.Err()
+}
+
+// SaveDisputeEvidence sends text to Stripe as the platform's evidence for the
+// dispute, along with the booking's details. Unless submit is set it is only
+// staged, and can be changed until it is.
+func SaveDisputeEvidence(db *database.DB, pay payments.Provider, id int, text string, submit bool) (models.Dispute, error) {
+	d, err := GetDispute(db, id)
+	if err != nil {
+		return d, err
+	}
+	if d.ClosedAt != nil || d.EvidenceSubmittedAt != nil {
+		return d, ErrDisputeClosed
+	}
+
+	var guestName string
+	var startsAt time.Time
+	var hours int
+	err = db.QueryRow(`
+		SELECT g.name, b.starts_at, b.duration_hours
+		FROM bookings b JOIN users g ON b.guest_id = g.id
+		WHERE b.id = $1
+	`, d.BookingID).Scan(&guestName, &startsAt, &hours)
+	if err != nil {
+		return d, fmt.Errorf("error getting booking %d: %w", d.BookingID, err)
+	}
+
+	updated, err := pay.UpdateDispute(d.StripeDisputeID, payments.DisputeEvidence{
+		CustomerName:       guestName,
+		ServiceDate:        startsAt.In(Tokyo).Format("2006-01-02"),
+		ProductDescription: fmt.Sprintf("Booking #%d: %d hour companion booking from %s", d.BookingID, hours, startsAt.In(Tokyo).Format("2006-01-02 15:04 MST")),
+		Text:               text,
+		Submit:             submit,
+	})
+	if err != nil {
+		return d, fmt.Errorf("error sending evidence for dispute %s: %w", d.StripeDisputeID, err)
+	}
+
+	d.Evidence = text
+	d.Status = models.DisputeStatus(updated.Status)
+	var submittedAt *time.Time
+	if submit {
+		now := time.Now()
+		submittedAt = &now
+	}
+	err = db.QueryRow(`
+		UPDATE disputes SET evidence = $1, status = $2, evidence_submitted_at = $3, updated_at = NOW()
+		WHERE id = $4
+		RETURNING evidence_submitted_at, updated_at
+	`, d.Evidence, d.Status, submittedAt, id).Scan(&d.EvidenceSubmittedAt, &d.UpdatedAt)
+	if err != nil {
+		return d, fmt.Errorf("error saving evidence for dispute %d: %w", id, err)
+	}
+	return d, nil
+}
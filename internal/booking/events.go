@@ -0,0 +1,118 @@
+package booking
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+)
+
+// Event types stored in booking_events.event_type
+const (
+	EventCreated        = "created"
+	EventStatusChanged  = "status_changed"
+	EventPaymentUpdated = "payment_updated"
+	EventRefunded       = "refunded"
+	EventRescheduled    = "rescheduled"
+	EventExtended       = "extended"
+	EventDisputed       = "disputed"
+	EventDisputeClosed  = "dispute_closed"
+)
+
+// Actor roles that are not a models.UserType
+const (
+	RoleAdmin  = "admin"
+	RoleSystem = "system"
+)
+
+// Actor identifies who caused a booking event.
+type Actor struct {
+	UserID *int
+	Role   string
+}
+
+// System is the actor for background jobs and webhooks.
+var System = Actor{Role: RoleSystem}
+
+// Admin is the actor for admin dashboard actions, which are not tied to a user.
+var Admin = Actor{Role: RoleAdmin}
+
+// UserActor returns the actor for an authenticated user.
+func UserActor(userID int, userType string) Actor {
+	return Actor{UserID: &userID, Role: userType}
+}
+
+// Event is one row of booking_events.
+type Event struct {
+	BookingID int
+	Type      string
+	From      *models.BookingStatus
+	To        *models.BookingStatus
+	Actor     Actor
+	Reason    string
+	Metadata  map[string]interface{}
+}
+
+// RecordEvent appends e to the booking's history.
+func RecordEvent(tx Execer, e Event) error {
+	role := e.Actor.Role
+	if role == "" {
+		role = RoleSystem
+	}
+
+	var reason *string
+	if e.Reason != "" {
+		reason = &e.Reason
+	}
+
+	metadata := []byte("{}")
+	if len(e.Metadata) > 0 {
+		var err error
+		metadata, err = json.Marshal(e.Metadata)
+		if err != nil {
+			return fmt.Errorf("error encoding event metadata: %w", err)
+		}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO booking_events (booking_id, event_type, from_status, to_status,
+		                            actor_id, actor_role, reason, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, e.BookingID, e.Type, e.From, e.To, e.Actor.UserID, role, reason, string(metadata))
+	if err != nil {
+		return fmt.Errorf("error writing event for booking %d: %w", e.BookingID, err)
+	}
+	return nil
+}
+
+// ListEvents returns a booking's history, oldest first.
+func ListEvents(db *database.DB, bookingID int) ([]models.BookingEvent, error) {
+	rows, err := db.Query(`
+		SELECT e.id, e.booking_id, e.event_type, e.from_status, e.to_status,
+		       e.actor_id, e.actor_role, u.name, e.reason, e.metadata, e.created_at
+		FROM booking_events e
+		LEFT JOIN users u ON e.actor_id = u.id
+		WHERE e.booking_id = $1
+		ORDER BY e.created_at, e.id
+	`, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying booking events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.BookingEvent{}
+	for rows.Next() {
+		var e models.BookingEvent
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.BookingID, &e.EventType, &e.FromStatus, &e.ToStatus,
+			&e.ActorID, &e.ActorRole, &e.ActorName, &e.Reason, &metadata, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning booking event: %w", err)
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, fmt.Errorf("error decoding event metadata: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,303 @@
+// Package booking owns the booking status lifecycle. Every status change goes
+// through Apply, which performs it as a single conditional UPDATE and records
+// it in booking_events.
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/points"
+)
+
+var (
+	// ErrIllegalTransition is returned when the requested status change is
+	// not allowed by the lifecycle.
+	ErrIllegalTransition = errors.New("illegal booking status transition")
+
+	// ErrStatusChanged is returned when the booking was no longer in the
+	// expected status, usually because a concurrent request won the race.
+	ErrStatusChanged = errors.New("booking status changed concurrently")
+)
+
+// transitions lists the legal status changes. Statuses without an entry are
+// terminal.
+var transitions = map[models.BookingStatus][]models.BookingStatus{
+	models.BookingStatusHeld: {
+		models.BookingStatusPending,
+		models.BookingStatusCancelled,
+		models.BookingStatusExpired,
+	},
+	models.BookingStatusPending: {
+		models.BookingStatusAccepted,
+		models.BookingStatusDeclined,
+		models.BookingStatusCancelled,
+		models.BookingStatusExpired,
+	},
+	models.BookingStatusAccepted: {
+		models.BookingStatusCompleted,
+		models.BookingStatusCancelled,
+	},
+}
+
+// timestampColumns maps a target status to the column recording when the
+// booking entered it.
+var timestampColumns = map[models.BookingStatus]string{
+	models.BookingStatusPending:   "confirmed_at",
+	models.BookingStatusAccepted:  "accepted_at",
+	models.BookingStatusDeclined:  "declined_at",
+	models.BookingStatusCompleted: "completed_at",
+	models.BookingStatusCancelled: "cancelled_at",
+	models.BookingStatusExpired:   "expired_at",
+}
+
+// CanTransition reports whether a booking may move from one status to another.
+func CanTransition(from, to models.BookingStatus) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Execer is satisfied by *sql.DB, *sql.Tx and *database.DB.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Transition describes a single status change.
+type Transition struct {
+	BookingID int
+	From      models.BookingStatus
+	To        models.BookingStatus
+	Actor     Actor
+	Reason    string
+	// Metadata is stored with the event, e.g. the Stripe error behind a
+	// cancellation.
+	Metadata map[string]interface{}
+	// Set holds extra booking columns to update in the same statement.
+	Set map[string]interface{}
+}
+
+// Apply performs t as one conditional UPDATE and writes its event. A booking
+// that is declined, cancelled or expired gets back the points spent on it. It
+// returns ErrIllegalTransition without touching the database if the change is
+// not allowed, and ErrStatusChanged if the booking was not in t.From.
+func Apply(tx ledger.Execer, t Transition) error {
+	if !CanTransition(t.From, t.To) {
+		return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, t.From, t.To)
+	}
+
+	now := time.Now()
+	args := []interface{}{t.To, now}
+	sets := []string{"status = $1", timestampColumns[t.To] + " = $2", "updated_at = $2"}
+
+	columns := make([]string, 0, len(t.Set))
+	for col := range t.Set {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	for _, col := range columns {
+		args = append(args, t.Set[col])
+		sets = append(sets, col+" = $"+strconv.Itoa(len(args)))
+	}
+
+	args = append(args, t.BookingID, t.From)
+	query := "UPDATE bookings SET " + strings.Join(sets, ", ") +
+		" WHERE id = $" + strconv.Itoa(len(args)-1) + " AND status = $" + strconv.Itoa(len(args))
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("error updating booking %d: %w", t.BookingID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error updating booking %d: %w", t.BookingID, err)
+	}
+	if n == 0 {
+		return ErrStatusChanged
+	}
+
+	err = RecordEvent(tx, Event{
+		BookingID: t.BookingID,
+		Type:      EventStatusChanged,
+		From:      &t.From,
+		To:        &t.To,
+		Actor:     t.Actor,
+		Reason:    t.Reason,
+		Metadata:  t.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A booking that ends without taking place gives back the points spent
+	// on it
+	if _, ongoing := transitions[t.To]; !ongoing && t.To != models.BookingStatusCompleted {
+		return points.Restore(tx, t.BookingID)
+	}
+	return nil
+}
+
+// RecordCreated writes the event for a newly inserted booking in status to.
+// Call it in the same transaction as the INSERT.
+func RecordCreated(tx Execer, bookingID int, to models.BookingStatus, actor Actor) error {
+	return RecordEvent(tx, Event{
+		BookingID: bookingID,
+		Type:      EventCreated,
+		To:        &to,
+		Actor:     actor,
+	})
+}
+
+// Machine runs transitions in their own database transaction.
+type Machine struct {
+	db *database.DB
+}
+
+func NewMachine(db *database.DB) *Machine {
+	return &Machine{db: db}
+}
+
+// Transition applies t and commits it.
+func (m *Machine) Transition(t Transition) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := Apply(tx, t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConfirmHold moves a held booking whose payment has been authorized to
+// pending, which starts the cast's response window.
+func (m *Machine) ConfirmHold(bookingID int, actor Actor) error {
+	return m.Transition(Transition{
+		BookingID: bookingID,
+		From:      models.BookingStatusHeld,
+		To:        models.BookingStatusPending,
+		Actor:     actor,
+		Set:       map[string]interface{}{"payment_status": models.PaymentStatusAuthorized},
+	})
+}
+
+// SetPaymentStatus records the outcome of a payment call made after a
+// transition. cause, if non-nil, is stored as the payment error. Moving to
+// captured also stamps captured_at.
+func (m *Machine) SetPaymentStatus(bookingID int, actor Actor, status models.PaymentStatus, cause error) error {
+	var paymentError *string
+	metadata := map[string]interface{}{"payment_status": status}
+	if cause != nil {
+		msg := cause.Error()
+		paymentError = &msg
+		metadata["error"] = msg
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE bookings SET payment_status = $1, payment_error = $2, updated_at = $3,
+		       captured_at = CASE WHEN $1 = 'captured' THEN $3 ELSE captured_at END
+		WHERE id = $4
+	`, status, paymentError, time.Now(), bookingID)
+	if err != nil {
+		return fmt.Errorf("error updating payment status for booking %d: %w", bookingID, err)
+	}
+
+	err = RecordEvent(tx, Event{
+		BookingID: bookingID,
+		Type:      EventPaymentUpdated,
+		Actor:     actor,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordRefund adds amount, in the booking's currency, to the booking's
+// refunded total, updates its payment status to refunded or
+// partially_refunded and books the refund in the ledger. A receipt already
+// issued for the booking is voided, so the next one shows what is left.
+func (m *Machine) RecordRefund(bookingID int, actor Actor, amount models.Money, refundID, reason string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := recordRefund(tx, bookingID, actor, amount, refundID, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordRefund(tx *sql.Tx, bookingID int, actor Actor, amount models.Money, refundID, reason string) error {
+	if err := ledger.Refund(tx, bookingID, amount, refundID, reason); err != nil {
+		return err
+	}
+	// The booking's amount drops when a reschedule shortens it, so whether
+	// anything is left is judged by what the guest still has paid
+	charged, err := ledger.Charged(tx, bookingID, amount.Currency)
+	if err != nil {
+		return err
+	}
+
+	var status models.PaymentStatus
+	err = tx.QueryRow(`
+		UPDATE bookings
+		SET refunded_amount = refunded_amount + $1,
+		    payment_status = CASE WHEN $2 THEN 'refunded'::payment_status
+		                          ELSE 'partially_refunded'::payment_status END,
+		    payment_error = NULL, updated_at = $3
+		WHERE id = $4
+		RETURNING payment_status
+	`, amount.Amount, !charged.IsPositive(), time.Now(), bookingID).Scan(&status)
+	if err != nil {
+		return fmt.Errorf("error recording refund for booking %d: %w", bookingID, err)
+	}
+
+	// The receipt's amount no longer stands. It keeps its number, and
+	// receipts.Issue issues a new one.
+	res, err := tx.Exec(`
+		UPDATE receipts SET voided_at = $1 WHERE booking_id = $2 AND voided_at IS NULL
+	`, time.Now(), bookingID)
+	if err != nil {
+		return fmt.Errorf("error voiding receipt for booking %d: %w", bookingID, err)
+	}
+	voided, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error voiding receipt for booking %d: %w", bookingID, err)
+	}
+
+	return RecordEvent(tx, Event{
+		BookingID: bookingID,
+		Type:      EventRefunded,
+		Actor:     actor,
+		Reason:    reason,
+		Metadata: map[string]interface{}{
+			"amount":         amount,
+			"refund_id":      refundID,
+			"payment_status": status,
+			"receipt_voided": voided > 0,
+		},
+	})
+}
@@ -0,0 +1,209 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/uso/uso/internal/models"
+)
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+type execCall struct {
+	query string
+	args  []interface{}
+}
+
+// fakeExecer records statements and reports rowsAffected for every UPDATE.
+type fakeExecer struct {
+	rowsAffected int64
+	calls        []execCall
+}
+
+func (f *fakeExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	f.calls = append(f.calls, execCall{query: query, args: args})
+	if strings.HasPrefix(strings.TrimSpace(query), "UPDATE") {
+		return fakeResult(f.rowsAffected), nil
+	}
+	return fakeResult(1), nil
+}
+
+// Apply only writes, so reads are never expected.
+func (f *fakeExecer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("unexpected query")
+}
+
+func (f *fakeExecer) QueryRow(query string, args ...interface{}) *sql.Row {
+	panic("unexpected query")
+}
+
+var allStatuses = []models.BookingStatus{
+	models.BookingStatusHeld,
+	models.BookingStatusPending,
+	models.BookingStatusAccepted,
+	models.BookingStatusDeclined,
+	models.BookingStatusCompleted,
+	models.BookingStatusCancelled,
+	models.BookingStatusExpired,
+}
+
+func TestTransitions(t *testing.T) {
+	legal := map[[2]models.BookingStatus]bool{
+		{models.BookingStatusHeld, models.BookingStatusPending}:       true,
+		{models.BookingStatusHeld, models.BookingStatusCancelled}:     true,
+		{models.BookingStatusHeld, models.BookingStatusExpired}:       true,
+		{models.BookingStatusPending, models.BookingStatusAccepted}:   true,
+		{models.BookingStatusPending, models.BookingStatusDeclined}:   true,
+		{models.BookingStatusPending, models.BookingStatusCancelled}:  true,
+		{models.BookingStatusPending, models.BookingStatusExpired}:    true,
+		{models.BookingStatusAccepted, models.BookingStatusCompleted}: true,
+		{models.BookingStatusAccepted, models.BookingStatusCancelled}: true,
+	}
+
+	for _, from := range allStatuses {
+		for _, to := range allStatuses {
+			from, to := from, to
+			want := legal[[2]models.BookingStatus{from, to}]
+
+			t.Run(string(from)+"->"+string(to), func(t *testing.T) {
+				if got := CanTransition(from, to); got != want {
+					t.Fatalf("CanTransition = %v, want %v", got, want)
+				}
+
+				db := &fakeExecer{rowsAffected: 1}
+				actor := 7
+				err := Apply(db, Transition{
+					BookingID: 42,
+					From:      from,
+					To:        to,
+					Actor:     UserActor(actor, "cast"),
+					Reason:    "test",
+				})
+
+				if !want {
+					if !errors.Is(err, ErrIllegalTransition) {
+						t.Fatalf("Apply error = %v, want ErrIllegalTransition", err)
+					}
+					if len(db.calls) != 0 {
+						t.Fatalf("illegal transition executed %d statements", len(db.calls))
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("Apply: %v", err)
+				}
+				// Bookings that end without taking place also give back their points
+				released := to == models.BookingStatusDeclined || to == models.BookingStatusCancelled || to == models.BookingStatusExpired
+				statements := 2
+				if released {
+					statements = 3
+				}
+				if len(db.calls) != statements {
+					t.Fatalf("got %d statements, want %d", len(db.calls), statements)
+				}
+				if released && !strings.Contains(db.calls[2].query, "INSERT INTO guest_points") {
+					t.Errorf("third statement does not restore points: %s", db.calls[2].query)
+				}
+
+				update := db.calls[0]
+				if !strings.Contains(update.query, timestampColumns[to]+" = $2") {
+					t.Errorf("UPDATE does not set %s: %s", timestampColumns[to], update.query)
+				}
+				if !strings.HasSuffix(update.query, "WHERE id = $3 AND status = $4") {
+					t.Errorf("UPDATE is not conditional on the old status: %s", update.query)
+				}
+				if update.args[0] != to || update.args[2] != 42 || update.args[3] != from {
+					t.Errorf("unexpected UPDATE args: %v", update.args)
+				}
+
+				event := db.calls[1]
+				if !strings.Contains(event.query, "INSERT INTO booking_events") {
+					t.Fatalf("second statement is not the event row: %s", event.query)
+				}
+				args := event.args
+				if args[1] != EventStatusChanged ||
+					*args[2].(*models.BookingStatus) != from ||
+					*args[3].(*models.BookingStatus) != to ||
+					*args[4].(*int) != actor || args[5] != "cast" ||
+					*args[6].(*string) != "test" {
+					t.Errorf("unexpected event args: %v", args)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyLostRace(t *testing.T) {
+	db := &fakeExecer{rowsAffected: 0}
+	err := Apply(db, Transition{
+		BookingID: 1,
+		From:      models.BookingStatusPending,
+		To:        models.BookingStatusAccepted,
+	})
+	if !errors.Is(err, ErrStatusChanged) {
+		t.Fatalf("Apply error = %v, want ErrStatusChanged", err)
+	}
+	if len(db.calls) != 1 {
+		t.Fatalf("event written for a transition that did not happen")
+	}
+}
+
+func TestApplyExtraColumns(t *testing.T) {
+	db := &fakeExecer{rowsAffected: 1}
+	err := Apply(db, Transition{
+		BookingID: 3,
+		From:      models.BookingStatusPending,
+		To:        models.BookingStatusDeclined,
+		Set: map[string]interface{}{
+			"payment_status": models.PaymentStatusCanceled,
+			"payment_error":  nil,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := "UPDATE bookings SET status = $1, declined_at = $2, updated_at = $2, " +
+		"payment_error = $3, payment_status = $4 WHERE id = $5 AND status = $6"
+	if got := db.calls[0].query; got != want {
+		t.Errorf("query =\n  %s\nwant\n  %s", got, want)
+	}
+}
+
+func TestRecordCreated(t *testing.T) {
+	db := &fakeExecer{}
+	if err := RecordCreated(db, 9, models.BookingStatusHeld, UserActor(5, "guest")); err != nil {
+		t.Fatalf("RecordCreated: %v", err)
+	}
+	args := db.calls[0].args
+	if args[0] != 9 || args[1] != EventCreated ||
+		args[2].(*models.BookingStatus) != nil ||
+		*args[3].(*models.BookingStatus) != models.BookingStatusHeld {
+		t.Errorf("unexpected event args: %v", args)
+	}
+}
+
+func TestRecordEventDefaults(t *testing.T) {
+	db := &fakeExecer{}
+	err := RecordEvent(db, Event{
+		BookingID: 1,
+		Type:      EventPaymentUpdated,
+		Metadata:  map[string]interface{}{"payment_status": "captured"},
+	})
+	if err != nil {
+		t.Fatalf("RecordEvent: %v", err)
+	}
+	args := db.calls[0].args
+	if args[4].(*int) != nil || args[5] != RoleSystem || args[6].(*string) != nil {
+		t.Errorf("missing actor should be recorded as system: %v", args)
+	}
+	if args[7] != `{"payment_status":"captured"}` {
+		t.Errorf("metadata = %v", args[7])
+	}
+}
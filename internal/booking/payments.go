@@ -0,0 +1,296 @@
+package booking
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// Purposes of booking_payments rows
+const (
+	PaymentPurposeReschedule = "reschedule"
+	PaymentPurposeExtension  = "extension"
+	PaymentPurposeTip        = "tip"
+)
+
+// Capture methods of booking_payments rows
+const (
+	CaptureManual    = "manual"
+	CaptureAutomatic = "automatic"
+)
+
+// CreateExtraPayment creates a PaymentIntent for amount on top of the
+// booking's main payment and links it to the booking. The guest confirms it
+// with the returned client secret. Use CaptureManual to hold the amount until
+// it is captured with the booking or on approval. idempotencyKey, if set, is
+// sent to Stripe so a retried request gets the same PaymentIntent back.
+func CreateExtraPayment(db *database.DB, pay payments.Provider, bookingID, guestID int, purpose string, amount models.Money, captureMethod, idempotencyKey string) (*models.BookingPayment, error) {
+	pi, err := pay.Authorize(payments.AuthorizeParams{
+		Amount: amount,
+		Metadata: map[string]string{
+			"booking_id": strconv.Itoa(bookingID),
+			"guest_id":   strconv.Itoa(guestID),
+			"purpose":    purpose,
+		},
+		ManualCapture:  captureMethod == CaptureManual,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating payment intent: %w", err)
+	}
+
+	p := models.BookingPayment{
+		BookingID:             bookingID,
+		Purpose:               purpose,
+		StripePaymentIntentID: pi.ID,
+		Amount:                amount,
+		CaptureMethod:         captureMethod,
+		Status:                models.PaymentStatusRequiresPayment,
+		ClientSecret:          pi.ClientSecret,
+	}
+	err = db.QueryRow(`
+		INSERT INTO booking_payments (booking_id, purpose, stripe_payment_intent_id, amount, capture_method, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, bookingID, purpose, pi.ID, amount.Amount, captureMethod, p.Status).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		if cancelErr := pay.Cancel(pi.ID); cancelErr != nil {
+			log.Printf("Error cancelling orphaned payment intent %s: %v", pi.ID, cancelErr)
+		}
+		return nil, fmt.Errorf("error saving booking payment: %w", err)
+	}
+	return &p, nil
+}
+
+// ListExtraPayments returns the booking's extra payments, oldest first.
+func ListExtraPayments(db *database.DB, bookingID int) ([]models.BookingPayment, error) {
+	rows, err := db.Query(`
+		SELECT bp.id, bp.booking_id, bp.purpose, bp.stripe_payment_intent_id, bp.amount, b.currency,
+		       bp.capture_method, bp.status, bp.refunded_amount, bp.cast_percent, bp.created_at
+		FROM booking_payments bp
+		JOIN bookings b ON bp.booking_id = b.id
+		WHERE bp.booking_id = $1
+		ORDER BY bp.created_at, bp.id
+	`, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying booking payments: %w", err)
+	}
+	defer rows.Close()
+
+	payments := []models.BookingPayment{}
+	for rows.Next() {
+		var p models.BookingPayment
+		if err := rows.Scan(&p.ID, &p.BookingID, &p.Purpose, &p.StripePaymentIntentID, &p.Amount.Amount,
+			&p.Amount.Currency, &p.CaptureMethod, &p.Status, &p.RefundedAmount.Amount, &p.CastPercent, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning booking payment: %w", err)
+		}
+		p.RefundedAmount.Currency = p.Amount.Currency
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// ExtraPaymentsTotal is the amount of the booking covered by extra payments
+// rather than its main PaymentIntent, in the booking's currency. Tips are on
+// top of the booking's amount, so they don't count.
+func ExtraPaymentsTotal(q Querier, bookingID int) (models.Money, error) {
+	var total models.Money
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(bp.amount), 0), b.currency
+		FROM bookings b
+		LEFT JOIN booking_payments bp ON bp.booking_id = b.id
+			AND bp.status NOT IN ('canceled', 'capture_failed')
+			AND bp.purpose <> 'tip'
+		WHERE b.id = $1
+		GROUP BY b.currency
+	`, bookingID).Scan(&total.Amount, &total.Currency)
+	return total, err
+}
+
+// CaptureExtraPayments captures the booking's manual-capture extra payments
+// for purpose, or for every purpose if it is empty. Payments the guest has not
+// confirmed yet fail to capture and are left as they are.
+func CaptureExtraPayments(db *database.DB, pay payments.Provider, bookingID int, purpose string) error {
+	payments, err := ListExtraPayments(db, bookingID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payments {
+		if p.CaptureMethod != CaptureManual || (purpose != "" && p.Purpose != purpose) {
+			continue
+		}
+		if err := CaptureExtraPayment(db, pay, p); err != nil {
+			log.Printf("Error capturing extra payment %s: %v", p.StripePaymentIntentID, err)
+		}
+	}
+	return nil
+}
+
+// CaptureExtraPayment captures a single manual-capture extra payment.
+func CaptureExtraPayment(db *database.DB, pay payments.Provider, p models.BookingPayment) error {
+	captured, err := CaptureExtraPaymentIntent(pay, p)
+	if err != nil || !captured {
+		return err
+	}
+	setExtraPaymentStatus(db, p.ID, models.PaymentStatusCaptured)
+	if err := BookExtraPayment(db, p, p.Amount); err != nil {
+		log.Printf("Error booking extra payment %s in the ledger: %v", p.StripePaymentIntentID, err)
+	}
+	return nil
+}
+
+// CaptureExtraPaymentIntent captures a manual-capture extra payment in Stripe
+// without recording it, for a caller that records it with
+// RecordExtraPaymentCapture in a transaction of its own. It reports false for
+// a payment that was already captured.
+func CaptureExtraPaymentIntent(pay payments.Provider, p models.BookingPayment) (bool, error) {
+	if p.Status == models.PaymentStatusCaptured {
+		return false, nil
+	}
+	if p.Status != models.PaymentStatusRequiresPayment && p.Status != models.PaymentStatusAuthorized {
+		return false, fmt.Errorf("extra payment %d is %s", p.ID, p.Status)
+	}
+	if _, err := pay.Capture(p.StripePaymentIntentID, models.Money{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RecordExtraPaymentCapture marks a captured extra payment as such and books
+// it in the ledger, in tx. The ledger locks the booking, so a caller already
+// holding it locked must record the capture here rather than through
+// CaptureExtraPayment.
+func RecordExtraPaymentCapture(tx ledger.Execer, p models.BookingPayment) error {
+	if _, err := tx.Exec(`UPDATE booking_payments SET status = $1 WHERE id = $2`, models.PaymentStatusCaptured, p.ID); err != nil {
+		return fmt.Errorf("error updating booking payment %d: %w", p.ID, err)
+	}
+	return bookExtraPayment(tx, p, p.Amount)
+}
+
+// BookExtraPayment posts amount captured on an extra payment to the ledger:
+// a tip as earned straight away, anything else as a charge for the booking.
+func BookExtraPayment(db *database.DB, p models.BookingPayment, amount models.Money) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := bookExtraPayment(tx, p, amount); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func bookExtraPayment(tx ledger.Execer, p models.BookingPayment, amount models.Money) error {
+	if p.Purpose == PaymentPurposeTip {
+		castPercent := 100
+		if p.CastPercent != nil {
+			castPercent = *p.CastPercent
+		}
+		return ledger.Tip(tx, p.BookingID, amount, p.StripePaymentIntentID, castPercent)
+	}
+	return ledger.Charge(tx, p.BookingID, amount, p.StripePaymentIntentID)
+}
+
+// CancelExtraPayments cancels the booking's uncaptured extra payments.
+func CancelExtraPayments(db *database.DB, pay payments.Provider, bookingID int) error {
+	payments, err := ListExtraPayments(db, bookingID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payments {
+		if err := CancelExtraPayment(db, pay, p); err != nil {
+			log.Printf("Error cancelling extra payment %s: %v", p.StripePaymentIntentID, err)
+		}
+	}
+	return nil
+}
+
+// CancelExtraPayment releases a single extra payment if it has not been
+// captured.
+func CancelExtraPayment(db *database.DB, pay payments.Provider, p models.BookingPayment) error {
+	if p.Status != models.PaymentStatusRequiresPayment && p.Status != models.PaymentStatusAuthorized {
+		return nil
+	}
+	if err := pay.Cancel(p.StripePaymentIntentID); err != nil {
+		return err
+	}
+	setExtraPaymentStatus(db, p.ID, models.PaymentStatusCanceled)
+	return nil
+}
+
+// GetExtraPayment returns one extra payment by ID.
+func GetExtraPayment(q Querier, paymentID int) (models.BookingPayment, error) {
+	var p models.BookingPayment
+	err := q.QueryRow(`
+		SELECT bp.id, bp.booking_id, bp.purpose, bp.stripe_payment_intent_id, bp.amount, b.currency,
+		       bp.capture_method, bp.status, bp.refunded_amount, bp.cast_percent, bp.created_at
+		FROM booking_payments bp
+		JOIN bookings b ON bp.booking_id = b.id
+		WHERE bp.id = $1
+	`, paymentID).Scan(&p.ID, &p.BookingID, &p.Purpose, &p.StripePaymentIntentID, &p.Amount.Amount,
+		&p.Amount.Currency, &p.CaptureMethod, &p.Status, &p.RefundedAmount.Amount, &p.CastPercent, &p.CreatedAt)
+	p.RefundedAmount.Currency = p.Amount.Currency
+	return p, err
+}
+
+// RefundExtraPayments refunds up to amount from the booking's captured extra
+// payments, newest first, and returns how much was refunded. A negative
+// amount refunds them in full. Tips are the cast's and never refunded here.
+func RefundExtraPayments(db *database.DB, pay payments.Provider, bookingID int, amount models.Money) (models.Money, error) {
+	refunded := amount.Zero()
+	payments, err := ListExtraPayments(db, bookingID)
+	if err != nil {
+		return refunded, err
+	}
+
+	for i := len(payments) - 1; i >= 0; i-- {
+		p := payments[i]
+		if p.Purpose == PaymentPurposeTip {
+			continue
+		}
+		if p.Status != models.PaymentStatusCaptured && p.Status != models.PaymentStatusPartiallyRefunded {
+			continue
+		}
+
+		available := p.Amount.Sub(p.RefundedAmount)
+		refundAmount := available
+		if !amount.IsNegative() {
+			refundAmount = available.Min(amount.Sub(refunded))
+		}
+		if !refundAmount.IsPositive() {
+			continue
+		}
+
+		if _, err := pay.Refund(p.StripePaymentIntentID, refundAmount, ""); err != nil {
+			return refunded, fmt.Errorf("error refunding extra payment %s: %w", p.StripePaymentIntentID, err)
+		}
+
+		status := models.PaymentStatusPartiallyRefunded
+		if refundAmount.Cmp(available) >= 0 {
+			status = models.PaymentStatusRefunded
+		}
+		if _, err := db.Exec(`
+			UPDATE booking_payments SET refunded_amount = refunded_amount + $1, status = $2
+			WHERE id = $3
+		`, refundAmount.Amount, status, p.ID); err != nil {
+			log.Printf("Error recording refund of extra payment %d: %v", p.ID, err)
+		}
+		refunded = refunded.Add(refundAmount)
+	}
+	return refunded, nil
+}
+
+func setExtraPaymentStatus(db *database.DB, paymentID int, status models.PaymentStatus) {
+	if _, err := db.Exec(`UPDATE booking_payments SET status = $1 WHERE id = $2`, status, paymentID); err != nil {
+		log.Printf("Error updating booking payment %d: %v", paymentID, err)
+	}
+}
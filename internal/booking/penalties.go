@@ -0,0 +1,68 @@
+package booking
+
+import (
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// CastPenaltyPolicy decides what happens to a cast who repeatedly cancels
+// accepted bookings at short notice.
+type CastPenaltyPolicy struct {
+	// LateNotice is the notice below which a cancellation is a strike.
+	LateNotice time.Duration
+	// Window is how far back strikes are counted.
+	Window time.Duration
+	// DemoteAfter strikes within Window demote the cast one rank.
+	DemoteAfter int
+	// SuspendAfter strikes within Window suspend the cast's listing for
+	// SuspensionPeriod.
+	SuspendAfter     int
+	SuspensionPeriod time.Duration
+}
+
+// Penalty actions recorded in cast_penalties.action
+const (
+	PenaltyDemoted   = "demoted"
+	PenaltySuspended = "suspended"
+)
+
+// CastPenalty is the outcome of evaluating a cast's strikes. Action is empty
+// when no penalty applies.
+type CastPenalty struct {
+	Action         string
+	FromRank       models.CastRank
+	ToRank         models.CastRank
+	SuspendedUntil time.Time
+}
+
+// IsLate reports whether cancelling with the given notice is a strike.
+func (p CastPenaltyPolicy) IsLate(notice time.Duration) bool {
+	return notice < p.LateNotice
+}
+
+// Evaluate returns the penalty for a cast of the given rank who now has
+// strikes late cancellations within the window.
+func (p CastPenaltyPolicy) Evaluate(strikes int, rank models.CastRank, now time.Time) CastPenalty {
+	if p.SuspendAfter > 0 && strikes >= p.SuspendAfter {
+		return CastPenalty{
+			Action:         PenaltySuspended,
+			FromRank:       rank,
+			ToRank:         rank,
+			SuspendedUntil: now.Add(p.SuspensionPeriod),
+		}
+	}
+
+	if p.DemoteAfter > 0 && strikes >= p.DemoteAfter {
+		if lower, ok := demotions[rank]; ok {
+			return CastPenalty{Action: PenaltyDemoted, FromRank: rank, ToRank: lower}
+		}
+	}
+
+	return CastPenalty{}
+}
+
+var demotions = map[models.CastRank]models.CastRank{
+	models.CastRankVIP:     models.CastRankPremium,
+	models.CastRankPremium: models.CastRankStandard,
+}
@@ -0,0 +1,48 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestCastPenaltyPolicy(t *testing.T) {
+	policy := CastPenaltyPolicy{
+		LateNotice:       24 * time.Hour,
+		Window:           90 * 24 * time.Hour,
+		DemoteAfter:      2,
+		SuspendAfter:     3,
+		SuspensionPeriod: 30 * 24 * time.Hour,
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, Tokyo)
+
+	tests := []struct {
+		name    string
+		strikes int
+		rank    models.CastRank
+		want    CastPenalty
+	}{
+		{"first strike", 1, models.CastRankVIP, CastPenalty{}},
+		{"vip demoted", 2, models.CastRankVIP,
+			CastPenalty{Action: PenaltyDemoted, FromRank: models.CastRankVIP, ToRank: models.CastRankPremium}},
+		{"premium demoted", 2, models.CastRankPremium,
+			CastPenalty{Action: PenaltyDemoted, FromRank: models.CastRankPremium, ToRank: models.CastRankStandard}},
+		{"standard cannot be demoted", 2, models.CastRankStandard, CastPenalty{}},
+		{"suspended", 3, models.CastRankStandard,
+			CastPenalty{Action: PenaltySuspended, FromRank: models.CastRankStandard, ToRank: models.CastRankStandard,
+				SuspendedUntil: now.Add(30 * 24 * time.Hour)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Evaluate(tt.strikes, tt.rank, now); got != tt.want {
+				t.Errorf("Evaluate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if !policy.IsLate(23*time.Hour) || policy.IsLate(24*time.Hour) {
+		t.Error("IsLate does not use LateNotice as the boundary")
+	}
+}
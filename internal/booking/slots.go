@@ -0,0 +1,49 @@
+package booking
+
+import "time"
+
+// Interval is a span of time from Start up to, but not including, End.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (i Interval) overlaps(o Interval) bool {
+	return i.Start.Before(o.End) && o.Start.Before(i.End)
+}
+
+// OpenSlots splits [from, to) into slots of length step and returns the ones
+// a new booking could use: inside the cast's working hours, not in the past,
+// and at least buffer away from every busy interval. Slots start on multiples
+// of step from midnight Tokyo time.
+func OpenSlots(a Availability, busy []Interval, from, to, now time.Time, step, buffer time.Duration) []Interval {
+	slots := []Interval{}
+	if step <= 0 {
+		return slots
+	}
+
+	from = from.In(Tokyo)
+	t := midnight(from)
+	for t.Before(from) {
+		t = t.Add(step)
+	}
+
+	for ; !t.Add(step).After(to); t = t.Add(step) {
+		slot := Interval{Start: t, End: t.Add(step)}
+		if t.Before(now) || !a.Covers(t, step) {
+			continue
+		}
+
+		free := true
+		for _, b := range busy {
+			if slot.overlaps(Interval{Start: b.Start.Add(-buffer), End: b.End.Add(buffer)}) {
+				free = false
+				break
+			}
+		}
+		if free {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
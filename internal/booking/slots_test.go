@@ -0,0 +1,115 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenSlots(t *testing.T) {
+	evening := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 18 * time.Hour, End: 22 * time.Hour},
+	}}
+	lateNight := Availability{Weekly: []Window{
+		{Weekday: time.Friday, Start: 22 * time.Hour, End: 24 * time.Hour},
+		{Weekday: time.Saturday, Start: 0, End: 2 * time.Hour},
+	}}
+	day := friday(0, 0)
+	nextDay := day.AddDate(0, 0, 1)
+	earlier := day.AddDate(0, 0, -1)
+
+	tests := []struct {
+		name   string
+		a      Availability
+		busy   []Interval
+		from   time.Time
+		to     time.Time
+		now    time.Time
+		step   time.Duration
+		buffer time.Duration
+		want   []string
+	}{
+		{
+			name: "hourly",
+			a:    evening, from: day, to: nextDay, now: earlier, step: time.Hour,
+			want: []string{"01-05 18:00", "01-05 19:00", "01-05 20:00", "01-05 21:00"},
+		},
+		{
+			name: "every 90 minutes",
+			a:    evening, from: day, to: nextDay, now: earlier, step: 90 * time.Minute,
+			// 16:30 and 21:00 run outside the window
+			want: []string{"01-05 18:00", "01-05 19:30"},
+		},
+		{
+			name: "aligned to midnight, not to from",
+			a:    evening, from: friday(18, 10), to: nextDay, now: earlier, step: 30 * time.Minute,
+			want: []string{"01-05 18:30", "01-05 19:00", "01-05 19:30", "01-05 20:00", "01-05 20:30", "01-05 21:00", "01-05 21:30"},
+		},
+		{
+			name: "up to but not past to",
+			a:    evening, from: day, to: friday(20, 30), now: earlier, step: time.Hour,
+			want: []string{"01-05 18:00", "01-05 19:00"},
+		},
+		{
+			name: "busy without a buffer",
+			a:    evening, from: day, to: nextDay, now: earlier, step: 30 * time.Minute,
+			busy: []Interval{{Start: friday(19, 0), End: friday(20, 0)}},
+			want: []string{"01-05 18:00", "01-05 18:30", "01-05 20:00", "01-05 20:30", "01-05 21:00", "01-05 21:30"},
+		},
+		{
+			name: "busy with a buffer",
+			a:    evening, from: day, to: nextDay, now: earlier, step: 30 * time.Minute, buffer: 30 * time.Minute,
+			busy: []Interval{{Start: friday(19, 0), End: friday(20, 0)}},
+			want: []string{"01-05 18:00", "01-05 20:30", "01-05 21:00", "01-05 21:30"},
+		},
+		{
+			name: "buffer reaching in from a booking outside the range",
+			a:    evening, from: day, to: nextDay, now: earlier, step: time.Hour, buffer: time.Hour,
+			busy: []Interval{{Start: friday(16, 0), End: friday(17, 30)}},
+			want: []string{"01-05 19:00", "01-05 20:00", "01-05 21:00"},
+		},
+		{
+			name: "in the past",
+			a:    evening, from: day, to: nextDay, now: friday(19, 15), step: time.Hour,
+			want: []string{"01-05 20:00", "01-05 21:00"},
+		},
+		{
+			name: "suspended until the evening",
+			a:    evening, from: day, to: nextDay.AddDate(0, 0, 7), now: friday(21, 0), step: time.Hour,
+			// and the next Friday's hours after that
+			want: []string{"01-05 21:00", "01-12 18:00", "01-12 19:00", "01-12 20:00", "01-12 21:00"},
+		},
+		{
+			name: "past midnight",
+			a:    lateNight, from: day, to: nextDay.AddDate(0, 0, 1), now: earlier, step: time.Hour,
+			want: []string{"01-05 22:00", "01-05 23:00", "01-06 00:00", "01-06 01:00"},
+		},
+		{
+			name: "busy across midnight",
+			a:    lateNight, from: day, to: nextDay.AddDate(0, 0, 1), now: earlier, step: time.Hour,
+			busy: []Interval{{Start: friday(23, 30), End: friday(23, 30).Add(time.Hour)}},
+			want: []string{"01-05 22:00", "01-06 01:00"},
+		},
+		{
+			name: "no step",
+			a:    evening, from: day, to: nextDay, now: earlier,
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slots := OpenSlots(tt.a, tt.busy, tt.from, tt.to, tt.now, tt.step, tt.buffer)
+			got := []string{}
+			for _, s := range slots {
+				if s.End.Sub(s.Start) != tt.step {
+					t.Errorf("slot %v to %v is not %v long", s.Start, s.End, tt.step)
+				}
+				got = append(got, s.Start.In(Tokyo).Format("01-02 15:04"))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("OpenSlots = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
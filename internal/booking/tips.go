@@ -0,0 +1,138 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// ErrNotTippable is returned for a tip on a booking that isn't completed.
+var ErrNotTippable = errors.New("only completed bookings can be tipped")
+
+// GuestCustomer returns the guest's Stripe customer, creating it the first
+// time.
+func GuestCustomer(db *database.DB, pay payments.Provider, guestID int) (string, error) {
+	var customerID sql.NullString
+	var email, name string
+	err := db.QueryRow(`
+		SELECT stripe_customer_id, email, name FROM users WHERE id = $1
+	`, guestID).Scan(&customerID, &email, &name)
+	if err != nil {
+		return "", fmt.Errorf("error getting guest %d: %w", guestID, err)
+	}
+	if customerID.Valid {
+		return customerID.String, nil
+	}
+
+	id, err := pay.CreateCustomer(payments.CustomerParams{
+		Email:          email,
+		Name:           name,
+		Metadata:       map[string]string{"user_id": strconv.Itoa(guestID)},
+		IdempotencyKey: fmt.Sprintf("customer-%d", guestID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating customer for guest %d: %w", guestID, err)
+	}
+	// A concurrent request may have saved the same customer first
+	err = db.QueryRow(`
+		UPDATE users SET stripe_customer_id = COALESCE(stripe_customer_id, $1) WHERE id = $2
+		RETURNING stripe_customer_id
+	`, id, guestID).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("error saving customer for guest %d: %w", guestID, err)
+	}
+	return id, nil
+}
+
+// CreateTip charges the guest amount as a tip for a completed booking, to the
+// card they paid for the booking with if it was saved. castPercent of it goes
+// to the cast. The tip is returned captured, or with a client secret if the
+// guest has to confirm it: there is no saved card, or the card asks them to
+// authenticate or was declined.
+func CreateTip(db *database.DB, pay payments.Provider, bookingID, guestID int, amount models.Money, castPercent int, idempotencyKey string) (*models.BookingPayment, error) {
+	var status models.BookingStatus
+	var mainIntent sql.NullString
+	err := db.QueryRow(`
+		SELECT status, stripe_payment_intent_id FROM bookings WHERE id = $1 AND guest_id = $2
+	`, bookingID, guestID).Scan(&status, &mainIntent)
+	if err != nil {
+		return nil, fmt.Errorf("error getting booking %d: %w", bookingID, err)
+	}
+	if status != models.BookingStatusCompleted {
+		return nil, ErrNotTippable
+	}
+
+	customer, err := GuestCustomer(db, pay, guestID)
+	if err != nil {
+		return nil, err
+	}
+	var paymentMethod string
+	if mainIntent.Valid {
+		pi, err := pay.Get(mainIntent.String)
+		if err != nil {
+			return nil, fmt.Errorf("error getting payment intent %s: %w", mainIntent.String, err)
+		}
+		paymentMethod = pi.PaymentMethod
+	}
+
+	pi, err := pay.Authorize(payments.AuthorizeParams{
+		Amount: amount,
+		Metadata: map[string]string{
+			"booking_id": strconv.Itoa(bookingID),
+			"guest_id":   strconv.Itoa(guestID),
+			"purpose":    PaymentPurposeTip,
+		},
+		Customer:       customer,
+		PaymentMethod:  paymentMethod,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating payment intent: %w", err)
+	}
+
+	p := models.BookingPayment{
+		BookingID:             bookingID,
+		Purpose:               PaymentPurposeTip,
+		StripePaymentIntentID: pi.ID,
+		Amount:                amount,
+		CaptureMethod:         CaptureAutomatic,
+		Status:                models.PaymentStatusRequiresPayment,
+		RefundedAmount:        amount.Zero(),
+		CastPercent:           &castPercent,
+	}
+	if pi.Status == payments.IntentSucceeded {
+		p.Status = models.PaymentStatusCaptured
+	} else {
+		p.ClientSecret = pi.ClientSecret
+	}
+	err = db.QueryRow(`
+		INSERT INTO booking_payments (booking_id, purpose, stripe_payment_intent_id, amount, capture_method,
+		                              status, cast_percent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, bookingID, p.Purpose, pi.ID, amount.Amount, p.CaptureMethod, p.Status, castPercent).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		if p.Status == models.PaymentStatusCaptured {
+			if _, refundErr := pay.Refund(pi.ID, models.Money{}, ""); refundErr != nil {
+				log.Printf("Error refunding orphaned payment intent %s: %v", pi.ID, refundErr)
+			}
+		} else if cancelErr := pay.Cancel(pi.ID); cancelErr != nil {
+			log.Printf("Error cancelling orphaned payment intent %s: %v", pi.ID, cancelErr)
+		}
+		return nil, fmt.Errorf("error saving tip: %w", err)
+	}
+
+	// Tips confirmed by the guest are booked when the webhook sees them
+	if p.Status == models.PaymentStatusCaptured {
+		if err := BookExtraPayment(db, p, pi.Received); err != nil {
+			log.Printf("Error booking tip %s in the ledger: %v", pi.ID, err)
+		}
+	}
+	return &p, nil
+}
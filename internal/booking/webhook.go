@@ -0,0 +1,290 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// HandlePaymentEvent applies a webhook event to the booking payment it
+// concerns. Events for payments that don't belong to a booking, and event
+// types we don't act on, are ignored. Events are delivered at least once and
+// in no particular order, and most of them echo a call we made ourselves, so
+// every case only moves state forward from where it is.
+func (m *Machine) HandlePaymentEvent(event *payments.Event) error {
+	if event.IntentID == "" {
+		return nil
+	}
+	switch event.Type {
+	case payments.EventIntentSucceeded, payments.EventIntentPaymentFailed,
+		payments.EventIntentCanceled, payments.EventIntentCapturableUpdated:
+		if event.Intent == nil {
+			return fmt.Errorf("event %s has no payment intent", event.ID)
+		}
+		return m.handlePaymentIntent(event.Type, event.Intent)
+	case payments.EventChargeRefunded:
+		return m.handleChargeRefunded(event)
+	case payments.EventDisputeCreated, payments.EventDisputeUpdated, payments.EventDisputeClosed:
+		if event.Dispute == nil {
+			return fmt.Errorf("event %s has no dispute", event.ID)
+		}
+		return m.handleDispute(event.IntentID, event.Dispute)
+	}
+	return nil
+}
+
+// intentOwner is the booking a PaymentIntent belongs to, along with the extra
+// payment when it isn't the booking's main one.
+type intentOwner struct {
+	bookingID     int
+	status        models.BookingStatus
+	paymentStatus models.PaymentStatus
+	extra         *models.BookingPayment
+}
+
+// findIntent returns nil if no booking uses the PaymentIntent.
+func (m *Machine) findIntent(paymentIntentID string) (*intentOwner, error) {
+	var o intentOwner
+	err := m.db.QueryRow(`
+		SELECT id, status, payment_status FROM bookings WHERE stripe_payment_intent_id = $1
+	`, paymentIntentID).Scan(&o.bookingID, &o.status, &o.paymentStatus)
+	if err == nil {
+		return &o, nil
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error getting booking for %s: %w", paymentIntentID, err)
+	}
+
+	var paymentID int
+	err = m.db.QueryRow(`
+		SELECT bp.id, b.id, b.status, b.payment_status
+		FROM booking_payments bp
+		JOIN bookings b ON bp.booking_id = b.id
+		WHERE bp.stripe_payment_intent_id = $1
+	`, paymentIntentID).Scan(&paymentID, &o.bookingID, &o.status, &o.paymentStatus)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting booking payment for %s: %w", paymentIntentID, err)
+	}
+
+	extra, err := GetExtraPayment(m.db, paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting booking payment %d: %w", paymentID, err)
+	}
+	o.extra = &extra
+	return &o, nil
+}
+
+func (m *Machine) handlePaymentIntent(eventType string, pi *payments.Intent) error {
+	o, err := m.findIntent(pi.ID)
+	if err != nil || o == nil {
+		return err
+	}
+	if o.extra != nil {
+		return m.handleExtraPaymentIntent(eventType, o.extra, pi)
+	}
+
+	uncaptured := o.paymentStatus == models.PaymentStatusRequiresPayment ||
+		o.paymentStatus == models.PaymentStatusAuthorized ||
+		o.paymentStatus == models.PaymentStatusCaptureFailed
+
+	switch eventType {
+	case payments.EventIntentCapturableUpdated:
+		// Confirms the hold in case the guest's client never called back
+		if o.status == models.BookingStatusHeld && pi.Status == payments.IntentRequiresCapture {
+			return ignoreStatusChanged(m.ConfirmHold(o.bookingID, System))
+		}
+
+	case payments.EventIntentSucceeded:
+		if uncaptured {
+			if err := m.SetPaymentStatus(o.bookingID, System, models.PaymentStatusCaptured, nil); err != nil {
+				return err
+			}
+		}
+		// A no-op when we booked the capture ourselves
+		return ledger.New(m.db).Charge(o.bookingID, pi.Received, pi.ID)
+
+	case payments.EventIntentPaymentFailed:
+		// The guest can retry the card until the hold runs out
+		if o.status == models.BookingStatusHeld {
+			cause := errors.New("payment failed")
+			if pi.LastError != "" {
+				cause = errors.New(pi.LastError)
+			}
+			return m.SetPaymentStatus(o.bookingID, System, models.PaymentStatusRequiresPayment, cause)
+		}
+
+	case payments.EventIntentCanceled:
+		if !uncaptured {
+			return nil
+		}
+		// Canceled outside our own flows, e.g. from the dashboard or because
+		// the authorization lapsed, so the booking can no longer be paid for
+		var err error
+		switch o.status {
+		case models.BookingStatusHeld:
+			err = m.Transition(Transition{
+				BookingID: o.bookingID,
+				From:      models.BookingStatusHeld,
+				To:        models.BookingStatusExpired,
+				Actor:     System,
+				Reason:    "payment was canceled",
+			})
+		case models.BookingStatusPending:
+			err = m.Transition(Transition{
+				BookingID: o.bookingID,
+				From:      models.BookingStatusPending,
+				To:        models.BookingStatusCancelled,
+				Actor:     System,
+				Reason:    "payment authorization was canceled",
+			})
+		}
+		if err := ignoreStatusChanged(err); err != nil {
+			return err
+		}
+		return m.SetPaymentStatus(o.bookingID, System, models.PaymentStatusCanceled, nil)
+	}
+	return nil
+}
+
+func (m *Machine) handleExtraPaymentIntent(eventType string, p *models.BookingPayment, pi *payments.Intent) error {
+	uncaptured := p.Status == models.PaymentStatusRequiresPayment || p.Status == models.PaymentStatusAuthorized
+
+	switch eventType {
+	case payments.EventIntentCapturableUpdated:
+		if p.Status == models.PaymentStatusRequiresPayment && pi.Status == payments.IntentRequiresCapture {
+			setExtraPaymentStatus(m.db, p.ID, models.PaymentStatusAuthorized)
+		}
+	case payments.EventIntentSucceeded:
+		if uncaptured {
+			setExtraPaymentStatus(m.db, p.ID, models.PaymentStatusCaptured)
+		}
+		return BookExtraPayment(m.db, *p, pi.Received)
+	case payments.EventIntentCanceled:
+		if uncaptured {
+			setExtraPaymentStatus(m.db, p.ID, models.PaymentStatusCanceled)
+		}
+	}
+	return nil
+}
+
+// handleChargeRefunded catches up with refunds made outside the app, such as
+// from the Stripe dashboard. Refunds we issued ourselves are already recorded,
+// so only the part of the charge's refunded total we don't know about yet is
+// added.
+func (m *Machine) handleChargeRefunded(event *payments.Event) error {
+	o, err := m.findIntent(event.IntentID)
+	if err != nil || o == nil {
+		return err
+	}
+
+	refundID := event.RefundID
+	total := event.AmountRefunded
+
+	if o.extra != nil {
+		missing := total.Sub(o.extra.RefundedAmount)
+		if !missing.IsPositive() {
+			return nil
+		}
+		status := models.PaymentStatusPartiallyRefunded
+		if total.Cmp(o.extra.Amount) >= 0 {
+			status = models.PaymentStatusRefunded
+		}
+		if _, err := m.db.Exec(`
+			UPDATE booking_payments SET refunded_amount = $1, status = $2 WHERE id = $3
+		`, total.Amount, status, o.extra.ID); err != nil {
+			return fmt.Errorf("error recording refund of booking payment %d: %w", o.extra.ID, err)
+		}
+		return m.RecordRefund(o.bookingID, System, missing, refundID, "refunded in Stripe")
+	}
+
+	// The booking's refunded total also covers its extra payments
+	known := total.Zero()
+	err = m.db.QueryRow(`
+		SELECT b.refunded_amount - COALESCE(
+			(SELECT SUM(refunded_amount) FROM booking_payments WHERE booking_id = b.id), 0), b.currency
+		FROM bookings b WHERE b.id = $1
+	`, o.bookingID).Scan(&known.Amount, &known.Currency)
+	if err != nil {
+		return fmt.Errorf("error getting refunds for booking %d: %w", o.bookingID, err)
+	}
+	if known.Currency != total.Currency {
+		return fmt.Errorf("refund in %s for booking %d charged in %s", total.Currency, o.bookingID, known.Currency)
+	}
+
+	missing := total.Sub(known)
+	if !missing.IsPositive() {
+		return nil
+	}
+	return m.RecordRefund(o.bookingID, System, missing, refundID, "refunded in Stripe")
+}
+
+// handleDispute records the dispute and flags the payment as disputed when it
+// is opened. The booking itself is left alone; admins follow up on the
+// dispute, and its outcome is applied when it closes.
+func (m *Machine) handleDispute(intentID string, dispute *payments.Dispute) error {
+	o, err := m.findIntent(intentID)
+	if err != nil || o == nil {
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	previous, err := recordDispute(tx, o.bookingID, intentID, dispute)
+	if err != nil {
+		return err
+	}
+
+	if previous == "" {
+		if o.extra != nil {
+			_, err = tx.Exec(`UPDATE booking_payments SET status = $1 WHERE id = $2`,
+				models.PaymentStatusDisputed, o.extra.ID)
+		} else {
+			_, err = tx.Exec(`UPDATE bookings SET payment_status = $1, updated_at = $2 WHERE id = $3`,
+				models.PaymentStatusDisputed, time.Now(), o.bookingID)
+		}
+		if err != nil {
+			return fmt.Errorf("error recording dispute for booking %d: %w", o.bookingID, err)
+		}
+
+		err = RecordEvent(tx, Event{
+			BookingID: o.bookingID,
+			Type:      EventDisputed,
+			Actor:     System,
+			Reason:    dispute.Reason,
+			Metadata: map[string]interface{}{
+				"dispute_id":               dispute.ID,
+				"amount":                   dispute.Amount,
+				"stripe_payment_intent_id": intentID,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if models.DisputeStatus(dispute.Status).Closed() && !previous.Closed() {
+		if err := m.handleDisputeClosed(tx, o, dispute); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ignoreStatusChanged treats finding the booking already moved on, usually by
+// the flow that triggered the event, as success.
+func ignoreStatusChanged(err error) error {
+	if errors.Is(err, ErrStatusChanged) || errors.Is(err, ErrIllegalTransition) {
+		return nil
+	}
+	return err
+}
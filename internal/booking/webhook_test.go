@@ -0,0 +1,580 @@
+package booking
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+const (
+	webhookBookingID = 42
+	webhookPaymentID = 3
+)
+
+func newTestMachine(t *testing.T) (*Machine, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return NewMachine(&database.DB{DB: db}), mock
+}
+
+// sqlText matches a statement containing s.
+func sqlText(s string) string {
+	return regexp.QuoteMeta(s)
+}
+
+// deliver builds the event the fake would send about the PaymentIntent now
+// and hands it to the machine as the webhook queue does.
+func deliver(t *testing.T, m *Machine, fake *payments.Fake, eventType, intentID string) error {
+	t.Helper()
+	payload, err := fake.Event(eventType, intentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := fake.DecodeEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.HandlePaymentEvent(event)
+}
+
+// expectOwner expects findIntent to find the PaymentIntent on the booking.
+func expectOwner(mock sqlmock.Sqlmock, intentID string, status models.BookingStatus, paymentStatus models.PaymentStatus) {
+	mock.ExpectQuery(sqlText("FROM bookings WHERE stripe_payment_intent_id = $1")).
+		WithArgs(intentID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "payment_status"}).
+			AddRow(webhookBookingID, status, paymentStatus))
+}
+
+// expectExtraOwner expects findIntent to find the PaymentIntent on one of
+// the booking's extra payments.
+func expectExtraOwner(mock sqlmock.Sqlmock, p models.BookingPayment) {
+	mock.ExpectQuery(sqlText("FROM bookings WHERE stripe_payment_intent_id = $1")).
+		WithArgs(p.StripePaymentIntentID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "payment_status"}))
+	mock.ExpectQuery(sqlText("WHERE bp.stripe_payment_intent_id = $1")).
+		WithArgs(p.StripePaymentIntentID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "status", "payment_status"}).
+			AddRow(p.ID, webhookBookingID, models.BookingStatusAccepted, models.PaymentStatusCaptured))
+	mock.ExpectQuery(sqlText("WHERE bp.id = $1")).
+		WithArgs(p.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "booking_id", "purpose", "stripe_payment_intent_id", "amount", "currency",
+			"capture_method", "status", "refunded_amount", "cast_percent", "created_at"}).
+			AddRow(p.ID, webhookBookingID, p.Purpose, p.StripePaymentIntentID, p.Amount.Amount, string(p.Amount.Currency),
+				p.CaptureMethod, p.Status, p.RefundedAmount.Amount, nil, p.CreatedAt))
+}
+
+// expectTransition expects the booking to move from one status to another,
+// or, if moved is false, to have moved on already.
+func expectTransition(mock sqlmock.Sqlmock, from, to models.BookingStatus, moved bool) {
+	if !moved {
+		mock.ExpectBegin()
+		mock.ExpectExec(sqlText("UPDATE bookings SET status = $1")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+		return
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec(sqlText("UPDATE bookings SET status = $1")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WithArgs(webhookBookingID, EventStatusChanged, from, to, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if to != models.BookingStatusPending {
+		mock.ExpectExec(sqlText("INSERT INTO guest_points")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+}
+
+// expectPaymentStatus expects SetPaymentStatus to record status with the
+// error message paymentError, which may be nil.
+func expectPaymentStatus(mock sqlmock.Sqlmock, status models.PaymentStatus, paymentError interface{}) {
+	mock.ExpectBegin()
+	mock.ExpectExec(sqlText("UPDATE bookings SET payment_status = $1")).
+		WithArgs(status, paymentError, sqlmock.AnyArg(), webhookBookingID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func expectLockBooking(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(sqlText("SELECT cast_id, status, currency, commission_percent")).
+		WithArgs(webhookBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"cast_id", "status", "currency", "commission_percent", "withholding_rate", "discount"}).
+			AddRow(7, models.BookingStatusAccepted, "JPY", 20, 1021, 0))
+}
+
+// expectPost expects a ledger transaction with an entry for each amount, or
+// none if posted is false because the reference was booked before.
+func expectPost(mock sqlmock.Sqlmock, kind, reference string, posted bool, entries ...models.Money) {
+	txn := sqlmock.NewRows([]string{"id"})
+	if posted {
+		txn.AddRow(1)
+	}
+	mock.ExpectQuery(sqlText("INSERT INTO ledger_transactions")).
+		WithArgs(kind, webhookBookingID, reference, sqlmock.AnyArg()).
+		WillReturnRows(txn)
+	if !posted {
+		return
+	}
+	for _, e := range entries {
+		mock.ExpectQuery(sqlText("INSERT INTO ledger_accounts")).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectExec(sqlText("INSERT INTO ledger_entries")).
+			WithArgs(1, 1, webhookBookingID, e.Amount, string(e.Currency)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+}
+
+// expectCharge expects amount captured on reference to be booked, unless it
+// was already.
+func expectCharge(mock sqlmock.Sqlmock, amount models.Money, reference string, posted bool) {
+	mock.ExpectBegin()
+	expectLockBooking(mock)
+	expectPost(mock, "charge", reference, posted, amount, amount.Neg())
+	mock.ExpectCommit()
+}
+
+// expectRefund expects RecordRefund to book amount refunded out of the
+// booking's deposit, leaving charged paid.
+func expectRefund(mock sqlmock.Sqlmock, amount models.Money, reference string, charged models.Money) {
+	mock.ExpectBegin()
+	expectLockBooking(mock)
+	mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(webhookBookingID, "guest_deposits", "JPY").
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(-amount.Add(charged).Amount))
+	expectPost(mock, "refund", reference, true, amount, amount.Neg())
+	mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(webhookBookingID, "stripe_clearing", "JPY", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(charged.Amount))
+	mock.ExpectQuery(sqlText("SET refunded_amount = refunded_amount + $1")).
+		WithArgs(amount.Amount, !charged.IsPositive(), sqlmock.AnyArg(), webhookBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_status"}).AddRow(models.PaymentStatusPartiallyRefunded))
+	mock.ExpectExec(sqlText("UPDATE receipts SET voided_at = $1")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WithArgs(webhookBookingID, EventRefunded, nil, nil, nil, RoleSystem, "refunded in Stripe", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestHandlePaymentEvent(t *testing.T) {
+	amount := models.JPY(12000)
+
+	tests := []struct {
+		name  string
+		event string
+		// setup plays the guest and Stripe up to the event
+		setup func(t *testing.T, fake *payments.Fake, pi string)
+		// expect sets up what the booking looks like and what the event
+		// should change
+		expect func(mock sqlmock.Sqlmock, pi string)
+	}{
+		{
+			name:  "for a payment that isn't a booking's",
+			event: payments.EventIntentSucceeded,
+			setup: capture(amount),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				mock.ExpectQuery(sqlText("FROM bookings WHERE stripe_payment_intent_id = $1")).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "status", "payment_status"}))
+				mock.ExpectQuery(sqlText("WHERE bp.stripe_payment_intent_id = $1")).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "id", "status", "payment_status"}))
+			},
+		},
+		{
+			name:  "authorized while held",
+			event: payments.EventIntentCapturableUpdated,
+			setup: confirm,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusHeld, models.PaymentStatusRequiresPayment)
+				expectTransition(mock, models.BookingStatusHeld, models.BookingStatusPending, true)
+			},
+		},
+		{
+			name:  "authorized after the guest's client confirmed the hold",
+			event: payments.EventIntentCapturableUpdated,
+			setup: confirm,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusPending, models.PaymentStatusAuthorized)
+			},
+		},
+		{
+			name:  "authorized, racing the guest's client",
+			event: payments.EventIntentCapturableUpdated,
+			setup: confirm,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusHeld, models.PaymentStatusRequiresPayment)
+				expectTransition(mock, models.BookingStatusHeld, models.BookingStatusPending, false)
+			},
+		},
+		{
+			name:  "captured outside the app",
+			event: payments.EventIntentSucceeded,
+			setup: capture(amount),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusAccepted, models.PaymentStatusAuthorized)
+				expectPaymentStatus(mock, models.PaymentStatusCaptured, nil)
+				expectCharge(mock, amount, pi, true)
+			},
+		},
+		{
+			name:  "captured by the app",
+			event: payments.EventIntentSucceeded,
+			setup: capture(amount),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusAccepted, models.PaymentStatusCaptured)
+				expectCharge(mock, amount, pi, false)
+			},
+		},
+		{
+			name:  "captured for less",
+			event: payments.EventIntentSucceeded,
+			setup: capture(models.JPY(8000)),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusAccepted, models.PaymentStatusCaptureFailed)
+				expectPaymentStatus(mock, models.PaymentStatusCaptured, nil)
+				expectCharge(mock, models.JPY(8000), pi, true)
+			},
+		},
+		{
+			name:  "declined while held",
+			event: payments.EventIntentPaymentFailed,
+			setup: decline("Your card has insufficient funds."),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusHeld, models.PaymentStatusRequiresPayment)
+				expectPaymentStatus(mock, models.PaymentStatusRequiresPayment, "Your card has insufficient funds.")
+			},
+		},
+		{
+			name:  "declined without a message",
+			event: payments.EventIntentPaymentFailed,
+			setup: decline(""),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusHeld, models.PaymentStatusRequiresPayment)
+				expectPaymentStatus(mock, models.PaymentStatusRequiresPayment, "payment failed")
+			},
+		},
+		{
+			name:  "declined after the hold ran out",
+			event: payments.EventIntentPaymentFailed,
+			setup: decline("Your card was declined."),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusExpired, models.PaymentStatusCanceled)
+			},
+		},
+		{
+			name:  "canceled while held",
+			event: payments.EventIntentCanceled,
+			setup: cancel,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusHeld, models.PaymentStatusRequiresPayment)
+				expectTransition(mock, models.BookingStatusHeld, models.BookingStatusExpired, true)
+				expectPaymentStatus(mock, models.PaymentStatusCanceled, nil)
+			},
+		},
+		{
+			name:  "canceled while pending",
+			event: payments.EventIntentCanceled,
+			setup: func(t *testing.T, fake *payments.Fake, pi string) {
+				confirm(t, fake, pi)
+				cancel(t, fake, pi)
+			},
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusPending, models.PaymentStatusAuthorized)
+				expectTransition(mock, models.BookingStatusPending, models.BookingStatusCancelled, true)
+				expectPaymentStatus(mock, models.PaymentStatusCanceled, nil)
+			},
+		},
+		{
+			name:  "canceled, racing a decline",
+			event: payments.EventIntentCanceled,
+			setup: func(t *testing.T, fake *payments.Fake, pi string) {
+				confirm(t, fake, pi)
+				cancel(t, fake, pi)
+			},
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusPending, models.PaymentStatusAuthorized)
+				expectTransition(mock, models.BookingStatusPending, models.BookingStatusCancelled, false)
+				expectPaymentStatus(mock, models.PaymentStatusCanceled, nil)
+			},
+		},
+		{
+			name:  "canceled by the app",
+			event: payments.EventIntentCanceled,
+			setup: cancel,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectOwner(mock, pi, models.BookingStatusDeclined, models.PaymentStatusCanceled)
+			},
+		},
+		{
+			name:  "extra payment authorized",
+			event: payments.EventIntentCapturableUpdated,
+			setup: confirm,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectExtraOwner(mock, extra(pi, amount, models.PaymentStatusRequiresPayment))
+				mock.ExpectExec(sqlText("UPDATE booking_payments SET status = $1 WHERE id = $2")).
+					WithArgs(models.PaymentStatusAuthorized, webhookPaymentID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:  "extra payment captured outside the app",
+			event: payments.EventIntentSucceeded,
+			setup: capture(amount),
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectExtraOwner(mock, extra(pi, amount, models.PaymentStatusAuthorized))
+				mock.ExpectExec(sqlText("UPDATE booking_payments SET status = $1 WHERE id = $2")).
+					WithArgs(models.PaymentStatusCaptured, webhookPaymentID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectCharge(mock, amount, pi, true)
+			},
+		},
+		{
+			name:  "extra payment canceled after capture",
+			event: payments.EventIntentCanceled,
+			setup: cancel,
+			expect: func(mock sqlmock.Sqlmock, pi string) {
+				expectExtraOwner(mock, extra(pi, amount, models.PaymentStatusCaptured))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestMachine(t)
+			fake := payments.NewFake()
+			pi, err := fake.Authorize(payments.AuthorizeParams{Amount: amount, ManualCapture: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t, fake, pi.ID)
+			tt.expect(mock, pi.ID)
+
+			if err := deliver(t, m, fake, tt.event, pi.ID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandlePaymentEventWithoutIntent(t *testing.T) {
+	m, _ := newTestMachine(t)
+	event := &payments.Event{ID: "evt_1", Type: payments.EventIntentSucceeded, IntentID: "pi_1"}
+	if err := m.HandlePaymentEvent(event); err == nil {
+		t.Error("handled an intent event without its intent")
+	}
+}
+
+func TestHandleChargeRefunded(t *testing.T) {
+	tests := []struct {
+		name string
+		// refunds are made on the main payment, in order
+		refunds []models.Money
+		// known is what the booking has on record as refunded on it
+		known    models.Money
+		currency models.Currency
+		// missing is what is left to record, and charged what the guest
+		// has paid after it
+		missing models.Money
+		charged models.Money
+	}{
+		{
+			name:     "refunded outside the app",
+			refunds:  []models.Money{models.JPY(5000)},
+			known:    models.JPY(0),
+			currency: models.CurrencyJPY,
+			missing:  models.JPY(5000),
+			charged:  models.JPY(7000),
+		},
+		{
+			name:     "refunded by the app",
+			refunds:  []models.Money{models.JPY(5000)},
+			known:    models.JPY(5000),
+			currency: models.CurrencyJPY,
+			missing:  models.JPY(0),
+		},
+		{
+			name:     "refunded again outside the app",
+			refunds:  []models.Money{models.JPY(5000), models.JPY(3000)},
+			known:    models.JPY(5000),
+			currency: models.CurrencyJPY,
+			missing:  models.JPY(3000),
+			charged:  models.JPY(4000),
+		},
+		{
+			name:     "delivered after a later refund by the app",
+			refunds:  []models.Money{models.JPY(5000)},
+			known:    models.JPY(8000),
+			currency: models.CurrencyJPY,
+			missing:  models.JPY(0),
+		},
+		{
+			name:     "refunded in full outside the app",
+			refunds:  []models.Money{models.JPY(12000)},
+			known:    models.JPY(0),
+			currency: models.CurrencyJPY,
+			missing:  models.JPY(12000),
+			charged:  models.JPY(0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestMachine(t)
+			fake := payments.NewFake()
+			pi := authorize(t, fake, models.JPY(12000))
+			capture(models.JPY(12000))(t, fake, pi)
+			var refundID string
+			for _, amount := range tt.refunds {
+				r, err := fake.Refund(pi, amount, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				refundID = r.ID
+			}
+
+			expectOwner(mock, pi, models.BookingStatusCancelled, models.PaymentStatusPartiallyRefunded)
+			mock.ExpectQuery(sqlText("SELECT b.refunded_amount - COALESCE(")).
+				WithArgs(webhookBookingID).
+				WillReturnRows(sqlmock.NewRows([]string{"refunded", "currency"}).AddRow(tt.known.Amount, string(tt.currency)))
+			if tt.missing.IsPositive() {
+				expectRefund(mock, tt.missing, refundID, tt.charged)
+			}
+
+			if err := deliver(t, m, fake, payments.EventChargeRefunded, pi); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("in another currency", func(t *testing.T) {
+		m, mock := newTestMachine(t)
+		fake := payments.NewFake()
+		pi := authorize(t, fake, models.JPY(12000))
+		capture(models.JPY(12000))(t, fake, pi)
+		if _, err := fake.Refund(pi, models.JPY(5000), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		expectOwner(mock, pi, models.BookingStatusCancelled, models.PaymentStatusCaptured)
+		mock.ExpectQuery(sqlText("SELECT b.refunded_amount - COALESCE(")).
+			WillReturnRows(sqlmock.NewRows([]string{"refunded", "currency"}).AddRow(0, "USD"))
+
+		if err := deliver(t, m, fake, payments.EventChargeRefunded, pi); err == nil {
+			t.Error("recorded a refund in another currency")
+		}
+	})
+}
+
+func TestHandleChargeRefundedOnExtraPayment(t *testing.T) {
+	amount := models.JPY(4000)
+
+	tests := []struct {
+		name     string
+		refunded models.Money
+		// known is the payment's refunded_amount before the event
+		known  models.Money
+		status models.PaymentStatus
+	}{
+		{"refunded in part", models.JPY(1500), models.JPY(0), models.PaymentStatusPartiallyRefunded},
+		{"refunded the rest", models.JPY(4000), models.JPY(1500), models.PaymentStatusRefunded},
+		{"refunded by the app", models.JPY(1500), models.JPY(1500), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestMachine(t)
+			fake := payments.NewFake()
+			pi := authorize(t, fake, amount)
+			capture(amount)(t, fake, pi)
+			r, err := fake.Refund(pi, tt.refunded, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := extra(pi, amount, models.PaymentStatusCaptured)
+			p.RefundedAmount = tt.known
+			expectExtraOwner(mock, p)
+			if tt.status != "" {
+				mock.ExpectExec(sqlText("UPDATE booking_payments SET refunded_amount = $1, status = $2 WHERE id = $3")).
+					WithArgs(tt.refunded.Amount, tt.status, webhookPaymentID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectRefund(mock, tt.refunded.Sub(tt.known), r.ID, models.JPY(12000))
+			}
+
+			if err := deliver(t, m, fake, payments.EventChargeRefunded, pi); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func authorize(t *testing.T, fake *payments.Fake, amount models.Money) string {
+	t.Helper()
+	pi, err := fake.Authorize(payments.AuthorizeParams{Amount: amount, ManualCapture: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pi.ID
+}
+
+func confirm(t *testing.T, fake *payments.Fake, pi string) {
+	t.Helper()
+	if err := fake.Confirm(pi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func capture(amount models.Money) func(t *testing.T, fake *payments.Fake, pi string) {
+	return func(t *testing.T, fake *payments.Fake, pi string) {
+		t.Helper()
+		confirm(t, fake, pi)
+		if _, err := fake.Capture(pi, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func decline(message string) func(t *testing.T, fake *payments.Fake, pi string) {
+	return func(t *testing.T, fake *payments.Fake, pi string) {
+		t.Helper()
+		if err := fake.Decline(pi, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func cancel(t *testing.T, fake *payments.Fake, pi string) {
+	t.Helper()
+	if err := fake.Cancel(pi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// extra is an extra payment on the booking made with the PaymentIntent.
+func extra(pi string, amount models.Money, status models.PaymentStatus) models.BookingPayment {
+	return models.BookingPayment{
+		ID:                    webhookPaymentID,
+		BookingID:             webhookBookingID,
+		Purpose:               PaymentPurposeReschedule,
+		StripePaymentIntentID: pi,
+		Amount:                amount,
+		CaptureMethod:         CaptureManual,
+		Status:                status,
+		RefundedAmount:        amount.Zero(),
+	}
+}
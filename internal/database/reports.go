@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// CreateReport saves a user report and fills in its ID and timestamps.
+func (db *DB) CreateReport(report *models.Report) error {
+	err := db.QueryRow(`
+		INSERT INTO reports (reporter_id, reported_user_id, reason, description, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at
+	`, report.ReporterID, report.ReportedUserID, report.Reason, report.Description, report.Status).
+		Scan(&report.ID, &report.CreatedAt, &report.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating report: %w", err)
+	}
+	return nil
+}
+
+// CreateBlock saves a block. Blocking a user twice keeps the first block.
+func (db *DB) CreateBlock(block *models.Block) error {
+	err := db.QueryRow(`
+		INSERT INTO blocks (user_id, blocked_user_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id, blocked_user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING id, created_at
+	`, block.UserID, block.BlockedUserID).Scan(&block.ID, &block.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating block: %w", err)
+	}
+	return nil
+}
+
+// RemoveBlock deletes userID's block of blockedUserID, if there is one.
+func (db *DB) RemoveBlock(userID int64, blockedUserID string) error {
+	_, err := db.Exec(`
+		DELETE FROM blocks WHERE user_id = $1 AND blocked_user_id = $2
+	`, userID, blockedUserID)
+	if err != nil {
+		return fmt.Errorf("error removing block: %w", err)
+	}
+	return nil
+}
+
+// GetBlockedUsers returns the users userID has blocked, most recent first.
+func (db *DB) GetBlockedUsers(userID int64) ([]models.Block, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.user_id, b.blocked_user_id, b.created_at,
+		       u.id, u.email, u.user_type, u.name, u.profile_image, u.created_at, u.updated_at
+		FROM blocks b
+		JOIN users u ON b.blocked_user_id = u.id
+		WHERE b.user_id = $1
+		ORDER BY b.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying blocks: %w", err)
+	}
+	defer rows.Close()
+
+	blocks := []models.Block{}
+	for rows.Next() {
+		var b models.Block
+		var u models.User
+		err := rows.Scan(&b.ID, &b.UserID, &b.BlockedUserID, &b.CreatedAt,
+			&u.ID, &u.Email, &u.UserType, &u.Name, &u.ProfileImage, &u.CreatedAt, &u.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning block: %w", err)
+		}
+		b.BlockedUser = &u
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// GetReports returns reports with the given status, or every report if status
+// is empty, most recent first.
+func (db *DB) GetReports(status string) ([]models.Report, error) {
+	rows, err := db.Query(`
+		SELECT id, reporter_id, reported_user_id, reason, COALESCE(description, ''),
+		       status, COALESCE(admin_notes, ''), created_at, updated_at
+		FROM reports
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+	`, status)
+	if err != nil {
+		return nil, fmt.Errorf("error querying reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		var r models.Report
+		err := rows.Scan(&r.ID, &r.ReporterID, &r.ReportedUserID, &r.Reason, &r.Description,
+			&r.Status, &r.AdminNotes, &r.CreatedAt, &r.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning report: %w", err)
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// UpdateReportStatus sets a report's status and admin notes.
+func (db *DB) UpdateReportStatus(reportID, status, adminNotes string) error {
+	res, err := db.Exec(`
+		UPDATE reports SET status = $1, admin_notes = $2 WHERE id = $3
+	`, status, adminNotes, reportID)
+	if err != nil {
+		return fmt.Errorf("error updating report: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("report %s not found", reportID)
+	}
+	return nil
+}
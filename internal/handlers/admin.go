@@ -9,37 +9,57 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
 	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
 	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+	"github.com/uso/uso/internal/referrals"
 )
 
 type AdminHandler struct {
-	db  *database.DB
-	cfg *config.Config
+	db        *database.DB
+	cfg       *config.Config
+	machine   *booking.Machine
+	payments  payments.Provider
+	referrals referrals.Program
 }
 
-func NewAdminHandler(db *database.DB, cfg *config.Config) *AdminHandler {
-	return &AdminHandler{db: db, cfg: cfg}
+func NewAdminHandler(db *database.DB, cfg *config.Config, pay payments.Provider) *AdminHandler {
+	return &AdminHandler{
+		db:        db,
+		cfg:       cfg,
+		machine:   booking.NewMachine(db),
+		payments:  pay,
+		referrals: ReferralProgram(cfg, PointsProgram(cfg), WithholdingRate(cfg)),
+	}
 }
 
 func (h *AdminHandler) GetDashboard(c *gin.Context) {
 	// Get summary statistics
 	var totalUsers, totalGuests, totalCasts, totalBookings int
-	var totalRevenue sql.NullFloat64
 
 	// Count users
 	h.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&totalUsers)
 	h.db.QueryRow("SELECT COUNT(*) FROM users WHERE user_type = 'guest'").Scan(&totalGuests)
 	h.db.QueryRow("SELECT COUNT(*) FROM users WHERE user_type = 'cast'").Scan(&totalCasts)
 	
-	// Count bookings and revenue
+	// Count bookings
 	h.db.QueryRow("SELECT COUNT(*) FROM bookings").Scan(&totalBookings)
-	h.db.QueryRow("SELECT SUM(amount) FROM bookings WHERE status = 'completed'").Scan(&totalRevenue)
+
+	// Money figures come from the ledger, so what was collected always equals
+	// the platform's revenue plus what is held for guests and owed to casts
+	balances, err := ledger.TypeBalances(h.db)
+	if err != nil {
+		log.Printf("Error getting ledger balances: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
 
 	// Get recent activity
 	recentBookings := []gin.H{}
 	rows, err := h.db.Query(`
-		SELECT b.id, b.booking_date, b.amount, b.status, 
+		SELECT b.id, b.starts_at, b.amount, b.currency, b.status, 
 		       g.name as guest_name, c.name as cast_name
 		FROM bookings b
 		JOIN users g ON b.guest_id = g.id
@@ -51,15 +71,15 @@ func (h *AdminHandler) GetDashboard(c *gin.Context) {
 		defer rows.Close()
 		for rows.Next() {
 			var id int
-			var bookingDate time.Time
-			var amount float64
+			var startsAt time.Time
+			var amount models.Money
 			var status models.BookingStatus
 			var guestName, castName string
 			
-			if err := rows.Scan(&id, &bookingDate, &amount, &status, &guestName, &castName); err == nil {
+			if err := rows.Scan(&id, &startsAt, &amount.Amount, &amount.Currency, &status, &guestName, &castName); err == nil {
 				recentBookings = append(recentBookings, gin.H{
 					"id":           id,
-					"booking_date": bookingDate,
+					"starts_at":    startsAt,
 					"amount":       amount,
 					"status":       status,
 					"guest_name":   guestName,
@@ -71,11 +91,15 @@ func (h *AdminHandler) GetDashboard(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"stats": gin.H{
-			"total_users":    totalUsers,
-			"total_guests":   totalGuests,
-			"total_casts":    totalCasts,
-			"total_bookings": totalBookings,
-			"total_revenue":  totalRevenue.Float64,
+			"total_users":     totalUsers,
+			"total_guests":    totalGuests,
+			"total_casts":     totalCasts,
+			"total_bookings":  totalBookings,
+			"total_revenue":   balances[ledger.TypePlatformFees],
+			"collected":       balances[ledger.TypeStripeClearing],
+			"guest_deposits":  balances[ledger.TypeGuestDeposits],
+			"cast_payable":    balances[ledger.TypeCastPayable],
+			"withholding_tax": balances[ledger.TypeWithholdingTax],
 		},
 		"recent_bookings": recentBookings,
 	})
@@ -153,6 +177,11 @@ func (h *AdminHandler) ApproveCast(c *gin.Context) {
 		return
 	}
 
+	// A referred cast's approval rewards them and whoever referred them
+	if _, err := h.referrals.Reward(h.db, castID, time.Now()); err != nil {
+		log.Printf("Error rewarding referral of cast %d: %v", castID, err)
+	}
+
 	// TODO: Send approval email
 
 	c.JSON(http.StatusOK, gin.H{"message": "Cast approved successfully"})
@@ -211,8 +240,8 @@ func (h *AdminHandler) GetAllBookings(c *gin.Context) {
 	offset := (page - 1) * limit
 
 	query := `
-		SELECT b.id, b.booking_date, b.start_time, b.duration_hours,
-		       b.location, b.amount, b.status, b.created_at,
+		SELECT b.id, b.starts_at, b.ends_at, b.duration_hours,
+		       b.location, b.amount, b.currency, b.status, b.created_at,
 		       g.id, g.name, g.email,
 		       c.id, c.name, c.email
 		FROM bookings b
@@ -245,9 +274,9 @@ func (h *AdminHandler) GetAllBookings(c *gin.Context) {
 		var guestName, guestEmail, castName, castEmail string
 
 		err := rows.Scan(
-			&booking.ID, &booking.BookingDate, &booking.StartTime,
-			&booking.DurationHours, &booking.Location, &booking.Amount,
-			&booking.Status, &booking.CreatedAt,
+			&booking.ID, &booking.StartsAt, &booking.EndsAt,
+			&booking.DurationHours, &booking.Location, &booking.Amount.Amount,
+			&booking.Amount.Currency, &booking.Status, &booking.CreatedAt,
 			&guestID, &guestName, &guestEmail,
 			&castID, &castName, &castEmail,
 		)
@@ -257,8 +286,8 @@ func (h *AdminHandler) GetAllBookings(c *gin.Context) {
 
 		bookings = append(bookings, gin.H{
 			"id":             booking.ID,
-			"booking_date":   booking.BookingDate,
-			"start_time":     booking.StartTime,
+			"starts_at":      booking.StartsAt,
+			"ends_at":        booking.EndsAt,
 			"duration_hours": booking.DurationHours,
 			"location":       booking.Location,
 			"amount":         booking.Amount,
@@ -284,33 +313,70 @@ func (h *AdminHandler) GetAllBookings(c *gin.Context) {
 	})
 }
 
+func (h *AdminHandler) GetBookingTimeline(c *gin.Context) {
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var exists bool
+	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM bookings WHERE id = $1)", bookingID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+
+	events, err := booking.ListEvents(h.db, bookingID)
+	if err != nil {
+		log.Printf("Error getting booking timeline: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"booking_id": bookingID,
+		"events":     events,
+	})
+}
+
 func (h *AdminHandler) GetAnalytics(c *gin.Context) {
 	// Get booking trends for last 30 days
 	thirtyDaysAgo := time.Now().AddDate(0, 0, -30)
 	
 	rows, err := h.db.Query(`
-		SELECT DATE(booking_date) as date, COUNT(*) as count, SUM(amount) as revenue
+		SELECT DATE(starts_at AT TIME ZONE 'Asia/Tokyo') as date, currency, COUNT(*) as count, SUM(amount) as revenue
 		FROM bookings
-		WHERE booking_date >= $1
-		GROUP BY DATE(booking_date)
-		ORDER BY date
+		WHERE starts_at >= $1
+		GROUP BY DATE(starts_at AT TIME ZONE 'Asia/Tokyo'), currency
+		ORDER BY date, currency
 	`, thirtyDaysAgo)
 
+	// One entry per day, with revenue split by currency
 	bookingTrends := []gin.H{}
 	if err == nil {
 		defer rows.Close()
+		var last gin.H
 		for rows.Next() {
 			var date time.Time
 			var count int
-			var revenue sql.NullFloat64
+			var revenue models.Money
 			
-			if err := rows.Scan(&date, &count, &revenue); err == nil {
-				bookingTrends = append(bookingTrends, gin.H{
-					"date":    date.Format("2006-01-02"),
-					"count":   count,
-					"revenue": revenue.Float64,
-				})
+			if err := rows.Scan(&date, &revenue.Currency, &count, &revenue.Amount); err != nil {
+				continue
+			}
+			day := date.Format("2006-01-02")
+			if last == nil || last["date"] != day {
+				last = gin.H{"date": day, "count": 0, "revenue": []models.Money{}}
+				bookingTrends = append(bookingTrends, last)
 			}
+			last["count"] = last["count"].(int) + count
+			last["revenue"] = append(last["revenue"].([]models.Money), revenue)
 		}
 	}
 
@@ -318,12 +384,12 @@ func (h *AdminHandler) GetAnalytics(c *gin.Context) {
 	topCasts := []gin.H{}
 	castRows, err := h.db.Query(`
 		SELECT c.id, c.name, COUNT(b.id) as booking_count, 
-		       SUM(b.amount) as total_revenue, AVG(r.rating) as avg_rating
+		       SUM(b.amount) as total_revenue, b.currency, AVG(r.rating) as avg_rating
 		FROM users c
 		JOIN bookings b ON c.id = b.cast_id
 		LEFT JOIN reviews r ON r.reviewed_id = c.id
 		WHERE b.status = 'completed'
-		GROUP BY c.id, c.name
+		GROUP BY c.id, c.name, b.currency
 		ORDER BY total_revenue DESC
 		LIMIT 10
 	`)
@@ -334,14 +400,15 @@ func (h *AdminHandler) GetAnalytics(c *gin.Context) {
 			var id int
 			var name string
 			var bookingCount int
-			var totalRevenue, avgRating sql.NullFloat64
+			var totalRevenue models.Money
+			var avgRating sql.NullFloat64
 			
-			if err := castRows.Scan(&id, &name, &bookingCount, &totalRevenue, &avgRating); err == nil {
+			if err := castRows.Scan(&id, &name, &bookingCount, &totalRevenue.Amount, &totalRevenue.Currency, &avgRating); err == nil {
 				topCasts = append(topCasts, gin.H{
 					"id":             id,
 					"name":           name,
 					"booking_count":  bookingCount,
-					"total_revenue":  totalRevenue.Float64,
+					"total_revenue":  totalRevenue,
 					"average_rating": avgRating.Float64,
 				})
 			}
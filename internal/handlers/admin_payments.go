@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/middleware"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// RefundBooking refunds the guest some or all of what they paid for a
+// booking, leaving out tips. amount is in the booking's currency's minor
+// units; without one everything still refundable is returned. A full refund of
+// a booking that hasn't taken place yet cancels it. An Idempotency-Key is
+// required so a retried request can't refund twice.
+func (h *AdminHandler) RefundBooking(c *gin.Context) {
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+	if middleware.IdempotencyKey(c) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key header is required"})
+		return
+	}
+
+	var req struct {
+		Amount *int64 `json:"amount"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var status models.BookingStatus
+	var currency models.Currency
+	var piID sql.NullString
+	err = h.db.QueryRow(`
+		SELECT status, currency, stripe_payment_intent_id FROM bookings WHERE id = $1
+	`, bookingID).Scan(&status, &currency, &piID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	refundable, err := ledger.Charged(h.db, bookingID, currency)
+	if err != nil {
+		log.Printf("Error getting refundable amount for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	amount := refundable
+	if req.Amount != nil {
+		amount = models.NewMoney(*req.Amount, currency)
+	}
+	if !amount.IsPositive() || amount.Cmp(refundable) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Amount must be positive and no more than what is refundable",
+			"refundable": refundable,
+		})
+		return
+	}
+
+	// Refund extra payments first, then the main one, as cancellations do
+	refunded, err := booking.RefundExtraPayments(h.db, h.payments, bookingID, amount)
+	var refundID string
+	if remaining := amount.Sub(refunded); err == nil && remaining.IsPositive() {
+		var r *payments.Refund
+		r, err = h.payments.Refund(piID.String, remaining, "")
+		if err == nil {
+			refundID = r.ID
+			refunded = refunded.Add(remaining)
+		}
+	}
+	if refunded.IsPositive() {
+		if err := h.machine.RecordRefund(bookingID, booking.Admin, refunded, refundID, req.Reason); err != nil {
+			log.Printf("Error recording refund for booking %d: %v", bookingID, err)
+		}
+	}
+	if err != nil {
+		log.Printf("Error refunding booking %d: %v", bookingID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Refund failed", "refunded": refunded})
+		return
+	}
+
+	// Nothing is left to pay for a booking that hasn't happened yet
+	if refunded.Cmp(refundable) >= 0 && (status == models.BookingStatusPending || status == models.BookingStatusAccepted) {
+		if err := booking.CancelExtraPayments(h.db, h.payments, bookingID); err != nil {
+			log.Printf("Error cancelling extra payments for booking %d: %v", bookingID, err)
+		}
+		err := h.machine.Transition(booking.Transition{
+			BookingID: bookingID,
+			From:      status,
+			To:        models.BookingStatusCancelled,
+			Actor:     booking.Admin,
+			Reason:    req.Reason,
+			Set:       map[string]interface{}{"cancelled_by": booking.RoleAdmin},
+		})
+		if err != nil {
+			log.Printf("Error cancelling refunded booking %d: %v", bookingID, err)
+		} else {
+			status = models.BookingStatusCancelled
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Refund issued",
+		"refunded":   refunded,
+		"refund_id":  refundID,
+		"refundable": refundable.Sub(refunded),
+		"status":     status,
+	})
+}
+
+// GetDisputes lists disputes. ?status=open or closed limits it to those.
+func (h *AdminHandler) GetDisputes(c *gin.Context) {
+	var open *bool
+	switch c.Query("status") {
+	case "open":
+		v := true
+		open = &v
+	case "closed":
+		v := false
+		open = &v
+	case "":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open or closed"})
+		return
+	}
+
+	disputes, err := booking.ListDisputes(h.db, open)
+	if err != nil {
+		log.Printf("Error getting disputes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"disputes": disputes})
+}
+
+// GetDispute returns a dispute with the booking's message history, which
+// admins can use as the starting point for their evidence.
+func (h *AdminHandler) GetDispute(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+
+	dispute, err := booking.GetDispute(h.db, id)
+	if errors.Is(err, booking.ErrDisputeNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting dispute: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	messages, err := booking.MessageHistory(h.db, dispute.BookingID)
+	if err != nil {
+		log.Printf("Error getting message history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	events, err := booking.ListEvents(h.db, dispute.BookingID)
+	if err != nil {
+		log.Printf("Error getting booking timeline: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dispute":         dispute,
+		"message_history": messages,
+		"events":          events,
+	})
+}
+
+// SaveDisputeEvidence sends the admin's evidence text for a dispute to
+// Stripe. It is staged until submit is set, after which it can't change.
+func (h *AdminHandler) SaveDisputeEvidence(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+
+	var req struct {
+		Evidence string `json:"evidence" binding:"required"`
+		Submit   bool   `json:"submit"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Stripe limits the evidence to 150,000 characters in all
+	if len([]rune(req.Evidence)) > 100000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Evidence is too long"})
+		return
+	}
+
+	dispute, err := booking.SaveDisputeEvidence(h.db, h.payments, id, req.Evidence, req.Submit)
+	switch {
+	case errors.Is(err, booking.ErrDisputeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	case errors.Is(err, booking.ErrDisputeClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Evidence can no longer be changed for this dispute"})
+		return
+	case err != nil:
+		log.Printf("Error saving dispute evidence: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send evidence"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dispute": dispute})
+}
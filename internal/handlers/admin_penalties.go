@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/models"
+)
+
+func (h *AdminHandler) GetCastPenalties(c *gin.Context) {
+	castID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cast ID"})
+		return
+	}
+
+	var name string
+	var rank models.CastRank
+	var suspendedUntil sql.NullTime
+	err = h.db.QueryRow(`
+		SELECT u.name, cp.rank, cp.suspended_until
+		FROM users u
+		JOIN cast_profiles cp ON u.id = cp.user_id
+		WHERE u.id = $1
+	`, castID).Scan(&name, &rank, &suspendedUntil)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cast not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting cast: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	cancellations := []gin.H{}
+	rows, err := h.db.Query(`
+		SELECT id, booking_id, reason, notice_hours, late, created_at
+		FROM cast_cancellations
+		WHERE cast_id = $1
+		ORDER BY created_at DESC
+	`, castID)
+	if err != nil {
+		log.Printf("Error getting cast cancellations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	strikes := 0
+	strikeWindowStart := time.Now().Add(-h.cfg.CastStrikeWindow)
+	for rows.Next() {
+		var id, bookingID int
+		var reason string
+		var noticeHours float64
+		var late bool
+		var createdAt time.Time
+
+		if err := rows.Scan(&id, &bookingID, &reason, &noticeHours, &late, &createdAt); err != nil {
+			continue
+		}
+		if late && createdAt.After(strikeWindowStart) {
+			strikes++
+		}
+
+		cancellations = append(cancellations, gin.H{
+			"id":           id,
+			"booking_id":   bookingID,
+			"reason":       reason,
+			"notice_hours": noticeHours,
+			"late":         late,
+			"created_at":   createdAt,
+		})
+	}
+
+	penalties, err := h.queryPenalties("WHERE p.cast_id = $1", castID)
+	if err != nil {
+		log.Printf("Error getting cast penalties: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var suspended interface{}
+	if suspendedUntil.Valid && suspendedUntil.Time.After(time.Now()) {
+		suspended = suspendedUntil.Time
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cast": gin.H{
+			"id":              castID,
+			"name":            name,
+			"rank":            rank,
+			"suspended_until": suspended,
+		},
+		"active_strikes": strikes,
+		"cancellations":  cancellations,
+		"penalties":      penalties,
+	})
+}
+
+func (h *AdminHandler) GetPenalties(c *gin.Context) {
+	penalties, err := h.queryPenalties("")
+	if err != nil {
+		log.Printf("Error getting penalties: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, penalties)
+}
+
+func (h *AdminHandler) queryPenalties(where string, args ...interface{}) ([]gin.H, error) {
+	rows, err := h.db.Query(`
+		SELECT p.id, p.cast_id, u.name, p.action, p.strike_count,
+		       p.from_rank, p.to_rank, p.suspended_until, p.created_at
+		FROM cast_penalties p
+		JOIN users u ON p.cast_id = u.id
+		`+where+`
+		ORDER BY p.created_at DESC
+		LIMIT 100
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	penalties := []gin.H{}
+	for rows.Next() {
+		var id, castID, strikeCount int
+		var castName, action string
+		var fromRank, toRank sql.NullString
+		var suspendedUntil sql.NullTime
+		var createdAt time.Time
+
+		if err := rows.Scan(&id, &castID, &castName, &action, &strikeCount,
+			&fromRank, &toRank, &suspendedUntil, &createdAt); err != nil {
+			continue
+		}
+
+		penalty := gin.H{
+			"id":           id,
+			"cast_id":      castID,
+			"cast_name":    castName,
+			"action":       action,
+			"strike_count": strikeCount,
+			"from_rank":    fromRank.String,
+			"to_rank":      toRank.String,
+			"created_at":   createdAt,
+		}
+		if suspendedUntil.Valid {
+			penalty["suspended_until"] = suspendedUntil.Time
+		}
+		penalties = append(penalties, penalty)
+	}
+	return penalties, rows.Err()
+}
+
+func (h *AdminHandler) ReinstateCast(c *gin.Context) {
+	castID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cast ID"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE cast_profiles SET suspended_until = NULL, updated_at = $1
+		WHERE user_id = $2 AND suspended_until IS NOT NULL
+	`, time.Now(), castID)
+	if err != nil {
+		log.Printf("Error reinstating cast: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reinstate cast"})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cast not found or not suspended"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cast reinstated"})
+}
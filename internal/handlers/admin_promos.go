@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/promos"
+)
+
+// GetPromoCodes lists every promo code with how many bookings have used it.
+func (h *AdminHandler) GetPromoCodes(c *gin.Context) {
+	codes, err := promos.List(h.db)
+	if err != nil {
+		log.Printf("Error getting promo codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"promo_codes": codes})
+}
+
+// CreatePromoCode adds a promo code. It is active straight away unless
+// active is false.
+func (h *AdminHandler) CreatePromoCode(c *gin.Context) {
+	var req models.PromoCodeInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	code, err := promos.Create(h.db, req)
+	if err != nil {
+		respondPromoSaveError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"promo_code": code})
+}
+
+// UpdatePromoCode replaces a promo code's settings. Set active to false to
+// withdraw it; bookings already made with it keep their discount.
+func (h *AdminHandler) UpdatePromoCode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	var req models.PromoCodeInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	code, err := promos.Update(h.db, id, req)
+	if err != nil {
+		respondPromoSaveError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"promo_code": code})
+}
+
+func respondPromoSaveError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, promos.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+	case errors.Is(err, promos.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, promos.ErrCodeTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "A promo code with this code already exists"})
+	default:
+		log.Printf("Error saving promo code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/points"
+	"github.com/uso/uso/internal/referrals"
+)
+
+// WithholdingRate reads WITHHOLDING_RATE, falling back to the default.
+func WithholdingRate(cfg *config.Config) int {
+	withholding, err := ledger.ParseWithholdingRate(cfg.WithholdingRate)
+	if err != nil {
+		log.Printf("Invalid WITHHOLDING_RATE, using default: %v", err)
+		withholding = ledger.DefaultWithholdingRate
+	}
+	return withholding
+}
+
+// ReferralProgram reads the referral rewards. Negative ones are turned off.
+func ReferralProgram(cfg *config.Config, program points.Program, withholding int) referrals.Program {
+	guestPoints, castBonus := cfg.ReferralGuestPoints, cfg.ReferralCastBonus
+	if guestPoints < 0 {
+		log.Printf("Invalid REFERRAL_GUEST_POINTS %d, using 0", guestPoints)
+		guestPoints = 0
+	}
+	if castBonus < 0 {
+		log.Printf("Invalid REFERRAL_CAST_BONUS %d, using 0", castBonus)
+		castBonus = 0
+	}
+	return referrals.Program{
+		GuestPoints: guestPoints,
+		CastBonus:   models.JPY(int64(castBonus)),
+		Withholding: withholding,
+		Points:      program,
+	}
+}
+
+// GetReferrals reports on the referral program: the most recent referrals
+// with the chain of users behind each, signs the referrer and referee are the
+// same person, and what was given out. ?suspicious=true lists only referrals
+// with such signs.
+func (h *AdminHandler) GetReferrals(c *gin.Context) {
+	list, err := referrals.List(h.db, 500)
+	if err != nil {
+		log.Printf("Error getting referrals: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	totals, err := referrals.Totals(h.db)
+	if err != nil {
+		log.Printf("Error getting referral totals: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	suspicious := 0
+	filtered := []models.Referral{}
+	for _, r := range list {
+		if r.Signals.Suspicious() {
+			suspicious++
+			filtered = append(filtered, r)
+		}
+	}
+	if c.Query("suspicious") == "true" {
+		list = filtered
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"referrals":  list,
+		"suspicious": suspicious,
+		"totals":     totals,
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/uso/uso/config"
 	"github.com/uso/uso/internal/database"
 	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/referrals"
 	"github.com/uso/uso/internal/utils"
 )
 
@@ -54,6 +56,29 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	var referrerID int
+	if req.ReferrerCode != "" {
+		referrerID, err = referrals.Referrer(h.db, req.ReferrerCode)
+		if errors.Is(err, referrals.ErrUnknownCode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid referral code"})
+			return
+		} else if err != nil {
+			log.Printf("Error looking up referral code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	referralCode, err := referrals.NewCode()
+	if err != nil {
+		log.Printf("Error generating referral code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+		return
+	}
+	var deviceID *string
+	if req.DeviceID != "" {
+		deviceID = &req.DeviceID
+	}
+
 	// Hash password
 	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
@@ -74,10 +99,12 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	// Insert user
 	var userID int
 	err = tx.QueryRow(`
-		INSERT INTO users (email, password_hash, user_type, name, phone, birth_date)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (email, password_hash, user_type, name, phone, birth_date,
+		                   referral_code, signup_device_id, signup_ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id
-	`, req.Email, hashedPassword, req.UserType, req.Name, req.Phone, req.BirthDate).Scan(&userID)
+	`, req.Email, hashedPassword, req.UserType, req.Name, req.Phone, req.BirthDate,
+	   referralCode, deviceID, c.ClientIP()).Scan(&userID)
 	
 	if err != nil {
 		log.Printf("Error inserting user: %v", err)
@@ -85,12 +112,22 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	// Both sides are rewarded once the new user qualifies
+	if referrerID != 0 {
+		if err := referrals.Record(tx, referrerID, userID); err != nil {
+			log.Printf("Error recording referral: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+			return
+		}
+	}
+
 	// If cast, create pending cast profile
 	if req.UserType == models.UserTypeCast {
+		rate := models.CastRankStandard.GetHourlyRate()
 		_, err = tx.Exec(`
-			INSERT INTO cast_profiles (user_id, hourly_rate, rank, service_areas, approval_status)
-			VALUES ($1, $2, $3, $4, $5)
-		`, userID, 60.0, models.CastRankStandard, []string{}, models.ApprovalStatusPending)
+			INSERT INTO cast_profiles (user_id, hourly_rate, currency, rank, service_areas, approval_status)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, userID, rate.Amount, rate.Currency, models.CastRankStandard, []string{}, models.ApprovalStatusPending)
 		
 		if err != nil {
 			log.Printf("Error creating cast profile: %v", err)
@@ -117,10 +154,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{
 		"token": token,
 		"user": gin.H{
-			"id":        userID,
-			"email":     req.Email,
-			"name":      req.Name,
-			"user_type": req.UserType,
+			"id":            userID,
+			"email":         req.Email,
+			"name":          req.Name,
+			"user_type":     req.UserType,
+			"referral_code": referralCode,
 		},
 	})
 }
@@ -183,6 +221,7 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 	var profile models.UserProfile
 	err := h.db.QueryRow(`
 		SELECT u.id, u.email, u.user_type, u.name, u.phone, u.birth_date, u.profile_image,
+		       COALESCE(u.referral_code, ''),
 		       COALESCE(AVG(r.rating), 0) as rating, COUNT(r.id) as review_count
 		FROM users u
 		LEFT JOIN reviews r ON r.reviewed_id = u.id
@@ -190,7 +229,7 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 		GROUP BY u.id
 	`, userID).Scan(
 		&profile.ID, &profile.Email, &profile.UserType, &profile.Name,
-		&profile.Phone, &profile.BirthDate, &profile.ProfileImage,
+		&profile.Phone, &profile.BirthDate, &profile.ProfileImage, &profile.ReferralCode,
 		&profile.Rating, &profile.ReviewCount,
 	)
 
@@ -204,12 +243,13 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 	if profile.UserType == models.UserTypeCast {
 		var castProfile models.CastProfile
 		err = h.db.QueryRow(`
-			SELECT id, user_id, bio, hourly_rate, rank, service_areas, approval_status, approved_at
+			SELECT id, user_id, bio, hourly_rate, currency, rank, service_areas, approval_status, approved_at,
+			       suspended_until
 			FROM cast_profiles WHERE user_id = $1
 		`, userID).Scan(
 			&castProfile.ID, &castProfile.UserID, &castProfile.Bio,
-			&castProfile.HourlyRate, &castProfile.Rank, &castProfile.ServiceAreas,
-			&castProfile.ApprovalStatus, &castProfile.ApprovedAt,
+			&castProfile.HourlyRate.Amount, &castProfile.HourlyRate.Currency, &castProfile.Rank, &castProfile.ServiceAreas,
+			&castProfile.ApprovalStatus, &castProfile.ApprovedAt, &castProfile.SuspendedUntil,
 		)
 		
 		if err == nil {
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+)
+
+func (h *CastHandler) GetAvailability(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, weekday, start_time, end_time
+		FROM cast_weekly_hours
+		WHERE cast_id = $1
+		ORDER BY weekday, start_time
+	`, userID)
+	if err != nil {
+		log.Printf("Error getting weekly hours: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	hours := []models.CastWeeklyHours{}
+	for rows.Next() {
+		var wh models.CastWeeklyHours
+		if err := rows.Scan(&wh.ID, &wh.Weekday, &wh.StartTime, &wh.EndTime); err != nil {
+			continue
+		}
+		// Present times the way they are submitted
+		if d, err := booking.ParseClock(wh.StartTime); err == nil {
+			wh.StartTime = booking.FormatClock(d)
+		}
+		if d, err := booking.ParseClock(wh.EndTime); err == nil {
+			wh.EndTime = booking.FormatClock(d)
+		}
+		hours = append(hours, wh)
+	}
+
+	blackoutRows, err := h.db.Query(`
+		SELECT id, blackout_date, reason, created_at
+		FROM cast_blackout_dates
+		WHERE cast_id = $1 AND blackout_date >= $2
+		ORDER BY blackout_date
+	`, userID, time.Now().In(booking.Tokyo).Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error getting blackout dates: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer blackoutRows.Close()
+
+	blackouts := []models.CastBlackoutDate{}
+	for blackoutRows.Next() {
+		var b models.CastBlackoutDate
+		if err := blackoutRows.Scan(&b.ID, &b.Date, &b.Reason, &b.CreatedAt); err != nil {
+			continue
+		}
+		blackouts = append(blackouts, b)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"weekly_hours":   hours,
+		"blackout_dates": blackouts,
+	})
+}
+
+// UpdateWeeklyHours replaces the cast's weekly schedule.
+func (h *CastHandler) UpdateWeeklyHours(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.WeeklyHoursUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, wh := range req.Hours {
+		start, err := booking.ParseClock(wh.StartTime)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		end, err := booking.ParseClock(wh.EndTime)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if end <= start {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be after start_time, split shifts past midnight at 24:00"})
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM cast_weekly_hours WHERE cast_id = $1`, userID)
+	for i := 0; err == nil && i < len(req.Hours); i++ {
+		wh := req.Hours[i]
+		_, err = tx.Exec(`
+			INSERT INTO cast_weekly_hours (cast_id, weekday, start_time, end_time)
+			VALUES ($1, $2, $3, $4)
+		`, userID, wh.Weekday, wh.StartTime, wh.EndTime)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating weekly hours: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update availability"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Availability updated successfully"})
+}
+
+func (h *CastHandler) AddBlackoutDate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req models.BlackoutDateCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reason *string
+	if req.Reason != "" {
+		reason = &req.Reason
+	}
+
+	var blackoutID int
+	err := h.db.QueryRow(`
+		INSERT INTO cast_blackout_dates (cast_id, blackout_date, reason)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (cast_id, blackout_date) DO UPDATE SET reason = EXCLUDED.reason
+		RETURNING id
+	`, userID, req.Date.Format("2006-01-02"), reason).Scan(&blackoutID)
+	if err != nil {
+		log.Printf("Error adding blackout date: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add blackout date"})
+		return
+	}
+
+	// Existing bookings are left alone, the cast cancels them separately
+	dayStart := time.Date(req.Date.Year(), req.Date.Month(), req.Date.Day(), 0, 0, 0, 0, booking.Tokyo)
+	var affected int
+	h.db.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE cast_id = $1 AND status IN ('held', 'pending', 'accepted')
+		AND tstzrange(starts_at, ends_at) && tstzrange($2, $3)
+	`, userID, dayStart, dayStart.AddDate(0, 0, 1)).Scan(&affected)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":                blackoutID,
+		"message":           "Blackout date added",
+		"existing_bookings": affected,
+	})
+}
+
+func (h *CastHandler) DeleteBlackoutDate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	blackoutID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid blackout date ID"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		DELETE FROM cast_blackout_dates WHERE id = $1 AND cast_id = $2
+	`, blackoutID, userID)
+	if err != nil {
+		log.Printf("Error deleting blackout date: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete blackout date"})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Blackout date not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Blackout date deleted"})
+}
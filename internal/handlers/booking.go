@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,24 +11,89 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
 	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/middleware"
 	"github.com/uso/uso/internal/models"
-	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/paymentintent"
-	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/uso/uso/internal/payments"
+	"github.com/uso/uso/internal/payouts"
+	"github.com/uso/uso/internal/points"
+	"github.com/uso/uso/internal/promos"
+	"github.com/uso/uso/internal/receipts"
+	"github.com/uso/uso/internal/referrals"
 )
 
 type BookingHandler struct {
-	db  *database.DB
-	cfg *config.Config
+	db           *database.DB
+	cfg          *config.Config
+	machine      *booking.Machine
+	payments     payments.Provider
+	cancellation booking.CancellationPolicy
+	commission   ledger.Commission
+	withholding  int
+	tipCast      int
+	points       points.Program
+	referrals    referrals.Program
+	registration string
+	ledger       *ledger.Ledger
+	payouts      *payouts.Payer
 }
 
-func NewBookingHandler(db *database.DB, cfg *config.Config) *BookingHandler {
-	return &BookingHandler{db: db, cfg: cfg}
+func NewBookingHandler(db *database.DB, cfg *config.Config, pay payments.Provider) *BookingHandler {
+	policy, err := booking.ParseCancellationPolicy(cfg.CancellationPolicy)
+	if err != nil {
+		log.Printf("Invalid CANCELLATION_POLICY, using default: %v", err)
+		policy = booking.DefaultCancellationPolicy
+	}
+
+	commission, err := ledger.ParseCommission(cfg.CommissionRates)
+	if err != nil {
+		log.Printf("Invalid COMMISSION_RATES, using default: %v", err)
+		commission = ledger.DefaultCommission
+	}
+
+	withholding := WithholdingRate(cfg)
+
+	tipCast := cfg.TipCastPercent
+	if tipCast < 0 || tipCast > 100 {
+		log.Printf("Invalid TIP_CAST_PERCENT %d, using default: 100", tipCast)
+		tipCast = 100
+	}
+
+	program := PointsProgram(cfg)
+
+	registration := cfg.InvoiceRegistrationNumber
+	if registration != "" && !receipts.ValidRegistrationNumber(registration) {
+		log.Printf("Invalid INVOICE_REGISTRATION_NUMBER %q, leaving it off receipts", registration)
+		registration = ""
+	}
+
+	return &BookingHandler{
+		db:           db,
+		cfg:          cfg,
+		machine:      booking.NewMachine(db),
+		payments:     pay,
+		cancellation: policy,
+		commission:   commission,
+		withholding:  withholding,
+		tipCast:      tipCast,
+		points:       program,
+		referrals:    ReferralProgram(cfg, program, withholding),
+		registration: registration,
+		ledger:       ledger.New(db),
+		payouts:      payouts.New(db, pay),
+	}
 }
 
-func (h *BookingHandler) CreateBooking(c *gin.Context) {
+// HoldBooking reserves a slot for the guest and creates the PaymentIntent they
+// confirm on the client. The booking stays held, invisible to the cast, until
+// ConfirmBooking or the Stripe webhook sees the payment authorized. Holds not
+// confirmed within BookingHoldTTL are released by the sweep job. A promo code
+// in the request is taken off what the guest pays, then any points they spend.
+func (h *BookingHandler) HoldBooking(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	
 	var req models.BookingCreate
@@ -39,13 +104,17 @@ func (h *BookingHandler) CreateBooking(c *gin.Context) {
 
 	// Verify cast exists and is approved
 	var castApprovalStatus models.ApprovalStatus
-	var hourlyRate float64
+	var hourlyRate models.Money
+	var castRank models.CastRank
+	var castAreas []string
+	var suspendedUntil sql.NullTime
 	err := h.db.QueryRow(`
-		SELECT cp.approval_status, cp.hourly_rate
+		SELECT cp.approval_status, cp.hourly_rate, cp.currency, cp.rank, cp.service_areas, cp.suspended_until
 		FROM users u
 		JOIN cast_profiles cp ON u.id = cp.user_id
 		WHERE u.id = $1 AND u.user_type = 'cast'
-	`, req.CastID).Scan(&castApprovalStatus, &hourlyRate)
+	`, req.CastID).Scan(&castApprovalStatus, &hourlyRate.Amount, &hourlyRate.Currency, &castRank,
+		pq.Array(&castAreas), &suspendedUntil)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Cast not found"})
@@ -57,39 +126,107 @@ func (h *BookingHandler) CreateBooking(c *gin.Context) {
 		return
 	}
 
+	if suspendedUntil.Valid && suspendedUntil.Time.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cast is not currently accepting bookings"})
+		return
+	}
+
+	if !req.StartsAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Booking must start in the future"})
+		return
+	}
+
+	// Check the cast's working hours and days off
+	availability, err := booking.LoadAvailability(h.db, req.CastID, req.StartsAt)
+	if err != nil {
+		log.Printf("Error getting cast availability: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !availability.Covers(req.StartsAt, time.Duration(req.DurationHours)*time.Hour) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cast is not available at this time"})
+		return
+	}
+
 	// Check for booking conflicts
-	var conflicts int
-	err = h.db.QueryRow(`
-		SELECT COUNT(*) FROM bookings
-		WHERE cast_id = $1 
-		AND booking_date = $2
-		AND status IN ('pending', 'accepted')
-		AND (
-			($3::time >= start_time AND $3::time < start_time + (duration_hours || ' hours')::interval) OR
-			(start_time >= $3::time AND start_time < $3::time + ($4 || ' hours')::interval)
-		)
-	`, req.CastID, req.BookingDate, req.StartTime, req.DurationHours).Scan(&conflicts)
+	conflict, err := booking.HasConflict(h.db, req.CastID, req.StartsAt, req.EndsAt(), 0)
+	if err != nil {
+		log.Printf("Error checking booking conflicts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
 
-	if conflicts > 0 {
+	if conflict {
 		c.JSON(http.StatusConflict, gin.H{"error": "Cast already has a booking at this time"})
 		return
 	}
 
 	// Calculate amount
-	amount := hourlyRate * float64(req.DurationHours)
-
-	// Create Stripe payment intent
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(amount * 100)), // Convert to cents
-		Currency: stripe.String("usd"),
-		Metadata: map[string]string{
-			"guest_id": strconv.Itoa(userID),
-			"cast_id":  strconv.Itoa(req.CastID),
-		},
-		CaptureMethod: stripe.String("manual"), // Don't capture until cast accepts
+	price := hourlyRate.Mul(int64(req.DurationHours))
+	amount := price
+	promoDiscount := price.Zero()
+	var promo *models.PromoCode
+	promoBooking := promos.Booking{GuestID: userID, CastRank: castRank, CastAreas: castAreas, Amount: price}
+	if req.PromoCode != "" {
+		promo, promoDiscount, err = promos.Apply(h.db, req.PromoCode, promoBooking, time.Now(), false)
+		if err != nil {
+			respondPromoError(c, err)
+			return
+		}
+		amount = price.Sub(promoDiscount)
 	}
 
-	pi, err := paymentintent.New(params)
+	// Points come off what is left, which must still be something to pay
+	if req.Points > 0 {
+		if price.Currency != points.Currency {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Points can only be used for bookings in yen"})
+			return
+		}
+		balance, err := points.Balance(h.db, userID, time.Now())
+		if err != nil {
+			log.Printf("Error getting points balance: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if req.Points > balance {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Not enough points", "balance": balance})
+			return
+		}
+		pointsDiscount := models.NewMoney(int64(req.Points), price.Currency)
+		if pointsDiscount.Cmp(amount) >= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Points can't pay for the whole booking", "max_points": amount.Amount - 1})
+			return
+		}
+		amount = amount.Sub(pointsDiscount)
+	}
+	discount := price.Sub(amount)
+
+	// Saving the card lets the guest tip afterwards without entering it again
+	customer, err := booking.GuestCustomer(h.db, h.payments, userID)
+	if err != nil {
+		log.Printf("Error getting Stripe customer for guest %d: %v", userID, err)
+	}
+
+	metadata := map[string]string{
+		"guest_id": strconv.Itoa(userID),
+		"cast_id":  strconv.Itoa(req.CastID),
+	}
+	if promo != nil {
+		metadata["promo_code"] = promo.Code
+	}
+
+	// Create the payment intent, captured only once the cast accepts
+	pi, err := h.payments.Authorize(payments.AuthorizeParams{
+		Amount:        amount,
+		Metadata:      metadata,
+		ManualCapture: true,
+		// Lets a reschedule raise the hold instead of charging separately
+		Incremental:       true,
+		Customer:          customer,
+		SavePaymentMethod: customer != "",
+		IdempotencyKey:    stripeIdempotencyKey(c, "booking-hold"),
+	})
 	if err != nil {
 		log.Printf("Error creating payment intent: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processing failed"})
@@ -97,29 +234,158 @@ func (h *BookingHandler) CreateBooking(c *gin.Context) {
 	}
 
 	// Create booking
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Check the code again with it locked, so its limits hold against
+	// bookings made at the same time
+	var promoID *int
+	if promo != nil {
+		locked, lockedDiscount, err := promos.Apply(tx, req.PromoCode, promoBooking, time.Now(), true)
+		if err == nil && lockedDiscount != promoDiscount {
+			err = promos.ErrNotApplicable
+		}
+		if err != nil {
+			if cancelErr := h.payments.Cancel(pi.ID); cancelErr != nil {
+				log.Printf("Error cancelling payment intent %s: %v", pi.ID, cancelErr)
+			}
+			respondPromoError(c, err)
+			return
+		}
+		promoID = &locked.ID
+	}
+
 	var bookingID int
-	err = h.db.QueryRow(`
-		INSERT INTO bookings (guest_id, cast_id, booking_date, start_time, duration_hours, 
-		                     location, amount, status, stripe_payment_intent_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	holdExpiresAt := time.Now().Add(h.cfg.BookingHoldTTL)
+	err = tx.QueryRow(`
+		INSERT INTO bookings (guest_id, cast_id, starts_at, ends_at, duration_hours, 
+		                     location, amount, currency, status, stripe_payment_intent_id,
+		                     payment_status, hold_expires_at, commission_percent, withholding_rate,
+		                     promo_code_id, discount, points_redeemed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 		RETURNING id
-	`, userID, req.CastID, req.BookingDate, req.StartTime, req.DurationHours,
-	   req.Location, amount, models.BookingStatusPending, pi.ID).Scan(&bookingID)
+	`, userID, req.CastID, req.StartsAt, req.EndsAt(), req.DurationHours,
+	   req.Location, amount.Amount, amount.Currency, models.BookingStatusHeld, pi.ID,
+	   models.PaymentStatusRequiresPayment, holdExpiresAt,
+	   h.commission.Percent(castRank), h.withholding, promoID, discount.Amount, req.Points).Scan(&bookingID)
 
+	if err == nil {
+		err = points.Redeem(tx, userID, bookingID, req.Points, time.Now())
+	}
+	if err == nil {
+		err = booking.RecordCreated(tx, bookingID, models.BookingStatusHeld,
+			booking.UserActor(userID, c.GetString("user_type")))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
+		if cancelErr := h.payments.Cancel(pi.ID); cancelErr != nil {
+			log.Printf("Error cancelling payment intent %s: %v", pi.ID, cancelErr)
+		}
+		if booking.IsOverlap(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cast already has a booking at this time"})
+			return
+		}
+		// Spent on another booking made at the same time
+		if errors.Is(err, points.ErrInsufficient) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Not enough points"})
+			return
+		}
 		log.Printf("Error creating booking: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create booking"})
 		return
 	}
 
+	c.JSON(http.StatusCreated, gin.H{
+		"booking_id":      bookingID,
+		"amount":          amount,
+		"discount":        discount,
+		"points_redeemed": req.Points,
+		"status":          models.BookingStatusHeld,
+		"hold_expires_at": holdExpiresAt,
+		"client_secret":   pi.ClientSecret,
+		"payment_intent":  pi.ID,
+	})
+}
+
+// ConfirmBooking turns the guest's hold into a pending booking once Stripe
+// reports the payment authorized. A hold past its TTL can still be confirmed
+// until the sweep job has released it.
+func (h *BookingHandler) ConfirmBooking(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var status models.BookingStatus
+	var paymentIntentID sql.NullString
+	err = h.db.QueryRow(`
+		SELECT status, stripe_payment_intent_id FROM bookings WHERE id = $1 AND guest_id = $2
+	`, bookingID, userID).Scan(&status, &paymentIntentID)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Already confirmed, most likely by the webhook
+	if status == models.BookingStatusPending || status == models.BookingStatusAccepted {
+		c.JSON(http.StatusOK, gin.H{"booking_id": bookingID, "status": status})
+		return
+	}
+	if status != models.BookingStatusHeld || !paymentIntentID.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Hold has expired, please book again"})
+		return
+	}
+
+	pi, err := h.payments.Get(paymentIntentID.String)
+	if err != nil {
+		log.Printf("Error getting payment intent %s: %v", paymentIntentID.String, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processing failed"})
+		return
+	}
+
+	if pi.Status != payments.IntentRequiresCapture {
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":          "Payment has not been authorized",
+			"payment_status": pi.Status,
+		})
+		return
+	}
+
+	err = h.machine.ConfirmHold(bookingID, booking.UserActor(userID, c.GetString("user_type")))
+	if errors.Is(err, booking.ErrStatusChanged) {
+		// The webhook may have confirmed it in the meantime
+		h.db.QueryRow(`SELECT status FROM bookings WHERE id = $1`, bookingID).Scan(&status)
+		if status == models.BookingStatusPending {
+			c.JSON(http.StatusOK, gin.H{"booking_id": bookingID, "status": status})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Hold has expired, please book again"})
+		return
+	}
+	if err != nil {
+		respondTransitionError(c, err, "Failed to confirm booking")
+		return
+	}
+
 	// TODO: Send email notification to cast
 
-	c.JSON(http.StatusCreated, gin.H{
-		"booking_id":     bookingID,
-		"amount":         amount,
-		"status":         models.BookingStatusPending,
-		"client_secret":  pi.ClientSecret,
-		"payment_intent": pi.ID,
+	c.JSON(http.StatusOK, gin.H{
+		"booking_id": bookingID,
+		"status":     models.BookingStatusPending,
 	})
 }
 
@@ -128,10 +394,13 @@ func (h *BookingHandler) GetGuestBookings(c *gin.Context) {
 	status := c.Query("status")
 	
 	query := `
-		SELECT b.id, b.guest_id, b.cast_id, b.booking_date, b.start_time, 
-		       b.duration_hours, b.location, b.amount, b.status,
+		SELECT b.id, b.guest_id, b.cast_id, b.starts_at, b.ends_at, 
+		       b.duration_hours, b.location, b.amount, b.discount, b.currency, b.status,
 		       b.created_at, u.name as cast_name, u.profile_image,
-		       cp.rank, COALESCE(AVG(r.rating), 0) as rating
+		       cp.rank, COALESCE(AVG(r.rating), 0) as rating,
+		       (SELECT COALESCE(SUM(bp.amount - bp.refunded_amount), 0) FROM booking_payments bp
+		        WHERE bp.booking_id = b.id AND bp.purpose = 'tip'
+		        AND bp.status IN ('captured', 'partially_refunded', 'disputed')) as tip
 		FROM bookings b
 		JOIN users u ON b.cast_id = u.id
 		JOIN cast_profiles cp ON u.id = cp.user_id
@@ -145,7 +414,7 @@ func (h *BookingHandler) GetGuestBookings(c *gin.Context) {
 		args = append(args, status)
 	}
 
-	query += " GROUP BY b.id, u.name, u.profile_image, cp.rank ORDER BY b.booking_date DESC, b.start_time DESC"
+	query += " GROUP BY b.id, u.name, u.profile_image, cp.rank ORDER BY b.starts_at DESC"
 
 	rows, err := h.db.Query(query, args...)
 	if err != nil {
@@ -162,12 +431,13 @@ func (h *BookingHandler) GetGuestBookings(c *gin.Context) {
 		var profileImage sql.NullString
 		var rank models.CastRank
 		var rating float64
+		var discount, tip int64
 
 		err := rows.Scan(
 			&booking.ID, &booking.GuestID, &booking.CastID,
-			&booking.BookingDate, &booking.StartTime, &booking.DurationHours,
-			&booking.Location, &booking.Amount, &booking.Status,
-			&booking.CreatedAt, &castName, &profileImage, &rank, &rating,
+			&booking.StartsAt, &booking.EndsAt, &booking.DurationHours,
+			&booking.Location, &booking.Amount.Amount, &discount, &booking.Amount.Currency, &booking.Status,
+			&booking.CreatedAt, &castName, &profileImage, &rank, &rating, &tip,
 		)
 		if err != nil {
 			continue
@@ -175,11 +445,13 @@ func (h *BookingHandler) GetGuestBookings(c *gin.Context) {
 
 		bookingData := gin.H{
 			"id":             booking.ID,
-			"booking_date":   booking.BookingDate,
-			"start_time":     booking.StartTime,
+			"starts_at":      booking.StartsAt,
+			"ends_at":        booking.EndsAt,
 			"duration_hours": booking.DurationHours,
 			"location":       booking.Location,
 			"amount":         booking.Amount,
+			"discount":       models.NewMoney(discount, booking.Amount.Currency),
+			"tip":            models.NewMoney(tip, booking.Amount.Currency),
 			"status":         booking.Status,
 			"created_at":     booking.CreatedAt,
 			"cast": gin.H{
@@ -209,7 +481,10 @@ func (h *BookingHandler) GetBooking(c *gin.Context) {
 	var guestImage, castImage sql.NullString
 
 	err = h.db.QueryRow(`
-		SELECT b.*, 
+		SELECT b.id, b.guest_id, b.cast_id, b.starts_at, b.ends_at,
+		       b.duration_hours, b.location, b.amount, b.currency, b.status,
+		       b.stripe_payment_intent_id, b.payment_status, b.declined_at, b.accepted_at,
+		       b.completed_at, b.cancelled_at, b.created_at, b.updated_at,
 		       g.name as guest_name, g.profile_image as guest_image,
 		       c.name as cast_name, c.profile_image as cast_image
 		FROM bookings b
@@ -218,9 +493,9 @@ func (h *BookingHandler) GetBooking(c *gin.Context) {
 		WHERE b.id = $1 AND (b.guest_id = $2 OR b.cast_id = $2)
 	`, bookingID, userID).Scan(
 		&booking.ID, &booking.GuestID, &booking.CastID,
-		&booking.BookingDate, &booking.StartTime, &booking.DurationHours,
-		&booking.Location, &booking.Amount, &booking.Status,
-		&booking.StripePaymentIntentID, &booking.DeclinedAt, &booking.AcceptedAt,
+		&booking.StartsAt, &booking.EndsAt, &booking.DurationHours,
+		&booking.Location, &booking.Amount.Amount, &booking.Amount.Currency, &booking.Status,
+		&booking.StripePaymentIntentID, &booking.PaymentStatus, &booking.DeclinedAt, &booking.AcceptedAt,
 		&booking.CompletedAt, &booking.CancelledAt, &booking.CreatedAt,
 		&booking.UpdatedAt, &guestName, &guestImage, &castName, &castImage,
 	)
@@ -232,12 +507,13 @@ func (h *BookingHandler) GetBooking(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"id":             booking.ID,
-		"booking_date":   booking.BookingDate,
-		"start_time":     booking.StartTime,
+		"starts_at":      booking.StartsAt,
+		"ends_at":        booking.EndsAt,
 		"duration_hours": booking.DurationHours,
 		"location":       booking.Location,
 		"amount":         booking.Amount,
 		"status":         booking.Status,
+		"payment_status": booking.PaymentStatus,
 		"created_at":     booking.CreatedAt,
 		"guest": gin.H{
 			"id":            booking.GuestID,
@@ -252,7 +528,7 @@ func (h *BookingHandler) GetBooking(c *gin.Context) {
 	})
 }
 
-func (h *BookingHandler) CancelBooking(c *gin.Context) {
+func (h *BookingHandler) GetBookingTimeline(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	bookingID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -260,51 +536,261 @@ func (h *BookingHandler) CancelBooking(c *gin.Context) {
 		return
 	}
 
-	// Verify ownership and status
-	var guestID int
-	var status models.BookingStatus
-	var paymentIntentID sql.NullString
+	// Only the guest and cast of a booking, or an admin, can see its history
+	isAdmin := c.GetString("user_type") == string(models.UserTypeAdmin)
+	var exists bool
 	err = h.db.QueryRow(`
-		SELECT guest_id, status, stripe_payment_intent_id 
+		SELECT EXISTS(SELECT 1 FROM bookings WHERE id = $1 AND ($3 OR guest_id = $2 OR cast_id = $2))
+	`, bookingID, userID, isAdmin).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking booking access: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+
+	events, err := booking.ListEvents(h.db, bookingID)
+	if err != nil {
+		log.Printf("Error getting booking timeline: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"booking_id": bookingID,
+		"events":     events,
+	})
+}
+
+// cancellableBooking is the state needed to quote and perform a guest
+// cancellation.
+type cancellableBooking struct {
+	guestID         int
+	status          models.BookingStatus
+	paymentIntentID sql.NullString
+	amount          models.Money
+	startsAt        time.Time
+}
+
+func (h *BookingHandler) loadCancellableBooking(c *gin.Context, bookingID int) (*cancellableBooking, bool) {
+	userID := c.GetInt("user_id")
+
+	var b cancellableBooking
+	err := h.db.QueryRow(`
+		SELECT guest_id, status, stripe_payment_intent_id, amount, currency, starts_at
 		FROM bookings WHERE id = $1
-	`, bookingID).Scan(&guestID, &status, &paymentIntentID)
+	`, bookingID).Scan(&b.guestID, &b.status, &b.paymentIntentID, &b.amount.Amount, &b.amount.Currency, &b.startsAt)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
-		return
+		return nil, false
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
 	}
 
-	if guestID != userID {
+	if b.guestID != userID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return nil, false
+	}
+
+	if !booking.CanTransition(b.status, models.BookingStatusCancelled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only cancel held, pending or accepted bookings"})
+		return nil, false
+	}
+
+	return &b, true
+}
+
+// cancellationQuote prices cancelling b now. Giving up a hold is free since
+// nothing has been authorized yet.
+func (h *BookingHandler) cancellationQuote(b *cancellableBooking) booking.CancellationQuote {
+	if b.status == models.BookingStatusHeld {
+		return booking.CancellationPolicy{}.Quote(b.amount, b.startsAt, time.Now())
+	}
+	return h.cancellation.Quote(b.amount, b.startsAt, time.Now())
+}
+
+func (h *BookingHandler) GetCancellationQuote(c *gin.Context) {
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
 		return
 	}
 
-	if status != models.BookingStatusPending {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only cancel pending bookings"})
+	b, ok := h.loadCancellableBooking(c, bookingID)
+	if !ok {
 		return
 	}
 
-	// Cancel Stripe payment intent
-	if paymentIntentID.Valid {
-		_, err = paymentintent.Cancel(paymentIntentID.String, nil)
-		if err != nil {
-			log.Printf("Error cancelling payment intent: %v", err)
+	tiers := []gin.H{}
+	for _, tier := range h.cancellation.Tiers {
+		tiers = append(tiers, gin.H{
+			"hours_before": tier.Before.Hours(),
+			"fee_percent":  tier.FeePercent,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"booking_id": bookingID,
+		"quote":      h.cancellationQuote(b),
+		"policy":     tiers,
+	})
+}
+
+func (h *BookingHandler) CancelBooking(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var req models.BookingCancel
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 	}
 
-	// Update booking status
-	_, err = h.db.Exec(`
-		UPDATE bookings 
-		SET status = $1, cancelled_at = $2, updated_at = $3
-		WHERE id = $4
-	`, models.BookingStatusCancelled, time.Now(), time.Now(), bookingID)
+	b, ok := h.loadCancellableBooking(c, bookingID)
+	if !ok {
+		return
+	}
 
+	quote := h.cancellationQuote(b)
+	actor := booking.UserActor(userID, c.GetString("user_type"))
+
+	err = h.machine.Transition(booking.Transition{
+		BookingID: bookingID,
+		From:      b.status,
+		To:        models.BookingStatusCancelled,
+		Actor:     actor,
+		Reason:    req.Reason,
+		Metadata: map[string]interface{}{
+			"fee_percent": quote.FeePercent,
+			"fee":         quote.Fee,
+			"refund":      quote.Refund,
+		},
+		Set: map[string]interface{}{
+			"cancelled_by":     string(models.UserTypeGuest),
+			"cancellation_fee": quote.Fee.Amount,
+		},
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel booking"})
+		respondTransitionError(c, err, "Failed to cancel booking")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Booking cancelled successfully"})
+	if b.paymentIntentID.Valid {
+		h.settleCancellation(bookingID, b, quote, actor)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Booking cancelled successfully",
+		"quote":   quote,
+	})
+}
+
+// settleCancellation collects the cancellation fee and returns the rest to the
+// guest. A held booking was never authorized, so its PaymentIntent is just
+// cancelled. A pending booking still holds an uncaptured authorization, so the
+// fee is captured from it and the remainder released; an accepted booking has
+// been captured in full, so the difference is refunded. Whatever fee is kept
+// is then settled in the ledger like a completed booking.
+func (h *BookingHandler) settleCancellation(bookingID int, b *cancellableBooking, quote booking.CancellationQuote, actor booking.Actor) {
+	piID := b.paymentIntentID.String
+	settle := b.status == models.BookingStatusAccepted
+
+	// Release extra payments that were never captured, such as a pending
+	// extension
+	if err := booking.CancelExtraPayments(h.db, h.payments, bookingID); err != nil {
+		log.Printf("Error cancelling extra payments for booking %d: %v", bookingID, err)
+	}
+
+	switch {
+	case b.status == models.BookingStatusHeld:
+		err := h.payments.Cancel(piID)
+		paymentStatus := models.PaymentStatusCanceled
+		if err != nil {
+			log.Printf("Error cancelling payment intent %s: %v", piID, err)
+			paymentStatus = models.PaymentStatusRequiresPayment
+		}
+		if err := h.machine.SetPaymentStatus(bookingID, actor, paymentStatus, err); err != nil {
+			log.Printf("Error recording payment status: %v", err)
+		}
+
+	case b.status == models.BookingStatusPending && quote.Fee.IsZero():
+		err := h.payments.Cancel(piID)
+		paymentStatus := models.PaymentStatusCanceled
+		if err != nil {
+			log.Printf("Error cancelling payment intent %s: %v", piID, err)
+			paymentStatus = models.PaymentStatusAuthorized
+		}
+		if err := h.machine.SetPaymentStatus(bookingID, actor, paymentStatus, err); err != nil {
+			log.Printf("Error recording payment status: %v", err)
+		}
+
+	case b.status == models.BookingStatusPending:
+		captured, err := h.payments.Capture(piID, quote.Fee)
+		paymentStatus := models.PaymentStatusCaptured
+		if err != nil {
+			log.Printf("Error capturing cancellation fee on %s: %v", piID, err)
+			paymentStatus = models.PaymentStatusAuthorized
+		}
+		if err := h.machine.SetPaymentStatus(bookingID, actor, paymentStatus, err); err != nil {
+			log.Printf("Error recording payment status: %v", err)
+		}
+		if err == nil {
+			if err := h.ledger.Charge(bookingID, captured.Received, captured.ID); err != nil {
+				log.Printf("Error recording cancellation fee in ledger: %v", err)
+			}
+			settle = true
+		}
+
+	case quote.Refund.IsPositive():
+		// Refund extra payments from a reschedule first, then the main one
+		refunded, err := booking.RefundExtraPayments(h.db, h.payments, bookingID, quote.Refund)
+		if err != nil {
+			log.Printf("Error refunding extra payments for booking %d: %v", bookingID, err)
+		}
+
+		var refundID string
+		if remaining := quote.Refund.Sub(refunded); err == nil && remaining.IsPositive() {
+			var r *payments.Refund
+			r, err = h.payments.Refund(piID, remaining, payments.RefundRequestedByCustomer)
+			if err != nil {
+				log.Printf("Error refunding payment intent %s: %v", piID, err)
+			} else {
+				refundID = r.ID
+				refunded = refunded.Add(remaining)
+			}
+		}
+
+		if err != nil {
+			if err := h.machine.SetPaymentStatus(bookingID, actor, models.PaymentStatusCaptured, err); err != nil {
+				log.Printf("Error recording payment status: %v", err)
+			}
+			// Leave the deposit unsettled until the refund is sorted out
+			settle = false
+		}
+		if refunded.IsPositive() {
+			if err := h.machine.RecordRefund(bookingID, actor, refunded, refundID, "guest cancellation"); err != nil {
+				log.Printf("Error recording refund: %v", err)
+			}
+		}
+	}
+
+	if settle {
+		if err := h.ledger.Settle(bookingID); err != nil {
+			log.Printf("Error settling cancellation fee for booking %d: %v", bookingID, err)
+		}
+	}
 }
 
 func (h *BookingHandler) CompleteBooking(c *gin.Context) {
@@ -318,14 +804,12 @@ func (h *BookingHandler) CompleteBooking(c *gin.Context) {
 	// Verify booking exists and is accepted
 	var castID, guestID int
 	var status models.BookingStatus
-	var bookingDate time.Time
-	var startTime string
-	var durationHours int
+	var endsAt time.Time
 
 	err = h.db.QueryRow(`
-		SELECT cast_id, guest_id, status, booking_date, start_time, duration_hours
+		SELECT cast_id, guest_id, status, ends_at
 		FROM bookings WHERE id = $1
-	`, bookingID).Scan(&castID, &guestID, &status, &bookingDate, &startTime, &durationHours)
+	`, bookingID).Scan(&castID, &guestID, &status, &endsAt)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
@@ -338,30 +822,51 @@ func (h *BookingHandler) CompleteBooking(c *gin.Context) {
 		return
 	}
 
-	if status != models.BookingStatusAccepted {
+	if !booking.CanTransition(status, models.BookingStatusCompleted) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Booking must be accepted first"})
 		return
 	}
 
 	// Check if booking time has passed
-	bookingEndTime := bookingDate.Add(time.Duration(durationHours) * time.Hour)
-	if time.Now().Before(bookingEndTime) {
+	if time.Now().Before(endsAt) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot complete booking before end time"})
 		return
 	}
 
 	// Update booking status
-	_, err = h.db.Exec(`
-		UPDATE bookings 
-		SET status = $1, completed_at = $2, updated_at = $3
-		WHERE id = $4
-	`, models.BookingStatusCompleted, time.Now(), time.Now(), bookingID)
-
+	err = h.machine.Transition(booking.Transition{
+		BookingID: bookingID,
+		From:      status,
+		To:        models.BookingStatusCompleted,
+		Actor:     booking.UserActor(userID, c.GetString("user_type")),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete booking"})
+		respondTransitionError(c, err, "Failed to complete booking")
 		return
 	}
 
+	// Split what the guest paid between the platform and the cast
+	if err := h.ledger.Settle(bookingID); err != nil {
+		log.Printf("Error settling booking %d: %v", bookingID, err)
+	} else if h.cfg.PayoutOnCompletion {
+		// Casts who haven't set up payouts are paid by the weekly batch once
+		// they have
+		if _, err := h.payouts.PayCast(castID); err != nil && !errors.Is(err, payouts.ErrNotEnabled) {
+			log.Printf("Error paying cast %d for booking %d: %v", castID, bookingID, err)
+		}
+	}
+
+	// Points are earned on what the guest paid whether or not the booking
+	// settled, and a referred guest's first completed booking rewards them
+	// and whoever referred them. The reward-completed-bookings job retries
+	// either if it fails.
+	if _, err := h.points.Earn(h.db, bookingID, time.Now()); err != nil {
+		log.Printf("Error crediting points for booking %d: %v", bookingID, err)
+	}
+	if _, err := h.referrals.Reward(h.db, guestID, time.Now()); err != nil {
+		log.Printf("Error rewarding referral of guest %d: %v", guestID, err)
+	}
+
 	// TODO: Send review request emails
 
 	c.JSON(http.StatusOK, gin.H{"message": "Booking completed successfully"})
@@ -378,39 +883,139 @@ func (h *BookingHandler) HandleStripeWebhook(c *gin.Context) {
 	}
 
 	// Verify webhook signature
-	event, err := webhook.ConstructEvent(payload, c.GetHeader("Stripe-Signature"), h.cfg.StripeWebhookSecret)
+	event, err := h.payments.ParseWebhook(payload, c.GetHeader("Stripe-Signature"))
 	if err != nil {
 		log.Printf("Webhook signature verification failed: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
 		return
 	}
 
-	// Handle the event
-	switch event.Type {
-	case "payment_intent.succeeded":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing webhook JSON"})
-			return
-		}
-		
-		// Update booking payment status
-		log.Printf("Payment succeeded for intent: %s", paymentIntent.ID)
-		
-	case "payment_intent.payment_failed":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing webhook JSON"})
-			return
-		}
-		
-		// Handle failed payment
-		log.Printf("Payment failed for intent: %s", paymentIntent.ID)
+	// Queue the event and answer straight away; a background job applies it.
+	// A retry of an event already queued is acknowledged without storing it
+	// again.
+	result, err := h.db.Exec(`
+		INSERT INTO stripe_events (id, event_type, payload)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO NOTHING
+	`, event.ID, event.Type, string(payload))
+	if err != nil {
+		log.Printf("Error queueing webhook event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store event"})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		log.Printf("Ignoring duplicate webhook event %s", event.ID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"received": true})
-}
\ No newline at end of file
+}
+
+// stripeIdempotencyKey derives the Stripe idempotency key for a call made
+// while handling the request, scoped to the user since Stripe keys are shared
+// across the whole account. It is "" when the client sent no Idempotency-Key.
+func stripeIdempotencyKey(c *gin.Context, scope string) string {
+	key := middleware.IdempotencyKey(c)
+	if key == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d-%s", scope, c.GetInt("user_id"), key)
+}
+
+// respondPromoError maps a promo code the guest can't use to an HTTP response.
+func respondPromoError(c *gin.Context, err error) {
+	var message string
+	switch {
+	case errors.Is(err, promos.ErrNotFound):
+		message = "Promo code not found"
+	case errors.Is(err, promos.ErrInactive):
+		message = "Promo code is not valid at this time"
+	case errors.Is(err, promos.ErrUsedUp):
+		message = "Promo code has been used up"
+	case errors.Is(err, promos.ErrUserLimit):
+		message = "You have already used this promo code"
+	case errors.Is(err, promos.ErrFirstBookingOnly):
+		message = "Promo code is only valid for your first booking"
+	case errors.Is(err, promos.ErrNotApplicable):
+		message = "Promo code can't be used for this booking"
+	case errors.Is(err, promos.ErrExceedsPrice):
+		message = "Promo code is worth more than this booking"
+	default:
+		log.Printf("Error applying promo code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": message})
+}
+
+// respondTransitionError maps a failed booking.Transition to an HTTP response.
+func respondTransitionError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, booking.ErrStatusChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": "Booking status has changed, please reload"})
+	case errors.Is(err, booking.ErrIllegalTransition):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Booking cannot be changed in its current status"})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// GetReceipt issues the guest's receipt for a completed or cancelled booking,
+// made out to ?name= or the guest's own name. Asking again re-issues it
+// marked as a copy, unless a refund has voided it since, in which case a new
+// receipt is issued for what is left. ?format=pdf downloads it; by default it is an HTML page
+// to view or print.
+func (h *BookingHandler) GetReceipt(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+	format := c.DefaultQuery("format", "html")
+	if format != "html" && format != "pdf" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be html, pdf or json"})
+		return
+	}
+	name := c.Query("name")
+	if len([]rune(name)) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is too long"})
+		return
+	}
+
+	issuer := receipts.Issuer{Name: h.cfg.CompanyName, Address: h.cfg.CompanyAddress, Phone: h.cfg.CompanyPhone}
+	receipt, err := receipts.Issue(h.db, issuer, h.registration, bookingID, userID, name)
+	switch {
+	case errors.Is(err, receipts.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	case errors.Is(err, receipts.ErrNotFinal):
+		c.JSON(http.StatusConflict, gin.H{"error": "A receipt can be issued once the booking is completed or cancelled"})
+		return
+	case errors.Is(err, receipts.ErrNothingPaid):
+		c.JSON(http.StatusConflict, gin.H{"error": "Nothing was paid for this booking"})
+		return
+	case errors.Is(err, receipts.ErrRecipientChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": "The receipt was already issued to a different name"})
+		return
+	case err != nil:
+		log.Printf("Error issuing receipt for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue receipt"})
+		return
+	}
+
+	switch format {
+	case "pdf":
+		c.Header("Content-Disposition", `attachment; filename="receipt-`+receipt.DisplayNumber()+`.pdf"`)
+		c.Data(http.StatusOK, "application/pdf", receipt.PDF())
+	case "json":
+		c.JSON(http.StatusOK, receipt)
+	default:
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := receipt.WriteHTML(c.Writer); err != nil {
+			log.Printf("Error writing receipt for booking %d: %v", bookingID, err)
+		}
+	}
+}
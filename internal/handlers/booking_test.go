@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// bookingFlow drives a booking through the guest, cast and admin handlers
+// against one database and one fake Stripe. Each step expects the statements
+// its handler runs, with the booking as the earlier steps left it.
+type bookingFlow struct {
+	t        *testing.T
+	mock     sqlmock.Sqlmock
+	fake     *payments.Fake
+	bookings *BookingHandler
+	casts    *CastHandler
+	admin    *AdminHandler
+
+	// startsAt is when the booking starts, amount what it costs at
+	// hourlyRate for hours
+	startsAt time.Time
+	hours    int
+	amount   models.Money
+	pi       string
+}
+
+const hourlyRate = 4000
+
+func newBookingFlow(t *testing.T, startsIn time.Duration) *bookingFlow {
+	db, mock := newTestDB(t)
+	fake := payments.NewFake()
+	cfg := &config.Config{BookingHoldTTL: 15 * time.Minute, CancellationPolicy: "48h:50,24h:100"}
+	return &bookingFlow{
+		t:        t,
+		mock:     mock,
+		fake:     fake,
+		bookings: NewBookingHandler(db, cfg, fake),
+		casts:    NewCastHandler(db, cfg, fake),
+		admin:    NewAdminHandler(db, cfg, fake),
+		startsAt: time.Now().Add(startsIn).Truncate(time.Hour),
+		hours:    3,
+		amount:   models.JPY(3 * hourlyRate),
+	}
+}
+
+func (f *bookingFlow) ledgerBooking(status models.BookingStatus) ledgerBooking {
+	return ledgerBooking{castID: testCastID, status: status}
+}
+
+// hold plays the guest booking the cast, who has no set hours, and keeps the
+// PaymentIntent the guest is to confirm.
+func (f *bookingFlow) hold() {
+	f.t.Helper()
+	customer, err := f.fake.CreateCustomer(payments.CustomerParams{Email: "guest@example.com"})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	f.mock.ExpectQuery(sqlText("SELECT cp.approval_status, cp.hourly_rate")).
+		WithArgs(testCastID).
+		WillReturnRows(sqlmock.NewRows([]string{"approval_status", "hourly_rate", "currency", "rank", "service_areas", "suspended_until"}).
+			AddRow(models.ApprovalStatusApproved, hourlyRate, "JPY", models.CastRankStandard, "{shibuya}", nil))
+	f.mock.ExpectQuery(sqlText("FROM cast_weekly_hours")).
+		WillReturnRows(sqlmock.NewRows([]string{"weekday", "start_time", "end_time"}))
+	f.mock.ExpectQuery(sqlText("FROM cast_blackout_dates")).
+		WillReturnRows(sqlmock.NewRows([]string{"blackout_date"}))
+	f.mock.ExpectQuery(sqlText("SELECT EXISTS(")).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	f.mock.ExpectQuery(sqlText("SELECT stripe_customer_id, email, name FROM users")).
+		WithArgs(testGuestID).
+		WillReturnRows(sqlmock.NewRows([]string{"stripe_customer_id", "email", "name"}).AddRow(customer, "guest@example.com", "Guest"))
+	f.mock.ExpectBegin()
+	f.mock.ExpectQuery(sqlText("INSERT INTO bookings")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testBookingID))
+	f.mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	f.mock.ExpectCommit()
+
+	w := serve(f.t, f.bookings.HoldBooking, testRequest{
+		userID:   testGuestID,
+		userType: models.UserTypeGuest,
+		body: models.BookingCreate{
+			CastID:        testCastID,
+			StartsAt:      f.startsAt,
+			DurationHours: f.hours,
+			Location:      "Shibuya",
+		},
+	})
+	body := decode(f.t, w)
+	if w.Code != http.StatusCreated {
+		f.t.Fatalf("HoldBooking = %d %v", w.Code, body)
+	}
+	f.pi, _ = body["payment_intent"].(string)
+	in, err := f.fake.Get(f.pi)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if in.Amount != f.amount {
+		f.t.Fatalf("authorized %v, want %v", in.Amount, f.amount)
+	}
+}
+
+// confirm plays the guest's client authorizing the card and confirming the
+// hold.
+func (f *bookingFlow) confirm() {
+	f.t.Helper()
+	if err := f.fake.Confirm(f.pi); err != nil {
+		f.t.Fatal(err)
+	}
+
+	f.mock.ExpectQuery(sqlText("SELECT status, stripe_payment_intent_id FROM bookings")).
+		WithArgs(testBookingID, testGuestID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "stripe_payment_intent_id"}).AddRow(models.BookingStatusHeld, f.pi))
+	f.mock.ExpectBegin()
+	expectTransition(f.mock, testBookingID, models.BookingStatusHeld, models.BookingStatusPending)
+	f.mock.ExpectCommit()
+
+	w := serve(f.t, f.bookings.ConfirmBooking, testRequest{
+		userID:   testGuestID,
+		userType: models.UserTypeGuest,
+		params:   bookingParam(testBookingID),
+	})
+	if w.Code != http.StatusOK {
+		f.t.Fatalf("ConfirmBooking = %d %s", w.Code, w.Body)
+	}
+}
+
+// rescheduleShorter plays the guest accepting the cast's request to cut the
+// pending booking by an hour.
+func (f *bookingFlow) rescheduleShorter() {
+	f.t.Helper()
+	hours := f.hours - 1
+	amount := f.amount.Prorate(int64(hours), int64(f.hours))
+
+	f.mock.ExpectBegin()
+	f.mock.ExpectQuery(sqlText("SELECT guest_id, cast_id, status, starts_at, duration_hours")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"guest_id", "cast_id", "status", "starts_at", "duration_hours", "amount", "currency", "stripe_payment_intent_id"}).
+			AddRow(testGuestID, testCastID, models.BookingStatusPending, f.startsAt, f.hours, f.amount.Amount, "JPY", f.pi))
+	f.mock.ExpectQuery(sqlText("FROM booking_reschedule_requests")).
+		WithArgs(1, testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "requested_by", "status", "new_starts_at", "new_duration_hours"}).
+			AddRow(1, testCastID, models.RescheduleStatusPending, f.startsAt, hours))
+	f.mock.ExpectQuery(sqlText("FROM cast_weekly_hours")).
+		WillReturnRows(sqlmock.NewRows([]string{"weekday", "start_time", "end_time"}))
+	f.mock.ExpectQuery(sqlText("FROM cast_blackout_dates")).
+		WillReturnRows(sqlmock.NewRows([]string{"blackout_date"}))
+	f.mock.ExpectQuery(sqlText("SELECT EXISTS(")).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	f.mock.ExpectExec(sqlText("UPDATE bookings SET starts_at = $1")).
+		WithArgs(f.startsAt, sqlmock.AnyArg(), hours, amount.Amount, sqlmock.AnyArg(), testBookingID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	f.mock.ExpectExec(sqlText("UPDATE booking_reschedule_requests")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	f.mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	f.mock.ExpectCommit()
+
+	w := serve(f.t, f.bookings.RespondToReschedule, testRequest{
+		userID:   testGuestID,
+		userType: models.UserTypeGuest,
+		params:   append(bookingParam(testBookingID), gin.Param{Key: "requestId", Value: "1"}),
+		body:     models.RescheduleResponse{Accepted: true},
+	})
+	if w.Code != http.StatusOK {
+		f.t.Fatalf("RespondToReschedule = %d %s", w.Code, w.Body)
+	}
+	f.hours, f.amount = hours, amount
+}
+
+// accept plays the cast accepting the pending booking, which captures what
+// it costs now.
+func (f *bookingFlow) accept() {
+	f.t.Helper()
+	expectPendingBooking(f.mock, f.pi)
+	expectAccept(f.mock, f.amount, models.JPY(0))
+	expectPaymentStatus(f.mock, testBookingID, models.PaymentStatusCaptured)
+	expectCharge(f.mock, testBookingID, f.ledgerBooking(models.BookingStatusAccepted), f.amount, f.pi)
+	expectExtraPayments(f.mock, testBookingID)
+
+	if code, body := respond(f.t, f.casts, true); code != http.StatusOK {
+		f.t.Fatalf("RespondToBooking = %d %v", code, body)
+	}
+}
+
+// expectCancel expects the guest's cancellation to load the booking in
+// status and cancel it.
+func (f *bookingFlow) expectCancel(status models.BookingStatus) {
+	f.mock.ExpectQuery(sqlText("SELECT guest_id, status, stripe_payment_intent_id, amount, currency, starts_at")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"guest_id", "status", "stripe_payment_intent_id", "amount", "currency", "starts_at"}).
+			AddRow(testGuestID, status, f.pi, f.amount.Amount, "JPY", f.startsAt))
+	f.mock.ExpectBegin()
+	expectTransition(f.mock, testBookingID, status, models.BookingStatusCancelled)
+	f.mock.ExpectCommit()
+	// Extra payments still uncaptured are released first
+	expectExtraPayments(f.mock, testBookingID)
+}
+
+// expectSettle expects what is left of the guest's deposit to be split
+// between the platform, the withheld tax and the cast.
+func (f *bookingFlow) expectSettle(deposit models.Money) {
+	f.mock.ExpectBegin()
+	expectLockBooking(f.mock, testBookingID, f.ledgerBooking(models.BookingStatusCancelled))
+	f.mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(testBookingID, "guest_deposits", "JPY").
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(deposit.Neg().Amount))
+	fee, tax, cast := ledger.Split(deposit, 20, 1021)
+	expectPost(f.mock, ledger.KindEarning, testBookingID, "", deposit, fee.Neg(), tax.Neg(), cast.Neg())
+	f.mock.ExpectCommit()
+}
+
+func (f *bookingFlow) cancel() {
+	f.t.Helper()
+	w := serve(f.t, f.bookings.CancelBooking, testRequest{
+		userID:   testGuestID,
+		userType: models.UserTypeGuest,
+		params:   bookingParam(testBookingID),
+	})
+	if w.Code != http.StatusOK {
+		f.t.Fatalf("CancelBooking = %d %s", w.Code, w.Body)
+	}
+}
+
+// refund plays an admin refunding amount of an accepted booking the guest
+// has paid charged for.
+func (f *bookingFlow) refund(amount, charged models.Money) {
+	f.t.Helper()
+	expectKeyClaimed(f.mock)
+	f.mock.ExpectQuery(sqlText("SELECT status, currency, stripe_payment_intent_id FROM bookings")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "currency", "stripe_payment_intent_id"}).
+			AddRow(models.BookingStatusAccepted, "JPY", f.pi))
+	f.mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(testBookingID, "stripe_clearing", "JPY", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(charged.Amount))
+	expectExtraPayments(f.mock, testBookingID)
+	expectRefund(f.mock, testBookingID, f.ledgerBooking(models.BookingStatusAccepted), charged, amount,
+		"re_fake_1", charged.Sub(amount))
+	expectResponseStored(f.mock)
+
+	w := serveIdempotent(f.t, f.bookings.db, f.admin.RefundBooking, testRequest{
+		userType: models.UserTypeAdmin,
+		params:   bookingParam(testBookingID),
+		body:     gin.H{"amount": amount.Amount, "reason": "late arrival"},
+	}, "refund-1")
+	if w.Code != http.StatusOK {
+		f.t.Fatalf("RefundBooking = %d %s", w.Code, w.Body)
+	}
+}
+
+func (f *bookingFlow) intentStatus() payments.IntentStatus {
+	f.t.Helper()
+	in, err := f.fake.Get(f.pi)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return in.Status
+}
+
+func TestBookingAcceptedThenCancelled(t *testing.T) {
+	// Inside 48 hours of the start the guest pays half
+	f := newBookingFlow(t, 30*time.Hour)
+	f.hold()
+	f.confirm()
+	f.accept()
+	f.refund(models.JPY(2000), f.amount)
+
+	// Half of the booking's amount is refunded, on top of the admin's refund
+	f.expectCancel(models.BookingStatusAccepted)
+	expectExtraPayments(f.mock, testBookingID)
+	expectRefund(f.mock, testBookingID, f.ledgerBooking(models.BookingStatusCancelled),
+		models.JPY(10000), models.JPY(6000), "re_fake_2", models.JPY(4000))
+	f.expectSettle(models.JPY(4000))
+	f.cancel()
+
+	if got := f.fake.Captured(f.pi); got != models.JPY(12000) {
+		t.Errorf("captured %v, want ¥12,000", got)
+	}
+	if got := f.fake.Refunded(f.pi); got != models.JPY(8000) {
+		t.Errorf("refunded %v, want ¥8,000", got)
+	}
+}
+
+func TestBookingDeclined(t *testing.T) {
+	f := newBookingFlow(t, 72*time.Hour)
+	f.hold()
+	f.confirm()
+
+	expectPendingBooking(f.mock, f.pi)
+	f.mock.ExpectBegin()
+	expectTransition(f.mock, testBookingID, models.BookingStatusPending, models.BookingStatusDeclined)
+	f.mock.ExpectCommit()
+	expectPaymentStatus(f.mock, testBookingID, models.PaymentStatusCanceled)
+	expectExtraPayments(f.mock, testBookingID)
+
+	if code, body := respond(t, f.casts, false); code != http.StatusOK {
+		t.Fatalf("RespondToBooking = %d %v", code, body)
+	}
+	if got := f.intentStatus(); got != payments.IntentCanceled {
+		t.Errorf("payment intent is %s, want the hold released", got)
+	}
+	if got := f.fake.Captured(f.pi); !got.IsZero() {
+		t.Errorf("captured %v from a declined booking", got)
+	}
+}
+
+func TestBookingCancelledWhilePending(t *testing.T) {
+	tests := []struct {
+		name     string
+		startsIn time.Duration
+		fee      models.Money
+	}{
+		{"free", 72 * time.Hour, models.JPY(0)},
+		{"with a fee", 30 * time.Hour, models.JPY(6000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newBookingFlow(t, tt.startsIn)
+			f.hold()
+			f.confirm()
+
+			f.expectCancel(models.BookingStatusPending)
+			if tt.fee.IsPositive() {
+				expectPaymentStatus(f.mock, testBookingID, models.PaymentStatusCaptured)
+				expectCharge(f.mock, testBookingID, f.ledgerBooking(models.BookingStatusCancelled), tt.fee, f.pi)
+				f.expectSettle(tt.fee)
+			} else {
+				expectPaymentStatus(f.mock, testBookingID, models.PaymentStatusCanceled)
+			}
+			f.cancel()
+
+			if got := f.fake.Captured(f.pi); got != tt.fee {
+				t.Errorf("captured %v, want the fee of %v", got, tt.fee)
+			}
+		})
+	}
+}
+
+// Accepting captures what the booking costs when the cast accepts, not what
+// was authorized when it was held.
+func TestBookingRescheduledShorterThenAccepted(t *testing.T) {
+	f := newBookingFlow(t, 72*time.Hour)
+	f.hold()
+	f.confirm()
+	f.rescheduleShorter()
+	f.accept()
+
+	if got := f.fake.Captured(f.pi); got != models.JPY(8000) {
+		t.Errorf("captured %v, want the ¥8,000 the shorter booking costs", got)
+	}
+}
+
+func TestBookingCaptureFails(t *testing.T) {
+	f := newBookingFlow(t, 72*time.Hour)
+	f.hold()
+	f.confirm()
+
+	f.fake.FailNext("capture", errors.New("card_declined"))
+	expectPendingBooking(f.mock, f.pi)
+	expectAccept(f.mock, f.amount, models.JPY(0))
+	expectExtraPayments(f.mock, testBookingID)
+	f.mock.ExpectBegin()
+	expectTransition(f.mock, testBookingID, models.BookingStatusAccepted, models.BookingStatusCancelled)
+	f.mock.ExpectCommit()
+
+	code, body := respond(t, f.casts, true)
+	if code != http.StatusPaymentRequired || body["status"] != string(models.BookingStatusCancelled) {
+		t.Fatalf("RespondToBooking = %d %v, want 402 and the booking cancelled", code, body)
+	}
+	if got := f.intentStatus(); got != payments.IntentCanceled {
+		t.Errorf("payment intent is %s, want the hold released", got)
+	}
+}
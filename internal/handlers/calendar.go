@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+)
+
+const (
+	defaultSlotMinutes  = 60
+	maxCalendarDays     = 31
+	defaultCalendarDays = 7
+)
+
+// GetCastAvailability returns a cast's open slots between from and to
+// (inclusive dates, Tokyo time). Only free time is returned so other guests'
+// bookings stay private.
+func (h *SearchHandler) GetCastAvailability(c *gin.Context) {
+	castID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cast ID"})
+		return
+	}
+
+	now := time.Now().In(booking.Tokyo)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, booking.Tokyo)
+
+	from := today
+	if s := c.Query("from"); s != "" {
+		if from, err = time.ParseInLocation("2006-01-02", s, booking.Tokyo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, use YYYY-MM-DD"})
+			return
+		}
+	}
+	to := from.AddDate(0, 0, defaultCalendarDays-1)
+	if s := c.Query("to"); s != "" {
+		if to, err = time.ParseInLocation("2006-01-02", s, booking.Tokyo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, use YYYY-MM-DD"})
+			return
+		}
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return
+	}
+	if to.Sub(from) >= maxCalendarDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Date range is limited to 31 days"})
+		return
+	}
+	end := to.AddDate(0, 0, 1)
+
+	granularity := defaultSlotMinutes
+	if s := c.Query("granularity"); s != "" {
+		granularity, err = strconv.Atoi(s)
+		if err != nil || granularity < 15 || granularity > 24*60 || (24*60)%granularity != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be a number of minutes between 15 and 1440 that divides a day"})
+			return
+		}
+	}
+	step := time.Duration(granularity) * time.Minute
+
+	var suspendedUntil sql.NullTime
+	err = h.db.QueryRow(`
+		SELECT cp.suspended_until
+		FROM users u
+		JOIN cast_profiles cp ON u.id = cp.user_id
+		WHERE u.id = $1 AND u.user_type = 'cast' AND cp.approval_status = 'approved'
+	`, castID).Scan(&suspendedUntil)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cast not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting cast: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	availability, err := booking.LoadAvailability(h.db, castID, from)
+	if err != nil {
+		log.Printf("Error getting cast availability: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Bookings just outside the range still block slots through the buffer
+	buffer := h.cfg.BookingBuffer
+	rows, err := h.db.Query(`
+		SELECT starts_at, ends_at
+		FROM bookings
+		WHERE cast_id = $1 AND status IN ('held', 'pending', 'accepted')
+		AND tstzrange(starts_at, ends_at) && tstzrange($2, $3)
+	`, castID, from.Add(-buffer), end.Add(buffer))
+	if err != nil {
+		log.Printf("Error getting cast bookings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	busy := []booking.Interval{}
+	for rows.Next() {
+		var b booking.Interval
+		if err := rows.Scan(&b.Start, &b.End); err != nil {
+			log.Printf("Error scanning booking: %v", err)
+			continue
+		}
+		busy = append(busy, b)
+	}
+
+	// A suspended cast has no open slots until the suspension ends
+	notBefore := now
+	if suspendedUntil.Valid && suspendedUntil.Time.After(notBefore) {
+		notBefore = suspendedUntil.Time
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cast_id":     castID,
+		"from":        from.Format("2006-01-02"),
+		"to":          to.Format("2006-01-02"),
+		"granularity": granularity,
+		"timezone":    booking.Tokyo.String(),
+		"slots":       booking.OpenSlots(availability, busy, from, end, notBefore, step, buffer),
+	})
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,17 +11,33 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
 	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
 	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+	"github.com/uso/uso/internal/payouts"
+	"github.com/uso/uso/internal/statements"
 )
 
 type CastHandler struct {
-	db  *database.DB
-	cfg *config.Config
+	db       *database.DB
+	cfg      *config.Config
+	machine  *booking.Machine
+	payments payments.Provider
+	ledger   *ledger.Ledger
+	payouts  *payouts.Payer
 }
 
-func NewCastHandler(db *database.DB, cfg *config.Config) *CastHandler {
-	return &CastHandler{db: db, cfg: cfg}
+func NewCastHandler(db *database.DB, cfg *config.Config, pay payments.Provider) *CastHandler {
+	return &CastHandler{
+		db:       db,
+		cfg:      cfg,
+		machine:  booking.NewMachine(db),
+		payments: pay,
+		ledger:   ledger.New(db),
+		payouts:  payouts.New(db, pay),
+	}
 }
 
 func (h *CastHandler) UpdateCastProfile(c *gin.Context) {
@@ -52,9 +70,10 @@ func (h *CastHandler) UpdateCastProfile(c *gin.Context) {
 
 	if req.Rank != nil {
 		hourlyRate := req.Rank.GetHourlyRate()
-		query += `rank = $` + strconv.Itoa(argCount) + `, hourly_rate = $` + strconv.Itoa(argCount+1) + `, `
-		args = append(args, *req.Rank, hourlyRate)
-		argCount += 2
+		query += `rank = $` + strconv.Itoa(argCount) + `, hourly_rate = $` + strconv.Itoa(argCount+1) +
+			`, currency = $` + strconv.Itoa(argCount+2) + `, `
+		args = append(args, *req.Rank, hourlyRate.Amount, hourlyRate.Currency)
+		argCount += 3
 	}
 
 	if len(req.ServiceAreas) > 0 {
@@ -163,12 +182,12 @@ func (h *CastHandler) GetCastBookings(c *gin.Context) {
 	status := c.Query("status")
 	
 	query := `
-		SELECT b.id, b.guest_id, b.cast_id, b.booking_date, b.start_time, 
-		       b.duration_hours, b.location, b.amount, b.status,
+		SELECT b.id, b.guest_id, b.cast_id, b.starts_at, b.ends_at, 
+		       b.duration_hours, b.location, b.amount, b.currency, b.status,
 		       b.created_at, u.name as guest_name, u.profile_image
 		FROM bookings b
 		JOIN users u ON b.guest_id = u.id
-		WHERE b.cast_id = $1
+		WHERE b.cast_id = $1 AND b.status <> 'held'
 	`
 	args := []interface{}{userID}
 
@@ -177,7 +196,7 @@ func (h *CastHandler) GetCastBookings(c *gin.Context) {
 		args = append(args, status)
 	}
 
-	query += " ORDER BY b.booking_date DESC, b.start_time DESC"
+	query += " ORDER BY b.starts_at DESC"
 
 	rows, err := h.db.Query(query, args...)
 	if err != nil {
@@ -195,8 +214,8 @@ func (h *CastHandler) GetCastBookings(c *gin.Context) {
 
 		err := rows.Scan(
 			&booking.ID, &booking.GuestID, &booking.CastID,
-			&booking.BookingDate, &booking.StartTime, &booking.DurationHours,
-			&booking.Location, &booking.Amount, &booking.Status,
+			&booking.StartsAt, &booking.EndsAt, &booking.DurationHours,
+			&booking.Location, &booking.Amount.Amount, &booking.Amount.Currency, &booking.Status,
 			&booking.CreatedAt, &guestName, &profileImage,
 		)
 		if err != nil {
@@ -205,8 +224,8 @@ func (h *CastHandler) GetCastBookings(c *gin.Context) {
 
 		bookingData := gin.H{
 			"id":             booking.ID,
-			"booking_date":   booking.BookingDate,
-			"start_time":     booking.StartTime,
+			"starts_at":      booking.StartsAt,
+			"ends_at":        booking.EndsAt,
 			"duration_hours": booking.DurationHours,
 			"location":       booking.Location,
 			"amount":         booking.Amount,
@@ -241,10 +260,12 @@ func (h *CastHandler) RespondToBooking(c *gin.Context) {
 	// Verify ownership and status
 	var castID int
 	var status models.BookingStatus
-	var createdAt time.Time
+	var confirmedAt time.Time
+	var paymentIntentID sql.NullString
 	err = h.db.QueryRow(`
-		SELECT cast_id, status, created_at FROM bookings WHERE id = $1
-	`, bookingID).Scan(&castID, &status, &createdAt)
+		SELECT cast_id, status, COALESCE(confirmed_at, created_at), stripe_payment_intent_id
+		FROM bookings WHERE id = $1
+	`, bookingID).Scan(&castID, &status, &confirmedAt, &paymentIntentID)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
@@ -261,79 +282,275 @@ func (h *CastHandler) RespondToBooking(c *gin.Context) {
 		return
 	}
 
-	// Check if within 24 hours
-	if time.Since(createdAt) > 24*time.Hour {
+	// Check if within the response window
+	if time.Since(confirmedAt) > models.BookingResponseWindow {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Response time expired"})
 		return
 	}
 
-	// Update booking status
-	newStatus := models.BookingStatusAccepted
-	var timestamp *time.Time
-	now := time.Now()
-	
 	if !req.Accepted {
-		newStatus = models.BookingStatusDeclined
-		_, err = h.db.Exec(`
-			UPDATE bookings SET status = $1, declined_at = $2, updated_at = $3
-			WHERE id = $4
-		`, newStatus, now, now, bookingID)
-	} else {
-		_, err = h.db.Exec(`
-			UPDATE bookings SET status = $1, accepted_at = $2, updated_at = $3
-			WHERE id = $4
-		`, newStatus, now, now, bookingID)
-		timestamp = &now
+		err = h.machine.Transition(booking.Transition{
+			BookingID: bookingID,
+			From:      status,
+			To:        models.BookingStatusDeclined,
+			Actor:     booking.UserActor(userID, c.GetString("user_type")),
+			Reason:    req.Message,
+		})
+		if err != nil {
+			respondTransitionError(c, err, "Failed to update booking")
+			return
+		}
+		now := time.Now()
+
+		// Release the authorization hold on the guest's card
+		paymentStatus := models.PaymentStatusCanceled
+		if paymentIntentID.Valid {
+			err := h.payments.Cancel(paymentIntentID.String)
+			if err != nil {
+				log.Printf("Error cancelling payment intent %s: %v", paymentIntentID.String, err)
+				paymentStatus = models.PaymentStatusAuthorized
+			}
+			if err := h.machine.SetPaymentStatus(bookingID, booking.UserActor(userID, c.GetString("user_type")), paymentStatus, err); err != nil {
+				log.Printf("Error recording payment status: %v", err)
+			}
+		}
+		if err := booking.CancelExtraPayments(h.db, h.payments, bookingID); err != nil {
+			log.Printf("Error cancelling extra payments for booking %d: %v", bookingID, err)
+		}
+
+		// TODO: Send email notification to guest
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Booking response recorded",
+			"status":         models.BookingStatusDeclined,
+			"payment_status": paymentStatus,
+			"responded_at":   now,
+		})
+		return
 	}
 
+	// Claim the booking before touching the payment so a concurrent expiry or
+	// guest cancellation can't leave money captured on a dead booking. The
+	// amount is read under the same lock, as a reschedule may have changed it
+	// since the booking was loaded above.
+	tx, err := h.db.Begin()
 	if err != nil {
-		log.Printf("Error updating booking status: %v", err)
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var amount models.Money
+	err = tx.QueryRow(`
+		SELECT amount, currency FROM bookings WHERE id = $1 FOR UPDATE
+	`, bookingID).Scan(&amount.Amount, &amount.Currency)
+	if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Part of the amount may be covered by extra payments from a reschedule,
+	// which are captured separately. Without the total the main capture could
+	// charge them twice, so the booking is left pending.
+	extras, err := booking.ExtraPaymentsTotal(tx, bookingID)
+	if err != nil {
+		log.Printf("Error getting extra payments for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	err = booking.Apply(tx, booking.Transition{
+		BookingID: bookingID,
+		From:      status,
+		To:        models.BookingStatusAccepted,
+		Actor:     booking.UserActor(userID, c.GetString("user_type")),
+		Reason:    req.Message,
+	})
+	if err != nil {
+		respondTransitionError(c, err, "Failed to update booking")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing booking acceptance: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update booking"})
 		return
 	}
+	now := time.Now()
+
+	// Capture the authorized payment. The amount is always explicit: the
+	// authorization is for the original amount, which is more than is owed
+	// if a reschedule has since made the booking shorter.
+	if paymentIntentID.Valid {
+		captureAmount := amount.Sub(extras)
+		captured, err := h.payments.Capture(paymentIntentID.String, captureAmount)
+		if err != nil {
+			log.Printf("Error capturing payment intent %s: %v", paymentIntentID.String, err)
+
+			// Nothing was collected, so the booking cannot go ahead. Cancel it
+			// and release whatever is left of the authorization.
+			if cancelErr := h.payments.Cancel(paymentIntentID.String); cancelErr != nil {
+				log.Printf("Error cancelling payment intent %s: %v", paymentIntentID.String, cancelErr)
+			}
+			if cancelErr := booking.CancelExtraPayments(h.db, h.payments, bookingID); cancelErr != nil {
+				log.Printf("Error cancelling extra payments for booking %d: %v", bookingID, cancelErr)
+			}
+
+			rollbackErr := h.machine.Transition(booking.Transition{
+				BookingID: bookingID,
+				From:      models.BookingStatusAccepted,
+				To:        models.BookingStatusCancelled,
+				Actor:     booking.System,
+				Reason:    "payment capture failed",
+				Metadata:  map[string]interface{}{"error": err.Error()},
+				Set: map[string]interface{}{
+					"cancelled_by":   booking.RoleSystem,
+					"payment_status": models.PaymentStatusCaptureFailed,
+					"payment_error":  err.Error(),
+				},
+			})
+			if rollbackErr != nil {
+				log.Printf("Error recording capture failure for booking %d: %v", bookingID, rollbackErr)
+			}
+
+			// TODO: Send email notification to guest
+
+			c.JSON(http.StatusPaymentRequired, gin.H{
+				"error":          "Payment capture failed, booking has been cancelled",
+				"status":         models.BookingStatusCancelled,
+				"payment_status": models.PaymentStatusCaptureFailed,
+			})
+			return
+		}
+
+		err = h.machine.SetPaymentStatus(bookingID, booking.UserActor(userID, c.GetString("user_type")), models.PaymentStatusCaptured, nil)
+		if err != nil {
+			log.Printf("Error recording capture for booking %d: %v", bookingID, err)
+		}
+		if err := h.ledger.Charge(bookingID, captured.Received, captured.ID); err != nil {
+			log.Printf("Error booking capture for booking %d in the ledger: %v", bookingID, err)
+		}
+		if err := booking.CaptureExtraPayments(h.db, h.payments, bookingID, booking.PaymentPurposeReschedule); err != nil {
+			log.Printf("Error capturing extra payments for booking %d: %v", bookingID, err)
+		}
+	}
 
 	// TODO: Send email notification to guest
-	// TODO: If accepted, capture Stripe payment
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":     "Booking response recorded",
-		"status":      newStatus,
-		"responded_at": timestamp,
+		"message":        "Booking response recorded",
+		"status":         models.BookingStatusAccepted,
+		"payment_status": models.PaymentStatusCaptured,
+		"responded_at":   now,
 	})
 }
 
+// GetEarnings reports what the cast has earned, net of the platform's
+// commission, from the ledger. Tips and referral bonuses count towards the
+// earnings and are also totalled on their own. Every amount is a list with one
+// entry per currency.
 func (h *CastHandler) GetEarnings(c *gin.Context) {
 	userID := c.GetInt("user_id")
-	
-	// Get earnings summary
-	var totalEarnings, thisMonthEarnings, pendingEarnings sql.NullFloat64
-	
-	err := h.db.QueryRow(`
-		SELECT 
-			SUM(CASE WHEN status = 'completed' THEN amount ELSE 0 END) as total_earnings,
-			SUM(CASE WHEN status = 'completed' AND 
-			    EXTRACT(YEAR FROM completed_at) = EXTRACT(YEAR FROM CURRENT_DATE) AND
-			    EXTRACT(MONTH FROM completed_at) = EXTRACT(MONTH FROM CURRENT_DATE)
-			    THEN amount ELSE 0 END) as this_month_earnings,
-			SUM(CASE WHEN status = 'accepted' THEN amount ELSE 0 END) as pending_earnings
-		FROM bookings
-		WHERE cast_id = $1
-	`, userID).Scan(&totalEarnings, &thisMonthEarnings, &pendingEarnings)
+	account := ledger.CastPayable(userID)
+
+	now := time.Now().In(booking.Tokyo)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, booking.Tokyo)
 
+	// Get earnings summary
+	rows, err := h.db.Query(`
+		SELECT e.currency,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE t.kind <> $3), 0) as total_earnings,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE t.kind <> $3 AND t.created_at >= $2), 0) as this_month_earnings,
+		       COALESCE(SUM(e.amount) FILTER (WHERE t.kind = $3), 0) as paid_out,
+		       -SUM(e.amount) as balance,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE t.kind = $4), 0) as tips,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE t.kind = $5), 0) as referral_bonuses
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		JOIN ledger_transactions t ON e.transaction_id = t.id
+		WHERE a.code = $1
+		GROUP BY e.currency
+		ORDER BY e.currency
+	`, account.Code, monthStart, ledger.KindPayout, ledger.KindTip, ledger.KindReferral)
 	if err != nil {
 		log.Printf("Error getting earnings: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Get recent completed bookings
-	rows, err := h.db.Query(`
-		SELECT id, booking_date, amount, completed_at
-		FROM bookings
-		WHERE cast_id = $1 AND status = 'completed'
-		ORDER BY completed_at DESC
+	totalEarnings := []models.Money{}
+	thisMonthEarnings := []models.Money{}
+	paidOut := []models.Money{}
+	balance := []models.Money{}
+	tips := []models.Money{}
+	referralBonuses := []models.Money{}
+	for rows.Next() {
+		var currency models.Currency
+		var total, thisMonth, paid, owed, tipped, bonuses int64
+		if err := rows.Scan(&currency, &total, &thisMonth, &paid, &owed, &tipped, &bonuses); err != nil {
+			log.Printf("Error scanning earnings: %v", err)
+			continue
+		}
+		totalEarnings = append(totalEarnings, models.NewMoney(total, currency))
+		thisMonthEarnings = append(thisMonthEarnings, models.NewMoney(thisMonth, currency))
+		paidOut = append(paidOut, models.NewMoney(paid, currency))
+		balance = append(balance, models.NewMoney(owed, currency))
+		tips = append(tips, models.NewMoney(tipped, currency))
+		referralBonuses = append(referralBonuses, models.NewMoney(bonuses, currency))
+	}
+	rows.Close()
+
+	// Accepted bookings the guest has paid for, with any discount the
+	// platform makes up, less the commission and tax that will be taken once
+	// they are completed
+	rows, err = h.db.Query(`
+		SELECT b.currency, b.commission_percent, b.withholding_rate, b.discount - SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		JOIN bookings b ON e.booking_id = b.id
+		WHERE a.code = $1 AND b.cast_id = $2 AND b.status = 'accepted'
+		GROUP BY b.id, b.currency, b.commission_percent, b.withholding_rate
+	`, ledger.GuestDeposits.Code, userID)
+	if err != nil {
+		log.Printf("Error getting pending earnings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	pending := []models.Money{}
+	for rows.Next() {
+		var deposit models.Money
+		var commission, withholding int
+		if err := rows.Scan(&deposit.Currency, &commission, &withholding, &deposit.Amount); err != nil {
+			log.Printf("Error scanning pending earnings: %v", err)
+			continue
+		}
+		_, _, net := ledger.Split(deposit, commission, withholding)
+		pending = append(pending, net)
+	}
+	rows.Close()
+
+	// Get the most recently settled bookings
+	rows, err = h.db.Query(`
+		SELECT b.id, b.starts_at, b.status, b.completed_at, e.currency,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.account_type = $3), 0) as platform_fee,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.account_type = $5), 0) as withholding_tax,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.code = $1), 0) as net,
+		       (SELECT COALESCE(-SUM(te.amount), 0)
+		        FROM ledger_entries te
+		        JOIN ledger_transactions tt ON te.transaction_id = tt.id
+		        JOIN ledger_accounts ta ON te.account_id = ta.id
+		        WHERE tt.booking_id = b.id AND tt.kind = $6 AND ta.code = $1) as tip
+		FROM ledger_transactions t
+		JOIN ledger_entries e ON e.transaction_id = t.id
+		JOIN ledger_accounts a ON e.account_id = a.id
+		JOIN bookings b ON t.booking_id = b.id
+		WHERE t.kind = $4 AND b.cast_id = $2
+		GROUP BY t.id, b.id, e.currency
+		ORDER BY t.created_at DESC
 		LIMIT 10
-	`, userID)
+	`, account.Code, userID, ledger.TypePlatformFees, ledger.KindEarning, ledger.TypeWithholdingTax, ledger.KindTip)
 
 	if err != nil {
 		log.Printf("Error getting recent bookings: %v", err)
@@ -345,23 +562,173 @@ func (h *CastHandler) GetEarnings(c *gin.Context) {
 	recentBookings := []gin.H{}
 	for rows.Next() {
 		var id int
-		var bookingDate, completedAt time.Time
-		var amount float64
-		
-		if err := rows.Scan(&id, &bookingDate, &amount, &completedAt); err == nil {
-			recentBookings = append(recentBookings, gin.H{
-				"id":           id,
-				"booking_date": bookingDate,
-				"amount":       amount,
-				"completed_at": completedAt,
-			})
+		var startsAt time.Time
+		var status models.BookingStatus
+		var completedAt sql.NullTime
+		var fee, tax, net models.Money
+		var tip int64
+
+		if err := rows.Scan(&id, &startsAt, &status, &completedAt, &fee.Currency, &fee.Amount, &tax.Amount, &net.Amount, &tip); err == nil {
+			tax.Currency = fee.Currency
+			net.Currency = fee.Currency
+			booking := gin.H{
+				"id":              id,
+				"starts_at":       startsAt,
+				"status":          status,
+				"amount":          fee.Add(tax).Add(net),
+				"platform_fee":    fee,
+				"withholding_tax": tax,
+				"net_amount":      net,
+				"tip":             models.NewMoney(tip, fee.Currency),
+			}
+			if completedAt.Valid {
+				booking["completed_at"] = completedAt.Time
+			}
+			recentBookings = append(recentBookings, booking)
 		}
 	}
 
+	// Payout account and recent transfers
+	var accountID sql.NullString
+	var detailsSubmitted, payoutsEnabled bool
+	err = h.db.QueryRow(`
+		SELECT stripe_account_id, payouts_details_submitted, payouts_enabled
+		FROM cast_profiles WHERE user_id = $1
+	`, userID).Scan(&accountID, &detailsSubmitted, &payoutsEnabled)
+	if err != nil {
+		log.Printf("Error getting payout account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	accountStatus := models.PayoutAccountNotConnected
+	if payoutsEnabled {
+		accountStatus = models.PayoutAccountEnabled
+	} else if accountID.Valid {
+		accountStatus = models.PayoutAccountOnboarding
+	}
+
+	recentPayouts, err := payouts.Payouts(h.db, userID, 10)
+	if err != nil {
+		log.Printf("Error getting payouts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"total_earnings":      totalEarnings.Float64,
-		"this_month_earnings": thisMonthEarnings.Float64,
-		"pending_earnings":    pendingEarnings.Float64,
+		"total_earnings":      totalEarnings,
+		"this_month_earnings": thisMonthEarnings,
+		"pending_earnings":    ledger.Sum(pending...),
+		"paid_out":            paidOut,
+		"balance":             balance,
+		"tips":                tips,
+		"referral_bonuses":    referralBonuses,
 		"recent_bookings":     recentBookings,
+		"payout_account": gin.H{
+			"status":            accountStatus,
+			"details_submitted": detailsSubmitted,
+		},
+		"recent_payouts": recentPayouts,
 	})
-}
\ No newline at end of file
+}
+
+// StartPayoutOnboarding returns a Stripe link where the cast sets up the
+// connected account their earnings are paid into. Links are single use, so
+// the client asks for a new one each time.
+func (h *CastHandler) StartPayoutOnboarding(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var email string
+	if err := h.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email); err != nil {
+		log.Printf("Error getting cast email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	returnURL := h.cfg.BaseURL + "/cast/earnings"
+	url, err := h.payouts.Onboard(userID, email, returnURL+"?onboarding=refresh", returnURL+"?onboarding=done")
+	if errors.Is(err, payouts.ErrAlreadyOnboarded) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payouts are already set up"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting payout onboarding for cast %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start payout setup"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": url})
+}
+
+// GetStatement returns the cast's earnings statement for ?month=YYYY-MM, the
+// current month by default, or with ?year=YYYY the annual summary they need
+// for their 支払調書. ?format=csv or pdf downloads it as a file.
+func (h *CastHandler) GetStatement(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	issuer := statements.Issuer{
+		Name:    h.cfg.CompanyName,
+		Address: h.cfg.CompanyAddress,
+		Phone:   h.cfg.CompanyPhone,
+		Number:  h.cfg.CompanyNumber,
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, csv or pdf"})
+		return
+	}
+
+	var (
+		doc interface {
+			WriteCSV(w io.Writer) error
+			PDF() []byte
+		}
+		filename string
+	)
+	if y := c.Query("year"); y != "" {
+		year, err := strconv.Atoi(y)
+		if err != nil || year < 2000 || year > 9999 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+			return
+		}
+		annual, err := statements.BuildAnnual(h.db, issuer, userID, year)
+		if err != nil {
+			log.Printf("Error building annual statement for cast %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+			return
+		}
+		doc, filename = annual, "withholding-summary-"+y
+	} else {
+		month := time.Now().In(booking.Tokyo).Format("2006-01")
+		if m := c.Query("month"); m != "" {
+			month = m
+		}
+		start, err := statements.ParseMonth(month)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		monthly, err := statements.BuildMonthly(h.db, issuer, userID, start)
+		if err != nil {
+			log.Printf("Error building statement for cast %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+			return
+		}
+		doc, filename = monthly, "statement-"+monthly.Month
+	}
+
+	switch format {
+	case "csv":
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := doc.WriteCSV(c.Writer); err != nil {
+			log.Printf("Error writing statement for cast %d: %v", userID, err)
+		}
+	case "pdf":
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.pdf"`)
+		c.Data(http.StatusOK, "application/pdf", doc.PDF())
+	default:
+		c.JSON(http.StatusOK, doc)
+	}
+}
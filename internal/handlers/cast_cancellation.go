@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+)
+
+func (h *CastHandler) penaltyPolicy() booking.CastPenaltyPolicy {
+	return booking.CastPenaltyPolicy{
+		LateNotice:       h.cfg.CastLateCancelNotice,
+		Window:           h.cfg.CastStrikeWindow,
+		DemoteAfter:      h.cfg.CastDemoteAfterStrikes,
+		SuspendAfter:     h.cfg.CastSuspendAfterStrikes,
+		SuspensionPeriod: h.cfg.CastSuspensionPeriod,
+	}
+}
+
+// CancelBooking lets a cast cancel a booking they already accepted. The guest
+// is refunded in full and late cancellations count as strikes against the
+// cast.
+func (h *CastHandler) CancelBooking(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var req models.CastBookingCancel
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var castID int
+	var status models.BookingStatus
+	var paymentIntentID sql.NullString
+	var amount models.Money
+	var startsAt time.Time
+	err = h.db.QueryRow(`
+		SELECT cast_id, status, stripe_payment_intent_id, amount, currency, starts_at
+		FROM bookings WHERE id = $1
+	`, bookingID).Scan(&castID, &status, &paymentIntentID, &amount.Amount, &amount.Currency, &startsAt)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if castID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	if status != models.BookingStatusAccepted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only accepted bookings can be cancelled, decline pending requests instead"})
+		return
+	}
+
+	now := time.Now()
+	notice := startsAt.Sub(now)
+	policy := h.penaltyPolicy()
+	late := policy.IsLate(notice)
+	actor := booking.UserActor(userID, c.GetString("user_type"))
+
+	// Cancel the booking and record the strike together
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	err = booking.Apply(tx, booking.Transition{
+		BookingID: bookingID,
+		From:      status,
+		To:        models.BookingStatusCancelled,
+		Actor:     actor,
+		Reason:    req.Reason,
+		Metadata:  map[string]interface{}{"late": late},
+		Set: map[string]interface{}{
+			"cancelled_by":     string(models.UserTypeCast),
+			"cancellation_fee": 0,
+		},
+	})
+	if err != nil {
+		respondTransitionError(c, err, "Failed to cancel booking")
+		return
+	}
+
+	noticeHours := float64(int(notice.Hours()*10)) / 10
+	_, err = tx.Exec(`
+		INSERT INTO cast_cancellations (cast_id, booking_id, reason, notice_hours, late)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, bookingID, req.Reason, noticeHours, late)
+	if err != nil {
+		log.Printf("Error recording cast cancellation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel booking"})
+		return
+	}
+
+	var penalty booking.CastPenalty
+	if late {
+		penalty, err = h.applyCastPenalty(tx, userID, policy, now)
+		if err != nil {
+			log.Printf("Error applying cast penalty: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel booking"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing cast cancellation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel booking"})
+		return
+	}
+
+	// Refund the guest in full, extra payments from a reschedule first, and
+	// record whatever was refunded even if the rest failed
+	refunded, err := booking.RefundExtraPayments(h.db, h.payments, bookingID, models.NewMoney(-1, amount.Currency))
+	if err != nil {
+		log.Printf("Error refunding extra payments for booking %d: %v", bookingID, err)
+	}
+	if err := booking.CancelExtraPayments(h.db, h.payments, bookingID); err != nil {
+		log.Printf("Error cancelling extra payments for booking %d: %v", bookingID, err)
+	}
+
+	var refundID string
+	if paymentIntentID.Valid {
+		r, err := h.payments.Refund(paymentIntentID.String, models.Money{}, "")
+		if err != nil {
+			log.Printf("Error refunding payment intent %s: %v", paymentIntentID.String, err)
+			if err := h.machine.SetPaymentStatus(bookingID, actor, models.PaymentStatusCaptured, err); err != nil {
+				log.Printf("Error recording payment status: %v", err)
+			}
+		} else {
+			refundID = r.ID
+			refunded = refunded.Add(r.Amount)
+		}
+	}
+	if refunded.IsPositive() {
+		if err := h.machine.RecordRefund(bookingID, actor, refunded, refundID, "cancelled by cast"); err != nil {
+			log.Printf("Error recording refund: %v", err)
+		}
+	}
+
+	// TODO: Send cancellation email to guest
+
+	response := gin.H{
+		"message":      "Booking cancelled, the guest will be refunded in full",
+		"late":         late,
+		"notice_hours": noticeHours,
+	}
+	if penalty.Action != "" {
+		response["penalty"] = gin.H{
+			"action":          penalty.Action,
+			"rank":            penalty.ToRank,
+			"suspended_until": penalty.SuspendedUntil,
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// applyCastPenalty counts the cast's recent strikes and demotes or suspends
+// them according to policy.
+func (h *CastHandler) applyCastPenalty(tx *sql.Tx, castID int, policy booking.CastPenaltyPolicy, now time.Time) (booking.CastPenalty, error) {
+	var strikes int
+	var rank models.CastRank
+	err := tx.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM cast_cancellations
+		        WHERE cast_id = $1 AND late AND created_at >= $2),
+		       rank
+		FROM cast_profiles WHERE user_id = $1
+		FOR UPDATE
+	`, castID, now.Add(-policy.Window)).Scan(&strikes, &rank)
+	if err != nil {
+		return booking.CastPenalty{}, err
+	}
+
+	penalty := policy.Evaluate(strikes, rank, now)
+	switch penalty.Action {
+	case booking.PenaltyDemoted:
+		rate := penalty.ToRank.GetHourlyRate()
+		_, err = tx.Exec(`
+			UPDATE cast_profiles SET rank = $1, hourly_rate = $2, currency = $3, updated_at = $4
+			WHERE user_id = $5
+		`, penalty.ToRank, rate.Amount, rate.Currency, now, castID)
+	case booking.PenaltySuspended:
+		_, err = tx.Exec(`
+			UPDATE cast_profiles SET suspended_until = $1, updated_at = $2
+			WHERE user_id = $3
+		`, penalty.SuspendedUntil, now, castID)
+	default:
+		return penalty, nil
+	}
+	if err != nil {
+		return booking.CastPenalty{}, err
+	}
+
+	var suspendedUntil *time.Time
+	if !penalty.SuspendedUntil.IsZero() {
+		suspendedUntil = &penalty.SuspendedUntil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO cast_penalties (cast_id, action, strike_count, from_rank, to_rank, suspended_until)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, castID, penalty.Action, strikes, penalty.FromRank, penalty.ToRank, suspendedUntil)
+	return penalty, err
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+func TestCastCancelRefundsExtraPaymentsWithTheMainOne(t *testing.T) {
+	db, mock := newTestDB(t)
+	fake := payments.NewFake()
+	h := NewCastHandler(db, &config.Config{}, fake)
+
+	pi := authorize(t, fake, models.JPY(12000))
+	if _, err := fake.Capture(pi, models.Money{}); err != nil {
+		t.Fatal(err)
+	}
+	extra, err := fake.Authorize(payments.AuthorizeParams{Amount: models.JPY(4000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Confirm(extra.ID); err != nil {
+		t.Fatal(err)
+	}
+	captured := extraPayment{
+		id: 1, purpose: booking.PaymentPurposeReschedule, intentID: extra.ID, amount: models.JPY(4000),
+		captureMethod: booking.CaptureAutomatic, status: models.PaymentStatusCaptured,
+	}
+
+	mock.ExpectQuery(sqlText("SELECT cast_id, status, stripe_payment_intent_id, amount, currency, starts_at")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"cast_id", "status", "stripe_payment_intent_id", "amount", "currency", "starts_at"}).
+			AddRow(testCastID, models.BookingStatusAccepted, pi, 16000, "JPY", testNow.Add(72*time.Hour)))
+	mock.ExpectBegin()
+	expectTransition(mock, testBookingID, models.BookingStatusAccepted, models.BookingStatusCancelled)
+	mock.ExpectExec(sqlText("INSERT INTO cast_cancellations")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	expectExtraPayments(mock, testBookingID, captured)
+	mock.ExpectExec(sqlText("UPDATE booking_payments SET refunded_amount = refunded_amount + $1")).
+		WithArgs(4000, models.PaymentStatusRefunded, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	captured.status, captured.refunded = models.PaymentStatusRefunded, captured.amount
+	expectExtraPayments(mock, testBookingID, captured)
+
+	// One refund of everything the guest paid, under the main refund's ID
+	expectRefund(mock, testBookingID, ledgerBooking{castID: testCastID, status: models.BookingStatusCancelled},
+		models.JPY(16000), models.JPY(16000), "re_fake_2", models.JPY(0))
+
+	w := serve(t, h.CancelBooking, testRequest{
+		userID:   testCastID,
+		userType: models.UserTypeCast,
+		params:   bookingParam(testBookingID),
+		body:     models.CastBookingCancel{Reason: "sick"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got := fake.Refunded(pi); got != models.JPY(12000) {
+		t.Errorf("refunded %v of the main payment, want ¥12,000", got)
+	}
+	if got := fake.Refunded(extra.ID); got != models.JPY(4000) {
+		t.Errorf("refunded %v of the extra payment, want ¥4,000", got)
+	}
+}
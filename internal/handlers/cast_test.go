@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+const (
+	testBookingID = 42
+	testCastID    = 7
+	testGuestID   = 9
+)
+
+// expectPendingBooking expects RespondToBooking to load a pending booking
+// paid with intentID.
+func expectPendingBooking(mock sqlmock.Sqlmock, intentID string) {
+	mock.ExpectQuery(sqlText("SELECT cast_id, status, COALESCE(confirmed_at, created_at)")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"cast_id", "status", "confirmed_at", "stripe_payment_intent_id"}).
+			AddRow(testCastID, models.BookingStatusPending, testNow, intentID))
+}
+
+// expectAccept expects RespondToBooking to lock the booking at amount, with
+// extras of it covered by extra payments, and accept it.
+func expectAccept(mock sqlmock.Sqlmock, amount, extras models.Money) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(sqlText("SELECT amount, currency FROM bookings WHERE id = $1 FOR UPDATE")).
+		WithArgs(testBookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(amount.Amount, string(amount.Currency)))
+	expectExtraPaymentsTotal(mock, testBookingID, extras)
+	expectTransition(mock, testBookingID, models.BookingStatusPending, models.BookingStatusAccepted)
+	mock.ExpectCommit()
+}
+
+func respond(t *testing.T, h *CastHandler, accepted bool) (int, map[string]interface{}) {
+	t.Helper()
+	w := serve(t, h.RespondToBooking, testRequest{
+		userID:   testCastID,
+		userType: models.UserTypeCast,
+		params:   bookingParam(testBookingID),
+		body:     models.BookingResponse{Accepted: accepted},
+	})
+	return w.Code, decode(t, w)
+}
+
+func TestRespondToBookingCapturesCurrentAmount(t *testing.T) {
+	accepted := ledgerBooking{castID: testCastID, status: models.BookingStatusAccepted}
+
+	tests := []struct {
+		name       string
+		authorized models.Money
+		// amount is the booking's amount when the cast accepts, after any
+		// reschedule, and extra what a reschedule charged on top
+		amount models.Money
+		extra  models.Money
+	}{
+		{
+			name:       "unchanged",
+			authorized: models.JPY(12000),
+			amount:     models.JPY(12000),
+			extra:      models.JPY(0),
+		},
+		{
+			name:       "rescheduled shorter while pending",
+			authorized: models.JPY(12000),
+			amount:     models.JPY(8000),
+			extra:      models.JPY(0),
+		},
+		{
+			name:       "rescheduled longer with an extra payment",
+			authorized: models.JPY(12000),
+			amount:     models.JPY(16000),
+			extra:      models.JPY(4000),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newTestDB(t)
+			fake := payments.NewFake()
+			h := NewCastHandler(db, &config.Config{}, fake)
+			pi := authorize(t, fake, tt.authorized)
+			main := tt.amount.Sub(tt.extra)
+
+			expectPendingBooking(mock, pi)
+			expectAccept(mock, tt.amount, tt.extra)
+			expectPaymentStatus(mock, testBookingID, models.PaymentStatusCaptured)
+			expectCharge(mock, testBookingID, accepted, main, pi)
+
+			var extraPI string
+			if tt.extra.IsPositive() {
+				extraPI = authorize(t, fake, tt.extra)
+				expectExtraPayments(mock, testBookingID, extraPayment{
+					id: 1, purpose: booking.PaymentPurposeReschedule, intentID: extraPI, amount: tt.extra,
+					captureMethod: booking.CaptureManual, status: models.PaymentStatusAuthorized,
+				})
+				mock.ExpectExec(sqlText("UPDATE booking_payments SET status = $1 WHERE id = $2")).
+					WithArgs(models.PaymentStatusCaptured, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectCharge(mock, testBookingID, accepted, tt.extra, extraPI)
+			} else {
+				expectExtraPayments(mock, testBookingID)
+			}
+
+			code, body := respond(t, h, true)
+			if code != http.StatusOK {
+				t.Fatalf("status = %d, body %v", code, body)
+			}
+			if got := fake.Captured(pi); got != main {
+				t.Errorf("captured %v on the main payment, want %v", got, main)
+			}
+			if extraPI != "" {
+				if got := fake.Captured(extraPI); got != tt.extra {
+					t.Errorf("captured %v on the extra payment, want %v", got, tt.extra)
+				}
+			}
+		})
+	}
+}
+
+func TestRespondToBookingLeavesPendingWithoutExtras(t *testing.T) {
+	db, mock := newTestDB(t)
+	fake := payments.NewFake()
+	h := NewCastHandler(db, &config.Config{}, fake)
+	pi := authorize(t, fake, models.JPY(12000))
+
+	expectPendingBooking(mock, pi)
+	mock.ExpectBegin()
+	mock.ExpectQuery(sqlText("SELECT amount, currency FROM bookings WHERE id = $1 FOR UPDATE")).
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(8000, "JPY"))
+	mock.ExpectQuery(sqlText("LEFT JOIN booking_payments bp")).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	code, body := respond(t, h, true)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, body %v", code, body)
+	}
+	if got := fake.Captured(pi); !got.IsZero() {
+		t.Errorf("captured %v without knowing the extra payments", got)
+	}
+}
@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+)
+
+// RequestExtension lets a guest ask to add hours to an accepted booking. The
+// main payment was captured when the cast accepted, so the extra hours are
+// held on a linked PaymentIntent that the guest confirms with the returned
+// client secret and that is captured once the cast approves.
+func (h *BookingHandler) RequestExtension(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var req models.BookingExtensionCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var guestID, castID int
+	var status models.BookingStatus
+	var endsAt time.Time
+	var currency models.Currency
+	var hourlyRate models.Money
+	err = h.db.QueryRow(`
+		SELECT b.guest_id, b.cast_id, b.status, b.ends_at, b.currency, cp.hourly_rate, cp.currency
+		FROM bookings b
+		JOIN cast_profiles cp ON cp.user_id = b.cast_id
+		WHERE b.id = $1
+	`, bookingID).Scan(&guestID, &castID, &status, &endsAt, &currency, &hourlyRate.Amount, &hourlyRate.Currency)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if guestID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	if status != models.BookingStatusAccepted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only accepted bookings can be extended"})
+		return
+	}
+
+	if !endsAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Booking has already ended"})
+		return
+	}
+
+	extendedEnd := endsAt.Add(time.Duration(req.Hours) * time.Hour)
+	conflict, err := booking.HasConflict(h.db, castID, endsAt, extendedEnd, bookingID)
+	if err != nil {
+		log.Printf("Error checking booking conflicts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if conflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cast has another booking during the extra time"})
+		return
+	}
+
+	var open bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM booking_extensions WHERE booking_id = $1 AND status = 'pending')
+	`, bookingID).Scan(&open)
+	if err != nil {
+		log.Printf("Error checking booking extensions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if open {
+		c.JSON(http.StatusConflict, gin.H{"error": "This booking already has an extension waiting for the cast"})
+		return
+	}
+
+	// The extension is charged on top of the booking, so it can't switch currency
+	if hourlyRate.Currency != currency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This booking can't be extended, please make a new booking"})
+		return
+	}
+	amount := hourlyRate.Mul(int64(req.Hours))
+
+	payment, err := booking.CreateExtraPayment(h.db, h.payments, bookingID, userID, booking.PaymentPurposeExtension, amount,
+		booking.CaptureManual, stripeIdempotencyKey(c, "booking-extension"))
+	if err != nil {
+		log.Printf("Error creating extension payment for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processing failed"})
+		return
+	}
+
+	ext := models.BookingExtension{
+		BookingID:        bookingID,
+		RequestedBy:      userID,
+		Hours:            req.Hours,
+		HourlyRate:       hourlyRate,
+		Amount:           amount,
+		BookingPaymentID: &payment.ID,
+		Status:           models.ExtensionStatusPending,
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO booking_extensions (booking_id, requested_by, hours, hourly_rate, amount, booking_payment_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, bookingID, userID, req.Hours, hourlyRate.Amount, amount.Amount, payment.ID).Scan(&ext.ID, &ext.CreatedAt)
+	if err != nil {
+		log.Printf("Error creating booking extension: %v", err)
+		if err := booking.CancelExtraPayment(h.db, h.payments, *payment); err != nil {
+			log.Printf("Error cancelling extension payment %s: %v", payment.StripePaymentIntentID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request extension"})
+		return
+	}
+
+	// TODO: Send email notification to cast
+
+	c.JSON(http.StatusCreated, gin.H{
+		"extension": ext,
+		"payment":   payment,
+	})
+}
+
+func (h *BookingHandler) GetExtensions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var exists bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM bookings WHERE id = $1 AND (guest_id = $2 OR cast_id = $2))
+	`, bookingID, userID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking booking access: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT e.id, e.booking_id, e.requested_by, e.hours, e.hourly_rate, e.amount, b.currency,
+		       e.booking_payment_id, e.status, e.responded_at, e.created_at
+		FROM booking_extensions e
+		JOIN bookings b ON e.booking_id = b.id
+		WHERE e.booking_id = $1
+		ORDER BY e.created_at DESC
+	`, bookingID)
+	if err != nil {
+		log.Printf("Error getting booking extensions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	extensions := []models.BookingExtension{}
+	for rows.Next() {
+		var e models.BookingExtension
+		err := rows.Scan(&e.ID, &e.BookingID, &e.RequestedBy, &e.Hours, &e.HourlyRate.Amount, &e.Amount.Amount,
+			&e.Amount.Currency, &e.BookingPaymentID, &e.Status, &e.RespondedAt, &e.CreatedAt)
+		if err != nil {
+			continue
+		}
+		e.HourlyRate.Currency = e.Amount.Currency
+		extensions = append(extensions, e)
+	}
+
+	c.JSON(http.StatusOK, extensions)
+}
+
+// RespondToExtension lets the cast approve or reject a guest's extension. On
+// approval the held payment is captured and the booking's duration and amount
+// grow in the same transaction; if the guest hasn't confirmed the payment yet
+// the extension stays pending.
+func (h *CastHandler) RespondToExtension(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+	extensionID, err := strconv.Atoi(c.Param("extensionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid extension ID"})
+		return
+	}
+
+	var req models.BookingResponse
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the booking so a concurrent cancel or reschedule waits
+	var castID, durationHours int
+	var status models.BookingStatus
+	var endsAt time.Time
+	err = tx.QueryRow(`
+		SELECT cast_id, status, ends_at, duration_hours
+		FROM bookings WHERE id = $1
+		FOR UPDATE
+	`, bookingID).Scan(&castID, &status, &endsAt, &durationHours)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if castID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	var ext models.BookingExtension
+	err = tx.QueryRow(`
+		SELECT e.id, e.hours, e.amount, b.currency, e.booking_payment_id, e.status
+		FROM booking_extensions e
+		JOIN bookings b ON e.booking_id = b.id
+		WHERE e.id = $1 AND e.booking_id = $2
+	`, extensionID, bookingID).Scan(&ext.ID, &ext.Hours, &ext.Amount.Amount, &ext.Amount.Currency, &ext.BookingPaymentID, &ext.Status)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Extension not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking extension: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if ext.Status != models.ExtensionStatusPending {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Extension already answered"})
+		return
+	}
+
+	var payment models.BookingPayment
+	if ext.BookingPaymentID != nil {
+		payment, err = booking.GetExtraPayment(tx, *ext.BookingPaymentID)
+		if err != nil {
+			log.Printf("Error getting extension payment: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	now := time.Now()
+
+	// A booking that is no longer accepted can't be extended, so close the
+	// extension and release the hold whatever the cast answered
+	if !req.Accepted || status != models.BookingStatusAccepted {
+		extStatus := models.ExtensionStatusRejected
+		if status != models.BookingStatusAccepted {
+			extStatus = models.ExtensionStatusCancelled
+		}
+		_, err = tx.Exec(`
+			UPDATE booking_extensions SET status = $1, responded_at = $2 WHERE id = $3
+		`, extStatus, now, extensionID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error updating booking extension: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update extension"})
+			return
+		}
+
+		if payment.ID != 0 {
+			if err := booking.CancelExtraPayment(h.db, h.payments, payment); err != nil {
+				log.Printf("Error cancelling extension payment %s: %v", payment.StripePaymentIntentID, err)
+			}
+		}
+
+		if extStatus == models.ExtensionStatusCancelled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Booking can no longer be extended"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Extension rejected", "status": extStatus})
+		return
+	}
+
+	extendedEnd := endsAt.Add(time.Duration(ext.Hours) * time.Hour)
+	conflict, err := booking.HasConflict(tx, castID, endsAt, extendedEnd, bookingID)
+	if err != nil {
+		log.Printf("Error checking booking conflicts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if conflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "You have another booking during the extra time"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE bookings SET ends_at = $1, duration_hours = duration_hours + $2, amount = amount + $3, updated_at = $4
+		WHERE id = $5
+	`, extendedEnd, ext.Hours, ext.Amount.Amount, now, bookingID)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE booking_extensions SET status = $1, responded_at = $2 WHERE id = $3
+		`, models.ExtensionStatusApproved, now, extensionID)
+	}
+	if err == nil {
+		err = booking.RecordEvent(tx, booking.Event{
+			BookingID: bookingID,
+			Type:      booking.EventExtended,
+			Actor:     booking.UserActor(userID, c.GetString("user_type")),
+			Reason:    req.Message,
+			Metadata: map[string]interface{}{
+				"extension_id": extensionID,
+				"hours":        ext.Hours,
+				"amount":       ext.Amount,
+			},
+		})
+	}
+	if booking.IsOverlap(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "You have another booking during the extra time"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error extending booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extend booking"})
+		return
+	}
+
+	// Capture while the booking is still locked so the extension only takes
+	// effect once it is paid for. The capture is recorded in the same
+	// transaction; should it not commit, the Stripe webhook records it.
+	if payment.ID != 0 {
+		captured, err := booking.CaptureExtraPaymentIntent(h.payments, payment)
+		if err != nil {
+			log.Printf("Error capturing extension payment %s: %v", payment.StripePaymentIntentID, err)
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "The guest hasn't completed payment for the extension yet"})
+			return
+		}
+		if captured {
+			if err := booking.RecordExtraPaymentCapture(tx, payment); err != nil {
+				log.Printf("Error recording extension payment %s: %v", payment.StripePaymentIntentID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extend booking"})
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing extension for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extend booking"})
+		return
+	}
+
+	// TODO: Send email notification to guest
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Extension approved",
+		"status":         models.ExtensionStatusApproved,
+		"duration_hours": durationHours + ext.Hours,
+		"ends_at":        extendedEnd,
+	})
+}
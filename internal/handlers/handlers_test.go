@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/middleware"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestDB returns a database whose statements must match the test's
+// expectations, in order. Unmet expectations fail the test when it ends.
+func newTestDB(t *testing.T) (*database.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return &database.DB{DB: db}, mock
+}
+
+// sqlText matches a statement containing s.
+func sqlText(s string) string {
+	return regexp.QuoteMeta(s)
+}
+
+// testRequest is a request as the auth middleware leaves it.
+type testRequest struct {
+	userID   int
+	userType models.UserType
+	params   gin.Params
+	headers  map[string]string
+	body     interface{}
+}
+
+// serve runs handler on r and returns the response.
+func serve(t *testing.T, handler gin.HandlerFunc, r testRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if r.body != nil {
+		if err := json.NewEncoder(&body).Encode(r.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", &body)
+	c.Request.Header.Set("Content-Type", "application/json")
+	for k, v := range r.headers {
+		c.Request.Header.Set(k, v)
+	}
+	c.Params = r.params
+	c.Set("user_id", r.userID)
+	c.Set("user_type", string(r.userType))
+	handler(c)
+	return w
+}
+
+// serveIdempotent runs handler behind the Idempotency middleware, as the
+// router does, with r sent under key. The test expects the key to be claimed
+// before the handler's statements and the response stored after them.
+func serveIdempotent(t *testing.T, db *database.DB, handler gin.HandlerFunc, r testRequest, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if r.body != nil {
+		if err := json.NewEncoder(&body).Encode(r.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	route, path := "", ""
+	for _, p := range r.params {
+		route += "/:" + p.Key
+		path += "/" + p.Value
+	}
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Set("user_id", r.userID)
+		c.Set("user_type", string(r.userType))
+	})
+	engine.Use(middleware.Idempotency(db))
+	engine.POST(route+"/", handler)
+
+	req := httptest.NewRequest(http.MethodPost, path+"/", &body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(middleware.IdempotencyHeader, key)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func expectKeyClaimed(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(sqlText("INSERT INTO idempotency_keys")).
+		WillReturnRows(sqlmock.NewRows([]string{"bool"}).AddRow(true))
+}
+
+func expectResponseStored(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(sqlText("UPDATE idempotency_keys")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func bookingParam(bookingID int) gin.Params {
+	return gin.Params{{Key: "id", Value: strconv.Itoa(bookingID)}}
+}
+
+// decode reads the JSON response into a map.
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var out map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return out
+}
+
+// expectTransition expects booking.Apply to move the booking from one status
+// to another. A booking that ends without taking place also has its points
+// restored.
+func expectTransition(mock sqlmock.Sqlmock, bookingID int, from, to models.BookingStatus) {
+	mock.ExpectExec(sqlText("UPDATE bookings SET status = $1")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WithArgs(bookingID, "status_changed", from, to, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	switch to {
+	case models.BookingStatusDeclined, models.BookingStatusCancelled, models.BookingStatusExpired:
+		mock.ExpectExec(sqlText("INSERT INTO guest_points")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+}
+
+// expectPaymentStatus expects Machine.SetPaymentStatus to record status.
+func expectPaymentStatus(mock sqlmock.Sqlmock, bookingID int, status models.PaymentStatus) {
+	mock.ExpectBegin()
+	mock.ExpectExec(sqlText("UPDATE bookings SET payment_status = $1")).
+		WithArgs(status, sqlmock.AnyArg(), sqlmock.AnyArg(), bookingID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// ledgerBooking is what the ledger locks a booking to read.
+type ledgerBooking struct {
+	castID int
+	status models.BookingStatus
+}
+
+func expectLockBooking(mock sqlmock.Sqlmock, bookingID int, b ledgerBooking) {
+	mock.ExpectQuery(sqlText("SELECT cast_id, status, currency, commission_percent")).
+		WithArgs(bookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"cast_id", "status", "currency", "commission_percent", "withholding_rate", "discount"}).
+			AddRow(b.castID, b.status, "JPY", 20, 1021, 0))
+}
+
+// expectPost expects ledger.Post to write a transaction with an entry for
+// each non-zero amount, in order. An empty reference is stored as NULL.
+func expectPost(mock sqlmock.Sqlmock, kind string, bookingID int, reference string, entries ...models.Money) {
+	var ref interface{}
+	if reference != "" {
+		ref = reference
+	}
+	mock.ExpectQuery(sqlText("INSERT INTO ledger_transactions")).
+		WithArgs(kind, bookingID, ref, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	for _, e := range entries {
+		if e.IsZero() {
+			continue
+		}
+		mock.ExpectQuery(sqlText("INSERT INTO ledger_accounts")).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectExec(sqlText("INSERT INTO ledger_entries")).
+			WithArgs(1, 1, bookingID, e.Amount, string(e.Currency)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+}
+
+// expectCharge expects Ledger.Charge to book amount captured on reference
+// for a booking that isn't completed yet.
+func expectCharge(mock sqlmock.Sqlmock, bookingID int, b ledgerBooking, amount models.Money, reference string) {
+	mock.ExpectBegin()
+	expectLockBooking(mock, bookingID, b)
+	expectPost(mock, "charge", bookingID, reference, amount, amount.Neg())
+	mock.ExpectCommit()
+}
+
+// expectBalance expects a ledger balance query for the booking to return
+// amount.
+func expectBalance(mock sqlmock.Sqlmock, bookingID int, amount models.Money) {
+	mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(bookingID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(amount.Amount))
+}
+
+// expectRefund expects Machine.RecordRefund to book amount refunded while
+// the booking's deposit still covers it, leaving charged paid for the
+// booking.
+func expectRefund(mock sqlmock.Sqlmock, bookingID int, b ledgerBooking, deposit, amount models.Money, reference string, charged models.Money) {
+	status := models.PaymentStatusPartiallyRefunded
+	if !charged.IsPositive() {
+		status = models.PaymentStatusRefunded
+	}
+
+	mock.ExpectBegin()
+	expectLockBooking(mock, bookingID, b)
+	mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(bookingID, "guest_deposits", "JPY").
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(deposit.Neg().Amount))
+	expectPost(mock, "refund", bookingID, reference, amount, amount.Neg())
+	mock.ExpectQuery(sqlText("FROM ledger_entries e")).
+		WithArgs(bookingID, "stripe_clearing", "JPY", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(charged.Amount))
+	mock.ExpectQuery(sqlText("SET refunded_amount = refunded_amount + $1")).
+		WithArgs(amount.Amount, !charged.IsPositive(), sqlmock.AnyArg(), bookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_status"}).AddRow(status))
+	mock.ExpectExec(sqlText("UPDATE receipts SET voided_at = $1")).
+		WithArgs(sqlmock.AnyArg(), bookingID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(sqlText("INSERT INTO booking_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// extraPayment is a booking_payments row.
+type extraPayment struct {
+	id            int
+	purpose       string
+	intentID      string
+	amount        models.Money
+	captureMethod string
+	status        models.PaymentStatus
+	refunded      models.Money
+}
+
+func expectExtraPayments(mock sqlmock.Sqlmock, bookingID int, extras ...extraPayment) {
+	rows := sqlmock.NewRows([]string{"id", "booking_id", "purpose", "stripe_payment_intent_id", "amount", "currency",
+		"capture_method", "status", "refunded_amount", "cast_percent", "created_at"})
+	for _, p := range extras {
+		rows.AddRow(p.id, bookingID, p.purpose, p.intentID, p.amount.Amount, string(p.amount.Currency),
+			p.captureMethod, p.status, p.refunded.Amount, nil, testNow)
+	}
+	mock.ExpectQuery(sqlText("FROM booking_payments bp")).
+		WithArgs(bookingID).
+		WillReturnRows(rows)
+}
+
+func expectExtraPaymentsTotal(mock sqlmock.Sqlmock, bookingID int, total models.Money) {
+	mock.ExpectQuery(sqlText("LEFT JOIN booking_payments bp")).
+		WithArgs(bookingID).
+		WillReturnRows(sqlmock.NewRows([]string{"sum", "currency"}).AddRow(total.Amount, string(total.Currency)))
+}
+
+var testNow = time.Now()
+
+// authorize plays a guest authorizing amount for a booking, as HoldBooking
+// and ConfirmBooking leave it, and returns the PaymentIntent's ID.
+func authorize(t *testing.T, fake *payments.Fake, amount models.Money) string {
+	t.Helper()
+	pi, err := fake.Authorize(payments.AuthorizeParams{Amount: amount, ManualCapture: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Confirm(pi.ID); err != nil {
+		t.Fatal(err)
+	}
+	return pi.ID
+}
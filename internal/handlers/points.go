@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/points"
+)
+
+// PointsProgram reads the points settings, falling back to the defaults for
+// ones out of range.
+func PointsProgram(cfg *config.Config) points.Program {
+	program := points.Program{
+		Rate:          cfg.PointsRate,
+		VIPMultiplier: cfg.PointsVIPMultiplier,
+		ExpiryMonths:  cfg.PointsExpiryMonths,
+	}
+	if program.Rate < 0 || program.Rate > 100 {
+		log.Printf("Invalid POINTS_RATE %d, using default: 1", program.Rate)
+		program.Rate = 1
+	}
+	if program.VIPMultiplier < 1 {
+		log.Printf("Invalid POINTS_VIP_MULTIPLIER %d, using default: 2", program.VIPMultiplier)
+		program.VIPMultiplier = 2
+	}
+	if program.ExpiryMonths < 1 {
+		log.Printf("Invalid POINTS_EXPIRY_MONTHS %d, using default: 12", program.ExpiryMonths)
+		program.ExpiryMonths = 12
+	}
+	return program
+}
+
+// GetPoints returns the guest's points balance, which of them lapse next and
+// their most recent points history.
+func (h *BookingHandler) GetPoints(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	now := time.Now()
+
+	balance, err := points.Balance(h.db, userID, now)
+	if err != nil {
+		log.Printf("Error getting points balance: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	expiring, expiresAt, err := points.NextExpiry(h.db, userID, now)
+	if err != nil {
+		log.Printf("Error getting points expiry: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	history, err := points.History(h.db, userID, 100)
+	if err != nil {
+		log.Printf("Error getting points history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var next gin.H
+	if expiring > 0 {
+		next = gin.H{"points": expiring, "expires_at": expiresAt}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"balance":        balance,
+		"currency":       points.Currency,
+		"next_expiry":    next,
+		"earn_rate":      h.points.Rate,
+		"vip_multiplier": h.points.VIPMultiplier,
+		"history":        history,
+	})
+}
@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+// reschedulableBooking is the part of a booking a reschedule reads and
+// changes.
+type reschedulableBooking struct {
+	guestID         int
+	castID          int
+	status          models.BookingStatus
+	startsAt        time.Time
+	durationHours   int
+	amount          models.Money
+	paymentIntentID sql.NullString
+}
+
+func (h *BookingHandler) ProposeReschedule(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var req models.RescheduleCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var b reschedulableBooking
+	err = h.db.QueryRow(`
+		SELECT guest_id, cast_id, status, starts_at, duration_hours
+		FROM bookings WHERE id = $1
+	`, bookingID).Scan(&b.guestID, &b.castID, &b.status, &b.startsAt, &b.durationHours)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if b.guestID != userID && b.castID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	if b.status != models.BookingStatusPending && b.status != models.BookingStatusAccepted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only reschedule pending or accepted bookings"})
+		return
+	}
+
+	newStartsAt, newDuration := b.startsAt, b.durationHours
+	if req.StartsAt != nil {
+		newStartsAt = *req.StartsAt
+	}
+	if req.DurationHours != nil {
+		newDuration = *req.DurationHours
+	}
+
+	if !newStartsAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New time must be in the future"})
+		return
+	}
+
+	if newStartsAt.Equal(b.startsAt) && newDuration == b.durationHours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to change"})
+		return
+	}
+
+	var open bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM booking_reschedule_requests WHERE booking_id = $1 AND status = 'pending')
+	`, bookingID).Scan(&open)
+	if err != nil {
+		log.Printf("Error checking reschedule requests: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if open {
+		c.JSON(http.StatusConflict, gin.H{"error": "This booking already has an open reschedule request"})
+		return
+	}
+
+	var reason *string
+	if req.Reason != "" {
+		reason = &req.Reason
+	}
+
+	var requestID int
+	err = h.db.QueryRow(`
+		INSERT INTO booking_reschedule_requests (booking_id, requested_by,
+		    old_starts_at, old_duration_hours, new_starts_at, new_duration_hours, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, bookingID, userID, b.startsAt, b.durationHours, newStartsAt, newDuration, reason).Scan(&requestID)
+	if err != nil {
+		log.Printf("Error creating reschedule request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reschedule request"})
+		return
+	}
+
+	// TODO: Notify the other party
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":                 requestID,
+		"status":             models.RescheduleStatusPending,
+		"new_starts_at":      newStartsAt,
+		"new_duration_hours": newDuration,
+	})
+}
+
+func (h *BookingHandler) GetRescheduleRequests(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var exists bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM bookings WHERE id = $1 AND (guest_id = $2 OR cast_id = $2))
+	`, bookingID, userID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking booking access: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, booking_id, requested_by, status,
+		       old_starts_at, old_duration_hours, new_starts_at, new_duration_hours,
+		       reason, responded_by, responded_at, created_at
+		FROM booking_reschedule_requests
+		WHERE booking_id = $1
+		ORDER BY created_at DESC
+	`, bookingID)
+	if err != nil {
+		log.Printf("Error getting reschedule requests: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	requests := []models.RescheduleRequest{}
+	for rows.Next() {
+		var r models.RescheduleRequest
+		err := rows.Scan(
+			&r.ID, &r.BookingID, &r.RequestedBy, &r.Status,
+			&r.OldStartsAt, &r.OldDurationHours, &r.NewStartsAt, &r.NewDurationHours,
+			&r.Reason, &r.RespondedBy, &r.RespondedAt, &r.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, r)
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// RespondToReschedule accepts or rejects a reschedule request. Only the party
+// who did not propose it can accept; the proposer can withdraw it by
+// responding with accepted=false.
+func (h *BookingHandler) RespondToReschedule(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+	requestID, err := strconv.Atoi(c.Param("requestId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reschedule request ID"})
+		return
+	}
+
+	var req models.RescheduleResponse
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the booking so a concurrent accept, cancel or reschedule waits
+	var b reschedulableBooking
+	err = tx.QueryRow(`
+		SELECT guest_id, cast_id, status, starts_at, duration_hours,
+		       amount, currency, stripe_payment_intent_id
+		FROM bookings WHERE id = $1
+		FOR UPDATE
+	`, bookingID).Scan(&b.guestID, &b.castID, &b.status, &b.startsAt,
+		&b.durationHours, &b.amount.Amount, &b.amount.Currency, &b.paymentIntentID)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if b.guestID != userID && b.castID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	var r models.RescheduleRequest
+	err = tx.QueryRow(`
+		SELECT id, requested_by, status, new_starts_at, new_duration_hours
+		FROM booking_reschedule_requests
+		WHERE id = $1 AND booking_id = $2
+	`, requestID, bookingID).Scan(&r.ID, &r.RequestedBy, &r.Status,
+		&r.NewStartsAt, &r.NewDurationHours)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reschedule request not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting reschedule request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if r.Status != models.RescheduleStatusPending {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reschedule request already answered"})
+		return
+	}
+
+	if r.RequestedBy == userID && req.Accepted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The other party must accept the reschedule"})
+		return
+	}
+
+	actor := booking.UserActor(userID, c.GetString("user_type"))
+
+	if !req.Accepted {
+		status := models.RescheduleStatusRejected
+		if r.RequestedBy == userID {
+			status = models.RescheduleStatusWithdrawn
+		}
+		_, err = tx.Exec(`
+			UPDATE booking_reschedule_requests SET status = $1, responded_by = $2, responded_at = $3
+			WHERE id = $4
+		`, status, userID, time.Now(), requestID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error updating reschedule request: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reschedule request"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Reschedule request " + string(status)})
+		return
+	}
+
+	if b.status != models.BookingStatusPending && b.status != models.BookingStatusAccepted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Booking can no longer be rescheduled"})
+		return
+	}
+
+	// The cast's hours may have changed since the request was made
+	availability, err := booking.LoadAvailability(h.db, b.castID, r.NewStartsAt)
+	if err != nil {
+		log.Printf("Error getting cast availability: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !availability.Covers(r.NewStartsAt, time.Duration(r.NewDurationHours)*time.Hour) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cast is not available at this time"})
+		return
+	}
+
+	newEndsAt := r.NewStartsAt.Add(time.Duration(r.NewDurationHours) * time.Hour)
+	conflict, err := booking.HasConflict(tx, b.castID, r.NewStartsAt, newEndsAt, bookingID)
+	if err != nil {
+		log.Printf("Error checking booking conflicts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if conflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cast already has a booking at this time"})
+		return
+	}
+
+	// Keep the hourly price the guest booked at, and any discount with it
+	newAmount := b.amount
+	if r.NewDurationHours != b.durationHours {
+		newAmount = b.amount.Prorate(int64(r.NewDurationHours), int64(b.durationHours))
+	}
+	delta := newAmount.Sub(b.amount)
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE bookings SET starts_at = $1, ends_at = $2, duration_hours = $3, amount = $4, updated_at = $5,
+		       discount = ROUND(discount * $3::numeric / duration_hours)
+		WHERE id = $6
+	`, r.NewStartsAt, newEndsAt, r.NewDurationHours, newAmount.Amount, now, bookingID)
+	if booking.IsOverlap(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cast already has a booking at this time"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error rescheduling booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reschedule booking"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE booking_reschedule_requests SET status = $1, responded_by = $2, responded_at = $3
+		WHERE id = $4
+	`, models.RescheduleStatusAccepted, userID, now, requestID)
+	if err != nil {
+		log.Printf("Error updating reschedule request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reschedule booking"})
+		return
+	}
+
+	err = booking.RecordEvent(tx, booking.Event{
+		BookingID: bookingID,
+		Type:      booking.EventRescheduled,
+		Actor:     actor,
+		Metadata: map[string]interface{}{
+			"reschedule_request_id": requestID,
+			"old_starts_at":         b.startsAt,
+			"old_duration_hours":    b.durationHours,
+			"new_starts_at":         r.NewStartsAt,
+			"new_duration_hours":    r.NewDurationHours,
+			"old_amount":            b.amount,
+			"new_amount":            newAmount,
+		},
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error rescheduling booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reschedule booking"})
+		return
+	}
+
+	response := gin.H{
+		"message":        "Booking rescheduled",
+		"starts_at":      r.NewStartsAt,
+		"ends_at":        newEndsAt,
+		"duration_hours": r.NewDurationHours,
+		"amount":         newAmount,
+	}
+
+	if !delta.IsZero() && b.paymentIntentID.Valid {
+		extra, err := h.adjustPayment(bookingID, &b, newAmount, delta, actor, booking.PaymentPurposeReschedule)
+		if err != nil {
+			log.Printf("Error adjusting payment for booking %d: %v", bookingID, err)
+			response["payment_error"] = "The booking was rescheduled but the payment could not be adjusted"
+		} else if extra != nil {
+			response["additional_payment"] = extra
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// adjustPayment brings what the guest pays in line with a booking whose amount
+// changed by delta. While the booking is pending its main PaymentIntent is
+// still uncaptured: a decrease is simply captured less of on accept, and an
+// increase raises the authorization where the card allows it and otherwise
+// needs a linked extra payment. Once accepted, a decrease is refunded and an
+// increase is charged as an extra payment. It returns the extra PaymentIntent
+// the guest still has to confirm, if any.
+func (h *BookingHandler) adjustPayment(bookingID int, b *reschedulableBooking, newAmount, delta models.Money, actor booking.Actor, purpose string) (*models.BookingPayment, error) {
+	piID := b.paymentIntentID.String
+
+	switch {
+	case b.status == models.BookingStatusPending && delta.IsNegative():
+		return nil, nil
+
+	case b.status == models.BookingStatusPending:
+		extras, err := booking.ExtraPaymentsTotal(h.db, bookingID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = h.payments.IncrementAuthorization(piID, newAmount.Sub(extras))
+		if err == nil {
+			return nil, nil
+		}
+		log.Printf("Could not increment authorization on %s, creating extra payment: %v", piID, err)
+		return booking.CreateExtraPayment(h.db, h.payments, bookingID, b.guestID, purpose, delta, booking.CaptureManual, "")
+
+	case delta.IsPositive():
+		return booking.CreateExtraPayment(h.db, h.payments, bookingID, b.guestID, purpose, delta, booking.CaptureAutomatic, "")
+	}
+
+	// Refund the difference, from extra payments first. Whatever was refunded
+	// is recorded even if the rest failed.
+	refundAmount := delta.Neg()
+	refunded, err := booking.RefundExtraPayments(h.db, h.payments, bookingID, refundAmount)
+
+	var refundID string
+	if remaining := refundAmount.Sub(refunded); err == nil && remaining.IsPositive() {
+		var r *payments.Refund
+		r, err = h.payments.Refund(piID, remaining, "")
+		if err == nil {
+			refundID = r.ID
+			refunded = refunded.Add(remaining)
+		}
+	}
+
+	if refunded.IsPositive() {
+		if recordErr := h.machine.RecordRefund(bookingID, actor, refunded, refundID, purpose); recordErr != nil {
+			log.Printf("Error recording refund for booking %d: %v", bookingID, recordErr)
+		}
+	}
+	return nil, err
+}
+
+func (h *BookingHandler) GetExtraPayments(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var guestID int
+	err = h.db.QueryRow(`SELECT guest_id FROM bookings WHERE id = $1`, bookingID).Scan(&guestID)
+	if err == sql.ErrNoRows || (err == nil && guestID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	payments, err := booking.ListExtraPayments(h.db, bookingID)
+	if err != nil {
+		log.Printf("Error getting booking payments: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Unpaid ones need their client secret so the guest can confirm them
+	for i, p := range payments {
+		if p.Status != models.PaymentStatusRequiresPayment {
+			continue
+		}
+		pi, err := h.payments.Get(p.StripePaymentIntentID)
+		if err != nil {
+			log.Printf("Error getting payment intent %s: %v", p.StripePaymentIntentID, err)
+			continue
+		}
+		payments[i].ClientSecret = pi.ClientSecret
+	}
+
+	c.JSON(http.StatusOK, payments)
+}
@@ -7,19 +7,23 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
+	"github.com/uso/uso/config"
+	"github.com/uso/uso/internal/booking"
 	"github.com/uso/uso/internal/database"
 	"github.com/uso/uso/internal/models"
 )
 
 type SearchHandler struct {
-	db *database.DB
+	db  *database.DB
+	cfg *config.Config
 }
 
-func NewSearchHandler(db *database.DB) *SearchHandler {
-	return &SearchHandler{db: db}
+func NewSearchHandler(db *database.DB, cfg *config.Config) *SearchHandler {
+	return &SearchHandler{db: db, cfg: cfg}
 }
 
 func (h *SearchHandler) SearchCasts(c *gin.Context) {
@@ -41,12 +45,13 @@ func (h *SearchHandler) SearchCasts(c *gin.Context) {
 	// Build query
 	query := `
 		SELECT DISTINCT u.id, u.name, u.profile_image, 
-		       cp.id as profile_id, cp.bio, cp.hourly_rate, cp.rank, cp.service_areas,
+		       cp.id as profile_id, cp.bio, cp.hourly_rate, cp.currency, cp.rank, cp.service_areas,
 		       COALESCE(AVG(r.rating), 0) as rating, COUNT(DISTINCT r.id) as review_count
 		FROM users u
 		JOIN cast_profiles cp ON u.id = cp.user_id
 		LEFT JOIN reviews r ON r.reviewed_id = u.id
 		WHERE u.user_type = 'cast' AND cp.approval_status = 'approved'
+		AND (cp.suspended_until IS NULL OR cp.suspended_until < NOW())
 	`
 	
 	args := []interface{}{}
@@ -78,20 +83,56 @@ func (h *SearchHandler) SearchCasts(c *gin.Context) {
 		argCount++
 	}
 
-	// Date/time availability filter
+	// Date/time availability filter. Date and times are Tokyo local time and
+	// without an end time the cast must be free for the minimum one hour.
 	if !params.Date.IsZero() && params.StartTime != "" {
+		startsAt, err := booking.StartsAt(params.Date, params.StartTime)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_time"})
+			return
+		}
+		endsAt := startsAt.Add(time.Hour)
+		if params.EndTime != "" {
+			if endsAt, err = booking.StartsAt(params.Date, params.EndTime); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_time"})
+				return
+			}
+			if !endsAt.After(startsAt) {
+				endsAt = endsAt.AddDate(0, 0, 1)
+			}
+		}
+
 		// Exclude casts with conflicting bookings
 		query += fmt.Sprintf(` AND u.id NOT IN (
 			SELECT cast_id FROM bookings 
-			WHERE booking_date = $%d 
-			AND status IN ('pending', 'accepted')
-			AND ($%d::time >= start_time AND $%d::time < start_time + (duration_hours || ' hours')::interval)
-		)`, argCount, argCount+1, argCount+1)
-		args = append(args, params.Date, params.StartTime)
+			WHERE status IN ('held', 'pending', 'accepted')
+			AND tstzrange(starts_at, ends_at) && tstzrange($%d, $%d)
+		)`, argCount, argCount+1)
+		args = append(args, startsAt, endsAt)
 		argCount += 2
+
+		// and those whose working hours or days off don't cover all of it
+		unavailable, err := booking.Unavailable(h.db, startsAt, endsAt)
+		if err != nil {
+			log.Printf("Error checking cast availability: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if len(unavailable) > 0 {
+			query += fmt.Sprintf(" AND u.id <> ALL($%d)", argCount)
+			args = append(args, pq.Array(unavailable))
+			argCount++
+		}
+	} else if !params.Date.IsZero() {
+		// Days off
+		query += fmt.Sprintf(` AND u.id NOT IN (
+			SELECT cast_id FROM cast_blackout_dates WHERE blackout_date = $%d
+		)`, argCount)
+		args = append(args, params.Date)
+		argCount++
 	}
 
-	query += " GROUP BY u.id, u.name, u.profile_image, cp.id, cp.bio, cp.hourly_rate, cp.rank, cp.service_areas"
+	query += " GROUP BY u.id, u.name, u.profile_image, cp.id, cp.bio, cp.hourly_rate, cp.currency, cp.rank, cp.service_areas"
 	query += " ORDER BY rating DESC, review_count DESC"
 	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", argCount, argCount+1)
 	args = append(args, params.Limit, offset)
@@ -111,14 +152,14 @@ func (h *SearchHandler) SearchCasts(c *gin.Context) {
 		var name string
 		var profileImage sql.NullString
 		var bio sql.NullString
-		var hourlyRate float64
+		var hourlyRate models.Money
 		var rank models.CastRank
 		var serviceAreas pq.StringArray
 		var rating float64
 		var reviewCount int
 
 		err := rows.Scan(&userID, &name, &profileImage, &profileID, &bio, 
-			&hourlyRate, &rank, &serviceAreas, &rating, &reviewCount)
+			&hourlyRate.Amount, &hourlyRate.Currency, &rank, &serviceAreas, &rating, &reviewCount)
 		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
@@ -148,7 +189,7 @@ func (h *SearchHandler) SearchCasts(c *gin.Context) {
 	}
 
 	// Get total count
-	countQuery := strings.Replace(query, "SELECT DISTINCT u.id, u.name, u.profile_image, cp.id as profile_id, cp.bio, cp.hourly_rate, cp.rank, cp.service_areas, COALESCE(AVG(r.rating), 0) as rating, COUNT(DISTINCT r.id) as review_count", "SELECT COUNT(DISTINCT u.id)", 1)
+	countQuery := strings.Replace(query, "SELECT DISTINCT u.id, u.name, u.profile_image, cp.id as profile_id, cp.bio, cp.hourly_rate, cp.currency, cp.rank, cp.service_areas, COALESCE(AVG(r.rating), 0) as rating, COUNT(DISTINCT r.id) as review_count", "SELECT COUNT(DISTINCT u.id)", 1)
 	countQuery = strings.Split(countQuery, " GROUP BY")[0]
 	countQuery = strings.Split(countQuery, " ORDER BY")[0]
 	countQuery = strings.Split(countQuery, " LIMIT")[0]
@@ -183,19 +224,20 @@ func (h *SearchHandler) GetCastProfile(c *gin.Context) {
 	
 	err = h.db.QueryRow(`
 		SELECT u.id, u.email, u.user_type, u.name, u.phone, u.birth_date, u.profile_image,
-		       cp.id, cp.user_id, cp.bio, cp.hourly_rate, cp.rank, cp.service_areas, 
+		       cp.id, cp.user_id, cp.bio, cp.hourly_rate, cp.currency, cp.rank, cp.service_areas, 
 		       cp.approval_status, cp.approved_at,
 		       COALESCE(AVG(r.rating), 0) as rating, COUNT(r.id) as review_count
 		FROM users u
 		JOIN cast_profiles cp ON u.id = cp.user_id
 		LEFT JOIN reviews r ON r.reviewed_id = u.id
 		WHERE u.id = $1 AND u.user_type = 'cast' AND cp.approval_status = 'approved'
+		AND (cp.suspended_until IS NULL OR cp.suspended_until < NOW())
 		GROUP BY u.id, cp.id
 	`, castID).Scan(
 		&profile.ID, &profile.Email, &profile.UserType, &profile.Name,
 		&profile.Phone, &profile.BirthDate, &profile.ProfileImage,
 		&castProfile.ID, &castProfile.UserID, &castProfile.Bio,
-		&castProfile.HourlyRate, &castProfile.Rank, &castProfile.ServiceAreas,
+		&castProfile.HourlyRate.Amount, &castProfile.HourlyRate.Currency, &castProfile.Rank, &castProfile.ServiceAreas,
 		&castProfile.ApprovalStatus, &castProfile.ApprovedAt,
 		&profile.Rating, &profile.ReviewCount,
 	)
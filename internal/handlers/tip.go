@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+)
+
+// TipBooking lets a guest tip the cast after a completed booking. amount is
+// in the booking's currency's minor units. The tip is charged to the card the
+// booking was paid with when it was saved; otherwise, or if the card needs
+// authenticating, the guest confirms it with the returned client secret.
+func (h *BookingHandler) TipBooking(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	bookingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var req struct {
+		Amount int64 `json:"amount" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var guestID int
+	var status models.BookingStatus
+	var bookingAmount models.Money
+	err = h.db.QueryRow(`
+		SELECT guest_id, status, amount, currency FROM bookings WHERE id = $1
+	`, bookingID).Scan(&guestID, &status, &bookingAmount.Amount, &bookingAmount.Currency)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if guestID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	if status != models.BookingStatusCompleted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only completed bookings can be tipped"})
+		return
+	}
+
+	amount := models.NewMoney(req.Amount, bookingAmount.Currency)
+	if !amount.IsPositive() || amount.Cmp(bookingAmount) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Tip must be positive and no more than the booking's amount",
+			"max_amount": bookingAmount,
+		})
+		return
+	}
+
+	tip, err := booking.CreateTip(h.db, h.payments, bookingID, userID, amount, h.tipCast,
+		stripeIdempotencyKey(c, "booking-tip"))
+	if errors.Is(err, booking.ErrNotTippable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only completed bookings can be tipped"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating tip for booking %d: %v", bookingID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processing failed"})
+		return
+	}
+
+	// TODO: Send email notification to cast
+
+	c.JSON(http.StatusCreated, gin.H{
+		"tip":                   tip,
+		"requires_confirmation": tip.Status != models.PaymentStatusCaptured,
+	})
+}
@@ -0,0 +1,297 @@
+package ledger
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+)
+
+// A booking's money moves through the ledger in three steps. A charge puts
+// what the guest paid into guest deposits. Refunds come out of the deposit
+// while there is one. Settling the booking, once it is completed or cancelled
+// with a fee, splits what is left between the platform's commission, the tax
+// withheld from the cast and the cast. Refunds after that take back from all
+// three in the same proportion. Tips skip the deposit and are earned as they
+// are paid. A discount, from a promo code or the guest's points, is paid by
+// the platform when a completed booking is settled, so the cast earns as if
+// the guest paid full price.
+
+type bookingRow struct {
+	castID      int
+	status      models.BookingStatus
+	currency    models.Currency
+	commission  int
+	withholding int
+	discount    models.Money
+}
+
+// lockBooking reads what the ledger needs to know about a booking and locks
+// it, so two postings for the same booking can't both see the same deposit.
+func lockBooking(tx Execer, bookingID int) (bookingRow, error) {
+	var b bookingRow
+	err := tx.QueryRow(`
+		SELECT cast_id, status, currency, commission_percent, withholding_rate, discount
+		FROM bookings WHERE id = $1
+		FOR UPDATE
+	`, bookingID).Scan(&b.castID, &b.status, &b.currency, &b.commission, &b.withholding, &b.discount.Amount)
+	if err != nil {
+		return b, fmt.Errorf("error getting booking %d: %w", bookingID, err)
+	}
+	b.discount.Currency = b.currency
+	return b, nil
+}
+
+// bookingBalance returns the booking's share of an account's balance, on the
+// account's normal side. kinds, if given, limits it to those transactions.
+func bookingBalance(tx Execer, bookingID int, a Account, currency models.Currency, kinds ...string) (models.Money, error) {
+	query := `
+		SELECT COALESCE(SUM(e.amount), 0)
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		JOIN ledger_transactions t ON e.transaction_id = t.id
+		WHERE e.booking_id = $1 AND a.code = $2 AND e.currency = $3
+	`
+	args := []interface{}{bookingID, a.Code, currency}
+	if len(kinds) > 0 {
+		query += " AND t.kind = ANY($4)"
+		args = append(args, pq.Array(kinds))
+	}
+
+	balance := models.Money{Currency: currency}
+	if err := tx.QueryRow(query, args...).Scan(&balance.Amount); err != nil {
+		return balance, fmt.Errorf("error getting %s balance of booking %d: %w", a.Code, bookingID, err)
+	}
+	if !debitNormal(a.Type) {
+		balance = balance.Neg()
+	}
+	return balance, nil
+}
+
+// Collected returns what the guest has been charged for the booking,
+// including extra payments, less what they were refunded.
+func Collected(tx Execer, bookingID int, currency models.Currency) (models.Money, error) {
+	return bookingBalance(tx, bookingID, StripeClearing, currency)
+}
+
+// Charged returns what the guest has paid for the booking itself, including
+// extra payments, less what they were refunded. Unlike Collected it leaves out
+// tips.
+func Charged(tx Execer, bookingID int, currency models.Currency) (models.Money, error) {
+	return bookingBalance(tx, bookingID, StripeClearing, currency, KindCharge, KindRefund)
+}
+
+// Charge records amount captured from the guest for the booking. reference
+// is the PaymentIntent it was captured on. A charge arriving after the
+// booking completed is settled straight away.
+func Charge(tx Execer, bookingID int, amount models.Money, reference string) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	b, err := lockBooking(tx, bookingID)
+	if err != nil {
+		return err
+	}
+	if amount.Currency != b.currency {
+		return fmt.Errorf("charge in %s for booking %d priced in %s", amount.Currency, bookingID, b.currency)
+	}
+
+	posted, err := Post(tx, Transaction{
+		Kind:      KindCharge,
+		BookingID: bookingID,
+		Reference: reference,
+		Entries: []Entry{
+			{Account: StripeClearing, Amount: amount},
+			{Account: GuestDeposits, Amount: amount.Neg()},
+		},
+	})
+	if err != nil || !posted || b.status != models.BookingStatusCompleted {
+		return err
+	}
+	return Settle(tx, bookingID)
+}
+
+// Tip records a tip the guest paid on a completed booking. reference is the
+// PaymentIntent it was paid with. castPercent of it goes to the cast, less
+// the tax withheld at the booking's rate, and the rest to the platform.
+func Tip(tx Execer, bookingID int, amount models.Money, reference string, castPercent int) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	b, err := lockBooking(tx, bookingID)
+	if err != nil {
+		return err
+	}
+	if amount.Currency != b.currency {
+		return fmt.Errorf("tip in %s for booking %d priced in %s", amount.Currency, bookingID, b.currency)
+	}
+	fee, tax, cast := Split(amount, 100-castPercent, b.withholding)
+
+	_, err = Post(tx, Transaction{
+		Kind:      KindTip,
+		BookingID: bookingID,
+		Reference: reference,
+		Entries: []Entry{
+			{Account: StripeClearing, Amount: amount},
+			{Account: PlatformFees, Amount: fee.Neg()},
+			{Account: WithholdingTax, Amount: tax.Neg()},
+			{Account: CastPayable(b.castID), Amount: cast.Neg()},
+		},
+	})
+	return err
+}
+
+// Refund records amount returned to the guest. reference is the Stripe
+// refund, if there is one.
+func Refund(tx Execer, bookingID int, amount models.Money, reference, reason string) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	b, err := lockBooking(tx, bookingID)
+	if err != nil {
+		return err
+	}
+	if amount.Currency != b.currency {
+		return fmt.Errorf("refund in %s for booking %d priced in %s", amount.Currency, bookingID, b.currency)
+	}
+
+	deposit, err := bookingBalance(tx, bookingID, GuestDeposits, b.currency)
+	if err != nil {
+		return err
+	}
+	fromDeposit := amount.Min(deposit)
+	if fromDeposit.IsNegative() {
+		fromDeposit = amount.Zero()
+	}
+
+	// Whatever the deposit doesn't cover was already earned, so it is taken
+	// back from the platform, the withheld tax and the cast in the proportion
+	// they were paid
+	rest := amount.Sub(fromDeposit)
+	fee, tax, castShare := rest.Zero(), rest.Zero(), rest.Zero()
+	if rest.IsPositive() {
+		earnedFee, err := bookingBalance(tx, bookingID, PlatformFees, b.currency, KindEarning, KindTip, KindRefund)
+		if err != nil {
+			return err
+		}
+		earnedTax, err := bookingBalance(tx, bookingID, WithholdingTax, b.currency, KindEarning, KindTip, KindRefund)
+		if err != nil {
+			return err
+		}
+		earnedCast, err := bookingBalance(tx, bookingID, CastPayable(b.castID), b.currency, KindEarning, KindTip, KindRefund)
+		if err != nil {
+			return err
+		}
+		earned := earnedFee.Add(earnedTax).Add(earnedCast)
+		if earned.IsPositive() {
+			fee = rest.Prorate(earnedFee.Amount, earned.Amount)
+			tax = rest.Prorate(earnedTax.Amount, earned.Amount)
+			castShare = rest.Sub(fee).Sub(tax)
+		} else {
+			// Refunding more than was ever charged; leave the deposit short
+			// so the overpayment shows up
+			fromDeposit = amount
+		}
+	}
+
+	_, err = Post(tx, Transaction{
+		Kind:        KindRefund,
+		BookingID:   bookingID,
+		Reference:   reference,
+		Description: reason,
+		Entries: []Entry{
+			{Account: GuestDeposits, Amount: fromDeposit},
+			{Account: PlatformFees, Amount: fee},
+			{Account: WithholdingTax, Amount: tax},
+			{Account: CastPayable(b.castID), Amount: castShare},
+			{Account: StripeClearing, Amount: amount.Neg()},
+		},
+	})
+	return err
+}
+
+// Settle moves what the booking still holds in guest deposits to the
+// platform's commission, the tax withheld and the cast, at the rates the
+// booking was made at. A completed booking's discount is added from
+// promotions the first time it is settled; a cancellation fee is split as
+// charged.
+func Settle(tx Execer, bookingID int) error {
+	b, err := lockBooking(tx, bookingID)
+	if err != nil {
+		return err
+	}
+
+	deposit, err := bookingBalance(tx, bookingID, GuestDeposits, b.currency)
+	if err != nil || !deposit.IsPositive() {
+		return err
+	}
+	discount := b.discount.Zero()
+	if b.status == models.BookingStatusCompleted && b.discount.IsPositive() {
+		spent, err := bookingBalance(tx, bookingID, Promotions, b.currency)
+		if err != nil {
+			return err
+		}
+		if b.discount.Cmp(spent) > 0 {
+			discount = b.discount.Sub(spent)
+		}
+	}
+	fee, tax, cast := Split(deposit.Add(discount), b.commission, b.withholding)
+
+	_, err = Post(tx, Transaction{
+		Kind:      KindEarning,
+		BookingID: bookingID,
+		Entries: []Entry{
+			{Account: GuestDeposits, Amount: deposit},
+			{Account: Promotions, Amount: discount},
+			{Account: PlatformFees, Amount: fee.Neg()},
+			{Account: WithholdingTax, Amount: tax.Neg()},
+			{Account: CastPayable(b.castID), Amount: cast.Neg()},
+		},
+	})
+	return err
+}
+
+// Ledger posts to the books in database transactions of its own. Use the
+// package functions to post as part of a wider transaction.
+type Ledger struct {
+	db *database.DB
+}
+
+func New(db *database.DB) *Ledger {
+	return &Ledger{db: db}
+}
+
+func (l *Ledger) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Charge is Charge in a transaction of its own.
+func (l *Ledger) Charge(bookingID int, amount models.Money, reference string) error {
+	return l.inTx(func(tx *sql.Tx) error { return Charge(tx, bookingID, amount, reference) })
+}
+
+// Refund is Refund in a transaction of its own.
+func (l *Ledger) Refund(bookingID int, amount models.Money, reference, reason string) error {
+	return l.inTx(func(tx *sql.Tx) error { return Refund(tx, bookingID, amount, reference, reason) })
+}
+
+// Tip is Tip in a transaction of its own.
+func (l *Ledger) Tip(bookingID int, amount models.Money, reference string, castPercent int) error {
+	return l.inTx(func(tx *sql.Tx) error { return Tip(tx, bookingID, amount, reference, castPercent) })
+}
+
+// Settle is Settle in a transaction of its own.
+func (l *Ledger) Settle(bookingID int) error {
+	return l.inTx(func(tx *sql.Tx) error { return Settle(tx, bookingID) })
+}
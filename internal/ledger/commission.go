@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// Commission is the platform's cut of a booking in percent, by the cast's
+// rank.
+type Commission map[models.CastRank]int
+
+var DefaultCommission = Commission{
+	models.CastRankStandard: 30,
+	models.CastRankPremium:  25,
+	models.CastRankVIP:      20,
+}
+
+// ParseCommission reads rates such as "standard:30,premium:25,vip:20". Ranks
+// left out pay the standard rate.
+func ParseCommission(s string) (Commission, error) {
+	c := Commission{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		rank, percent, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid commission rate %q", part)
+		}
+		r := models.CastRank(strings.TrimSpace(rank))
+		switch r {
+		case models.CastRankStandard, models.CastRankPremium, models.CastRankVIP:
+		default:
+			return nil, fmt.Errorf("unknown rank in commission rate %q", part)
+		}
+		pct, err := strconv.Atoi(strings.TrimSpace(percent))
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid percent in commission rate %q", part)
+		}
+		c[r] = pct
+	}
+	if _, ok := c[models.CastRankStandard]; !ok {
+		return nil, fmt.Errorf("commission rates must include the standard rank")
+	}
+	return c, nil
+}
+
+// Percent returns the commission on bookings with a cast of the given rank.
+func (c Commission) Percent(rank models.CastRank) int {
+	if pct, ok := c[rank]; ok {
+		return pct
+	}
+	return c[models.CastRankStandard]
+}
@@ -0,0 +1,258 @@
+// Package ledger keeps a double-entry record of the money that moves through
+// the platform: what guests are charged and refunded, the platform's
+// commission, what is owed to casts and what has been paid out to them.
+package ledger
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+)
+
+// Account types stored in ledger_accounts.account_type
+const (
+	// TypeStripeClearing is money held by Stripe on the platform's behalf.
+	TypeStripeClearing = "stripe_clearing"
+	// TypeGuestDeposits is money charged for bookings that haven't been
+	// earned yet, owed back to the guest if the booking falls through.
+	TypeGuestDeposits = "guest_deposits"
+	// TypePlatformFees is the platform's commission.
+	TypePlatformFees = "platform_fees"
+	// TypeCastPayable is what a cast has earned and not yet been paid.
+	TypeCastPayable = "cast_payable"
+	// TypeWithholdingTax is income tax withheld from casts' earnings, owed
+	// to the tax office.
+	TypeWithholdingTax = "withholding_tax"
+	// TypePromotions is what the platform has spent on guests' discounts
+	// and referral bonuses.
+	TypePromotions = "promotions"
+)
+
+// Transaction kinds stored in ledger_transactions.kind
+const (
+	KindCharge  = "charge"
+	KindRefund  = "refund"
+	KindEarning = "earning"
+	KindPayout  = "payout"
+	KindTip     = "tip"
+	// KindReferral is a cast's bonus for a referral, not tied to a booking.
+	KindReferral = "referral"
+)
+
+// Account is one of the books money is posted to.
+type Account struct {
+	Code   string
+	Type   string
+	UserID *int
+}
+
+// The platform's own accounts, created by the ledger migration
+var (
+	StripeClearing = Account{Code: "stripe_clearing", Type: TypeStripeClearing}
+	GuestDeposits  = Account{Code: "guest_deposits", Type: TypeGuestDeposits}
+	PlatformFees   = Account{Code: "platform_fees", Type: TypePlatformFees}
+	WithholdingTax = Account{Code: "withholding_tax", Type: TypeWithholdingTax}
+	Promotions     = Account{Code: "promotions", Type: TypePromotions}
+)
+
+// CastPayable returns the account of what the platform owes a cast.
+func CastPayable(castID int) Account {
+	return Account{Code: "cast_payable:" + strconv.Itoa(castID), Type: TypeCastPayable, UserID: &castID}
+}
+
+// debitNormal reports whether the account's balance is its debits less its
+// credits. Every account but Stripe clearing and the promotions expense is a
+// liability or revenue, whose balance is the other way round.
+func debitNormal(accountType string) bool {
+	return accountType == TypeStripeClearing || accountType == TypePromotions
+}
+
+// Entry is one side of a transaction. Debits are positive, credits negative.
+type Entry struct {
+	Account Account
+	Amount  models.Money
+}
+
+// Transaction is a set of entries that together move money between accounts.
+type Transaction struct {
+	Kind        string
+	BookingID   int
+	Reference   string
+	Description string
+	Entries     []Entry
+}
+
+// Execer is satisfied by *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Validate checks that the transaction's entries balance in every currency.
+func (t Transaction) Validate() error {
+	if t.Kind == "" {
+		return fmt.Errorf("ledger transaction has no kind")
+	}
+	sums := map[models.Currency]int64{}
+	for _, e := range t.Entries {
+		if e.Amount.Currency == "" {
+			return fmt.Errorf("ledger entry for %s has no currency", e.Account.Code)
+		}
+		sums[e.Amount.Currency] += e.Amount.Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%s transaction is out of balance by %d %s", t.Kind, sum, currency)
+		}
+	}
+	return nil
+}
+
+// Post writes the transaction. A transaction with the same kind and
+// reference as one already posted is skipped, so a Stripe object seen twice
+// is only booked once; posted reports whether anything was written.
+func Post(tx Execer, t Transaction) (posted bool, err error) {
+	if err := t.Validate(); err != nil {
+		return false, err
+	}
+
+	var bookingID *int
+	if t.BookingID != 0 {
+		bookingID = &t.BookingID
+	}
+	var reference, description *string
+	if t.Reference != "" {
+		reference = &t.Reference
+	}
+	if t.Description != "" {
+		description = &t.Description
+	}
+
+	var txnID int64
+	err = tx.QueryRow(`
+		INSERT INTO ledger_transactions (kind, booking_id, reference, description)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, reference) DO NOTHING
+		RETURNING id
+	`, t.Kind, bookingID, reference, description).Scan(&txnID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error recording ledger transaction: %w", err)
+	}
+
+	for _, e := range t.Entries {
+		if e.Amount.IsZero() {
+			continue
+		}
+		accountID, err := accountID(tx, e.Account)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO ledger_entries (transaction_id, account_id, booking_id, amount, currency)
+			VALUES ($1, $2, $3, $4, $5)
+		`, txnID, accountID, bookingID, e.Amount.Amount, e.Amount.Currency)
+		if err != nil {
+			return false, fmt.Errorf("error recording ledger entry: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// accountID returns the account's ID, opening it on first use.
+func accountID(tx Execer, a Account) (int, error) {
+	var id int
+	err := tx.QueryRow(`
+		INSERT INTO ledger_accounts (code, account_type, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code
+		RETURNING id
+	`, a.Code, a.Type, a.UserID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error getting ledger account %s: %w", a.Code, err)
+	}
+	return id, nil
+}
+
+// Balances returns the account's balance in each currency it holds, on the
+// account's normal side, so a positive amount owed to a cast is positive.
+func Balances(q Execer, a Account) ([]models.Money, error) {
+	rows, err := q.Query(`
+		SELECT e.currency, SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		WHERE a.code = $1
+		GROUP BY e.currency
+		ORDER BY e.currency
+	`, a.Code)
+	if err != nil {
+		return nil, fmt.Errorf("error querying balance of %s: %w", a.Code, err)
+	}
+	defer rows.Close()
+
+	balances := []models.Money{}
+	for rows.Next() {
+		var m models.Money
+		if err := rows.Scan(&m.Currency, &m.Amount); err != nil {
+			return nil, fmt.Errorf("error scanning balance of %s: %w", a.Code, err)
+		}
+		if !debitNormal(a.Type) {
+			m = m.Neg()
+		}
+		balances = append(balances, m)
+	}
+	return balances, rows.Err()
+}
+
+// TypeBalances returns the combined balance of every account of each type,
+// per currency, on the accounts' normal side.
+func TypeBalances(db *database.DB) (map[string][]models.Money, error) {
+	rows, err := db.Query(`
+		SELECT a.account_type, e.currency, SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		GROUP BY a.account_type, e.currency
+		ORDER BY a.account_type, e.currency
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ledger balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := map[string][]models.Money{}
+	for _, t := range []string{TypeStripeClearing, TypeGuestDeposits, TypePlatformFees, TypeCastPayable, TypeWithholdingTax} {
+		balances[t] = []models.Money{}
+	}
+	for rows.Next() {
+		var accountType string
+		var m models.Money
+		if err := rows.Scan(&accountType, &m.Currency, &m.Amount); err != nil {
+			return nil, fmt.Errorf("error scanning ledger balance: %w", err)
+		}
+		if !debitNormal(accountType) {
+			m = m.Neg()
+		}
+		balances[accountType] = append(balances[accountType], m)
+	}
+	return balances, rows.Err()
+}
+
+// Sum adds up amounts per currency, in currency order.
+func Sum(amounts ...models.Money) []models.Money {
+	totals := map[models.Currency]int64{}
+	for _, m := range amounts {
+		totals[m.Currency] += m.Amount
+	}
+	sums := make([]models.Money, 0, len(totals))
+	for currency, amount := range totals {
+		sums = append(sums, models.NewMoney(amount, currency))
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Currency < sums[j].Currency })
+	return sums
+}
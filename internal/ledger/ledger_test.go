@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestParseCommission(t *testing.T) {
+	c, err := ParseCommission("standard:30, vip:15")
+	if err != nil {
+		t.Fatalf("ParseCommission: %v", err)
+	}
+	if c.Percent(models.CastRankVIP) != 15 || c.Percent(models.CastRankPremium) != 30 {
+		t.Fatalf("unexpected rates: %+v", c)
+	}
+
+	for _, s := range []string{"vip:20", "standard:thirty", "standard:120", "gold:10,standard:30", "standard"} {
+		if _, err := ParseCommission(s); err == nil {
+			t.Errorf("ParseCommission(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestTransactionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		wantErr bool
+	}{
+		{"balanced", []Entry{
+			{StripeClearing, models.JPY(12000)},
+			{PlatformFees, models.JPY(-3600)},
+			{CastPayable(7), models.JPY(-8400)},
+		}, false},
+		{"out of balance", []Entry{
+			{StripeClearing, models.JPY(12000)},
+			{GuestDeposits, models.JPY(-11000)},
+		}, true},
+		{"balanced per currency", []Entry{
+			{StripeClearing, models.JPY(100)},
+			{GuestDeposits, models.JPY(-100)},
+			{StripeClearing, models.NewMoney(500, models.CurrencyUSD)},
+			{GuestDeposits, models.NewMoney(-500, models.CurrencyUSD)},
+		}, false},
+		{"mixed currencies", []Entry{
+			{StripeClearing, models.JPY(100)},
+			{GuestDeposits, models.NewMoney(-100, models.CurrencyUSD)},
+		}, true},
+		{"no currency", []Entry{
+			{StripeClearing, models.Money{Amount: 100}},
+			{GuestDeposits, models.Money{Amount: -100}},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Transaction{Kind: KindCharge, Entries: tt.entries}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSum(t *testing.T) {
+	got := Sum(models.JPY(100), models.NewMoney(250, models.CurrencyUSD), models.JPY(-40))
+	want := []models.Money{models.JPY(60), models.NewMoney(250, models.CurrencyUSD)}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Sum = %v, want %v", got, want)
+	}
+}
+
+func TestParseWithholdingRate(t *testing.T) {
+	for in, want := range map[string]int{"10.21": 1021, "20.42": 2042, "10": 1000, "0": 0, "10.5": 1050} {
+		if got, err := ParseWithholdingRate(in); err != nil || got != want {
+			t.Errorf("ParseWithholdingRate(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "ten", "10.211", "-1", "101"} {
+		if _, err := ParseWithholdingRate(in); err == nil {
+			t.Errorf("ParseWithholdingRate(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	fee, tax, cast := Split(models.JPY(20000), 30, DefaultWithholdingRate)
+	// ¥14,000 to the cast, less 10.21% = ¥1,429.4 withheld
+	if fee != models.JPY(6000) || tax != models.JPY(1429) || cast != models.JPY(12571) {
+		t.Fatalf("Split = %v, %v, %v", fee, tax, cast)
+	}
+	if fee.Add(tax).Add(cast) != models.JPY(20000) {
+		t.Fatal("Split does not add up to what was paid")
+	}
+
+	if _, tax, cast := Split(models.JPY(10000), 20, 0); !tax.IsZero() || cast != models.JPY(8000) {
+		t.Fatalf("Split without withholding = %v, %v", tax, cast)
+	}
+}
@@ -0,0 +1,17 @@
+package ledger
+
+import "github.com/uso/uso/internal/models"
+
+// Payout records amount transferred to the cast's connected account, settling
+// that much of what they are owed. reference is the Stripe transfer.
+func Payout(tx Execer, castID int, amount models.Money, reference string) error {
+	_, err := Post(tx, Transaction{
+		Kind:      KindPayout,
+		Reference: reference,
+		Entries: []Entry{
+			{Account: CastPayable(castID), Amount: amount},
+			{Account: StripeClearing, Amount: amount.Neg()},
+		},
+	})
+	return err
+}
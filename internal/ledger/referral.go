@@ -0,0 +1,24 @@
+package ledger
+
+import "github.com/uso/uso/internal/models"
+
+// ReferralBonus records a bonus the platform pays a cast for a referral, out
+// of the promotions budget. Tax is withheld from it at withholdingRate, as
+// from the cast's earnings. reference identifies the reward, so it is only
+// booked once.
+func ReferralBonus(tx Execer, castID int, amount models.Money, withholdingRate int, reference string) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	_, tax, cast := Split(amount, 0, withholdingRate)
+	_, err := Post(tx, Transaction{
+		Kind:      KindReferral,
+		Reference: reference,
+		Entries: []Entry{
+			{Account: Promotions, Amount: amount},
+			{Account: WithholdingTax, Amount: tax.Neg()},
+			{Account: CastPayable(castID), Amount: cast.Neg()},
+		},
+	})
+	return err
+}
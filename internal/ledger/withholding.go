@@ -0,0 +1,43 @@
+package ledger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// DefaultWithholdingRate is the income tax withheld from casts' earnings in
+// basis points: 10.21%, the 10% rate on fees paid to individuals plus the
+// reconstruction surtax.
+const DefaultWithholdingRate = 1021
+
+// ParseWithholdingRate reads a rate in percent such as "10.21" into basis
+// points.
+func ParseWithholdingRate(s string) (int, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if whole == "" {
+		return 0, fmt.Errorf("invalid withholding rate %q", s)
+	}
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("withholding rate %q has more than two decimals", s)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	bp, err := strconv.Atoi(whole + frac)
+	if err != nil || bp < 0 || bp > 10000 {
+		return 0, fmt.Errorf("invalid withholding rate %q", s)
+	}
+	return bp, nil
+}
+
+// Split divides what a guest paid for a booking into the platform's
+// commission, the income tax withheld from the cast's share, and what is left
+// for the cast. The tax drops fractions of a yen, as the National Tax Agency
+// requires.
+func Split(paid models.Money, commission, withholdingRate int) (fee, tax, cast models.Money) {
+	fee = paid.Percent(commission)
+	share := paid.Sub(fee)
+	tax = share.ProrateDown(int64(withholdingRate), 10000)
+	return fee, tax, share.Sub(tax)
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/database"
+)
+
+const (
+	// IdempotencyHeader is the request header clients set to make a
+	// mutating request safe to retry.
+	IdempotencyHeader = "Idempotency-Key"
+
+	idempotencyKeyContext = "idempotency_key"
+	maxIdempotencyKeyLen  = 255
+
+	// A request still marked in progress after this long is assumed to have
+	// died with its server, and a retry may take it over.
+	idempotencyLockTimeout = time.Minute
+)
+
+// Idempotency replays the stored response when an authenticated user retries
+// a POST, PUT, PATCH or DELETE with an Idempotency-Key they have already
+// used. A retry whose method, path or body differs from the original is
+// rejected, as is one arriving while the original is still running. The first
+// response is kept whatever its status, so a client retrying after an error
+// must use a new key. Requests without the header pass straight through. Must
+// run after AuthRequired or AdminOnly; admins, who have no user ID, share one
+// set of keys.
+func Idempotency(db *database.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyHeader)
+		if key == "" || !isMutating(c.Request.Method) {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := c.GetInt("user_id")
+		path := c.Request.URL.Path
+		hash := requestHash(c.Request.Method, path, body)
+
+		// Claim the key, or take over one abandoned mid-request
+		var claimed bool
+		err = db.QueryRow(`
+			INSERT INTO idempotency_keys (user_id, key, method, path, request_hash)
+			VALUES (NULLIF($1, 0), $2, $3, $4, $5)
+			ON CONFLICT ((COALESCE(user_id, 0)), key) DO UPDATE SET created_at = CURRENT_TIMESTAMP
+			WHERE idempotency_keys.completed_at IS NULL
+			AND idempotency_keys.request_hash = EXCLUDED.request_hash
+			AND idempotency_keys.created_at < $6
+			RETURNING true
+		`, userID, key, c.Request.Method, path, hash, time.Now().Add(-idempotencyLockTimeout)).Scan(&claimed)
+
+		if err == sql.ErrNoRows {
+			replayIdempotent(c, db, userID, key, hash)
+			return
+		} else if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Set(idempotencyKeyContext, key)
+
+		c.Next()
+
+		_, err = db.Exec(`
+			UPDATE idempotency_keys
+			SET status_code = $1, content_type = $2, response_body = $3, completed_at = $4
+			WHERE COALESCE(user_id, 0) = $5 AND key = $6
+		`, writer.Status(), writer.Header().Get("Content-Type"), writer.body.Bytes(), time.Now(), userID, key)
+		if err != nil {
+			log.Printf("Error storing response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// IdempotencyKey returns the Idempotency-Key the current request was claimed
+// under, or "" if it has none. Handlers pass it on to Stripe so a retried
+// request can't create a second charge either.
+func IdempotencyKey(c *gin.Context) string {
+	return c.GetString(idempotencyKeyContext)
+}
+
+func replayIdempotent(c *gin.Context, db *database.DB, userID int, key, hash string) {
+	var storedHash string
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := db.QueryRow(`
+		SELECT request_hash, status_code, content_type, response_body
+		FROM idempotency_keys WHERE COALESCE(user_id, 0) = $1 AND key = $2
+	`, userID, key).Scan(&storedHash, &statusCode, &contentType, &body)
+	if err != nil {
+		log.Printf("Error getting idempotency key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.Abort()
+		return
+	}
+
+	switch {
+	case storedHash != hash:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+	case !statusCode.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(int(statusCode.Int64), contentType.String, body)
+	}
+	c.Abort()
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body so it can be stored.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
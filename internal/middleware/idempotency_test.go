@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/uso/uso/internal/database"
+)
+
+const (
+	testUserID = 7
+	testKey    = "key-1"
+	testPath   = "/api/bookings/42/tip"
+	testBody   = `{"amount":1000}`
+)
+
+const (
+	claimQuery  = "INSERT INTO idempotency_keys"
+	replayQuery = "SELECT request_hash, status_code, content_type, response_body"
+	storeQuery  = "UPDATE idempotency_keys"
+)
+
+// takeover matches the claim's cutoff if a claim made at claimedAt and not
+// completed would be taken over, or, with stale false, if it would not.
+type takeover struct {
+	claimedAt time.Time
+	stale     bool
+}
+
+func (m takeover) Match(v driver.Value) bool {
+	cutoff, ok := v.(time.Time)
+	return ok && m.claimedAt.Before(cutoff) == m.stale
+}
+
+// newIdempotentRouter serves testPath behind Idempotency, counting the times
+// the handler runs.
+func newIdempotentRouter(t *testing.T) (*gin.Engine, sqlmock.Sqlmock, *int) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	calls := 0
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user_id", testUserID) })
+	r.Use(Idempotency(&database.DB{DB: db}))
+	r.Any(testPath, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusCreated, gin.H{"tip": calls, "key": IdempotencyKey(c)})
+	})
+	return r, mock, &calls
+}
+
+func send(r *gin.Engine, method, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, testPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func expectStored(mock sqlmock.Sqlmock, body string) {
+	mock.ExpectExec(storeQuery).
+		WithArgs(http.StatusCreated, "application/json; charset=utf-8", []byte(body), sqlmock.AnyArg(), testUserID, testKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestIdempotencyFirstRequest(t *testing.T) {
+	r, mock, calls := newIdempotentRouter(t)
+	hash := requestHash(http.MethodPost, testPath, []byte(testBody))
+
+	mock.ExpectQuery(claimQuery).
+		WithArgs(testUserID, testKey, http.MethodPost, testPath, hash, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"bool"}).AddRow(true))
+	expectStored(mock, `{"key":"key-1","tip":1}`)
+
+	w := send(r, http.MethodPost, testKey, testBody)
+	if w.Code != http.StatusCreated || *calls != 1 {
+		t.Fatalf("status = %d after %d calls, want 201 after 1", w.Code, *calls)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("first response marked as replayed")
+	}
+}
+
+func TestIdempotencyRetry(t *testing.T) {
+	hash := requestHash(http.MethodPost, testPath, []byte(testBody))
+	stored := []string{"request_hash", "status_code", "content_type", "response_body"}
+
+	tests := []struct {
+		name   string
+		body   string
+		stored *sqlmock.Rows
+		code   int
+		want   string
+		// replayed is whether the response is the stored one
+		replayed bool
+	}{
+		{
+			name: "replays the stored response",
+			body: testBody,
+			stored: sqlmock.NewRows(stored).
+				AddRow(hash, http.StatusCreated, "application/json; charset=utf-8", []byte(`{"tip":1}`)),
+			code:     http.StatusCreated,
+			want:     `{"tip":1}`,
+			replayed: true,
+		},
+		{
+			name: "replays an error response too",
+			body: testBody,
+			stored: sqlmock.NewRows(stored).
+				AddRow(hash, http.StatusPaymentRequired, "application/json; charset=utf-8", []byte(`{"error":"card declined"}`)),
+			code:     http.StatusPaymentRequired,
+			want:     `{"error":"card declined"}`,
+			replayed: true,
+		},
+		{
+			name: "rejects a different body",
+			body: `{"amount":5000}`,
+			stored: sqlmock.NewRows(stored).
+				AddRow(hash, http.StatusCreated, "application/json; charset=utf-8", []byte(`{"tip":1}`)),
+			code: http.StatusUnprocessableEntity,
+			want: "different request",
+		},
+		{
+			name: "rejects a different body while the original runs",
+			body: `{"amount":5000}`,
+			stored: sqlmock.NewRows(stored).
+				AddRow(hash, nil, nil, nil),
+			code: http.StatusUnprocessableEntity,
+			want: "different request",
+		},
+		{
+			name: "waits for the original",
+			body: testBody,
+			stored: sqlmock.NewRows(stored).
+				AddRow(hash, nil, nil, nil),
+			code: http.StatusConflict,
+			want: "still in progress",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock, calls := newIdempotentRouter(t)
+
+			// The claim matches nothing to update: the key is taken
+			mock.ExpectQuery(claimQuery).
+				WithArgs(testUserID, testKey, http.MethodPost, testPath, requestHash(http.MethodPost, testPath, []byte(tt.body)), sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"bool"}))
+			mock.ExpectQuery(replayQuery).
+				WithArgs(testUserID, testKey).
+				WillReturnRows(tt.stored)
+
+			w := send(r, http.MethodPost, testKey, tt.body)
+			if *calls != 0 {
+				t.Errorf("handler ran %d times on a retry", *calls)
+			}
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("got %d %s, want %d containing %q", w.Code, w.Body, tt.code, tt.want)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+				t.Errorf("Idempotent-Replayed = %v, want %v", replayed, tt.replayed)
+			}
+		})
+	}
+}
+
+// A claim left in progress for over a minute is assumed dead: the retry takes
+// it over, runs the handler and stores its response. A younger one is
+// waited for.
+func TestIdempotencyTakesOverStaleClaim(t *testing.T) {
+	hash := requestHash(http.MethodPost, testPath, []byte(testBody))
+
+	t.Run("within a minute", func(t *testing.T) {
+		r, mock, calls := newIdempotentRouter(t)
+		mock.ExpectQuery(claimQuery).
+			WithArgs(testUserID, testKey, http.MethodPost, testPath, hash,
+				takeover{claimedAt: time.Now().Add(-50 * time.Second), stale: false}).
+			WillReturnRows(sqlmock.NewRows([]string{"bool"}))
+		mock.ExpectQuery(replayQuery).
+			WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body"}).
+				AddRow(hash, nil, nil, nil))
+
+		w := send(r, http.MethodPost, testKey, testBody)
+		if w.Code != http.StatusConflict || *calls != 0 {
+			t.Errorf("status = %d after %d calls, want 409 after 0", w.Code, *calls)
+		}
+	})
+
+	t.Run("after a minute", func(t *testing.T) {
+		r, mock, calls := newIdempotentRouter(t)
+		mock.ExpectQuery(claimQuery).
+			WithArgs(testUserID, testKey, http.MethodPost, testPath, hash,
+				takeover{claimedAt: time.Now().Add(-61 * time.Second), stale: true}).
+			WillReturnRows(sqlmock.NewRows([]string{"bool"}).AddRow(true))
+		expectStored(mock, `{"key":"key-1","tip":1}`)
+
+		w := send(r, http.MethodPost, testKey, testBody)
+		if w.Code != http.StatusCreated || *calls != 1 {
+			t.Errorf("status = %d after %d calls, want 201 after 1", w.Code, *calls)
+		}
+	})
+}
+
+func TestIdempotencyPassesThrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		key    string
+	}{
+		{"without a key", http.MethodPost, ""},
+		{"a GET", http.MethodGet, testKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, calls := newIdempotentRouter(t)
+			w := send(r, tt.method, tt.key, testBody)
+			if w.Code != http.StatusCreated || *calls != 1 {
+				t.Errorf("status = %d after %d calls, want 201 after 1", w.Code, *calls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyRejectsLongKey(t *testing.T) {
+	r, _, calls := newIdempotentRouter(t)
+	w := send(r, http.MethodPost, strings.Repeat("k", maxIdempotencyKeyLen+1), testBody)
+	if w.Code != http.StatusBadRequest || *calls != 0 {
+		t.Errorf("status = %d after %d calls, want 400 after 0", w.Code, *calls)
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// CastWeeklyHours is one recurring working window. Weekday 0 is Sunday and
+// times are "15:04" in Tokyo time; EndTime may be "24:00".
+type CastWeeklyHours struct {
+	ID        int    `json:"id,omitempty"`
+	Weekday   int    `json:"weekday" binding:"min=0,max=6"`
+	StartTime string `json:"start_time" binding:"required"`
+	EndTime   string `json:"end_time" binding:"required"`
+}
+
+type CastBlackoutDate struct {
+	ID        int       `json:"id"`
+	Date      time.Time `json:"date"`
+	Reason    *string   `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WeeklyHoursUpdate replaces a cast's whole weekly schedule. An empty list
+// removes all restrictions.
+type WeeklyHoursUpdate struct {
+	Hours []CastWeeklyHours `json:"hours" binding:"dive"`
+}
+
+type BlackoutDateCreate struct {
+	Date   time.Time `json:"date" binding:"required"`
+	Reason string    `json:"reason" binding:"max=500"`
+}
@@ -8,13 +8,19 @@ import (
 type BookingStatus string
 
 const (
+	BookingStatusHeld      BookingStatus = "held"
 	BookingStatusPending   BookingStatus = "pending"
 	BookingStatusAccepted  BookingStatus = "accepted"
 	BookingStatusDeclined  BookingStatus = "declined"
 	BookingStatusCompleted BookingStatus = "completed"
 	BookingStatusCancelled BookingStatus = "cancelled"
+	BookingStatusExpired   BookingStatus = "expired"
 )
 
+// BookingResponseWindow is how long a cast has to accept or decline a
+// pending booking before it expires.
+const BookingResponseWindow = 24 * time.Hour
+
 func (bs BookingStatus) Value() (driver.Value, error) {
 	return string(bs), nil
 }
@@ -24,33 +30,178 @@ func (bs *BookingStatus) Scan(value interface{}) error {
 	return nil
 }
 
+type PaymentStatus string
+
+const (
+	PaymentStatusAuthorized        PaymentStatus = "authorized"
+	PaymentStatusCaptured          PaymentStatus = "captured"
+	PaymentStatusCanceled          PaymentStatus = "canceled"
+	PaymentStatusCaptureFailed     PaymentStatus = "capture_failed"
+	PaymentStatusPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentStatusRefunded          PaymentStatus = "refunded"
+	PaymentStatusRequiresPayment   PaymentStatus = "requires_payment"
+	PaymentStatusDisputed          PaymentStatus = "disputed"
+)
+
+func (ps PaymentStatus) Value() (driver.Value, error) {
+	return string(ps), nil
+}
+
+func (ps *PaymentStatus) Scan(value interface{}) error {
+	*ps = PaymentStatus(value.(string))
+	return nil
+}
+
 type Booking struct {
-	ID                   int           `json:"id"`
-	GuestID              int           `json:"guest_id"`
-	CastID               int           `json:"cast_id"`
-	BookingDate          time.Time     `json:"booking_date"`
-	StartTime            string        `json:"start_time"`
-	DurationHours        int           `json:"duration_hours"`
-	Location             string        `json:"location"`
-	Amount               float64       `json:"amount"`
-	Status               BookingStatus `json:"status"`
-	StripePaymentIntentID *string      `json:"stripe_payment_intent_id,omitempty"`
-	DeclinedAt           *time.Time    `json:"declined_at,omitempty"`
-	AcceptedAt           *time.Time    `json:"accepted_at,omitempty"`
-	CompletedAt          *time.Time    `json:"completed_at,omitempty"`
-	CancelledAt          *time.Time    `json:"cancelled_at,omitempty"`
-	CreatedAt            time.Time     `json:"created_at"`
-	UpdatedAt            time.Time     `json:"updated_at"`
-	Guest                *User         `json:"guest,omitempty"`
-	Cast                 *User         `json:"cast,omitempty"`
+	ID                    int           `json:"id"`
+	GuestID               int           `json:"guest_id"`
+	CastID                int           `json:"cast_id"`
+	StartsAt              time.Time     `json:"starts_at"`
+	EndsAt                time.Time     `json:"ends_at"`
+	DurationHours         int           `json:"duration_hours"`
+	Location              string        `json:"location"`
+	Amount                Money         `json:"amount"`
+	Status                BookingStatus `json:"status"`
+	StripePaymentIntentID *string       `json:"stripe_payment_intent_id,omitempty"`
+	PaymentStatus         PaymentStatus `json:"payment_status"`
+	PaymentError          *string       `json:"payment_error,omitempty"`
+	CapturedAt            *time.Time    `json:"captured_at,omitempty"`
+	CancellationFee       *Money        `json:"cancellation_fee,omitempty"`
+	RefundedAmount        Money         `json:"refunded_amount"`
+	DeclinedAt            *time.Time    `json:"declined_at,omitempty"`
+	AcceptedAt            *time.Time    `json:"accepted_at,omitempty"`
+	CompletedAt           *time.Time    `json:"completed_at,omitempty"`
+	CancelledAt           *time.Time    `json:"cancelled_at,omitempty"`
+	ExpiredAt             *time.Time    `json:"expired_at,omitempty"`
+	HoldExpiresAt         *time.Time    `json:"hold_expires_at,omitempty"`
+	ConfirmedAt           *time.Time    `json:"confirmed_at,omitempty"`
+	CreatedAt             time.Time     `json:"created_at"`
+	UpdatedAt             time.Time     `json:"updated_at"`
+	Guest                 *User         `json:"guest,omitempty"`
+	Cast                  *User         `json:"cast,omitempty"`
+}
+
+// BookingEvent is one entry in a booking's history.
+type BookingEvent struct {
+	ID         int                    `json:"id"`
+	BookingID  int                    `json:"booking_id"`
+	EventType  string                 `json:"event_type"`
+	FromStatus *BookingStatus         `json:"from_status,omitempty"`
+	ToStatus   *BookingStatus         `json:"to_status,omitempty"`
+	ActorID    *int                   `json:"actor_id,omitempty"`
+	ActorRole  string                 `json:"actor_role"`
+	ActorName  *string                `json:"actor_name,omitempty"`
+	Reason     *string                `json:"reason,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// BookingPayment is a PaymentIntent charged on top of a booking's main one.
+type BookingPayment struct {
+	ID                    int           `json:"id"`
+	BookingID             int           `json:"booking_id"`
+	Purpose               string        `json:"purpose"`
+	StripePaymentIntentID string        `json:"stripe_payment_intent_id"`
+	Amount                Money         `json:"amount"`
+	CaptureMethod         string        `json:"capture_method"`
+	Status                PaymentStatus `json:"status"`
+	RefundedAmount        Money         `json:"refunded_amount"`
+	// CastPercent is the share of a tip that goes to the cast.
+	CastPercent *int      `json:"cast_percent,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ClientSecret is fetched from Stripe for payments the guest still has
+	// to confirm; it is not stored.
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+type RescheduleStatus string
+
+const (
+	RescheduleStatusPending   RescheduleStatus = "pending"
+	RescheduleStatusAccepted  RescheduleStatus = "accepted"
+	RescheduleStatusRejected  RescheduleStatus = "rejected"
+	RescheduleStatusWithdrawn RescheduleStatus = "withdrawn"
+)
+
+// RescheduleRequest is a proposal by one side of a booking to move or
+// resize it.
+type RescheduleRequest struct {
+	ID               int              `json:"id"`
+	BookingID        int              `json:"booking_id"`
+	RequestedBy      int              `json:"requested_by"`
+	Status           RescheduleStatus `json:"status"`
+	OldStartsAt      time.Time        `json:"old_starts_at"`
+	OldDurationHours int              `json:"old_duration_hours"`
+	NewStartsAt      time.Time        `json:"new_starts_at"`
+	NewDurationHours int              `json:"new_duration_hours"`
+	Reason           *string          `json:"reason,omitempty"`
+	RespondedBy      *int             `json:"responded_by,omitempty"`
+	RespondedAt      *time.Time       `json:"responded_at,omitempty"`
+	CreatedAt        time.Time        `json:"created_at"`
 }
 
+// RescheduleCreate proposes new values; omitted fields keep their current
+// value.
+type RescheduleCreate struct {
+	StartsAt      *time.Time `json:"starts_at"`
+	DurationHours *int       `json:"duration_hours" binding:"omitempty,min=1"`
+	Reason        string     `json:"reason" binding:"max=500"`
+}
+
+type RescheduleResponse struct {
+	Accepted bool `json:"accepted"`
+}
+
+type ExtensionStatus string
+
+const (
+	ExtensionStatusPending   ExtensionStatus = "pending"
+	ExtensionStatusApproved  ExtensionStatus = "approved"
+	ExtensionStatusRejected  ExtensionStatus = "rejected"
+	ExtensionStatusCancelled ExtensionStatus = "cancelled"
+)
+
+// BookingExtension is a guest's request to add hours to an accepted booking.
+type BookingExtension struct {
+	ID               int             `json:"id"`
+	BookingID        int             `json:"booking_id"`
+	RequestedBy      int             `json:"requested_by"`
+	Hours            int             `json:"hours"`
+	HourlyRate       Money           `json:"hourly_rate"`
+	Amount           Money           `json:"amount"`
+	BookingPaymentID *int            `json:"booking_payment_id,omitempty"`
+	Status           ExtensionStatus `json:"status"`
+	RespondedAt      *time.Time      `json:"responded_at,omitempty"`
+	CreatedAt        time.Time       `json:"created_at"`
+}
+
+type BookingExtensionCreate struct {
+	Hours int `json:"hours" binding:"required,min=1,max=12"`
+}
+
+// BookingCreate takes the start as an RFC 3339 timestamp, e.g.
+// "2024-05-01T23:00:00+09:00".
 type BookingCreate struct {
 	CastID        int       `json:"cast_id" binding:"required"`
-	BookingDate   time.Time `json:"booking_date" binding:"required"`
-	StartTime     string    `json:"start_time" binding:"required"`
+	StartsAt      time.Time `json:"starts_at" binding:"required"`
 	DurationHours int       `json:"duration_hours" binding:"required,min=1"`
 	Location      string    `json:"location" binding:"required"`
+	// PromoCode, if given, is taken off the price, and then Points.
+	PromoCode string `json:"promo_code" binding:"max=50"`
+	Points    int    `json:"points" binding:"min=0"`
+}
+
+// EndsAt is when the requested booking would end.
+func (b BookingCreate) EndsAt() time.Time {
+	return b.StartsAt.Add(time.Duration(b.DurationHours) * time.Hour)
+}
+
+type BookingCancel struct {
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+type CastBookingCancel struct {
+	Reason string `json:"reason" binding:"required,max=500"`
 }
 
 type BookingResponse struct {
@@ -88,4 +239,4 @@ type ReviewCreate struct {
 	BookingID int     `json:"booking_id" binding:"required"`
 	Rating    int     `json:"rating" binding:"required,min=1,max=5"`
 	Comment   *string `json:"comment" binding:"omitempty,max=500"`
-}
\ No newline at end of file
+}
@@ -22,16 +22,16 @@ func (cr *CastRank) Scan(value interface{}) error {
 	return nil
 }
 
-func (cr CastRank) GetHourlyRate() float64 {
+func (cr CastRank) GetHourlyRate() Money {
 	switch cr {
 	case CastRankStandard:
-		return 60.0
+		return JPY(6000)
 	case CastRankPremium:
-		return 100.0
+		return JPY(10000)
 	case CastRankVIP:
-		return 150.0
+		return JPY(15000)
 	default:
-		return 60.0
+		return JPY(6000)
 	}
 }
 
@@ -56,11 +56,12 @@ type CastProfile struct {
 	ID             int            `json:"id"`
 	UserID         int            `json:"user_id"`
 	Bio            *string        `json:"bio,omitempty"`
-	HourlyRate     float64        `json:"hourly_rate"`
+	HourlyRate     Money          `json:"hourly_rate"`
 	Rank           CastRank       `json:"rank"`
 	ServiceAreas   []string       `json:"service_areas"`
 	ApprovalStatus ApprovalStatus `json:"approval_status"`
 	ApprovedAt     *time.Time     `json:"approved_at,omitempty"`
+	SuspendedUntil *time.Time     `json:"suspended_until,omitempty"`
 	CreatedAt      time.Time      `json:"created_at"`
 	UpdatedAt      time.Time      `json:"updated_at"`
 	GalleryImages  []GalleryImage `json:"gallery_images,omitempty"`
@@ -91,8 +92,8 @@ type CastSearchParams struct {
 	Date      time.Time `form:"date" time_format:"2006-01-02"`
 	StartTime string    `form:"start_time"`
 	EndTime   string    `form:"end_time"`
-	MinPrice  float64   `form:"min_price"`
-	MaxPrice  float64   `form:"max_price"`
+	MinPrice  int64     `form:"min_price"` // in minor units of the cast's currency
+	MaxPrice  int64     `form:"max_price"`
 	Rank      CastRank  `form:"rank"`
 	Page      int       `form:"page,default=1"`
 	Limit     int       `form:"limit,default=20"`
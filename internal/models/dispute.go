@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// DisputeStatus is Stripe's status for a dispute, such as "needs_response"
+// or "won". Statuses Stripe adds later are stored as they come.
+type DisputeStatus string
+
+const (
+	DisputeStatusWarningNeedsResponse DisputeStatus = "warning_needs_response"
+	DisputeStatusWarningUnderReview   DisputeStatus = "warning_under_review"
+	DisputeStatusWarningClosed        DisputeStatus = "warning_closed"
+	DisputeStatusNeedsResponse        DisputeStatus = "needs_response"
+	DisputeStatusUnderReview          DisputeStatus = "under_review"
+	DisputeStatusWon                  DisputeStatus = "won"
+	DisputeStatusLost                 DisputeStatus = "lost"
+)
+
+// Closed reports whether the dispute has been decided.
+func (s DisputeStatus) Closed() bool {
+	return s == DisputeStatusWon || s == DisputeStatusLost || s == DisputeStatusWarningClosed
+}
+
+// Dispute is a chargeback the guest's bank opened against one of a
+// booking's payments.
+type Dispute struct {
+	ID                    int           `json:"id"`
+	StripeDisputeID       string        `json:"stripe_dispute_id"`
+	BookingID             int           `json:"booking_id"`
+	StripePaymentIntentID string        `json:"stripe_payment_intent_id"`
+	Amount                Money         `json:"amount"`
+	Reason                string        `json:"reason"`
+	Status                DisputeStatus `json:"status"`
+	EvidenceDueBy         *time.Time    `json:"evidence_due_by,omitempty"`
+	// Evidence is the admin's written case, sent to Stripe when submitted.
+	Evidence            string     `json:"evidence"`
+	EvidenceSubmittedAt *time.Time `json:"evidence_submitted_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	ClosedAt            *time.Time `json:"closed_at,omitempty"`
+}
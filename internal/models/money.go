@@ -0,0 +1,185 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Currency is an ISO 4217 code.
+type Currency string
+
+const (
+	CurrencyJPY Currency = "JPY"
+	CurrencyUSD Currency = "USD"
+)
+
+// DefaultCurrency is what casts are priced in.
+const DefaultCurrency = CurrencyJPY
+
+// zeroDecimal lists currencies without a minor unit, where one unit of
+// Money.Amount is a whole yen, won and so on.
+var zeroDecimal = map[Currency]bool{
+	"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true,
+	"KMF": true, "KRW": true, "MGA": true, "PYG": true, "RWF": true,
+	"UGX": true, "VND": true, "VUV": true, "XAF": true, "XOF": true, "XPF": true,
+}
+
+var symbols = map[Currency]string{
+	CurrencyJPY: "¥",
+	CurrencyUSD: "$",
+}
+
+// Decimals is the number of digits after the decimal point in the
+// currency's major unit: 0 for JPY, 2 for USD.
+func (c Currency) Decimals() int {
+	if zeroDecimal[c] {
+		return 0
+	}
+	return 2
+}
+
+// Money is an amount in a currency's minor units, cents for USD and whole yen
+// for JPY. Arithmetic between amounts in different currencies panics; every
+// amount on a booking shares the booking's currency.
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+func NewMoney(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// JPY returns an amount of yen.
+func JPY(yen int64) Money {
+	return Money{Amount: yen, Currency: CurrencyJPY}
+}
+
+func (m Money) mustMatch(o Money) {
+	if m.Currency != o.Currency {
+		panic(fmt.Sprintf("money: mixing %s and %s", m.Currency, o.Currency))
+	}
+}
+
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return Money{Amount: m.Amount - o.Amount, Currency: m.Currency}
+}
+
+// Mul multiplies the amount by n, e.g. an hourly rate by a number of hours.
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Prorate returns num/den of the amount, rounded half away from zero to the
+// nearest minor unit.
+func (m Money) Prorate(num, den int64) Money {
+	return Money{Amount: divRound(m.Amount*num, den), Currency: m.Currency}
+}
+
+// ProrateDown returns num/den of the amount, dropping any fraction of a minor
+// unit, as Japanese withholding tax is calculated.
+func (m Money) ProrateDown(num, den int64) Money {
+	return Money{Amount: m.Amount * num / den, Currency: m.Currency}
+}
+
+// Percent returns pct percent of the amount, rounded like Prorate.
+func (m Money) Percent(pct int) Money {
+	return m.Prorate(int64(pct), 100)
+}
+
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Zero returns no money in m's currency.
+func (m Money) Zero() Money {
+	return Money{Currency: m.Currency}
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o.
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	}
+	return 0
+}
+
+// Min returns the smaller of m and o.
+func (m Money) Min(o Money) Money {
+	if m.Cmp(o) <= 0 {
+		return m
+	}
+	return o
+}
+
+// Major formats the amount in major units without a symbol, e.g. "12000" for
+// ¥12,000 or "120.50" for $120.50.
+func (m Money) Major() string {
+	d := m.Currency.Decimals()
+	if d == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+	abs := m.Amount
+	sign := ""
+	if abs < 0 {
+		abs, sign = -abs, "-"
+	}
+	unit := int64(1)
+	for i := 0; i < d; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, abs/unit, d, abs%unit)
+}
+
+// String formats the amount for display, e.g. "¥12,000" or "$120.50".
+// Currencies without a known symbol are prefixed with their code.
+func (m Money) String() string {
+	major := m.Major()
+	sign := ""
+	if strings.HasPrefix(major, "-") {
+		sign, major = "-", major[1:]
+	}
+	whole, frac := major, ""
+	if i := strings.IndexByte(major, '.'); i >= 0 {
+		whole, frac = major[:i], major[i:]
+	}
+
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+
+	symbol, ok := symbols[m.Currency]
+	if !ok {
+		symbol = string(m.Currency) + " "
+	}
+	return sign + symbol + b.String() + frac
+}
+
+func divRound(n, d int64) int64 {
+	if d < 0 {
+		n, d = -n, -d
+	}
+	if n < 0 {
+		return -((-n + d/2) / d)
+	}
+	return (n + d/2) / d
+}
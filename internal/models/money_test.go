@@ -0,0 +1,103 @@
+package models
+
+import "testing"
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{JPY(0), "¥0"},
+		{JPY(600), "¥600"},
+		{JPY(12000), "¥12,000"},
+		{JPY(1234567), "¥1,234,567"},
+		{JPY(-4500), "-¥4,500"},
+		{NewMoney(12050, CurrencyUSD), "$120.50"},
+		{NewMoney(5, CurrencyUSD), "$0.05"},
+		{NewMoney(-123456, CurrencyUSD), "-$1,234.56"},
+		{NewMoney(1000, "EUR"), "EUR 10.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyMajor(t *testing.T) {
+	if got := JPY(12000).Major(); got != "12000" {
+		t.Errorf("JPY Major = %q", got)
+	}
+	if got := NewMoney(12000, CurrencyUSD).Major(); got != "120.00" {
+		t.Errorf("USD Major = %q", got)
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	rate := JPY(6000)
+	amount := rate.Mul(3)
+	if amount != JPY(18000) {
+		t.Fatalf("Mul = %v", amount)
+	}
+	if got := amount.Sub(JPY(5000)).Add(JPY(1)); got != JPY(13001) {
+		t.Errorf("Sub/Add = %v", got)
+	}
+	if got := amount.Neg(); !got.IsNegative() || got.Amount != -18000 {
+		t.Errorf("Neg = %v", got)
+	}
+	if got := JPY(5).Min(JPY(3)); got != JPY(3) {
+		t.Errorf("Min = %v", got)
+	}
+	if JPY(1).Cmp(JPY(2)) != -1 || JPY(2).Cmp(JPY(2)) != 0 || JPY(3).Cmp(JPY(2)) != 1 {
+		t.Error("Cmp ordering is wrong")
+	}
+}
+
+func TestMoneyRounding(t *testing.T) {
+	tests := []struct {
+		m        Money
+		num, den int64
+		want     int64
+	}{
+		{JPY(18000), 2, 3, 12000},
+		{JPY(10000), 1, 3, 3333},
+		{JPY(20000), 1, 3, 6667},
+		{JPY(5), 1, 2, 3},
+		{JPY(-5), 1, 2, -3},
+		{NewMoney(999, CurrencyUSD), 50, 100, 500},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Prorate(tt.num, tt.den); got.Amount != tt.want || got.Currency != tt.m.Currency {
+			t.Errorf("%v.Prorate(%d, %d) = %v, want %d", tt.m, tt.num, tt.den, got, tt.want)
+		}
+	}
+
+	if got := JPY(12345).Percent(50); got != JPY(6173) {
+		t.Errorf("Percent = %v", got)
+	}
+	// 10.21% of ¥14,000 is ¥1,429.4; the fraction is dropped, never rounded up
+	if got := JPY(14000).ProrateDown(1021, 10000); got != JPY(1429) {
+		t.Errorf("ProrateDown = %v, want ¥1,429", got)
+	}
+	if got := JPY(9999).ProrateDown(1021, 10000); got != JPY(1020) {
+		t.Errorf("ProrateDown = %v, want ¥1,020", got)
+	}
+}
+
+func TestMoneyMixedCurrenciesPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding JPY to USD did not panic")
+		}
+	}()
+	JPY(100).Add(NewMoney(100, CurrencyUSD))
+}
+
+func TestCurrencyDecimals(t *testing.T) {
+	if CurrencyJPY.Decimals() != 0 || Currency("KRW").Decimals() != 0 {
+		t.Error("zero-decimal currency reported minor units")
+	}
+	if CurrencyUSD.Decimals() != 2 {
+		t.Error("USD should have two decimals")
+	}
+}
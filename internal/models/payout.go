@@ -0,0 +1,50 @@
+package models
+
+import (
+	"database/sql/driver"
+	"time"
+)
+
+type PayoutStatus string
+
+const (
+	PayoutStatusPending PayoutStatus = "pending"
+	PayoutStatusPaid    PayoutStatus = "paid"
+	PayoutStatusFailed  PayoutStatus = "failed"
+)
+
+func (ps PayoutStatus) Value() (driver.Value, error) {
+	return string(ps), nil
+}
+
+func (ps *PayoutStatus) Scan(value interface{}) error {
+	*ps = PayoutStatus(value.(string))
+	return nil
+}
+
+// Payout is a transfer of what a cast is owed to their Stripe connected
+// account.
+type Payout struct {
+	ID               int          `json:"id"`
+	CastID           int          `json:"cast_id"`
+	Amount           Money        `json:"amount"`
+	Status           PayoutStatus `json:"status"`
+	StripeAccountID  string       `json:"-"`
+	StripeTransferID *string      `json:"stripe_transfer_id,omitempty"`
+	FailureReason    *string      `json:"failure_reason,omitempty"`
+	CreatedAt        time.Time    `json:"created_at"`
+	PaidAt           *time.Time   `json:"paid_at,omitempty"`
+}
+
+// PayoutAccountStatus is how far a cast is through setting up payouts.
+type PayoutAccountStatus string
+
+const (
+	// PayoutAccountNotConnected means the cast hasn't started onboarding.
+	PayoutAccountNotConnected PayoutAccountStatus = "not_connected"
+	// PayoutAccountOnboarding means onboarding was started but Stripe can't
+	// pay the cast yet.
+	PayoutAccountOnboarding PayoutAccountStatus = "onboarding"
+	// PayoutAccountEnabled means the cast can be paid.
+	PayoutAccountEnabled PayoutAccountStatus = "enabled"
+)
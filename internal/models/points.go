@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// PointsKind is what changed a guest's points balance.
+type PointsKind string
+
+const (
+	PointsEarned   PointsKind = "earned"
+	PointsRedeemed PointsKind = "redeemed"
+	// PointsRestored gives back points spent on a booking that fell through.
+	PointsRestored PointsKind = "restored"
+	PointsExpired  PointsKind = "expired"
+	// PointsReferral is a reward for referring, or being referred by,
+	// another user.
+	PointsReferral PointsKind = "referral"
+)
+
+// PointsEntry is one change to a guest's points balance.
+type PointsEntry struct {
+	ID        int        `json:"id"`
+	BookingID *int       `json:"booking_id,omitempty"`
+	Kind      PointsKind `json:"kind"`
+	Points    int        `json:"points"`
+	// ExpiresAt is when what is left of earned or restored points lapses.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
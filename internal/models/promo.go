@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// DiscountType is how a promo code takes money off a booking.
+type DiscountType string
+
+const (
+	// DiscountPercent takes DiscountValue percent off.
+	DiscountPercent DiscountType = "percent"
+	// DiscountFixed takes DiscountValue, in minor units of Currency, off.
+	DiscountFixed DiscountType = "fixed"
+)
+
+// PromoCode is a discount guests can enter when booking. The platform pays
+// for the discount; the cast earns as if the full price had been paid.
+type PromoCode struct {
+	ID            int          `json:"id"`
+	Code          string       `json:"code"`
+	Description   string       `json:"description"`
+	DiscountType  DiscountType `json:"discount_type"`
+	DiscountValue int64        `json:"discount_value"`
+	// Currency is that of a fixed discount, which only applies to bookings
+	// priced in it.
+	Currency *Currency `json:"currency,omitempty"`
+	// StartsAt and EndsAt bound when the code can be used, if set.
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	// MaxUses caps the bookings made with the code, and MaxUsesPerUser those
+	// made by each guest. Nil means no limit.
+	MaxUses          *int `json:"max_uses,omitempty"`
+	MaxUsesPerUser   *int `json:"max_uses_per_user,omitempty"`
+	FirstBookingOnly bool `json:"first_booking_only"`
+	// CastRanks and ServiceAreas, if not empty, limit the code to casts of
+	// those ranks and casts serving one of those areas.
+	CastRanks    []CastRank `json:"cast_ranks"`
+	ServiceAreas []string   `json:"service_areas"`
+	Active       bool       `json:"active"`
+	// Uses counts the bookings made with the code that weren't declined or
+	// left to expire.
+	Uses      int       `json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PromoCodeInput creates or replaces a promo code. Amounts are in minor
+// units.
+type PromoCodeInput struct {
+	Code             string       `json:"code" binding:"required,max=50"`
+	Description      string       `json:"description" binding:"max=500"`
+	DiscountType     DiscountType `json:"discount_type" binding:"required,oneof=percent fixed"`
+	DiscountValue    int64        `json:"discount_value" binding:"required,min=1"`
+	Currency         *Currency    `json:"currency"`
+	StartsAt         *time.Time   `json:"starts_at"`
+	EndsAt           *time.Time   `json:"ends_at"`
+	MaxUses          *int         `json:"max_uses" binding:"omitempty,min=1"`
+	MaxUsesPerUser   *int         `json:"max_uses_per_user" binding:"omitempty,min=1"`
+	FirstBookingOnly bool         `json:"first_booking_only"`
+	CastRanks        []CastRank   `json:"cast_ranks" binding:"dive,oneof=standard premium vip"`
+	ServiceAreas     []string     `json:"service_areas"`
+	Active           *bool        `json:"active"`
+}
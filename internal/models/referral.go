@@ -0,0 +1,79 @@
+package models
+
+import "time"
+
+// ReferralStatus is whether a referral's rewards have been granted.
+type ReferralStatus string
+
+const (
+	// ReferralPending waits for the referee to qualify: a guest by completing
+	// their first booking, a cast by being approved.
+	ReferralPending  ReferralStatus = "pending"
+	ReferralRewarded ReferralStatus = "rewarded"
+)
+
+// ReferralRewardKind is how a side of a referral was rewarded.
+type ReferralRewardKind string
+
+const (
+	// ReferralRewardPoints are points for a guest.
+	ReferralRewardPoints ReferralRewardKind = "points"
+	// ReferralRewardBonus is money for a cast, paid out with their earnings.
+	ReferralRewardBonus ReferralRewardKind = "bonus"
+)
+
+// ReferralParty is one side of a referral.
+type ReferralParty struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	UserType UserType `json:"user_type"`
+}
+
+// ReferralSignals are signs the referrer and referee are the same person.
+type ReferralSignals struct {
+	SamePhone  bool `json:"same_phone"`
+	SameDevice bool `json:"same_device"`
+	SameIP     bool `json:"same_ip"`
+	// DeviceAccounts counts the other users who signed up from the
+	// referee's device.
+	DeviceAccounts int `json:"device_accounts"`
+}
+
+// Suspicious reports whether any signal was seen.
+func (s ReferralSignals) Suspicious() bool {
+	return s.SamePhone || s.SameDevice || s.SameIP || s.DeviceAccounts > 0
+}
+
+// ReferralReward is what one side of a referral got: Amount points, or a
+// bonus of Amount in Currency's minor units.
+type ReferralReward struct {
+	UserID   int                `json:"user_id"`
+	Kind     ReferralRewardKind `json:"kind"`
+	Amount   int64              `json:"amount"`
+	Currency *Currency          `json:"currency,omitempty"`
+}
+
+// Referral is a user who signed up with another user's code.
+type Referral struct {
+	ID       int            `json:"id"`
+	Referrer ReferralParty  `json:"referrer"`
+	Referee  ReferralParty  `json:"referee"`
+	Status   ReferralStatus `json:"status"`
+	// Chain is the user IDs from the first referrer down to the referee.
+	Chain      []int            `json:"chain"`
+	Signals    ReferralSignals  `json:"signals"`
+	Rewards    []ReferralReward `json:"rewards"`
+	RewardedAt *time.Time       `json:"rewarded_at,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// ReferralTotals sum up the whole program.
+type ReferralTotals struct {
+	Referrals int `json:"referrals"`
+	Pending   int `json:"pending"`
+	Rewarded  int `json:"rewarded"`
+	// Points is what guests were given, and Bonuses what casts were.
+	Points  int64   `json:"points"`
+	Bonuses []Money `json:"bonuses"`
+}
@@ -42,6 +42,11 @@ type UserRegistration struct {
 	Name      string    `json:"name" binding:"required"`
 	Phone     *string   `json:"phone"`
 	BirthDate *time.Time `json:"birth_date" binding:"required"`
+	// ReferrerCode is the referral code of the user who invited them, if any
+	ReferrerCode string `json:"referrer_code" binding:"max=20"`
+	// DeviceID identifies the app install signing up, to spot users
+	// referring themselves
+	DeviceID string `json:"device_id" binding:"max=255"`
 }
 
 type UserLogin struct {
@@ -57,6 +62,7 @@ type UserProfile struct {
 	Phone        *string          `json:"phone,omitempty"`
 	BirthDate    *time.Time       `json:"birth_date,omitempty"`
 	ProfileImage *string          `json:"profile_image,omitempty"`
+	ReferralCode string           `json:"referral_code,omitempty"`
 	CastProfile  *CastProfile     `json:"cast_profile,omitempty"`
 	Rating       *float64         `json:"rating,omitempty"`
 	ReviewCount  int              `json:"review_count"`
@@ -0,0 +1,621 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// FakeSignature is the only webhook signature Fake accepts.
+const FakeSignature = "fake-signature"
+
+// Fake is an in-memory Provider that follows Stripe's PaymentIntent rules
+// closely enough for booking tests. IDs are numbered in creation order, so
+// runs are deterministic. Tests play the guest's part with Confirm and
+// Decline, and the cast's with CompleteOnboarding.
+type Fake struct {
+	// DeclineIncrements makes IncrementAuthorization fail, like a card
+	// without incremental authorization support.
+	DeclineIncrements bool
+	// AuthenticateSavedCards makes charges to saved cards wait for the guest
+	// to authenticate, as 3D Secure does, instead of succeeding at once.
+	AuthenticateSavedCards bool
+
+	mu       sync.Mutex
+	nextID   int
+	intents  map[string]*fakeIntent
+	keys     map[string]string
+	failures map[string]error
+	refunds  int
+
+	accounts     map[string]*Account
+	transfers    []Transfer
+	transferKeys map[string]int
+
+	disputes map[string]*fakeDispute
+
+	// customers maps each customer to the cards saved to it
+	customers map[string]map[string]bool
+}
+
+type fakeDispute struct {
+	Dispute
+	intentID string
+	evidence DisputeEvidence
+	// seq orders an Intent's disputes
+	seq int
+}
+
+type fakeIntent struct {
+	Intent
+	metadata      map[string]string
+	customer      string
+	save          bool
+	manualCapture bool
+	incremental   bool
+	refunded      models.Money
+	lastRefundID  string
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		intents:  map[string]*fakeIntent{},
+		keys:     map[string]string{},
+		failures: map[string]error{},
+
+		accounts:     map[string]*Account{},
+		transferKeys: map[string]int{},
+
+		disputes: map[string]*fakeDispute{},
+
+		customers: map[string]map[string]bool{},
+	}
+}
+
+// FailNext makes the next call to op ("authorize", "get", "increment",
+// "capture", "cancel", "refund", "create_account", "get_account",
+// "onboarding_link", "transfer", "update_dispute" or "create_customer") return
+// err without doing anything.
+func (f *Fake) FailNext(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = err
+}
+
+func (f *Fake) failure(op string) error {
+	err := f.failures[op]
+	delete(f.failures, op)
+	return err
+}
+
+func (f *Fake) intent(intentID string) (*fakeIntent, error) {
+	in, ok := f.intents[intentID]
+	if !ok {
+		return nil, fmt.Errorf("no such payment intent: %s", intentID)
+	}
+	return in, nil
+}
+
+func (f *Fake) Authorize(p AuthorizeParams) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("authorize"); err != nil {
+		return nil, err
+	}
+	if !p.Amount.IsPositive() || p.Amount.Currency == "" {
+		return nil, fmt.Errorf("invalid amount %v", p.Amount)
+	}
+	if id, ok := f.keys[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		in := f.intents[id].Intent
+		return &in, nil
+	}
+	if p.Customer != "" && f.customers[p.Customer] == nil {
+		return nil, fmt.Errorf("no such customer: %s", p.Customer)
+	}
+	if p.PaymentMethod != "" && !f.customers[p.Customer][p.PaymentMethod] {
+		return nil, fmt.Errorf("payment method %s is not saved to customer %q", p.PaymentMethod, p.Customer)
+	}
+
+	f.nextID++
+	id := fmt.Sprintf("pi_fake_%d", f.nextID)
+	in := &fakeIntent{
+		Intent: Intent{
+			ID:           id,
+			Amount:       p.Amount,
+			Received:     p.Amount.Zero(),
+			Status:       IntentRequiresPaymentMethod,
+			ClientSecret: id + "_secret",
+		},
+		metadata:      p.Metadata,
+		customer:      p.Customer,
+		save:          p.SavePaymentMethod,
+		manualCapture: p.ManualCapture,
+		incremental:   p.Incremental,
+		refunded:      p.Amount.Zero(),
+	}
+	f.intents[id] = in
+	if p.IdempotencyKey != "" {
+		f.keys[p.IdempotencyKey] = id
+	}
+	if p.PaymentMethod != "" {
+		in.PaymentMethod = p.PaymentMethod
+		if f.AuthenticateSavedCards {
+			in.Status = IntentRequiresAction
+		} else {
+			in.confirm()
+		}
+	}
+
+	out := in.Intent
+	return &out, nil
+}
+
+func (f *Fake) Get(intentID string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("get"); err != nil {
+		return nil, err
+	}
+	in, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	out := in.Intent
+	return &out, nil
+}
+
+func (f *Fake) IncrementAuthorization(intentID string, amount models.Money) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("increment"); err != nil {
+		return nil, err
+	}
+	in, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Status != IntentRequiresCapture {
+		return nil, fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	if !in.incremental || f.DeclineIncrements {
+		return nil, fmt.Errorf("payment intent %s does not support incremental authorization", intentID)
+	}
+	if amount.Currency != in.Amount.Currency || amount.Cmp(in.Amount) <= 0 {
+		return nil, fmt.Errorf("amount %v must exceed the authorized %v", amount, in.Amount)
+	}
+	in.Amount = amount
+
+	out := in.Intent
+	return &out, nil
+}
+
+func (f *Fake) Capture(intentID string, amount models.Money) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("capture"); err != nil {
+		return nil, err
+	}
+	in, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Status != IntentRequiresCapture {
+		return nil, fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	if amount.IsZero() {
+		amount = in.Amount
+	}
+	if amount.Currency != in.Amount.Currency || amount.Cmp(in.Amount) > 0 {
+		return nil, fmt.Errorf("amount %v exceeds the authorized %v", amount, in.Amount)
+	}
+	in.Received = amount
+	in.Status = IntentSucceeded
+
+	out := in.Intent
+	return &out, nil
+}
+
+func (f *Fake) Cancel(intentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("cancel"); err != nil {
+		return err
+	}
+	in, err := f.intent(intentID)
+	if err != nil {
+		return err
+	}
+	if in.Status == IntentSucceeded || in.Status == IntentCanceled {
+		return fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	in.Status = IntentCanceled
+	return nil
+}
+
+func (f *Fake) Refund(intentID string, amount models.Money, reason string) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("refund"); err != nil {
+		return nil, err
+	}
+	in, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Status != IntentSucceeded {
+		return nil, fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	left := in.Received.Sub(in.refunded)
+	if amount.IsZero() {
+		amount = left
+	}
+	if amount.Currency != left.Currency || !amount.IsPositive() || amount.Cmp(left) > 0 {
+		return nil, fmt.Errorf("refund of %v exceeds the %v left on %s", amount, left, intentID)
+	}
+	in.refunded = in.refunded.Add(amount)
+
+	f.refunds++
+	r := Refund{ID: fmt.Sprintf("re_fake_%d", f.refunds), Amount: amount}
+	in.lastRefundID = r.ID
+	return &r, nil
+}
+
+func (f *Fake) CreateCustomer(p CustomerParams) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("create_customer"); err != nil {
+		return "", err
+	}
+	if id, ok := f.keys[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		return id, nil
+	}
+	f.nextID++
+	id := fmt.Sprintf("cus_fake_%d", f.nextID)
+	f.customers[id] = map[string]bool{}
+	if p.IdempotencyKey != "" {
+		f.keys[p.IdempotencyKey] = id
+	}
+	return id, nil
+}
+
+func (f *Fake) account(accountID string) (*Account, error) {
+	a, ok := f.accounts[accountID]
+	if !ok {
+		return nil, fmt.Errorf("no such account: %s", accountID)
+	}
+	return a, nil
+}
+
+func (f *Fake) CreateAccount(p AccountParams) (*Account, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("create_account"); err != nil {
+		return nil, err
+	}
+	f.nextID++
+	a := &Account{ID: fmt.Sprintf("acct_fake_%d", f.nextID)}
+	f.accounts[a.ID] = a
+
+	out := *a
+	return &out, nil
+}
+
+func (f *Fake) GetAccount(accountID string) (*Account, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("get_account"); err != nil {
+		return nil, err
+	}
+	a, err := f.account(accountID)
+	if err != nil {
+		return nil, err
+	}
+	out := *a
+	return &out, nil
+}
+
+func (f *Fake) OnboardingLink(accountID, refreshURL, returnURL string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("onboarding_link"); err != nil {
+		return "", err
+	}
+	if _, err := f.account(accountID); err != nil {
+		return "", err
+	}
+	if refreshURL == "" || returnURL == "" {
+		return "", fmt.Errorf("refresh and return URLs are required")
+	}
+	return "https://connect.stripe.test/setup/" + accountID, nil
+}
+
+func (f *Fake) Transfer(p TransferParams) (*Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("transfer"); err != nil {
+		return nil, err
+	}
+	if i, ok := f.transferKeys[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		t := f.transfers[i]
+		return &t, nil
+	}
+	a, err := f.account(p.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTransferRejected, err)
+	}
+	if !a.PayoutsEnabled {
+		return nil, fmt.Errorf("%w: account %s has not finished onboarding", ErrTransferRejected, a.ID)
+	}
+	if !p.Amount.IsPositive() || p.Amount.Currency == "" {
+		return nil, fmt.Errorf("%w: invalid amount %v", ErrTransferRejected, p.Amount)
+	}
+
+	t := Transfer{ID: fmt.Sprintf("tr_fake_%d", len(f.transfers)+1), Amount: p.Amount, Destination: a.ID}
+	f.transfers = append(f.transfers, t)
+	if p.IdempotencyKey != "" {
+		f.transferKeys[p.IdempotencyKey] = len(f.transfers) - 1
+	}
+	return &t, nil
+}
+
+func (f *Fake) UpdateDispute(disputeID string, evidence DisputeEvidence) (*Dispute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.failure("update_dispute"); err != nil {
+		return nil, err
+	}
+	d, ok := f.disputes[disputeID]
+	if !ok {
+		return nil, fmt.Errorf("no such dispute: %s", disputeID)
+	}
+	if d.Status != string(models.DisputeStatusNeedsResponse) {
+		return nil, fmt.Errorf("dispute %s is %s", disputeID, d.Status)
+	}
+	d.evidence = evidence
+	if evidence.Submit {
+		d.Status = string(models.DisputeStatusUnderReview)
+	}
+	out := d.Dispute
+	return &out, nil
+}
+
+func (f *Fake) ParseWebhook(payload []byte, signature string) (*Event, error) {
+	if signature != FakeSignature {
+		return nil, ErrInvalidSignature
+	}
+	return f.DecodeEvent(payload)
+}
+
+func (f *Fake) DecodeEvent(payload []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, fmt.Errorf("error parsing event: %w", err)
+	}
+	return &e, nil
+}
+
+// Confirm plays the guest confirming the Intent's card, or authenticating
+// a saved one: a manual-capture Intent becomes requires_capture and any
+// other is charged straight away. A card the Intent was told to save is
+// saved to its customer.
+func (f *Fake) Confirm(intentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, err := f.intent(intentID)
+	if err != nil {
+		return err
+	}
+	if in.Status != IntentRequiresPaymentMethod && in.Status != IntentRequiresAction {
+		return fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	if in.save && in.customer != "" && in.PaymentMethod == "" {
+		f.nextID++
+		in.PaymentMethod = fmt.Sprintf("pm_fake_%d", f.nextID)
+		f.customers[in.customer][in.PaymentMethod] = true
+	}
+	in.confirm()
+	return nil
+}
+
+func (in *fakeIntent) confirm() {
+	in.LastError = ""
+	if in.manualCapture {
+		in.Status = IntentRequiresCapture
+	} else {
+		in.Status = IntentSucceeded
+		in.Received = in.Amount
+	}
+}
+
+// Decline plays the guest's card being declined, or failing authentication,
+// with message. The Intent stays open for another attempt, as on Stripe.
+func (f *Fake) Decline(intentID, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, err := f.intent(intentID)
+	if err != nil {
+		return err
+	}
+	if in.Status != IntentRequiresPaymentMethod && in.Status != IntentRequiresAction {
+		return fmt.Errorf("payment intent %s is %s", intentID, in.Status)
+	}
+	in.Status = IntentRequiresPaymentMethod
+	in.LastError = message
+	return nil
+}
+
+// CompleteOnboarding plays the cast finishing Connect onboarding and Stripe
+// verifying them, so the account can be paid.
+func (f *Fake) CompleteOnboarding(accountID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a, err := f.account(accountID)
+	if err != nil {
+		return err
+	}
+	a.DetailsSubmitted = true
+	a.PayoutsEnabled = true
+	return nil
+}
+
+// Transfers returns the transfers made to the account, oldest first.
+func (f *Fake) Transfers(accountID string) []Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []Transfer
+	for _, t := range f.transfers {
+		if t.Destination == accountID {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// ResolveDispute plays the guest's bank deciding the dispute.
+func (f *Fake) ResolveDispute(disputeID string, won bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.disputes[disputeID]
+	if !ok {
+		return fmt.Errorf("no such dispute: %s", disputeID)
+	}
+	d.Status = string(models.DisputeStatusLost)
+	if won {
+		d.Status = string(models.DisputeStatusWon)
+	}
+	return nil
+}
+
+// Evidence returns the evidence last sent for the dispute.
+func (f *Fake) Evidence(disputeID string) DisputeEvidence {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.disputes[disputeID]; ok {
+		return d.evidence
+	}
+	return DisputeEvidence{}
+}
+
+// Captured returns how much has been captured from the Intent.
+func (f *Fake) Captured(intentID string) models.Money {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if in, ok := f.intents[intentID]; ok {
+		return in.Received
+	}
+	return models.Money{}
+}
+
+// Refunded returns how much has been refunded from the Intent.
+func (f *Fake) Refunded(intentID string) models.Money {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if in, ok := f.intents[intentID]; ok {
+		return in.refunded
+	}
+	return models.Money{}
+}
+
+// Metadata returns the metadata the Intent was created with.
+func (f *Fake) Metadata(intentID string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if in, ok := f.intents[intentID]; ok {
+		return in.metadata
+	}
+	return nil
+}
+
+// Event builds the webhook payload Stripe would send for eventType about the
+// Intent in its current state, to pass to ParseWebhook with FakeSignature.
+func (f *Fake) Event(eventType, intentID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	f.nextID++
+	e := Event{
+		ID:             fmt.Sprintf("evt_fake_%d", f.nextID),
+		Type:           eventType,
+		IntentID:       intentID,
+		AmountRefunded: in.refunded,
+		RefundID:       in.lastRefundID,
+	}
+	switch eventType {
+	case EventIntentSucceeded, EventIntentPaymentFailed, EventIntentCanceled, EventIntentCapturableUpdated:
+		out := in.Intent
+		e.Intent = &out
+	case EventDisputeCreated:
+		d := &fakeDispute{
+			Dispute: Dispute{
+				ID:     fmt.Sprintf("dp_fake_%d", f.nextID),
+				Amount: in.Received,
+				Reason: "fraudulent",
+				Status: string(models.DisputeStatusNeedsResponse),
+			},
+			intentID: intentID,
+			seq:      f.nextID,
+		}
+		f.disputes[d.ID] = d
+		out := d.Dispute
+		e.Dispute = &out
+	case EventDisputeUpdated, EventDisputeClosed:
+		// About the Intent's most recent dispute
+		var latest *fakeDispute
+		for _, d := range f.disputes {
+			if d.intentID == intentID && (latest == nil || d.seq > latest.seq) {
+				latest = d
+			}
+		}
+		if latest == nil {
+			return nil, fmt.Errorf("payment intent %s has no dispute", intentID)
+		}
+		out := latest.Dispute
+		e.Dispute = &out
+	}
+	return json.Marshal(e)
+}
+
+// AccountEvent builds the account.updated payload Stripe would send for the
+// account in its current state.
+func (f *Fake) AccountEvent(accountID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a, err := f.account(accountID)
+	if err != nil {
+		return nil, err
+	}
+	f.nextID++
+	out := *a
+	return json.Marshal(Event{
+		ID:      fmt.Sprintf("evt_fake_%d", f.nextID),
+		Type:    EventAccountUpdated,
+		Account: &out,
+	})
+}
+
+var _ Provider = (*Fake)(nil)
+var _ Provider = (*Stripe)(nil)
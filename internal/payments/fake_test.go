@@ -0,0 +1,370 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func authorize(t *testing.T, f *Fake, p AuthorizeParams) *Intent {
+	t.Helper()
+	if p.Amount.IsZero() {
+		p.Amount = models.JPY(10000)
+	}
+	in, err := f.Authorize(p)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	return in
+}
+
+func TestFakeManualCaptureLifecycle(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{ManualCapture: true})
+
+	if in.ID != "pi_fake_1" || in.ClientSecret == "" || in.Status != IntentRequiresPaymentMethod {
+		t.Fatalf("unexpected new intent: %+v", in)
+	}
+	if _, err := f.Capture(in.ID, models.Money{}); err == nil {
+		t.Fatal("captured an intent the guest never confirmed")
+	}
+
+	if err := f.Confirm(in.ID); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if got, _ := f.Get(in.ID); got.Status != IntentRequiresCapture {
+		t.Fatalf("status after Confirm = %s, want requires_capture", got.Status)
+	}
+
+	if _, err := f.Capture(in.ID, models.JPY(12000)); err == nil {
+		t.Fatal("captured more than was authorized")
+	}
+	captured, err := f.Capture(in.ID, models.JPY(6000))
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if captured.Status != IntentSucceeded || captured.Received != models.JPY(6000) || f.Captured(in.ID) != models.JPY(6000) {
+		t.Fatalf("after Capture: status %s, received %v, captured %v", captured.Status, captured.Received, f.Captured(in.ID))
+	}
+
+	if err := f.Cancel(in.ID); err == nil {
+		t.Fatal("cancelled a captured intent")
+	}
+
+	r, err := f.Refund(in.ID, models.JPY(1000), RefundRequestedByCustomer)
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if r.ID != "re_fake_1" || r.Amount != models.JPY(1000) {
+		t.Fatalf("unexpected refund: %+v", r)
+	}
+	if _, err := f.Refund(in.ID, models.JPY(5001), ""); err == nil {
+		t.Fatal("refunded more than was left")
+	}
+	if r, err := f.Refund(in.ID, models.Money{}, ""); err != nil || r.Amount != models.JPY(5000) {
+		t.Fatalf("Refund of the rest = %+v, %v, want 5000", r, err)
+	}
+	if f.Refunded(in.ID) != models.JPY(6000) {
+		t.Fatalf("Refunded = %v, want ¥6,000", f.Refunded(in.ID))
+	}
+}
+
+func TestFakeAutomaticCapture(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{Amount: models.JPY(2500)})
+
+	if err := f.Confirm(in.ID); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	got, _ := f.Get(in.ID)
+	if got.Status != IntentSucceeded || f.Captured(in.ID) != models.JPY(2500) {
+		t.Fatalf("after Confirm: status %s, captured %v", got.Status, f.Captured(in.ID))
+	}
+}
+
+func TestFakeDecline(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{ManualCapture: true})
+
+	if err := f.Decline(in.ID, "Your card was declined."); err != nil {
+		t.Fatalf("Decline: %v", err)
+	}
+	got, _ := f.Get(in.ID)
+	if got.Status != IntentRequiresPaymentMethod || got.LastError != "Your card was declined." {
+		t.Fatalf("after Decline: %+v", got)
+	}
+
+	// The guest may try another card
+	if err := f.Confirm(in.ID); err != nil {
+		t.Fatalf("Confirm after decline: %v", err)
+	}
+	if got, _ := f.Get(in.ID); got.LastError != "" {
+		t.Fatalf("LastError not cleared: %q", got.LastError)
+	}
+}
+
+func TestFakeSavedCard(t *testing.T) {
+	f := NewFake()
+	customer, err := f.CreateCustomer(CustomerParams{Email: "guest@example.com"})
+	if err != nil {
+		t.Fatalf("CreateCustomer: %v", err)
+	}
+	hold := authorize(t, f, AuthorizeParams{ManualCapture: true, Customer: customer, SavePaymentMethod: true})
+	if hold.PaymentMethod != "" {
+		t.Fatalf("card saved before the guest confirmed: %+v", hold)
+	}
+	if err := f.Confirm(hold.ID); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	got, _ := f.Get(hold.ID)
+	if got.PaymentMethod == "" {
+		t.Fatal("confirmed card was not saved")
+	}
+
+	// A later payment is charged to the saved card straight away
+	tip := authorize(t, f, AuthorizeParams{Amount: models.JPY(3000), Customer: customer, PaymentMethod: got.PaymentMethod})
+	if tip.Status != IntentSucceeded || tip.Received != models.JPY(3000) {
+		t.Fatalf("charge to saved card: %+v", tip)
+	}
+	if _, err := f.Authorize(AuthorizeParams{Amount: models.JPY(3000), PaymentMethod: got.PaymentMethod}); err == nil {
+		t.Fatal("charged a saved card without its customer")
+	}
+
+	// Unless the card asks the guest to authenticate
+	f.AuthenticateSavedCards = true
+	tip = authorize(t, f, AuthorizeParams{Amount: models.JPY(3000), Customer: customer, PaymentMethod: got.PaymentMethod})
+	if tip.Status != IntentRequiresAction || tip.ClientSecret == "" {
+		t.Fatalf("charge needing authentication: %+v", tip)
+	}
+	if err := f.Confirm(tip.ID); err != nil {
+		t.Fatalf("Confirm after authentication: %v", err)
+	}
+	if f.Captured(tip.ID) != models.JPY(3000) {
+		t.Fatalf("captured %v after authentication, want ¥3,000", f.Captured(tip.ID))
+	}
+}
+
+func TestFakeCancel(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{ManualCapture: true})
+
+	if err := f.Cancel(in.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if err := f.Cancel(in.ID); err == nil {
+		t.Fatal("cancelled an intent twice")
+	}
+	if err := f.Confirm(in.ID); err == nil {
+		t.Fatal("confirmed a cancelled intent")
+	}
+}
+
+func TestFakeIdempotencyKey(t *testing.T) {
+	f := NewFake()
+	first := authorize(t, f, AuthorizeParams{IdempotencyKey: "booking-hold-1-abc"})
+	retry := authorize(t, f, AuthorizeParams{IdempotencyKey: "booking-hold-1-abc"})
+	other := authorize(t, f, AuthorizeParams{IdempotencyKey: "booking-hold-1-def"})
+
+	if retry.ID != first.ID {
+		t.Errorf("retry created %s, want %s", retry.ID, first.ID)
+	}
+	if other.ID == first.ID {
+		t.Errorf("different key reused %s", first.ID)
+	}
+}
+
+func TestFakeIncrementAuthorization(t *testing.T) {
+	tests := []struct {
+		name        string
+		incremental bool
+		decline     bool
+		confirm     bool
+		amount      models.Money
+		wantErr     bool
+	}{
+		{"raises the hold", true, false, true, models.JPY(15000), false},
+		{"not requested", false, false, true, models.JPY(15000), true},
+		{"card declines", true, true, true, models.JPY(15000), true},
+		{"not yet authorized", true, false, false, models.JPY(15000), true},
+		{"not an increase", true, false, true, models.JPY(10000), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake()
+			f.DeclineIncrements = tt.decline
+			in := authorize(t, f, AuthorizeParams{ManualCapture: true, Incremental: tt.incremental})
+			if tt.confirm {
+				if err := f.Confirm(in.ID); err != nil {
+					t.Fatalf("Confirm: %v", err)
+				}
+			}
+
+			got, err := f.IncrementAuthorization(in.ID, tt.amount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("IncrementAuthorization succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("IncrementAuthorization: %v", err)
+			}
+			if got.Amount != tt.amount {
+				t.Fatalf("Amount = %v, want %v", got.Amount, tt.amount)
+			}
+		})
+	}
+}
+
+func TestFakeFailNext(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{ManualCapture: true})
+	f.Confirm(in.ID)
+
+	boom := errors.New("card_declined")
+	f.FailNext("capture", boom)
+	if _, err := f.Capture(in.ID, models.Money{}); !errors.Is(err, boom) {
+		t.Fatalf("Capture error = %v, want %v", err, boom)
+	}
+	if !f.Captured(in.ID).IsZero() {
+		t.Fatal("failed capture collected money")
+	}
+	if _, err := f.Capture(in.ID, models.Money{}); err != nil {
+		t.Fatalf("second Capture: %v", err)
+	}
+}
+
+func TestFakeWebhook(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{ManualCapture: true})
+	f.Confirm(in.ID)
+
+	payload, err := f.Event(EventIntentCapturableUpdated, in.ID)
+	if err != nil {
+		t.Fatalf("Event: %v", err)
+	}
+
+	if _, err := f.ParseWebhook(payload, "forged"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("ParseWebhook with a bad signature = %v, want ErrInvalidSignature", err)
+	}
+
+	e, err := f.ParseWebhook(payload, FakeSignature)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if e.Type != EventIntentCapturableUpdated || e.IntentID != in.ID ||
+		e.Intent == nil || e.Intent.Status != IntentRequiresCapture {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	f.Capture(in.ID, models.Money{})
+	f.Refund(in.ID, models.JPY(400), "")
+	payload, _ = f.Event(EventChargeRefunded, in.ID)
+	e, err = f.DecodeEvent(payload)
+	if err != nil {
+		t.Fatalf("DecodeEvent: %v", err)
+	}
+	if e.AmountRefunded != models.JPY(400) || e.RefundID != "re_fake_1" {
+		t.Fatalf("unexpected refund event: %+v", e)
+	}
+}
+
+func TestFakeConnectTransfers(t *testing.T) {
+	f := NewFake()
+	a, err := f.CreateAccount(AccountParams{Email: "cast@example.com"})
+	if err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if a.DetailsSubmitted || a.PayoutsEnabled {
+		t.Fatalf("new account already onboarded: %+v", a)
+	}
+
+	link, err := f.OnboardingLink(a.ID, "https://uso.test/refresh", "https://uso.test/return")
+	if err != nil || link == "" {
+		t.Fatalf("OnboardingLink = %q, %v", link, err)
+	}
+
+	params := TransferParams{Amount: models.JPY(7000), Destination: a.ID, IdempotencyKey: "payout-1"}
+	if _, err := f.Transfer(params); !errors.Is(err, ErrTransferRejected) {
+		t.Fatalf("Transfer before onboarding = %v, want ErrTransferRejected", err)
+	}
+
+	if err := f.CompleteOnboarding(a.ID); err != nil {
+		t.Fatalf("CompleteOnboarding: %v", err)
+	}
+	if got, _ := f.GetAccount(a.ID); !got.PayoutsEnabled {
+		t.Fatalf("account after onboarding: %+v", got)
+	}
+
+	first, err := f.Transfer(params)
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	retry, err := f.Transfer(params)
+	if err != nil || retry.ID != first.ID {
+		t.Fatalf("retried Transfer = %+v, %v, want %s", retry, err, first.ID)
+	}
+	if got := f.Transfers(a.ID); len(got) != 1 || got[0].Amount != models.JPY(7000) {
+		t.Fatalf("Transfers = %+v, want one of ¥7,000", got)
+	}
+
+	if _, err := f.Transfer(TransferParams{Amount: models.JPY(100), Destination: "acct_missing"}); !errors.Is(err, ErrTransferRejected) {
+		t.Fatalf("Transfer to unknown account = %v, want ErrTransferRejected", err)
+	}
+
+	payload, err := f.AccountEvent(a.ID)
+	if err != nil {
+		t.Fatalf("AccountEvent: %v", err)
+	}
+	e, err := f.ParseWebhook(payload, FakeSignature)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if e.Type != EventAccountUpdated || e.Account == nil || e.Account.ID != a.ID || !e.Account.PayoutsEnabled {
+		t.Fatalf("unexpected account event: %+v", e)
+	}
+}
+
+func TestFakeDispute(t *testing.T) {
+	f := NewFake()
+	in := authorize(t, f, AuthorizeParams{Amount: models.JPY(20000)})
+	if err := f.Confirm(in.ID); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+
+	payload, err := f.Event(EventDisputeCreated, in.ID)
+	if err != nil {
+		t.Fatalf("Event: %v", err)
+	}
+	e, _ := f.ParseWebhook(payload, FakeSignature)
+	if e.Dispute == nil || e.Dispute.Status != "needs_response" || e.Dispute.Amount != models.JPY(20000) {
+		t.Fatalf("unexpected dispute event: %+v", e)
+	}
+	id := e.Dispute.ID
+
+	d, err := f.UpdateDispute(id, DisputeEvidence{Text: "draft"})
+	if err != nil || d.Status != "needs_response" {
+		t.Fatalf("staging evidence = %+v, %v", d, err)
+	}
+	d, err = f.UpdateDispute(id, DisputeEvidence{Text: "messages", Submit: true})
+	if err != nil || d.Status != "under_review" {
+		t.Fatalf("submitting evidence = %+v, %v", d, err)
+	}
+	if got := f.Evidence(id); got.Text != "messages" {
+		t.Errorf("Evidence = %+v", got)
+	}
+	if _, err := f.UpdateDispute(id, DisputeEvidence{Text: "more"}); err == nil {
+		t.Error("UpdateDispute after submitting succeeded")
+	}
+
+	if err := f.ResolveDispute(id, false); err != nil {
+		t.Fatalf("ResolveDispute: %v", err)
+	}
+	payload, _ = f.Event(EventDisputeClosed, in.ID)
+	e, _ = f.ParseWebhook(payload, FakeSignature)
+	if e.Dispute == nil || e.Dispute.ID != id || e.Dispute.Status != "lost" {
+		t.Fatalf("unexpected closed event: %+v", e.Dispute)
+	}
+}
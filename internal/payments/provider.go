@@ -0,0 +1,226 @@
+// Package payments is the boundary between bookings and the card processor.
+// Handlers and jobs talk to a Provider; Stripe is the production
+// implementation and Fake stands in for it in tests.
+package payments
+
+import (
+	"errors"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+// IntentStatus mirrors Stripe's PaymentIntent statuses.
+type IntentStatus string
+
+const (
+	IntentRequiresPaymentMethod IntentStatus = "requires_payment_method"
+	IntentRequiresConfirmation  IntentStatus = "requires_confirmation"
+	IntentRequiresAction        IntentStatus = "requires_action"
+	IntentProcessing            IntentStatus = "processing"
+	IntentRequiresCapture       IntentStatus = "requires_capture"
+	IntentCanceled              IntentStatus = "canceled"
+	IntentSucceeded             IntentStatus = "succeeded"
+)
+
+// Intent is a payment the guest authorizes on the client with ClientSecret.
+type Intent struct {
+	ID     string       `json:"id"`
+	Amount models.Money `json:"amount"`
+	// Received is how much of Amount has been captured.
+	Received     models.Money `json:"received"`
+	Status       IntentStatus `json:"status"`
+	ClientSecret string       `json:"client_secret,omitempty"`
+	// LastError is why the most recent confirmation attempt failed.
+	LastError string `json:"last_error,omitempty"`
+	// PaymentMethod is the card the Intent was paid with, if it was saved
+	// to the customer for later payments.
+	PaymentMethod string `json:"payment_method,omitempty"`
+}
+
+// AuthorizeParams describes a new Intent.
+type AuthorizeParams struct {
+	Amount   models.Money
+	Metadata map[string]string
+	// ManualCapture holds the funds until Capture instead of charging as soon
+	// as the guest confirms.
+	ManualCapture bool
+	// Incremental asks the card network to allow IncrementAuthorization
+	// later, where the card supports it.
+	Incremental bool
+	// Customer is who is paying, and SavePaymentMethod keeps their card on
+	// the customer once they confirm, so later payments can reuse it.
+	Customer          string
+	SavePaymentMethod bool
+	// PaymentMethod charges a card saved to Customer straight away instead
+	// of waiting for the guest to confirm. If the card needs the guest to
+	// authenticate, or is declined, the Intent comes back for them to
+	// confirm with ClientSecret.
+	PaymentMethod string
+	// IdempotencyKey, if set, makes a repeated call return the same Intent.
+	IdempotencyKey string
+}
+
+// CustomerParams describes a new customer, the guest payments are saved to.
+type CustomerParams struct {
+	Email    string
+	Name     string
+	Metadata map[string]string
+	// IdempotencyKey, if set, makes a repeated call return the same
+	// customer.
+	IdempotencyKey string
+}
+
+// Refund reasons
+const (
+	RefundRequestedByCustomer = "requested_by_customer"
+)
+
+// Refund is money returned from a captured Intent.
+type Refund struct {
+	ID     string       `json:"id"`
+	Amount models.Money `json:"amount"`
+}
+
+// Event types handled from the webhook
+const (
+	EventIntentSucceeded         = "payment_intent.succeeded"
+	EventIntentPaymentFailed     = "payment_intent.payment_failed"
+	EventIntentCanceled          = "payment_intent.canceled"
+	EventIntentCapturableUpdated = "payment_intent.amount_capturable_updated"
+	EventChargeRefunded          = "charge.refunded"
+	EventDisputeCreated          = "charge.dispute.created"
+	EventDisputeUpdated          = "charge.dispute.updated"
+	EventDisputeClosed           = "charge.dispute.closed"
+	EventAccountUpdated          = "account.updated"
+)
+
+// Event is a webhook notification. IntentID is the payment it concerns;
+// which of the other fields are set depends on Type.
+type Event struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	IntentID string `json:"intent_id,omitempty"`
+
+	// Intent is the payment's state for payment_intent.* events.
+	Intent *Intent `json:"intent,omitempty"`
+
+	// AmountRefunded is the charge's refunded total for charge.refunded, and
+	// RefundID its most recent refund.
+	AmountRefunded models.Money `json:"amount_refunded"`
+	RefundID       string       `json:"refund_id,omitempty"`
+
+	// Dispute is set for charge.dispute.* events.
+	Dispute *Dispute `json:"dispute,omitempty"`
+
+	// Account is set for account.updated.
+	Account *Account `json:"account,omitempty"`
+}
+
+// Dispute is a chargeback opened by the guest's bank.
+type Dispute struct {
+	ID     string       `json:"id"`
+	Amount models.Money `json:"amount"`
+	Reason string       `json:"reason"`
+	Status string       `json:"status"`
+	// EvidenceDueBy is when Stripe stops accepting evidence, if it does.
+	EvidenceDueBy *time.Time `json:"evidence_due_by,omitempty"`
+}
+
+// DisputeEvidence is the platform's side of a Dispute, as sent to the
+// guest's bank.
+type DisputeEvidence struct {
+	CustomerName       string
+	ServiceDate        string
+	ProductDescription string
+	// Text is the written case, such as the booking's message history.
+	Text string
+	// Submit sends the evidence to the bank. Without it Stripe only stores
+	// it, and it can still be changed.
+	Submit bool
+}
+
+// Account is a cast's Connect Express account, which payouts are transferred
+// to.
+type Account struct {
+	ID string `json:"id"`
+	// DetailsSubmitted is whether the cast has finished onboarding.
+	DetailsSubmitted bool `json:"details_submitted"`
+	// PayoutsEnabled is whether Stripe will pay the account out to the
+	// cast's bank, which it only does once their identity is verified.
+	PayoutsEnabled bool `json:"payouts_enabled"`
+}
+
+// AccountParams describes a new Account.
+type AccountParams struct {
+	Email    string
+	Metadata map[string]string
+}
+
+// TransferParams describes money moved from the platform's balance to a
+// connected Account.
+type TransferParams struct {
+	Amount      models.Money
+	Destination string
+	Description string
+	Metadata    map[string]string
+	// IdempotencyKey, if set, makes a repeated call return the same Transfer.
+	IdempotencyKey string
+}
+
+// Transfer is money sent to a connected Account.
+type Transfer struct {
+	ID          string       `json:"id"`
+	Amount      models.Money `json:"amount"`
+	Destination string       `json:"destination"`
+}
+
+// ErrInvalidSignature is returned by ParseWebhook for a payload that didn't
+// come from the provider.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ErrTransferRejected is returned by Transfer when the provider refused the
+// transfer, as opposed to an error that leaves it unknown whether the
+// transfer was made.
+var ErrTransferRejected = errors.New("transfer rejected")
+
+// Provider authorizes, captures and refunds guest payments, and pays casts
+// through their connected accounts.
+type Provider interface {
+	// Authorize creates an Intent for the guest to confirm on the client.
+	Authorize(p AuthorizeParams) (*Intent, error)
+	// Get returns the Intent's current state.
+	Get(intentID string) (*Intent, error)
+	// IncrementAuthorization raises an uncaptured Intent to amount in total.
+	IncrementAuthorization(intentID string, amount models.Money) (*Intent, error)
+	// Capture collects amount from an authorized Intent, or all of it if
+	// amount is zero, and releases the rest.
+	Capture(intentID string, amount models.Money) (*Intent, error)
+	// Cancel releases an Intent that hasn't been captured.
+	Cancel(intentID string) error
+	// Refund returns amount from a captured Intent, or what is left of it if
+	// amount is zero.
+	Refund(intentID string, amount models.Money, reason string) (*Refund, error)
+	// CreateCustomer creates a customer and returns its ID.
+	CreateCustomer(p CustomerParams) (string, error)
+
+	// CreateAccount opens a connected Account for a cast.
+	CreateAccount(p AccountParams) (*Account, error)
+	// GetAccount returns the Account's current state.
+	GetAccount(accountID string) (*Account, error)
+	// OnboardingLink returns a single-use URL where the cast fills in the
+	// Account's details. Stripe sends them to returnURL when they are done,
+	// or to refreshURL if the link has expired.
+	OnboardingLink(accountID, refreshURL, returnURL string) (string, error)
+	// Transfer moves money from the platform's balance to an Account.
+	Transfer(p TransferParams) (*Transfer, error)
+
+	// UpdateDispute sends evidence for a Dispute.
+	UpdateDispute(disputeID string, evidence DisputeEvidence) (*Dispute, error)
+
+	// ParseWebhook verifies a webhook request and decodes its event.
+	ParseWebhook(payload []byte, signature string) (*Event, error)
+	// DecodeEvent decodes a payload ParseWebhook has already accepted, such
+	// as one stored for later processing.
+	DecodeEvent(payload []byte) (*Event, error)
+}
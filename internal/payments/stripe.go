@@ -0,0 +1,348 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/uso/uso/internal/models"
+)
+
+// Stripe is the Provider backed by the Stripe API.
+type Stripe struct {
+	api           *client.API
+	webhookSecret string
+}
+
+func NewStripe(secretKey, webhookSecret string) *Stripe {
+	api := &client.API{}
+	api.Init(secretKey, nil)
+	return &Stripe{api: api, webhookSecret: webhookSecret}
+}
+
+func (s *Stripe) Authorize(p AuthorizeParams) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(stripeAmount(p.Amount)),
+		Currency: stripe.String(stripeCurrency(p.Amount.Currency)),
+		Metadata: p.Metadata,
+	}
+	if p.ManualCapture {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+	if p.Incremental {
+		params.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{
+			Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{
+				RequestIncrementalAuthorization: stripe.String("if_available"),
+			},
+		}
+	}
+	if p.Customer != "" {
+		params.Customer = stripe.String(p.Customer)
+	}
+	if p.SavePaymentMethod {
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOnSession))
+	}
+	if p.PaymentMethod != "" {
+		// Confirmed here, with the guest in the app to authenticate if the
+		// card asks; cards only, so no redirect is needed
+		params.PaymentMethod = stripe.String(p.PaymentMethod)
+		params.PaymentMethodTypes = stripe.StringSlice([]string{"card"})
+		params.Confirm = stripe.Bool(true)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+
+	pi, err := s.api.PaymentIntents.New(params)
+	if err != nil {
+		// A declined card leaves the Intent open for the guest to try again
+		var stripeErr *stripe.Error
+		if p.PaymentMethod != "" && errors.As(err, &stripeErr) && stripeErr.PaymentIntent != nil {
+			return intentFromStripe(stripeErr.PaymentIntent), nil
+		}
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) Get(intentID string) (*Intent, error) {
+	pi, err := s.api.PaymentIntents.Get(intentID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) IncrementAuthorization(intentID string, amount models.Money) (*Intent, error) {
+	pi, err := s.api.PaymentIntents.IncrementAuthorization(intentID, &stripe.PaymentIntentIncrementAuthorizationParams{
+		Amount: stripe.Int64(stripeAmount(amount)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) Capture(intentID string, amount models.Money) (*Intent, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	if amount.IsPositive() {
+		params.AmountToCapture = stripe.Int64(stripeAmount(amount))
+	}
+	pi, err := s.api.PaymentIntents.Capture(intentID, params)
+	if err != nil {
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) Cancel(intentID string) error {
+	_, err := s.api.PaymentIntents.Cancel(intentID, nil)
+	return err
+}
+
+func (s *Stripe) Refund(intentID string, amount models.Money, reason string) (*Refund, error) {
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(intentID)}
+	if amount.IsPositive() {
+		params.Amount = stripe.Int64(stripeAmount(amount))
+	}
+	if reason != "" {
+		params.Reason = stripe.String(reason)
+	}
+	r, err := s.api.Refunds.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &Refund{ID: r.ID, Amount: moneyFromStripe(r.Amount, r.Currency)}, nil
+}
+
+func (s *Stripe) CreateCustomer(p CustomerParams) (string, error) {
+	params := &stripe.CustomerParams{Metadata: p.Metadata}
+	if p.Email != "" {
+		params.Email = stripe.String(p.Email)
+	}
+	if p.Name != "" {
+		params.Name = stripe.String(p.Name)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+	c, err := s.api.Customers.New(params)
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func (s *Stripe) CreateAccount(p AccountParams) (*Account, error) {
+	params := &stripe.AccountParams{
+		Type:     stripe.String(string(stripe.AccountTypeExpress)),
+		Country:  stripe.String("JP"),
+		Metadata: p.Metadata,
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			Transfers: &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+		},
+	}
+	if p.Email != "" {
+		params.Email = stripe.String(p.Email)
+	}
+	a, err := s.api.Accounts.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return accountFromStripe(a), nil
+}
+
+func (s *Stripe) GetAccount(accountID string) (*Account, error) {
+	a, err := s.api.Accounts.GetByID(accountID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return accountFromStripe(a), nil
+}
+
+func (s *Stripe) OnboardingLink(accountID, refreshURL, returnURL string) (string, error) {
+	link, err := s.api.AccountLinks.New(&stripe.AccountLinkParams{
+		Account:    stripe.String(accountID),
+		RefreshURL: stripe.String(refreshURL),
+		ReturnURL:  stripe.String(returnURL),
+		Type:       stripe.String(string(stripe.AccountLinkTypeAccountOnboarding)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return link.URL, nil
+}
+
+func (s *Stripe) Transfer(p TransferParams) (*Transfer, error) {
+	params := &stripe.TransferParams{
+		Amount:      stripe.Int64(stripeAmount(p.Amount)),
+		Currency:    stripe.String(stripeCurrency(p.Amount.Currency)),
+		Destination: stripe.String(p.Destination),
+		Metadata:    p.Metadata,
+	}
+	if p.Description != "" {
+		params.Description = stripe.String(p.Description)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+	t, err := s.api.Transfers.New(params)
+	if err != nil {
+		// A 4xx other than a conflict or rate limit means Stripe looked at
+		// the request and turned it down
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode >= 400 && stripeErr.HTTPStatusCode < 500 &&
+			stripeErr.HTTPStatusCode != http.StatusConflict && stripeErr.HTTPStatusCode != http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w: %v", ErrTransferRejected, err)
+		}
+		return nil, err
+	}
+	out := &Transfer{ID: t.ID, Amount: moneyFromStripe(t.Amount, t.Currency)}
+	if t.Destination != nil {
+		out.Destination = t.Destination.ID
+	}
+	return out, nil
+}
+
+func (s *Stripe) UpdateDispute(disputeID string, evidence DisputeEvidence) (*Dispute, error) {
+	params := &stripe.DisputeParams{
+		Evidence: &stripe.DisputeEvidenceParams{},
+		Submit:   stripe.Bool(evidence.Submit),
+	}
+	if evidence.CustomerName != "" {
+		params.Evidence.CustomerName = stripe.String(evidence.CustomerName)
+	}
+	if evidence.ServiceDate != "" {
+		params.Evidence.ServiceDate = stripe.String(evidence.ServiceDate)
+	}
+	if evidence.ProductDescription != "" {
+		params.Evidence.ProductDescription = stripe.String(evidence.ProductDescription)
+	}
+	if evidence.Text != "" {
+		params.Evidence.UncategorizedText = stripe.String(evidence.Text)
+	}
+	d, err := s.api.Disputes.Update(disputeID, params)
+	if err != nil {
+		return nil, err
+	}
+	return disputeFromStripe(d), nil
+}
+
+func (s *Stripe) ParseWebhook(payload []byte, signature string) (*Event, error) {
+	event, err := webhook.ConstructEvent(payload, signature, s.webhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return eventFromStripe(event)
+}
+
+func (s *Stripe) DecodeEvent(payload []byte) (*Event, error) {
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("error parsing event: %w", err)
+	}
+	return eventFromStripe(event)
+}
+
+// stripeAmount converts to Stripe's amount, which is in the currency's
+// smallest unit. For zero-decimal currencies such as JPY that is the whole
+// unit, the same as Money, so ¥12,000 is sent as 12000 rather than 1200000.
+func stripeAmount(m models.Money) int64 {
+	return m.Amount
+}
+
+func stripeCurrency(c models.Currency) string {
+	return strings.ToLower(string(c))
+}
+
+func moneyFromStripe(amount int64, currency stripe.Currency) models.Money {
+	return models.NewMoney(amount, models.Currency(strings.ToUpper(string(currency))))
+}
+
+func intentFromStripe(pi *stripe.PaymentIntent) *Intent {
+	in := &Intent{
+		ID:           pi.ID,
+		Amount:       moneyFromStripe(pi.Amount, pi.Currency),
+		Received:     moneyFromStripe(pi.AmountReceived, pi.Currency),
+		Status:       IntentStatus(pi.Status),
+		ClientSecret: pi.ClientSecret,
+	}
+	if pi.LastPaymentError != nil {
+		in.LastError = pi.LastPaymentError.Msg
+	}
+	if pi.PaymentMethod != nil && pi.SetupFutureUsage != "" {
+		in.PaymentMethod = pi.PaymentMethod.ID
+	}
+	return in
+}
+
+func accountFromStripe(a *stripe.Account) *Account {
+	return &Account{ID: a.ID, DetailsSubmitted: a.DetailsSubmitted, PayoutsEnabled: a.PayoutsEnabled}
+}
+
+func disputeFromStripe(d *stripe.Dispute) *Dispute {
+	out := &Dispute{
+		ID:     d.ID,
+		Amount: moneyFromStripe(d.Amount, d.Currency),
+		Reason: string(d.Reason),
+		Status: string(d.Status),
+	}
+	if d.EvidenceDetails != nil && d.EvidenceDetails.DueBy > 0 {
+		due := time.Unix(d.EvidenceDetails.DueBy, 0)
+		out.EvidenceDueBy = &due
+	}
+	return out
+}
+
+// eventFromStripe keeps what bookings need from the event's object. Types we
+// don't handle come back with only ID and Type set.
+func eventFromStripe(event stripe.Event) (*Event, error) {
+	e := &Event{ID: event.ID, Type: string(event.Type)}
+
+	switch e.Type {
+	case EventIntentSucceeded, EventIntentPaymentFailed, EventIntentCanceled, EventIntentCapturableUpdated:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return nil, fmt.Errorf("error parsing payment intent: %w", err)
+		}
+		e.Intent = intentFromStripe(&pi)
+		e.IntentID = pi.ID
+
+	case EventChargeRefunded:
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, fmt.Errorf("error parsing charge: %w", err)
+		}
+		if charge.PaymentIntent != nil {
+			e.IntentID = charge.PaymentIntent.ID
+		}
+		e.AmountRefunded = moneyFromStripe(charge.AmountRefunded, charge.Currency)
+		if charge.Refunds != nil && len(charge.Refunds.Data) > 0 {
+			e.RefundID = charge.Refunds.Data[0].ID
+		}
+
+	case EventDisputeCreated, EventDisputeUpdated, EventDisputeClosed:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return nil, fmt.Errorf("error parsing dispute: %w", err)
+		}
+		if dispute.PaymentIntent != nil {
+			e.IntentID = dispute.PaymentIntent.ID
+		}
+		e.Dispute = disputeFromStripe(&dispute)
+
+	case EventAccountUpdated:
+		var account stripe.Account
+		if err := json.Unmarshal(event.Data.Raw, &account); err != nil {
+			return nil, fmt.Errorf("error parsing account: %w", err)
+		}
+		e.Account = accountFromStripe(&account)
+	}
+	return e, nil
+}
@@ -0,0 +1,96 @@
+package payments
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestStripeDecodeEvent(t *testing.T) {
+	dueBy := time.Unix(1791676800, 0)
+	tests := []struct {
+		name    string
+		payload string
+		want    Event
+	}{
+		{
+			name: "payment intent",
+			payload: `{"id": "evt_1", "type": "payment_intent.payment_failed", "data": {"object": {
+				"id": "pi_1", "object": "payment_intent", "amount": 12000, "currency": "jpy", "status": "requires_payment_method",
+				"client_secret": "pi_1_secret", "last_payment_error": {"message": "Your card was declined."}}}}`,
+			want: Event{ID: "evt_1", Type: EventIntentPaymentFailed, IntentID: "pi_1", Intent: &Intent{
+				ID: "pi_1", Amount: models.JPY(12000), Received: models.JPY(0), Status: IntentRequiresPaymentMethod,
+				ClientSecret: "pi_1_secret", LastError: "Your card was declined.",
+			}},
+		},
+		{
+			name: "charge refunded",
+			payload: `{"id": "evt_2", "type": "charge.refunded", "data": {"object": {
+				"id": "ch_1", "object": "charge", "payment_intent": "pi_2", "amount_refunded": 3000, "currency": "usd",
+				"refunds": {"object": "list", "data": [{"id": "re_2", "object": "refund", "amount": 1000, "currency": "usd"}]}}}}`,
+			want: Event{ID: "evt_2", Type: EventChargeRefunded, IntentID: "pi_2", AmountRefunded: models.NewMoney(3000, models.CurrencyUSD), RefundID: "re_2"},
+		},
+		{
+			name: "dispute",
+			payload: `{"id": "evt_3", "type": "charge.dispute.created", "data": {"object": {
+				"id": "dp_1", "object": "dispute", "payment_intent": "pi_3", "amount": 8000, "currency": "jpy", "reason": "fraudulent",
+				"status": "needs_response", "evidence_details": {"due_by": 1791676800}}}}`,
+			want: Event{ID: "evt_3", Type: EventDisputeCreated, IntentID: "pi_3",
+				Dispute: &Dispute{ID: "dp_1", Amount: models.JPY(8000), Reason: "fraudulent", Status: "needs_response", EvidenceDueBy: &dueBy}},
+		},
+		{
+			name: "dispute closed",
+			payload: `{"id": "evt_6", "type": "charge.dispute.closed", "data": {"object": {
+				"id": "dp_1", "object": "dispute", "payment_intent": "pi_3", "amount": 8000, "currency": "jpy", "reason": "fraudulent",
+				"status": "lost"}}}`,
+			want: Event{ID: "evt_6", Type: EventDisputeClosed, IntentID: "pi_3",
+				Dispute: &Dispute{ID: "dp_1", Amount: models.JPY(8000), Reason: "fraudulent", Status: "lost"}},
+		},
+		{
+			name: "account updated",
+			payload: `{"id": "evt_5", "type": "account.updated", "data": {"object": {
+				"id": "acct_1", "object": "account", "type": "express", "details_submitted": true, "payouts_enabled": false}}}`,
+			want: Event{ID: "evt_5", Type: EventAccountUpdated,
+				Account: &Account{ID: "acct_1", DetailsSubmitted: true}},
+		},
+		{
+			name:    "unhandled type",
+			payload: `{"id": "evt_4", "type": "customer.created", "data": {"object": {"id": "cus_1"}}}`,
+			want:    Event{ID: "evt_4", Type: "customer.created"},
+		},
+	}
+
+	s := NewStripe("sk_test", "whsec_test")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.DecodeEvent([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("DecodeEvent: %v", err)
+			}
+			if got.ID != tt.want.ID || got.Type != tt.want.Type || got.IntentID != tt.want.IntentID ||
+				got.AmountRefunded != tt.want.AmountRefunded || got.RefundID != tt.want.RefundID {
+				t.Errorf("DecodeEvent = %+v, want %+v", got, tt.want)
+			}
+			if (got.Intent == nil) != (tt.want.Intent == nil) || got.Intent != nil && *got.Intent != *tt.want.Intent {
+				t.Errorf("Intent = %+v, want %+v", got.Intent, tt.want.Intent)
+			}
+			if (got.Dispute == nil) != (tt.want.Dispute == nil) || got.Dispute != nil && !reflect.DeepEqual(got.Dispute, tt.want.Dispute) {
+				t.Errorf("Dispute = %+v, want %+v", got.Dispute, tt.want.Dispute)
+			}
+			if (got.Account == nil) != (tt.want.Account == nil) || got.Account != nil && *got.Account != *tt.want.Account {
+				t.Errorf("Account = %+v, want %+v", got.Account, tt.want.Account)
+			}
+		})
+	}
+}
+
+func TestStripeParseWebhookRejectsBadSignature(t *testing.T) {
+	s := NewStripe("sk_test", "whsec_test")
+	_, err := s.ParseWebhook([]byte(`{"id": "evt_1"}`), "t=1,v1=bad")
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("ParseWebhook error = %v, want ErrInvalidSignature", err)
+	}
+}
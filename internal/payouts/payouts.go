@@ -0,0 +1,380 @@
+// Package payouts pays casts what the ledger says they are owed, by transfer
+// to their Stripe Connect Express accounts.
+package payouts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+var (
+	// ErrNotEnabled is returned when paying a cast Stripe can't pay yet,
+	// because they haven't finished onboarding.
+	ErrNotEnabled = errors.New("cast has not finished payout onboarding")
+	// ErrAlreadyOnboarded is returned by Onboard for a cast who can already
+	// be paid.
+	ErrAlreadyOnboarded = errors.New("cast has already finished payout onboarding")
+)
+
+// Payer opens casts' connected accounts and transfers their earnings.
+type Payer struct {
+	db  *database.DB
+	pay payments.Provider
+}
+
+func New(db *database.DB, pay payments.Provider) *Payer {
+	return &Payer{db: db, pay: pay}
+}
+
+// Onboard returns a link where the cast sets up their connected account,
+// opening the account first if they don't have one yet.
+func (p *Payer) Onboard(castID int, email, refreshURL, returnURL string) (string, error) {
+	var accountID sql.NullString
+	var enabled bool
+	err := p.db.QueryRow(`
+		SELECT stripe_account_id, payouts_enabled FROM cast_profiles WHERE user_id = $1
+	`, castID).Scan(&accountID, &enabled)
+	if err != nil {
+		return "", fmt.Errorf("error getting cast profile of %d: %w", castID, err)
+	}
+	if enabled {
+		return "", ErrAlreadyOnboarded
+	}
+
+	if !accountID.Valid {
+		a, err := p.pay.CreateAccount(payments.AccountParams{
+			Email:    email,
+			Metadata: map[string]string{"cast_id": strconv.Itoa(castID)},
+		})
+		if err != nil {
+			return "", fmt.Errorf("error creating connected account: %w", err)
+		}
+		// Another request may have opened an account first; keep whichever
+		// was stored
+		err = p.db.QueryRow(`
+			UPDATE cast_profiles
+			SET stripe_account_id = COALESCE(stripe_account_id, $1), updated_at = $2
+			WHERE user_id = $3
+			RETURNING stripe_account_id
+		`, a.ID, time.Now(), castID).Scan(&accountID)
+		if err != nil {
+			return "", fmt.Errorf("error storing connected account of %d: %w", castID, err)
+		}
+	}
+
+	return p.pay.OnboardingLink(accountID.String, refreshURL, returnURL)
+}
+
+// HandleEvent applies account.updated events to the cast whose connected
+// account it is. Other events are ignored. The account is fetched afresh
+// rather than taken from the event, as events may arrive out of order.
+func (p *Payer) HandleEvent(event *payments.Event) error {
+	if event.Type != payments.EventAccountUpdated || event.Account == nil {
+		return nil
+	}
+	a, err := p.pay.GetAccount(event.Account.ID)
+	if err != nil {
+		return fmt.Errorf("error getting account %s: %w", event.Account.ID, err)
+	}
+	_, err = p.db.Exec(`
+		UPDATE cast_profiles
+		SET payouts_details_submitted = $1, payouts_enabled = $2, updated_at = $3
+		WHERE stripe_account_id = $4
+	`, a.DetailsSubmitted, a.PayoutsEnabled, time.Now(), a.ID)
+	if err != nil {
+		return fmt.Errorf("error updating payout status of %s: %w", a.ID, err)
+	}
+	return nil
+}
+
+// PayCast transfers everything the cast is owed, one transfer per currency,
+// and returns the payouts it made or tried to make. Payouts left pending by
+// an earlier run are retried with the same idempotency key, so they are
+// never sent twice.
+func (p *Payer) PayCast(castID int) ([]models.Payout, error) {
+	queued, err := p.queue(castID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range queued {
+		if err := p.send(&queued[i]); err != nil {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
+
+// queue writes a pending payout for whatever the cast is owed beyond the
+// payouts already pending, and returns all of the cast's pending payouts.
+func (p *Payer) queue(castID int) ([]models.Payout, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the profile keeps two runs from both queueing the balance
+	var accountID sql.NullString
+	var enabled bool
+	err = tx.QueryRow(`
+		SELECT stripe_account_id, payouts_enabled FROM cast_profiles WHERE user_id = $1 FOR UPDATE
+	`, castID).Scan(&accountID, &enabled)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cast profile of %d: %w", castID, err)
+	}
+	if !accountID.Valid || !enabled {
+		return nil, ErrNotEnabled
+	}
+
+	pending, err := listPayouts(tx, castID, models.PayoutStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	balances, err := ledger.Balances(tx, ledger.CastPayable(castID))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, amount := range unpaid(balances, pending) {
+		po := models.Payout{
+			CastID:          castID,
+			Amount:          amount,
+			Status:          models.PayoutStatusPending,
+			StripeAccountID: accountID.String,
+		}
+		err := tx.QueryRow(`
+			INSERT INTO payouts (cast_id, amount, currency, stripe_account_id)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at
+		`, castID, amount.Amount, amount.Currency, accountID.String).Scan(&po.ID, &po.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error queueing payout for %d: %w", castID, err)
+		}
+		pending = append(pending, po)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing payouts: %w", err)
+	}
+	return pending, nil
+}
+
+// unpaid returns, per currency, what the balances hold beyond the pending
+// payouts. Currencies with nothing left to pay are left out.
+func unpaid(balances []models.Money, pending []models.Payout) []models.Money {
+	amounts := make([]models.Money, 0, len(balances)+len(pending))
+	amounts = append(amounts, balances...)
+	for _, po := range pending {
+		amounts = append(amounts, po.Amount.Neg())
+	}
+
+	var owed []models.Money
+	for _, m := range ledger.Sum(amounts...) {
+		if m.IsPositive() {
+			owed = append(owed, m)
+		}
+	}
+	return owed
+}
+
+// send makes the payout's transfer and records the outcome. A transfer
+// Stripe rejects fails the payout, and the money goes out with the next one;
+// any other error leaves it pending to be retried.
+func (p *Payer) send(po *models.Payout) error {
+	t, err := p.pay.Transfer(payments.TransferParams{
+		Amount:      po.Amount,
+		Destination: po.StripeAccountID,
+		Description: "Uso earnings",
+		Metadata: map[string]string{
+			"cast_id":   strconv.Itoa(po.CastID),
+			"payout_id": strconv.Itoa(po.ID),
+		},
+		IdempotencyKey: "payout-" + strconv.Itoa(po.ID),
+	})
+	if err != nil {
+		reason := err.Error()
+		po.FailureReason = &reason
+		status := models.PayoutStatusPending
+		if errors.Is(err, payments.ErrTransferRejected) {
+			status = models.PayoutStatusFailed
+		}
+		po.Status = status
+		_, dbErr := p.db.Exec(`
+			UPDATE payouts SET status = $1, failure_reason = $2 WHERE id = $3 AND status = 'pending'
+		`, status, reason, po.ID)
+		if dbErr != nil {
+			return fmt.Errorf("error recording failure of payout %d: %w", po.ID, dbErr)
+		}
+		log.Printf("Payout %d to cast %d not sent: %v", po.ID, po.CastID, err)
+		return nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE payouts
+		SET status = $1, stripe_transfer_id = $2, failure_reason = NULL, paid_at = $3
+		WHERE id = $4
+	`, models.PayoutStatusPaid, t.ID, now, po.ID)
+	if err != nil {
+		return fmt.Errorf("error recording payout %d: %w", po.ID, err)
+	}
+	if err := ledger.Payout(tx, po.CastID, po.Amount, t.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing payout %d: %w", po.ID, err)
+	}
+
+	po.Status = models.PayoutStatusPaid
+	po.StripeTransferID = &t.ID
+	po.FailureReason = nil
+	po.PaidAt = &now
+	return nil
+}
+
+// PayAll pays every cast who can be paid and is owed something or has a
+// payout pending.
+func (p *Payer) PayAll(ctx context.Context) error {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT cp.user_id
+		FROM cast_profiles cp
+		WHERE cp.payouts_enabled AND (
+			EXISTS (SELECT 1 FROM payouts po WHERE po.cast_id = cp.user_id AND po.status = 'pending')
+			OR EXISTS (
+				SELECT 1
+				FROM ledger_accounts a
+				JOIN ledger_entries e ON e.account_id = a.id
+				WHERE a.user_id = cp.user_id AND a.account_type = $1
+				GROUP BY e.currency
+				HAVING SUM(e.amount) < 0
+			)
+		)
+		ORDER BY cp.user_id
+	`, ledger.TypeCastPayable)
+	if err != nil {
+		return fmt.Errorf("error querying casts to pay: %w", err)
+	}
+
+	var castIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning cast to pay: %w", err)
+		}
+		castIDs = append(castIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading casts to pay: %w", err)
+	}
+
+	var failed int
+	for _, castID := range castIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, err := p.PayCast(castID); err != nil && !errors.Is(err, ErrNotEnabled) {
+			log.Printf("Error paying cast %d: %v", castID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d casts could not be paid", failed, len(castIDs))
+	}
+	return nil
+}
+
+// Payouts returns the cast's most recent payouts, newest first.
+func Payouts(db *database.DB, castID, limit int) ([]models.Payout, error) {
+	rows, err := db.Query(`
+		SELECT id, cast_id, amount, currency, status, stripe_account_id,
+		       stripe_transfer_id, failure_reason, created_at, paid_at
+		FROM payouts
+		WHERE cast_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, castID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying payouts of %d: %w", castID, err)
+	}
+	defer rows.Close()
+	return scanPayouts(rows)
+}
+
+func listPayouts(tx ledger.Execer, castID int, status models.PayoutStatus) ([]models.Payout, error) {
+	rows, err := tx.Query(`
+		SELECT id, cast_id, amount, currency, status, stripe_account_id,
+		       stripe_transfer_id, failure_reason, created_at, paid_at
+		FROM payouts
+		WHERE cast_id = $1 AND status = $2
+		ORDER BY id
+	`, castID, status)
+	if err != nil {
+		return nil, fmt.Errorf("error querying payouts of %d: %w", castID, err)
+	}
+	defer rows.Close()
+	return scanPayouts(rows)
+}
+
+func scanPayouts(rows *sql.Rows) ([]models.Payout, error) {
+	payouts := []models.Payout{}
+	for rows.Next() {
+		var po models.Payout
+		var transferID, reason sql.NullString
+		var paidAt sql.NullTime
+		if err := rows.Scan(&po.ID, &po.CastID, &po.Amount.Amount, &po.Amount.Currency, &po.Status,
+			&po.StripeAccountID, &transferID, &reason, &po.CreatedAt, &paidAt); err != nil {
+			return nil, fmt.Errorf("error scanning payout: %w", err)
+		}
+		if transferID.Valid {
+			po.StripeTransferID = &transferID.String
+		}
+		if reason.Valid {
+			po.FailureReason = &reason.String
+		}
+		if paidAt.Valid {
+			po.PaidAt = &paidAt.Time
+		}
+		payouts = append(payouts, po)
+	}
+	return payouts, rows.Err()
+}
+
+// BatchWeek returns the start of the weekly payout period now falls in:
+// midnight in Tokyo on the most recent payout day.
+func BatchWeek(now time.Time, day time.Weekday) time.Time {
+	t := now.In(booking.Tokyo)
+	back := (int(t.Weekday()) - int(day) + 7) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-back, 0, 0, 0, 0, booking.Tokyo)
+}
+
+// ParseWeekday parses a day name such as "monday" or "Mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if name == full || name == full[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
@@ -0,0 +1,317 @@
+package payouts
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/payments"
+)
+
+func TestUnpaid(t *testing.T) {
+	usd := func(amount int64) models.Money { return models.NewMoney(amount, models.CurrencyUSD) }
+
+	tests := []struct {
+		name     string
+		balances []models.Money
+		pending  []models.Payout
+		want     []models.Money
+	}{
+		{"nothing owed", nil, nil, nil},
+		{"whole balance", []models.Money{models.JPY(21000)}, nil, []models.Money{models.JPY(21000)}},
+		{
+			"less what is pending",
+			[]models.Money{models.JPY(21000)},
+			[]models.Payout{{Amount: models.JPY(14000)}},
+			[]models.Money{models.JPY(7000)},
+		},
+		{
+			"all pending",
+			[]models.Money{models.JPY(14000)},
+			[]models.Payout{{Amount: models.JPY(14000)}},
+			nil,
+		},
+		{
+			"clawed back below zero",
+			[]models.Money{models.JPY(-3000), usd(500)},
+			nil,
+			[]models.Money{usd(500)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unpaid(tt.balances, tt.pending); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unpaid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchWeek(t *testing.T) {
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, booking.Tokyo)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"on the payout day", monday.Add(9 * time.Hour), monday},
+		{"later in the week", monday.AddDate(0, 0, 6).Add(23 * time.Hour), monday},
+		{"next payout day", monday.AddDate(0, 0, 7), monday.AddDate(0, 0, 7)},
+		// Sunday 20:00 UTC is already Monday in Tokyo
+		{"in another zone", time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC), monday.AddDate(0, 0, 7)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BatchWeek(tt.now, time.Monday); !got.Equal(tt.want) {
+				t.Errorf("BatchWeek(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	for in, want := range map[string]time.Weekday{"monday": time.Monday, "Fri": time.Friday, " SUNDAY ": time.Sunday} {
+		if got, err := ParseWeekday(in); err != nil || got != want {
+			t.Errorf("ParseWeekday(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseWeekday("payday"); err == nil {
+		t.Error("ParseWeekday accepted an unknown day")
+	}
+}
+
+const (
+	testCastID   = 7
+	testPayoutID = 5
+)
+
+func newTestPayer(t *testing.T, fake *payments.Fake) (*Payer, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return New(&database.DB{DB: db}, fake), mock
+}
+
+// onboardedAccount opens a connected account for the cast, finished
+// onboarding unless told otherwise.
+func onboardedAccount(t *testing.T, fake *payments.Fake, onboarded bool) string {
+	t.Helper()
+	a, err := fake.CreateAccount(payments.AccountParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onboarded {
+		if err := fake.CompleteOnboarding(a.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a.ID
+}
+
+// expectQueue expects queue to find the cast owed balance with the pending
+// payouts already queued, and to queue a payout for anything left over.
+func expectQueue(mock sqlmock.Sqlmock, accountID string, balance models.Money, pending []models.Payout, queued models.Money) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM cast_profiles WHERE user_id = $1 FOR UPDATE")).
+		WithArgs(testCastID).
+		WillReturnRows(sqlmock.NewRows([]string{"stripe_account_id", "payouts_enabled"}).AddRow(accountID, true))
+
+	rows := sqlmock.NewRows([]string{"id", "cast_id", "amount", "currency", "status", "stripe_account_id",
+		"stripe_transfer_id", "failure_reason", "created_at", "paid_at"})
+	for _, po := range pending {
+		rows.AddRow(po.ID, testCastID, po.Amount.Amount, string(po.Amount.Currency), po.Status, accountID,
+			nil, po.FailureReason, time.Now(), nil)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE cast_id = $1 AND status = $2")).
+		WithArgs(testCastID, models.PayoutStatusPending).
+		WillReturnRows(rows)
+
+	// Cast payable is a liability, credited with what the cast earns
+	mock.ExpectQuery(regexp.QuoteMeta("GROUP BY e.currency")).
+		WithArgs(ledger.CastPayable(testCastID).Code).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "sum"}).AddRow(string(balance.Currency), balance.Neg().Amount))
+
+	if queued.IsPositive() {
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO payouts")).
+			WithArgs(testCastID, queued.Amount, string(queued.Currency), accountID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(testPayoutID, time.Now()))
+	}
+	mock.ExpectCommit()
+}
+
+// expectPaid expects the payout to be marked paid by transferID and the
+// transfer to be booked in the ledger, out of what the cast is owed.
+func expectPaid(mock sqlmock.Sqlmock, amount models.Money, transferID string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET status = $1, stripe_transfer_id = $2")).
+		WithArgs(models.PayoutStatusPaid, transferID, sqlmock.AnyArg(), testPayoutID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO ledger_transactions")).
+		WithArgs(ledger.KindPayout, nil, transferID, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	for i, e := range []struct {
+		account ledger.Account
+		amount  models.Money
+	}{
+		{ledger.CastPayable(testCastID), amount},
+		{ledger.StripeClearing, amount.Neg()},
+	} {
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO ledger_accounts")).
+			WithArgs(e.account.Code, e.account.Type, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i + 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ledger_entries")).
+			WithArgs(11, i+1, nil, e.amount.Amount, string(e.amount.Currency)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func expectNotSent(mock sqlmock.Sqlmock, status models.PayoutStatus) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payouts SET status = $1, failure_reason = $2")).
+		WithArgs(status, sqlmock.AnyArg(), testPayoutID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestPayCast(t *testing.T) {
+	owed := models.JPY(21000)
+
+	t.Run("pays what is owed", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+		account := onboardedAccount(t, fake, true)
+
+		expectQueue(mock, account, owed, nil, owed)
+		expectPaid(mock, owed, "tr_fake_1")
+
+		paid, err := p.PayCast(testCastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paid) != 1 || paid[0].Status != models.PayoutStatusPaid || *paid[0].StripeTransferID != "tr_fake_1" {
+			t.Errorf("PayCast = %+v, want one payout paid by tr_fake_1", paid)
+		}
+		if got := fake.Transfers(account); len(got) != 1 || got[0].Amount != owed {
+			t.Errorf("transfers = %+v, want one of %v", got, owed)
+		}
+	})
+
+	t.Run("retries a pending payout under the same key", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+		account := onboardedAccount(t, fake, true)
+
+		// The last run made the transfer but never heard back
+		if _, err := fake.Transfer(payments.TransferParams{
+			Amount: owed, Destination: account, IdempotencyKey: "payout-5",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		pending := []models.Payout{{ID: testPayoutID, Amount: owed, Status: models.PayoutStatusPending}}
+		expectQueue(mock, account, owed, pending, models.JPY(0))
+		expectPaid(mock, owed, "tr_fake_1")
+
+		if _, err := p.PayCast(testCastID); err != nil {
+			t.Fatal(err)
+		}
+		if got := fake.Transfers(account); len(got) != 1 {
+			t.Errorf("transfers = %+v, want the one made before", got)
+		}
+	})
+
+	t.Run("queues what was earned since the pending payout", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+		account := onboardedAccount(t, fake, true)
+
+		pending := []models.Payout{{ID: testPayoutID - 1, Amount: models.JPY(14000), Status: models.PayoutStatusPending}}
+		expectQueue(mock, account, owed, pending, models.JPY(7000))
+		// The pending payout fails to go out again, and the new one is not
+		// tried after it
+		fake.FailNext("transfer", errors.New("connection reset"))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE payouts SET status = $1, failure_reason = $2")).
+			WithArgs(models.PayoutStatusPending, "connection reset", testPayoutID-1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectPaid(mock, models.JPY(7000), "tr_fake_1")
+
+		paid, err := p.PayCast(testCastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paid) != 2 || paid[0].Status != models.PayoutStatusPending || paid[1].Status != models.PayoutStatusPaid {
+			t.Errorf("PayCast = %+v, want the old payout pending and the new one paid", paid)
+		}
+	})
+
+	t.Run("fails a rejected transfer", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+		// Stripe disabled the account after we last heard from it
+		account := onboardedAccount(t, fake, false)
+
+		expectQueue(mock, account, owed, nil, owed)
+		expectNotSent(mock, models.PayoutStatusFailed)
+
+		paid, err := p.PayCast(testCastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paid) != 1 || paid[0].Status != models.PayoutStatusFailed || paid[0].FailureReason == nil {
+			t.Errorf("PayCast = %+v, want one failed payout with its reason", paid)
+		}
+	})
+
+	t.Run("leaves a payout pending on any other error", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+		account := onboardedAccount(t, fake, true)
+
+		expectQueue(mock, account, owed, nil, owed)
+		fake.FailNext("transfer", errors.New("connection reset"))
+		expectNotSent(mock, models.PayoutStatusPending)
+
+		paid, err := p.PayCast(testCastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paid) != 1 || paid[0].Status != models.PayoutStatusPending {
+			t.Errorf("PayCast = %+v, want one pending payout", paid)
+		}
+		if got := fake.Transfers(account); len(got) != 0 {
+			t.Errorf("transfers = %+v, want none", got)
+		}
+	})
+
+	t.Run("not onboarded", func(t *testing.T) {
+		fake := payments.NewFake()
+		p, mock := newTestPayer(t, fake)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("FROM cast_profiles WHERE user_id = $1 FOR UPDATE")).
+			WillReturnRows(sqlmock.NewRows([]string{"stripe_account_id", "payouts_enabled"}).AddRow(nil, false))
+		mock.ExpectRollback()
+
+		if _, err := p.PayCast(testCastID); !errors.Is(err, ErrNotEnabled) {
+			t.Errorf("PayCast = %v, want ErrNotEnabled", err)
+		}
+	})
+}
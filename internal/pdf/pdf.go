@@ -0,0 +1,155 @@
+// Package pdf writes the simple text-and-rules documents the platform sends
+// out, such as statements and receipts. Text is set in Heisei Kaku Gothic, one
+// of the Japanese fonts PDF readers are expected to supply, so documents stay
+// small and need no font files.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// A4 in points, the unit all positions are given in.
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Document is a PDF being built up a page at a time.
+type Document struct {
+	title string
+	pages []*Page
+}
+
+// New starts a document. title is shown by readers in place of the file name.
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// Page is one page of a Document. Positions are measured from the top-left
+// corner, with y growing down the page, and text is placed by its baseline.
+type Page struct {
+	content bytes.Buffer
+}
+
+// AddPage appends a blank A4 page.
+func (d *Document) AddPage() *Page {
+	p := &Page{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// Text writes s starting at x.
+func (p *Page) Text(x, y, size float64, s string) {
+	fmt.Fprintf(&p.content, "BT /F1 %.2f Tf %.2f %.2f Td <%s> Tj ET\n", size, x, PageHeight-y, encode(s))
+}
+
+// TextRight writes s ending at x, for figures in a column.
+func (p *Page) TextRight(x, y, size float64, s string) {
+	p.Text(x-TextWidth(s, size), y, size, s)
+}
+
+// Line draws a thin rule from (x1, y1) to (x2, y2).
+func (p *Page) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, PageHeight-y1, x2, PageHeight-y2)
+}
+
+// Rect draws the outline of a box with its top-left corner at (x, y).
+func (p *Page) Rect(x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f %.2f %.2f re S\n", x, PageHeight-y-h, w, h)
+}
+
+// TextWidth returns how wide s is set at size. Latin characters are half
+// width and everything else full width.
+func TextWidth(s string, size float64) float64 {
+	var units int
+	for _, r := range s {
+		units += runeWidth(r)
+	}
+	return float64(units) * size / 1000
+}
+
+func runeWidth(r rune) int {
+	if r < 0x80 || r == '¥' {
+		return 500
+	}
+	return 1000
+}
+
+// encode returns s as hex UTF-16BE, which is what the UniJIS-UCS2 encoding
+// reads. Characters outside the Basic Multilingual Plane can't be shown and
+// become question marks.
+func encode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 0xFFFF || utf16.IsSurrogate(r) {
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	return b.String()
+}
+
+// The Type 0 font all text is set in. UniJIS-UCS2-HW-H maps Latin
+// characters to the half-width glyphs, which the widths below describe.
+const fontObjects = `<< /Type /Font /Subtype /Type0 /BaseFont /HeiseiKakuGo-W5 /Encoding /UniJIS-UCS2-HW-H /DescendantFonts [4 0 R] >>
+<< /Type /Font /Subtype /CIDFontType0 /BaseFont /HeiseiKakuGo-W5 /CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 2 >> /FontDescriptor 5 0 R /DW 1000 /W [1 95 500 231 389 500] >>
+<< /Type /FontDescriptor /FontName /HeiseiKakuGo-W5 /Flags 4 /FontBBox [-92 -250 1010 922] /ItalicAngle 0 /Ascent 752 /Descent -221 /CapHeight 737 /StemV 114 >>`
+
+// WriteTo writes the finished document.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 to 6 are fixed; each page then takes two, its page object
+	// and its content stream
+	const firstPage = 7
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, f := range strings.Split(fontObjects, "\n") {
+		obj(f)
+	}
+	obj(fmt.Sprintf("<< /Title <FEFF%s> /Producer (Uso) >>", encode(d.title)))
+
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			PageWidth, PageHeight, firstPage+2*i+1))
+
+		var stream bytes.Buffer
+		zw := zlib.NewWriter(&stream)
+		zw.Write(p.content.Bytes())
+		zw.Close()
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", stream.Len(), stream.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the finished document.
+func (d *Document) Bytes() []byte {
+	var buf bytes.Buffer
+	d.WriteTo(&buf)
+	return buf.Bytes()
+}
@@ -0,0 +1,63 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestDocumentXref(t *testing.T) {
+	d := New("支払明細書 2026-10")
+	p := d.AddPage()
+	p.Text(40, 60, 16, "支払明細書")
+	p.TextRight(555, 100, 10, "¥12,571")
+	p.Line(40, 110, 555, 110)
+	d.AddPage().Rect(40, 40, 100, 20)
+	out := d.Bytes()
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF: %q...", out[:20])
+	}
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Error("page count missing")
+	}
+
+	// Every xref entry must point at the object it numbers
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 10 {
+		t.Fatalf("xref has %d objects, want 10", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		want := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !bytes.HasPrefix(out[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q, want %q", i+1, out[off:off+10], want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	if got := encode("A円"); got != "00415186" {
+		t.Errorf("encode = %s", got)
+	}
+	if got := encode("🙂"); got != "003F" {
+		t.Errorf("encode of an emoji = %s, want a question mark", got)
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	// Half width for Latin and the yen sign, full width for kana and kanji
+	if got := TextWidth("¥1,000", 10); got != 30 {
+		t.Errorf("TextWidth of figures = %v, want 30", got)
+	}
+	if got := TextWidth("源泉", 10); got != 20 {
+		t.Errorf("TextWidth of kanji = %v, want 20", got)
+	}
+}
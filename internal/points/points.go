@@ -0,0 +1,273 @@
+// Package points keeps guests' loyalty points, earned on completed bookings
+// and spent as a discount on later ones.
+//
+// Points are kept as lots: each booking's earned points, points awarded
+// otherwise and points given back from a booking that fell through make a
+// lot that lapses on its own date. Spending takes from the lots that lapse
+// first, so a guest never loses points they could have used.
+package points
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+)
+
+// Currency is what points are worth: a point takes one yen off a booking, and
+// only yen bookings earn them.
+const Currency = models.CurrencyJPY
+
+var (
+	// ErrInsufficient is returned for spending more points than the guest has.
+	ErrInsufficient = errors.New("not enough points")
+	// ErrCurrency is returned for spending points on a booking not in yen.
+	ErrCurrency = errors.New("points can only be spent on bookings in yen")
+)
+
+// Program is how points are earned.
+type Program struct {
+	// Rate is the percent of what the guest paid they earn as points.
+	Rate int
+	// VIPMultiplier multiplies the points for a booking with a VIP cast.
+	VIPMultiplier int
+	// ExpiryMonths is how long points last once earned.
+	ExpiryMonths int
+}
+
+// Earned returns the points a guest earns for paying paid for a booking with a
+// cast of the given rank, rounded down.
+func (p Program) Earned(paid models.Money, rank models.CastRank) int {
+	if paid.Currency != Currency || !paid.IsPositive() || p.Rate <= 0 {
+		return 0
+	}
+	n := paid.Amount * int64(p.Rate) / 100
+	if rank == models.CastRankVIP && p.VIPMultiplier > 1 {
+		n *= int64(p.VIPMultiplier)
+	}
+	return int(n)
+}
+
+// Earn credits the guest with the points for a completed booking and returns
+// how many. A booking earns once; later calls return 0.
+func (p Program) Earn(db *database.DB, bookingID int, now time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var guestID int
+	var status models.BookingStatus
+	var currency models.Currency
+	var rank models.CastRank
+	err = tx.QueryRow(`
+		SELECT b.guest_id, b.status, b.currency, cp.rank
+		FROM bookings b
+		JOIN cast_profiles cp ON b.cast_id = cp.user_id
+		WHERE b.id = $1
+	`, bookingID).Scan(&guestID, &status, &currency, &rank)
+	if err != nil {
+		return 0, fmt.Errorf("error getting booking %d: %w", bookingID, err)
+	}
+	if status != models.BookingStatusCompleted {
+		return 0, fmt.Errorf("booking %d is %s, not completed", bookingID, status)
+	}
+
+	paid, err := ledger.Collected(tx, bookingID, currency)
+	if err != nil {
+		return 0, err
+	}
+	n := p.Earned(paid, rank)
+	if n == 0 {
+		return 0, nil
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO guest_points (guest_id, booking_id, kind, points, remaining, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+		ON CONFLICT (booking_id, kind) WHERE kind IN ('earned', 'redeemed', 'restored') DO NOTHING
+	`, guestID, bookingID, models.PointsEarned, n, now.AddDate(0, p.ExpiryMonths, 0))
+	if err != nil {
+		return 0, fmt.Errorf("error crediting points for booking %d: %w", bookingID, err)
+	}
+	if added, _ := res.RowsAffected(); added == 0 {
+		return 0, nil
+	}
+	return n, tx.Commit()
+}
+
+// Award credits the guest with n points of the given kind that aren't for a
+// booking, such as a referral reward, lasting as long as earned points.
+func (p Program) Award(tx ledger.Execer, guestID int, kind models.PointsKind, n int, now time.Time) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO guest_points (guest_id, kind, points, remaining, expires_at)
+		VALUES ($1, $2, $3, $3, $4)
+	`, guestID, kind, n, now.AddDate(0, p.ExpiryMonths, 0))
+	if err != nil {
+		return fmt.Errorf("error awarding points to guest %d: %w", guestID, err)
+	}
+	return nil
+}
+
+// Balance returns the points the guest can spend at now.
+func Balance(q ledger.Execer, guestID int, now time.Time) (int, error) {
+	var n int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(remaining), 0) FROM guest_points
+		WHERE guest_id = $1 AND remaining > 0 AND expires_at > $2
+	`, guestID, now).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("error getting points balance of guest %d: %w", guestID, err)
+	}
+	return n, nil
+}
+
+// NextExpiry returns the guest's points that lapse first and when, or zero
+// points if they have none.
+func NextExpiry(q ledger.Execer, guestID int, now time.Time) (int, *time.Time, error) {
+	var n int
+	var at *time.Time
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(remaining), 0), MIN(expires_at) FROM guest_points
+		WHERE guest_id = $1 AND remaining > 0 AND expires_at = (
+			SELECT MIN(expires_at) FROM guest_points
+			WHERE guest_id = $1 AND remaining > 0 AND expires_at > $2
+		)
+	`, guestID, now).Scan(&n, &at)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error getting next points expiry of guest %d: %w", guestID, err)
+	}
+	return n, at, nil
+}
+
+// History returns the guest's points entries, newest first.
+func History(db *database.DB, guestID, limit int) ([]models.PointsEntry, error) {
+	rows, err := db.Query(`
+		SELECT id, booking_id, kind, points, expires_at, created_at
+		FROM guest_points
+		WHERE guest_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, guestID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying points of guest %d: %w", guestID, err)
+	}
+	defer rows.Close()
+
+	entries := []models.PointsEntry{}
+	for rows.Next() {
+		var e models.PointsEntry
+		if err := rows.Scan(&e.ID, &e.BookingID, &e.Kind, &e.Points, &e.ExpiresAt, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning points entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Redeem spends n of the guest's points on a booking, from the lots that lapse
+// first. Call it in the transaction that saves the booking, which must set its
+// points_redeemed to n. The lots stay locked until the transaction ends, so
+// two bookings can't spend the same points.
+func Redeem(tx *sql.Tx, guestID, bookingID, n int, now time.Time) error {
+	if n <= 0 {
+		return nil
+	}
+	rows, err := tx.Query(`
+		SELECT id, remaining, expires_at FROM guest_points
+		WHERE guest_id = $1 AND remaining > 0 AND expires_at > $2
+		ORDER BY expires_at, id
+		FOR UPDATE
+	`, guestID, now)
+	if err != nil {
+		return fmt.Errorf("error querying points of guest %d: %w", guestID, err)
+	}
+	type lot struct {
+		id, take  int
+		expiresAt time.Time
+	}
+	var lots []lot
+	need := n
+	for rows.Next() && need > 0 {
+		var l lot
+		var remaining int
+		if err := rows.Scan(&l.id, &remaining, &l.expiresAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning points lot: %w", err)
+		}
+		l.take = min(remaining, need)
+		need -= l.take
+		lots = append(lots, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying points of guest %d: %w", guestID, err)
+	}
+	if need > 0 {
+		return ErrInsufficient
+	}
+
+	for _, l := range lots {
+		if _, err := tx.Exec(`UPDATE guest_points SET remaining = remaining - $1 WHERE id = $2`, l.take, l.id); err != nil {
+			return fmt.Errorf("error spending points lot %d: %w", l.id, err)
+		}
+	}
+	// Points given back if the booking falls through last as long as the
+	// latest of the lots they came from
+	_, err = tx.Exec(`
+		INSERT INTO guest_points (guest_id, booking_id, kind, points, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, guestID, bookingID, models.PointsRedeemed, -n, lots[len(lots)-1].expiresAt)
+	if err != nil {
+		return fmt.Errorf("error spending points on booking %d: %w", bookingID, err)
+	}
+	return nil
+}
+
+// Restore gives back the points spent on a booking that was declined,
+// cancelled or expired, as a new lot. It does nothing for a booking that
+// didn't use points or already had them back.
+func Restore(tx ledger.Execer, bookingID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO guest_points (guest_id, booking_id, kind, points, remaining, expires_at)
+		SELECT guest_id, booking_id, $2, -points, -points, expires_at
+		FROM guest_points
+		WHERE booking_id = $1 AND kind = $3
+		ON CONFLICT (booking_id, kind) WHERE kind IN ('earned', 'redeemed', 'restored') DO NOTHING
+	`, bookingID, models.PointsRestored, models.PointsRedeemed)
+	if err != nil {
+		return fmt.Errorf("error restoring points of booking %d: %w", bookingID, err)
+	}
+	return nil
+}
+
+// Expire writes off what is left of lots that lapsed by now and returns how
+// many points went.
+func Expire(db *database.DB, now time.Time) (int64, error) {
+	var n int64
+	err := db.QueryRow(`
+		WITH lapsed AS (
+			SELECT id, guest_id, booking_id, remaining FROM guest_points
+			WHERE remaining > 0 AND expires_at <= $1
+			FOR UPDATE SKIP LOCKED
+		), cleared AS (
+			UPDATE guest_points g SET remaining = 0 FROM lapsed l WHERE g.id = l.id
+		), written AS (
+			INSERT INTO guest_points (guest_id, booking_id, kind, points)
+			SELECT guest_id, booking_id, $2, -remaining FROM lapsed
+		)
+		SELECT COALESCE(SUM(remaining), 0) FROM lapsed
+	`, now, models.PointsExpired).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("error expiring points: %w", err)
+	}
+	return n, nil
+}
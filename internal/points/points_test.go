@@ -0,0 +1,35 @@
+package points
+
+import (
+	"testing"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestEarned(t *testing.T) {
+	p := Program{Rate: 1, VIPMultiplier: 2, ExpiryMonths: 12}
+	for _, tc := range []struct {
+		name string
+		paid models.Money
+		rank models.CastRank
+		want int
+	}{
+		{"standard", models.JPY(25000), models.CastRankStandard, 250},
+		{"premium", models.JPY(30000), models.CastRankPremium, 300},
+		{"vip", models.JPY(40000), models.CastRankVIP, 800},
+		{"rounded down", models.JPY(12345), models.CastRankStandard, 123},
+		{"refunded", models.JPY(0), models.CastRankStandard, 0},
+		{"not yen", models.NewMoney(20000, models.CurrencyUSD), models.CastRankStandard, 0},
+	} {
+		if got := p.Earned(tc.paid, tc.rank); got != tc.want {
+			t.Errorf("%s: Earned(%v, %s) = %d, want %d", tc.name, tc.paid, tc.rank, got, tc.want)
+		}
+	}
+
+	if got := (Program{Rate: 0, VIPMultiplier: 2}).Earned(models.JPY(40000), models.CastRankVIP); got != 0 {
+		t.Errorf("Earned with no rate = %d, want 0", got)
+	}
+	if got := (Program{Rate: 3}).Earned(models.JPY(10000), models.CastRankVIP); got != 300 {
+		t.Errorf("Earned with no VIP multiplier = %d, want 300", got)
+	}
+}
@@ -0,0 +1,333 @@
+// Package promos keeps the promo codes admins set up for campaigns and works
+// out what they take off guests' bookings.
+package promos
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/models"
+)
+
+// Reasons a code can't be used for a booking
+var (
+	ErrNotFound         = errors.New("promo code not found")
+	ErrInactive         = errors.New("promo code is not active")
+	ErrUsedUp           = errors.New("promo code has been used up")
+	ErrUserLimit        = errors.New("promo code already used the maximum number of times")
+	ErrFirstBookingOnly = errors.New("promo code is for first bookings only")
+	ErrNotApplicable    = errors.New("promo code doesn't apply to this booking")
+	ErrExceedsPrice     = errors.New("promo code is worth more than the booking")
+)
+
+// Reasons a code can't be saved
+var (
+	ErrInvalid   = errors.New("invalid promo code")
+	ErrCodeTaken = errors.New("promo code already exists")
+)
+
+var (
+	codePattern     = regexp.MustCompile(`^[A-Z0-9_-]+$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Querier runs the queries Apply needs, on the database or in a transaction.
+type Querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Booking is what a code is checked against.
+type Booking struct {
+	GuestID   int
+	CastRank  models.CastRank
+	CastAreas []string
+	// Amount is the full price, before the discount.
+	Amount models.Money
+}
+
+// Normalize returns code as it is stored: trimmed and upper case.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate checks a promo code before it is saved.
+func Validate(in models.PromoCodeInput) error {
+	if !codePattern.MatchString(Normalize(in.Code)) {
+		return fmt.Errorf("%w: code may only contain letters, digits, - and _", ErrInvalid)
+	}
+	switch in.DiscountType {
+	case models.DiscountPercent:
+		if in.DiscountValue < 1 || in.DiscountValue > 99 {
+			return fmt.Errorf("%w: percent discounts must be between 1 and 99", ErrInvalid)
+		}
+		if in.Currency != nil {
+			return fmt.Errorf("%w: percent discounts don't take a currency", ErrInvalid)
+		}
+	case models.DiscountFixed:
+		if in.Currency == nil || !currencyPattern.MatchString(string(*in.Currency)) {
+			return fmt.Errorf("%w: fixed discounts need a currency such as JPY", ErrInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: unknown discount type %q", ErrInvalid, in.DiscountType)
+	}
+	if in.StartsAt != nil && in.EndsAt != nil && !in.EndsAt.After(*in.StartsAt) {
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalid)
+	}
+	return nil
+}
+
+// Check reports whether the code can be used for the booking at now, as far
+// as the code alone decides: usage limits are counted by Apply.
+func Check(p *models.PromoCode, b Booking, now time.Time) error {
+	if !p.Active || (p.StartsAt != nil && now.Before(*p.StartsAt)) || (p.EndsAt != nil && !now.Before(*p.EndsAt)) {
+		return ErrInactive
+	}
+	if len(p.CastRanks) > 0 && !containsRank(p.CastRanks, b.CastRank) {
+		return ErrNotApplicable
+	}
+	if len(p.ServiceAreas) > 0 && !overlaps(p.ServiceAreas, b.CastAreas) {
+		return ErrNotApplicable
+	}
+	if p.DiscountType == models.DiscountFixed && (p.Currency == nil || *p.Currency != b.Amount.Currency) {
+		return ErrNotApplicable
+	}
+	return nil
+}
+
+// Discount returns what the code takes off amount. The guest must still pay
+// something, as Stripe can't authorize nothing.
+func Discount(p *models.PromoCode, amount models.Money) (models.Money, error) {
+	var d models.Money
+	switch p.DiscountType {
+	case models.DiscountPercent:
+		d = amount.Percent(int(p.DiscountValue))
+	case models.DiscountFixed:
+		d = models.NewMoney(p.DiscountValue, amount.Currency)
+	default:
+		return amount.Zero(), fmt.Errorf("unknown discount type %q", p.DiscountType)
+	}
+	if d.Cmp(amount) >= 0 {
+		return amount.Zero(), ErrExceedsPrice
+	}
+	return d, nil
+}
+
+// Apply looks up code and returns it with what it takes off the booking. In a
+// transaction, pass lock to hold the code until the booking is saved, so
+// bookings made at the same time can't use it past its limits.
+func Apply(q Querier, code string, b Booking, now time.Time, lock bool) (*models.PromoCode, models.Money, error) {
+	query := `SELECT ` + columns + ` FROM promo_codes p WHERE UPPER(p.code) = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	p, err := scan(q.QueryRow(query, Normalize(code)))
+	if err == sql.ErrNoRows {
+		return nil, models.Money{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, models.Money{}, fmt.Errorf("error getting promo code: %w", err)
+	}
+	if err := Check(p, b, now); err != nil {
+		return nil, models.Money{}, err
+	}
+
+	// Counted again now the code is locked: the count read with it comes from
+	// before the lock was granted, so it can miss bookings saved meanwhile
+	var byGuest int
+	err = q.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE guest_id = $2) FROM bookings
+		WHERE promo_code_id = $1 AND status NOT IN ('declined', 'expired')
+	`, p.ID, b.GuestID).Scan(&p.Uses, &byGuest)
+	if err != nil {
+		return nil, models.Money{}, fmt.Errorf("error counting uses of promo code %d: %w", p.ID, err)
+	}
+	if p.MaxUses != nil && p.Uses >= *p.MaxUses {
+		return nil, models.Money{}, ErrUsedUp
+	}
+	if p.MaxUsesPerUser != nil && byGuest >= *p.MaxUsesPerUser {
+		return nil, models.Money{}, ErrUserLimit
+	}
+	if p.FirstBookingOnly {
+		var booked bool
+		err := q.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM bookings WHERE guest_id = $1 AND status NOT IN ('declined', 'expired'))
+		`, b.GuestID).Scan(&booked)
+		if err != nil {
+			return nil, models.Money{}, fmt.Errorf("error checking guest %d's bookings: %w", b.GuestID, err)
+		}
+		if booked {
+			return nil, models.Money{}, ErrFirstBookingOnly
+		}
+	}
+
+	d, err := Discount(p, b.Amount)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	return p, d, nil
+}
+
+// columns are a promo code's, with its uses counted.
+const columns = `
+	p.id, p.code, p.description, p.discount_type, p.discount_value, p.currency,
+	p.starts_at, p.ends_at, p.max_uses, p.max_uses_per_user, p.first_booking_only,
+	p.cast_ranks, p.service_areas, p.active, p.created_at, p.updated_at,
+	(SELECT COUNT(*) FROM bookings b WHERE b.promo_code_id = p.id AND b.status NOT IN ('declined', 'expired'))`
+
+func scan(row interface{ Scan(...interface{}) error }) (*models.PromoCode, error) {
+	var p models.PromoCode
+	var ranks []string
+	var maxUses, maxPerUser sql.NullInt64
+	err := row.Scan(&p.ID, &p.Code, &p.Description, &p.DiscountType, &p.DiscountValue, &p.Currency,
+		&p.StartsAt, &p.EndsAt, &maxUses, &maxPerUser, &p.FirstBookingOnly,
+		pq.Array(&ranks), pq.Array(&p.ServiceAreas), &p.Active, &p.CreatedAt, &p.UpdatedAt, &p.Uses)
+	if err != nil {
+		return nil, err
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		p.MaxUses = &n
+	}
+	if maxPerUser.Valid {
+		n := int(maxPerUser.Int64)
+		p.MaxUsesPerUser = &n
+	}
+	p.CastRanks = []models.CastRank{}
+	for _, r := range ranks {
+		p.CastRanks = append(p.CastRanks, models.CastRank(r))
+	}
+	if p.ServiceAreas == nil {
+		p.ServiceAreas = []string{}
+	}
+	return &p, nil
+}
+
+// List returns every promo code, newest first.
+func List(db *database.DB) ([]models.PromoCode, error) {
+	rows, err := db.Query(`SELECT ` + columns + ` FROM promo_codes p ORDER BY p.id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying promo codes: %w", err)
+	}
+	defer rows.Close()
+
+	codes := []models.PromoCode{}
+	for rows.Next() {
+		p, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning promo code: %w", err)
+		}
+		codes = append(codes, *p)
+	}
+	return codes, rows.Err()
+}
+
+// Get returns a promo code by its ID.
+func Get(db *database.DB, id int) (*models.PromoCode, error) {
+	p, err := scan(db.QueryRow(`SELECT `+columns+` FROM promo_codes p WHERE p.id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting promo code %d: %w", id, err)
+	}
+	return p, nil
+}
+
+// Create saves a new promo code. It is active unless in says otherwise.
+func Create(db *database.DB, in models.PromoCodeInput) (*models.PromoCode, error) {
+	if err := Validate(in); err != nil {
+		return nil, err
+	}
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO promo_codes (code, description, discount_type, discount_value, currency, starts_at, ends_at,
+		                         max_uses, max_uses_per_user, first_booking_only, cast_ranks, service_areas, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id
+	`, inputArgs(in, true)...).Scan(&id)
+	if err != nil {
+		return nil, saveError(err)
+	}
+	return Get(db, id)
+}
+
+// Update replaces a promo code's settings. Bookings already made with it
+// keep the discount they got.
+func Update(db *database.DB, id int, in models.PromoCodeInput) (*models.PromoCode, error) {
+	if err := Validate(in); err != nil {
+		return nil, err
+	}
+	args := append(inputArgs(in, false), id)
+	res, err := db.Exec(`
+		UPDATE promo_codes
+		SET code = $1, description = $2, discount_type = $3, discount_value = $4, currency = $5,
+		    starts_at = $6, ends_at = $7, max_uses = $8, max_uses_per_user = $9, first_booking_only = $10,
+		    cast_ranks = $11, service_areas = $12, active = COALESCE($13, active)
+		WHERE id = $14
+	`, args...)
+	if err != nil {
+		return nil, saveError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return Get(db, id)
+}
+
+// inputArgs are in's columns in the order Create and Update take them. An
+// unset active is true for a new code and left as it is otherwise.
+func inputArgs(in models.PromoCodeInput, create bool) []interface{} {
+	ranks := make([]string, len(in.CastRanks))
+	for i, r := range in.CastRanks {
+		ranks[i] = string(r)
+	}
+	areas := in.ServiceAreas
+	if areas == nil {
+		areas = []string{}
+	}
+	var active interface{}
+	if in.Active != nil {
+		active = *in.Active
+	} else if create {
+		active = true
+	}
+	return []interface{}{
+		Normalize(in.Code), strings.TrimSpace(in.Description), in.DiscountType, in.DiscountValue, in.Currency,
+		in.StartsAt, in.EndsAt, in.MaxUses, in.MaxUsesPerUser, in.FirstBookingOnly,
+		pq.Array(ranks), pq.Array(areas), active,
+	}
+}
+
+func saveError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrCodeTaken
+	}
+	return fmt.Errorf("error saving promo code: %w", err)
+}
+
+func containsRank(ranks []models.CastRank, r models.CastRank) bool {
+	for _, x := range ranks {
+		if x == r {
+			return true
+		}
+	}
+	return false
+}
+
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
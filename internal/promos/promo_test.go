@@ -0,0 +1,92 @@
+package promos
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestValidate(t *testing.T) {
+	jpy := models.CurrencyJPY
+	start := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(30 * 24 * time.Hour)
+	for _, tc := range []struct {
+		name string
+		in   models.PromoCodeInput
+		ok   bool
+	}{
+		{"percent", models.PromoCodeInput{Code: "spring-10", DiscountType: models.DiscountPercent, DiscountValue: 10}, true},
+		{"fixed", models.PromoCodeInput{Code: "WELCOME", DiscountType: models.DiscountFixed, DiscountValue: 3000, Currency: &jpy}, true},
+		{"window", models.PromoCodeInput{Code: "APRIL", DiscountType: models.DiscountPercent, DiscountValue: 5, StartsAt: &start, EndsAt: &end}, true},
+		{"bad code", models.PromoCodeInput{Code: "10% OFF", DiscountType: models.DiscountPercent, DiscountValue: 10}, false},
+		{"whole price", models.PromoCodeInput{Code: "FREE", DiscountType: models.DiscountPercent, DiscountValue: 100}, false},
+		{"percent with currency", models.PromoCodeInput{Code: "X", DiscountType: models.DiscountPercent, DiscountValue: 10, Currency: &jpy}, false},
+		{"fixed without currency", models.PromoCodeInput{Code: "X", DiscountType: models.DiscountFixed, DiscountValue: 1000}, false},
+		{"window backwards", models.PromoCodeInput{Code: "X", DiscountType: models.DiscountPercent, DiscountValue: 5, StartsAt: &end, EndsAt: &start}, false},
+	} {
+		err := Validate(tc.in)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, ErrInvalid)) {
+			t.Errorf("%s: Validate = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	jpy := models.CurrencyJPY
+	now := time.Date(2024, 4, 15, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	b := Booking{GuestID: 1, CastRank: models.CastRankPremium, CastAreas: []string{"Ginza", "Roppongi"}, Amount: models.JPY(20000)}
+
+	for _, tc := range []struct {
+		name string
+		p    models.PromoCode
+		want error
+	}{
+		{"any booking", models.PromoCode{Active: true, DiscountType: models.DiscountPercent}, nil},
+		{"inactive", models.PromoCode{DiscountType: models.DiscountPercent}, ErrInactive},
+		{"not started", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, StartsAt: &after}, ErrInactive},
+		{"ended", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, EndsAt: &before}, ErrInactive},
+		{"in window", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, StartsAt: &before, EndsAt: &after}, nil},
+		{"rank", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, CastRanks: []models.CastRank{models.CastRankPremium}}, nil},
+		{"other rank", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, CastRanks: []models.CastRank{models.CastRankVIP}}, ErrNotApplicable},
+		{"area", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, ServiceAreas: []string{"Shibuya", "Ginza"}}, nil},
+		{"other area", models.PromoCode{Active: true, DiscountType: models.DiscountPercent, ServiceAreas: []string{"Shibuya"}}, ErrNotApplicable},
+		{"currency", models.PromoCode{Active: true, DiscountType: models.DiscountFixed, Currency: &jpy}, nil},
+	} {
+		if err := Check(&tc.p, b, now); !errors.Is(err, tc.want) || (err == nil) != (tc.want == nil) {
+			t.Errorf("%s: Check = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	usd := models.CurrencyUSD
+	p := models.PromoCode{Active: true, DiscountType: models.DiscountFixed, Currency: &usd}
+	if err := Check(&p, b, now); !errors.Is(err, ErrNotApplicable) {
+		t.Errorf("fixed discount in another currency: Check = %v, want ErrNotApplicable", err)
+	}
+}
+
+func TestDiscount(t *testing.T) {
+	jpy := models.CurrencyJPY
+	for _, tc := range []struct {
+		p      models.PromoCode
+		amount int64
+		want   int64
+		err    error
+	}{
+		{models.PromoCode{DiscountType: models.DiscountPercent, DiscountValue: 10}, 25000, 2500, nil},
+		{models.PromoCode{DiscountType: models.DiscountPercent, DiscountValue: 15}, 12345, 1852, nil}, // 1851.75
+		{models.PromoCode{DiscountType: models.DiscountFixed, DiscountValue: 3000, Currency: &jpy}, 20000, 3000, nil},
+		{models.PromoCode{DiscountType: models.DiscountFixed, DiscountValue: 3000, Currency: &jpy}, 3000, 0, ErrExceedsPrice},
+	} {
+		got, err := Discount(&tc.p, models.JPY(tc.amount))
+		if !errors.Is(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("Discount(%s %d, ¥%d) error = %v, want %v", tc.p.DiscountType, tc.p.DiscountValue, tc.amount, err, tc.err)
+			continue
+		}
+		if got != models.JPY(tc.want) {
+			t.Errorf("Discount(%s %d, ¥%d) = %v, want ¥%d", tc.p.DiscountType, tc.p.DiscountValue, tc.amount, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package receipts issues guests' receipts (領収書) for bookings. Receipts
+// carry what the invoice system requires of a qualified simplified invoice
+// (適格簡易請求書): the issuer's registration number, the tax rate and the
+// consumption tax included in the amount.
+package receipts
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+)
+
+// StandardTaxRate is the consumption tax rate, in percent, that bookings'
+// prices include.
+const StandardTaxRate = 10
+
+var (
+	// ErrNotFound means the booking doesn't exist or isn't the guest's.
+	ErrNotFound = errors.New("booking not found")
+	// ErrNotFinal means the booking isn't completed or cancelled yet, so
+	// what the guest pays for it may still change.
+	ErrNotFinal = errors.New("booking is not completed or cancelled")
+	// ErrNothingPaid means the guest was refunded everything they paid.
+	ErrNothingPaid = errors.New("nothing was paid for the booking")
+	// ErrRecipientChanged means a copy was asked for in a different name
+	// from the original's.
+	ErrRecipientChanged = errors.New("receipt was issued to a different name")
+)
+
+var registrationNumber = regexp.MustCompile(`^T[0-9]{13}$`)
+
+// ValidRegistrationNumber reports whether s is a qualified invoice issuer
+// registration number, "T" followed by 13 digits.
+func ValidRegistrationNumber(s string) bool {
+	return registrationNumber.MatchString(s)
+}
+
+// Issuer is the platform operator, who receives the guest's payment.
+type Issuer struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+// Receipt is a receipt for what the guest paid for a booking.
+type Receipt struct {
+	Number        int       `json:"number"`
+	BookingID     int       `json:"booking_id"`
+	RecipientName string    `json:"recipient_name"`
+	Description   string    `json:"description"`
+	Issuer        Issuer    `json:"issuer"`
+	IssuedAt      time.Time `json:"issued_at"`
+	// Amount is what the guest paid for the booking, less refunds,
+	// including Tax at TaxRate percent. A zero TaxRate means the amount isn't
+	// subject to consumption tax. Tips are left off: they are a gift to the
+	// cast rather than payment for the booking, so they are outside
+	// consumption tax and not part of the invoice.
+	Amount  models.Money `json:"amount"`
+	TaxRate int          `json:"tax_rate"`
+	Tax     models.Money `json:"tax"`
+	// RegistrationNumber is the issuer's as it was when the receipt was
+	// first issued. Without one the receipt isn't a qualified invoice.
+	RegistrationNumber string `json:"registration_number,omitempty"`
+	// Copy counts the times the receipt has been re-issued, 0 for the
+	// original.
+	Copy int `json:"copy"`
+}
+
+// Duplicate reports whether the receipt is a re-issued copy (再発行).
+func (r *Receipt) Duplicate() bool {
+	return r.Copy > 0
+}
+
+// DisplayNumber is the receipt number as printed.
+func (r *Receipt) DisplayNumber() string {
+	return fmt.Sprintf("R%08d", r.Number)
+}
+
+// IncludedTax returns the consumption tax included in amount at rate
+// percent, rounded down once for the whole receipt.
+func IncludedTax(amount models.Money, rate int) models.Money {
+	return amount.ProrateDown(int64(rate), int64(100+rate))
+}
+
+// Issue returns the guest's receipt for the booking, issuing it the first
+// time and a copy after that. A refund voids the receipt (see
+// booking.Machine.RecordRefund), and the next call issues a new one, under a
+// new number, for what was paid by then. recipient is the name it is made out to; an
+// empty one means the guest's own name, or the original's for a copy.
+// registration is the issuer's registration number, if it has one.
+func Issue(db *database.DB, issuer Issuer, registration string, bookingID, guestID int, recipient string) (*Receipt, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		status        models.BookingStatus
+		currency      models.Currency
+		startsAt      time.Time
+		durationHours int
+		guestName     string
+	)
+	err = tx.QueryRow(`
+		SELECT b.status, b.currency, b.starts_at, b.duration_hours, g.name
+		FROM bookings b
+		JOIN users g ON b.guest_id = g.id
+		WHERE b.id = $1 AND b.guest_id = $2
+		FOR UPDATE OF b
+	`, bookingID, guestID).Scan(&status, &currency, &startsAt, &durationHours, &guestName)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting booking %d: %w", bookingID, err)
+	}
+	recipient = strings.TrimSpace(recipient)
+
+	r, err := get(tx, bookingID)
+	if err == nil {
+		if recipient != "" && recipient != r.RecipientName {
+			return nil, ErrRecipientChanged
+		}
+		err = tx.QueryRow(`
+			UPDATE receipts SET copies = copies + 1, last_copied_at = NOW()
+			WHERE booking_id = $1 AND voided_at IS NULL
+			RETURNING copies
+		`, bookingID).Scan(&r.Copy)
+		if err != nil {
+			return nil, fmt.Errorf("error re-issuing receipt: %w", err)
+		}
+		r.Issuer = issuer
+		return r, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	r = &Receipt{BookingID: bookingID, Issuer: issuer, RegistrationNumber: registration}
+	if recipient == "" {
+		recipient = guestName
+	}
+	r.RecipientName = recipient
+
+	// The booking is only receipted once it is completed or cancelled, so
+	// only a refund or a tip can change what was paid afterwards. A refund
+	// voids the receipt, and tips aren't on it.
+	detail := fmt.Sprintf("予約番号 #%d（%s〜 %d時間）",
+		bookingID, startsAt.In(booking.Tokyo).Format("2006/01/02 15:04"), durationHours)
+	switch status {
+	case models.BookingStatusCompleted:
+		r.Description = "接客サービス料 " + detail
+		r.TaxRate = StandardTaxRate
+	case models.BookingStatusCancelled:
+		// A cancellation fee compensates for the booking lost rather than
+		// paying for a service, so it is outside consumption tax
+		r.Description = "キャンセル料 " + detail
+	default:
+		return nil, ErrNotFinal
+	}
+
+	r.Amount, err = ledger.Charged(tx, bookingID, currency)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Amount.IsPositive() {
+		return nil, ErrNothingPaid
+	}
+	r.Tax = IncludedTax(r.Amount, r.TaxRate)
+
+	// Numbers are taken under a table lock rather than from a sequence, so
+	// a failed issue leaves no gap
+	if _, err := tx.Exec("LOCK TABLE receipts IN EXCLUSIVE MODE"); err != nil {
+		return nil, fmt.Errorf("error locking receipts: %w", err)
+	}
+	var reg *string
+	if registration != "" {
+		reg = &registration
+	}
+	err = tx.QueryRow(`
+		INSERT INTO receipts (number, booking_id, recipient_name, description,
+		                      amount, currency, tax_rate, tax, registration_number)
+		SELECT COALESCE(MAX(number), 0) + 1, $1, $2, $3, $4, $5, $6, $7, $8 FROM receipts
+		RETURNING number, issued_at
+	`, bookingID, r.RecipientName, r.Description, r.Amount.Amount, r.Amount.Currency,
+		r.TaxRate, r.Tax.Amount, reg).Scan(&r.Number, &r.IssuedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error issuing receipt: %w", err)
+	}
+	return r, tx.Commit()
+}
+
+// get returns the booking's current receipt as first issued, or
+// sql.ErrNoRows if it has none or it was voided.
+func get(tx *sql.Tx, bookingID int) (*Receipt, error) {
+	r := &Receipt{BookingID: bookingID}
+	var reg sql.NullString
+	err := tx.QueryRow(`
+		SELECT number, recipient_name, description, amount, currency,
+		       tax_rate, tax, registration_number, issued_at
+		FROM receipts WHERE booking_id = $1 AND voided_at IS NULL
+		FOR UPDATE
+	`, bookingID).Scan(&r.Number, &r.RecipientName, &r.Description, &r.Amount.Amount, &r.Amount.Currency,
+		&r.TaxRate, &r.Tax.Amount, &reg, &r.IssuedAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting receipt for booking %d: %w", bookingID, err)
+	}
+	r.Tax.Currency = r.Amount.Currency
+	r.RegistrationNumber = reg.String
+	return r, nil
+}
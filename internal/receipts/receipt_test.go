@@ -0,0 +1,97 @@
+package receipts
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/models"
+)
+
+func TestValidRegistrationNumber(t *testing.T) {
+	for s, want := range map[string]bool{
+		"T1234567890123":  true,
+		"1234567890123":   false,
+		"T123456789012":   false,
+		"T12345678901234": false,
+		"t1234567890123":  false,
+		"T12345678901a3":  false,
+		"":                false,
+	} {
+		if got := ValidRegistrationNumber(s); got != want {
+			t.Errorf("ValidRegistrationNumber(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestIncludedTax(t *testing.T) {
+	for _, tc := range []struct {
+		amount int64
+		rate   int
+		want   int64
+	}{
+		{22000, 10, 2000},
+		{12345, 10, 1122}, // 1122.27, rounded down
+		{9999, 10, 909},
+		{5000, 0, 0},
+	} {
+		if got := IncludedTax(models.JPY(tc.amount), tc.rate); got != models.JPY(tc.want) {
+			t.Errorf("IncludedTax(%d, %d) = %v, want ¥%d", tc.amount, tc.rate, got, tc.want)
+		}
+	}
+}
+
+func receipt(copy int) *Receipt {
+	return &Receipt{
+		Number:             42,
+		BookingID:          7,
+		RecipientName:      "株式会社<テスト>",
+		Description:        "接客サービス料 予約番号 #7（2026/10/01 19:00〜 2時間）",
+		Issuer:             Issuer{Name: "Uso"},
+		IssuedAt:           time.Date(2026, 10, 2, 1, 0, 0, 0, time.UTC),
+		Amount:             models.JPY(22000),
+		TaxRate:            10,
+		Tax:                models.JPY(2000),
+		RegistrationNumber: "T1234567890123",
+		Copy:               copy,
+	}
+}
+
+func TestHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := receipt(0).WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		"No. R00000042",
+		"発行日 2026年10月2日",
+		"株式会社&lt;テスト&gt; 様",
+		"¥22,000-",
+		"10%対象 ¥22,000（内消費税等 ¥2,000）",
+		"登録番号 T1234567890123",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %q", want)
+		}
+	}
+	if strings.Contains(html, "再発行") {
+		t.Error("original receipt marked as re-issued")
+	}
+
+	buf.Reset()
+	receipt(1).WriteHTML(&buf)
+	if !strings.Contains(buf.String(), "領収書（再発行）") || !strings.Contains(buf.String(), `class="duplicate"`) {
+		t.Error("copy not marked as re-issued")
+	}
+}
+
+func TestPDF(t *testing.T) {
+	for _, r := range []*Receipt{receipt(0), receipt(2)} {
+		b := r.PDF()
+		if !bytes.HasPrefix(b, []byte("%PDF-")) || !bytes.Contains(b, []byte("/Count 1")) {
+			t.Errorf("copy %d: not a one-page PDF", r.Copy)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package receipts
+
+import (
+	"html/template"
+	"io"
+	"strconv"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/pdf"
+)
+
+// TaxLabel describes the tax included in the amount, as printed beside it.
+func (r *Receipt) TaxLabel() string {
+	if r.TaxRate == 0 {
+		return "不課税"
+	}
+	return strconv.Itoa(r.TaxRate) + "%対象"
+}
+
+// IssuedDate is the date the receipt was first issued, in Tokyo.
+func (r *Receipt) IssuedDate() string {
+	return r.IssuedAt.In(booking.Tokyo).Format("2006年1月2日")
+}
+
+// Layout of the PDF receipt, in points
+const (
+	marginLeft  = 60.0
+	marginRight = pdf.PageWidth - 60
+)
+
+// PDF renders the receipt.
+func (r *Receipt) PDF() []byte {
+	title := "領収書"
+	if r.Duplicate() {
+		title = "領収書（再発行）"
+	}
+	d := pdf.New(title + " " + r.DisplayNumber())
+	p := d.AddPage()
+
+	if r.Duplicate() {
+		p.Rect(marginLeft, 40, 80, 24)
+		p.Text(marginLeft+16, 57, 14, "再発行")
+	}
+	p.Text(pdf.PageWidth/2-pdf.TextWidth(title, 22)/2, 100, 22, title)
+	p.TextRight(marginRight, 60, 9, "No. "+r.DisplayNumber())
+	p.TextRight(marginRight, 74, 9, "発行日 "+r.IssuedDate())
+
+	p.Text(marginLeft, 150, 14, r.RecipientName+" 様")
+	p.Line(marginLeft, 156, marginLeft+280, 156)
+
+	amount := r.Amount.String() + "-"
+	p.Rect(marginLeft, 180, marginRight-marginLeft, 44)
+	p.Text(marginLeft+16, 208, 12, "金額")
+	p.TextRight(marginRight-16, 210, 20, amount)
+
+	y := 250.0
+	rows := [][2]string{
+		{"但し", r.Description + " として"},
+		{"内訳", r.TaxLabel() + " " + r.Amount.String()},
+	}
+	if r.TaxRate > 0 {
+		rows = append(rows, [2]string{"", "（内消費税等 " + r.Tax.String() + "）"})
+	}
+	for _, row := range rows {
+		p.Text(marginLeft, y, 10, row[0])
+		p.Text(marginLeft+50, y, 10, row[1])
+		y += 18
+	}
+	p.Text(marginLeft+50, y, 10, "上記正に領収いたしました。")
+
+	y = 400
+	for _, s := range []string{r.Issuer.Name, r.Issuer.Address, r.Issuer.Phone} {
+		if s != "" {
+			p.TextRight(marginRight, y, 10, s)
+			y += 14
+		}
+	}
+	if r.RegistrationNumber != "" {
+		p.TextRight(marginRight, y, 10, "登録番号 "+r.RegistrationNumber)
+	}
+	if r.Duplicate() {
+		p.Text(marginLeft, 520, 8, "本書は再発行したものです。原本と同一の内容で、原本に代わるものではありません。")
+	}
+	return d.Bytes()
+}
+
+var htmlTemplate = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>{{if .Duplicate}}領収書（再発行）{{else}}領収書{{end}} {{.DisplayNumber}}</title>
+<style>
+body { font-family: "Hiragino Kaku Gothic ProN", "Noto Sans JP", sans-serif; max-width: 640px; margin: 40px auto; color: #111; }
+h1 { text-align: center; letter-spacing: 0.5em; }
+.duplicate { display: inline-block; border: 2px solid #c00; color: #c00; padding: 4px 12px; font-weight: bold; }
+.meta { text-align: right; font-size: 13px; }
+.recipient { font-size: 20px; border-bottom: 1px solid #111; display: inline-block; min-width: 60%; }
+.amount { border: 1px solid #111; padding: 12px 16px; font-size: 26px; text-align: right; margin: 24px 0; }
+.amount span { float: left; font-size: 16px; line-height: 36px; }
+.issuer { text-align: right; margin-top: 48px; }
+.note { font-size: 12px; color: #555; }
+</style>
+</head>
+<body>
+{{if .Duplicate}}<p class="duplicate">再発行</p>{{end}}
+<h1>領収書</h1>
+<p class="meta">No. {{.DisplayNumber}}<br>発行日 {{.IssuedDate}}</p>
+<p class="recipient">{{.RecipientName}} 様</p>
+<p class="amount"><span>金額</span>{{.Amount}}-</p>
+<p>但し {{.Description}} として<br>
+内訳 {{.TaxLabel}} {{.Amount}}{{if .TaxRate}}（内消費税等 {{.Tax}}）{{end}}<br>
+上記正に領収いたしました。</p>
+<div class="issuer">
+{{with .Issuer.Name}}{{.}}<br>{{end}}
+{{with .Issuer.Address}}{{.}}<br>{{end}}
+{{with .Issuer.Phone}}{{.}}<br>{{end}}
+{{with .RegistrationNumber}}登録番号 {{.}}{{end}}
+</div>
+{{if .Duplicate}}<p class="note">本書は再発行したものです。原本と同一の内容で、原本に代わるものではありません。</p>{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML renders the receipt as a page to view or print.
+func (r *Receipt) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
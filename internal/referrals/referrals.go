@@ -0,0 +1,324 @@
+// Package referrals runs the referral program. Every user has a code others
+// can sign up with; once the new user qualifies, both are rewarded.
+package referrals
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/points"
+)
+
+// ErrUnknownCode is returned for a code no user has.
+var ErrUnknownCode = errors.New("unknown referral code")
+
+// Codes leave out letters and digits that are easily mistaken for each other.
+const (
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 8
+)
+
+// NewCode returns a random code for a new user.
+func NewCode() (string, error) {
+	b := make([]byte, codeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating referral code: %w", err)
+	}
+	// 256 is a multiple of the alphabet's 32 letters, so each is as likely
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// Normalize returns code as it is stored: trimmed and upper case.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Referrer returns the user whose code this is.
+func Referrer(q ledger.Execer, code string) (int, error) {
+	var id int
+	err := q.QueryRow(`SELECT id FROM users WHERE referral_code = $1`, Normalize(code)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrUnknownCode
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up referral code: %w", err)
+	}
+	return id, nil
+}
+
+// Record notes that refereeID signed up with referrerID's code. Call it in
+// the transaction that creates the referee.
+func Record(tx ledger.Execer, referrerID, refereeID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO referrals (referrer_id, referee_id, status) VALUES ($1, $2, $3)
+	`, referrerID, refereeID, models.ReferralPending)
+	if err != nil {
+		return fmt.Errorf("error recording referral of user %d: %w", refereeID, err)
+	}
+	return nil
+}
+
+// Program is what each side of a referral gets once the referee qualifies.
+// Guests get points; casts get a bonus paid out with their earnings, with tax
+// withheld at Withholding basis points. Admins get nothing.
+type Program struct {
+	GuestPoints int
+	CastBonus   models.Money
+	Withholding int
+	Points      points.Program
+}
+
+// Reward grants both sides of the user's referral their rewards, if they
+// signed up with a code and the rewards haven't been granted yet. Call it
+// once the user qualifies. It reports whether rewards were granted.
+func (p Program) Reward(db *database.DB, refereeID int, now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var referralID, referrerID int
+	err = tx.QueryRow(`
+		SELECT id, referrer_id FROM referrals WHERE referee_id = $1 AND status = $2
+		FOR UPDATE
+	`, refereeID, models.ReferralPending).Scan(&referralID, &referrerID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error getting referral of user %d: %w", refereeID, err)
+	}
+
+	for _, userID := range []int{referrerID, refereeID} {
+		if err := p.grant(tx, referralID, userID, now); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE referrals SET status = $1, rewarded_at = $2 WHERE id = $3
+	`, models.ReferralRewarded, now, referralID)
+	if err != nil {
+		return false, fmt.Errorf("error updating referral %d: %w", referralID, err)
+	}
+	return true, tx.Commit()
+}
+
+// grant rewards one side of a referral as suits their user type.
+func (p Program) grant(tx *sql.Tx, referralID, userID int, now time.Time) error {
+	var userType models.UserType
+	if err := tx.QueryRow(`SELECT user_type FROM users WHERE id = $1`, userID).Scan(&userType); err != nil {
+		return fmt.Errorf("error getting user %d: %w", userID, err)
+	}
+
+	var kind models.ReferralRewardKind
+	var amount int64
+	var currency *models.Currency
+	switch {
+	case userType == models.UserTypeGuest && p.GuestPoints > 0:
+		if err := p.Points.Award(tx, userID, models.PointsReferral, p.GuestPoints, now); err != nil {
+			return err
+		}
+		kind, amount = models.ReferralRewardPoints, int64(p.GuestPoints)
+	case userType == models.UserTypeCast && p.CastBonus.IsPositive():
+		reference := fmt.Sprintf("referral-%d-%d", referralID, userID)
+		if err := ledger.ReferralBonus(tx, userID, p.CastBonus, p.Withholding, reference); err != nil {
+			return err
+		}
+		kind, amount, currency = models.ReferralRewardBonus, p.CastBonus.Amount, &p.CastBonus.Currency
+	default:
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO referral_rewards (referral_id, user_id, kind, amount, currency)
+		VALUES ($1, $2, $3, $4, $5)
+	`, referralID, userID, kind, amount, currency)
+	if err != nil {
+		return fmt.Errorf("error recording referral reward for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+// List returns the most recent referrals, newest first, with their chains,
+// fraud signals and rewards.
+func List(db *database.DB, limit int) ([]models.Referral, error) {
+	// Phone numbers are compared on their digits alone, however they were
+	// written
+	rows, err := db.Query(`
+		SELECT r.id, r.status, r.rewarded_at, r.created_at,
+		       a.id, a.name, a.email, a.user_type, b.id, b.name, b.email, b.user_type,
+		       COALESCE(REGEXP_REPLACE(a.phone, '\D', '', 'g') = REGEXP_REPLACE(b.phone, '\D', '', 'g')
+		                AND REGEXP_REPLACE(b.phone, '\D', '', 'g') <> '', false),
+		       COALESCE(a.signup_device_id = b.signup_device_id, false),
+		       COALESCE(a.signup_ip = b.signup_ip, false),
+		       (SELECT COUNT(*) FROM users u WHERE u.signup_device_id = b.signup_device_id AND u.id <> b.id)
+		FROM referrals r
+		JOIN users a ON r.referrer_id = a.id
+		JOIN users b ON r.referee_id = b.id
+		ORDER BY r.id DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying referrals: %w", err)
+	}
+	defer rows.Close()
+
+	referrals := []models.Referral{}
+	byID := map[int]*models.Referral{}
+	var ids, referees []int
+	for rows.Next() {
+		var r models.Referral
+		err := rows.Scan(&r.ID, &r.Status, &r.RewardedAt, &r.CreatedAt,
+			&r.Referrer.ID, &r.Referrer.Name, &r.Referrer.Email, &r.Referrer.UserType,
+			&r.Referee.ID, &r.Referee.Name, &r.Referee.Email, &r.Referee.UserType,
+			&r.Signals.SamePhone, &r.Signals.SameDevice, &r.Signals.SameIP, &r.Signals.DeviceAccounts)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning referral: %w", err)
+		}
+		r.Rewards = []models.ReferralReward{}
+		referrals = append(referrals, r)
+		ids = append(ids, r.ID)
+		referees = append(referees, r.Referee.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying referrals: %w", err)
+	}
+	for i := range referrals {
+		byID[referrals[i].ID] = &referrals[i]
+	}
+
+	if err := addRewards(db, ids, byID); err != nil {
+		return nil, err
+	}
+	referredBy, err := referrers(db, referees)
+	if err != nil {
+		return nil, err
+	}
+	for i := range referrals {
+		referrals[i].Chain = Chain(referredBy, referrals[i].Referee.ID)
+	}
+	return referrals, nil
+}
+
+func addRewards(db *database.DB, ids []int, byID map[int]*models.Referral) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := db.Query(`
+		SELECT referral_id, user_id, kind, amount, currency FROM referral_rewards
+		WHERE referral_id = ANY($1)
+		ORDER BY id
+	`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("error querying referral rewards: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var referralID int
+		var rw models.ReferralReward
+		if err := rows.Scan(&referralID, &rw.UserID, &rw.Kind, &rw.Amount, &rw.Currency); err != nil {
+			return fmt.Errorf("error scanning referral reward: %w", err)
+		}
+		byID[referralID].Rewards = append(byID[referralID].Rewards, rw)
+	}
+	return rows.Err()
+}
+
+// referrers maps each of the given referred users, and everyone above them,
+// to who referred them. The path stops the walk at a loop.
+func referrers(db *database.DB, userIDs []int) (map[int]int, error) {
+	referredBy := map[int]int{}
+	if len(userIDs) == 0 {
+		return referredBy, nil
+	}
+	rows, err := db.Query(`
+		WITH RECURSIVE up (referee_id, referrer_id, path) AS (
+			SELECT referee_id, referrer_id, ARRAY[referee_id] FROM referrals
+			WHERE referee_id = ANY($1)
+			UNION ALL
+			SELECT r.referee_id, r.referrer_id, up.path || r.referee_id
+			FROM referrals r
+			JOIN up ON r.referee_id = up.referrer_id
+			WHERE r.referee_id <> ALL(up.path)
+		)
+		SELECT DISTINCT referee_id, referrer_id FROM up
+	`, pq.Array(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("error querying referrers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var referee, referrer int
+		if err := rows.Scan(&referee, &referrer); err != nil {
+			return nil, fmt.Errorf("error scanning referral: %w", err)
+		}
+		referredBy[referee] = referrer
+	}
+	return referredBy, rows.Err()
+}
+
+// Chain follows referredBy up from userID and returns the users from the
+// first referrer down to userID. A loop, which only a data fix could make,
+// ends the chain where it would repeat.
+func Chain(referredBy map[int]int, userID int) []int {
+	chain := []int{userID}
+	seen := map[int]bool{userID: true}
+	for id, ok := referredBy[userID]; ok && !seen[id]; id, ok = referredBy[id] {
+		chain = append(chain, id)
+		seen[id] = true
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// Totals sums up every referral and reward.
+func Totals(db *database.DB) (models.ReferralTotals, error) {
+	t := models.ReferralTotals{Bonuses: []models.Money{}}
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE status = $1), COUNT(*) FILTER (WHERE status = $2)
+		FROM referrals
+	`, models.ReferralPending, models.ReferralRewarded).Scan(&t.Referrals, &t.Pending, &t.Rewarded)
+	if err != nil {
+		return t, fmt.Errorf("error counting referrals: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT kind, COALESCE(currency, ''), SUM(amount) FROM referral_rewards
+		GROUP BY kind, currency
+		ORDER BY kind, currency
+	`)
+	if err != nil {
+		return t, fmt.Errorf("error summing referral rewards: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind models.ReferralRewardKind
+		var currency models.Currency
+		var sum int64
+		if err := rows.Scan(&kind, &currency, &sum); err != nil {
+			return t, fmt.Errorf("error scanning referral reward total: %w", err)
+		}
+		if kind == models.ReferralRewardPoints {
+			t.Points += sum
+		} else {
+			t.Bonuses = append(t.Bonuses, models.NewMoney(sum, currency))
+		}
+	}
+	return t, rows.Err()
+}
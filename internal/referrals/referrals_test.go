@@ -0,0 +1,51 @@
+package referrals
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := NewCode()
+		if err != nil {
+			t.Fatalf("NewCode: %v", err)
+		}
+		if len(code) != codeLength {
+			t.Errorf("NewCode = %q, want %d characters", code, codeLength)
+		}
+		for _, r := range code {
+			if !strings.ContainsRune(codeAlphabet, r) {
+				t.Errorf("NewCode = %q, has %q outside the alphabet", code, r)
+			}
+		}
+		if Normalize(code) != code {
+			t.Errorf("NewCode = %q, not normalized", code)
+		}
+		if seen[code] {
+			t.Errorf("NewCode returned %q twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestChain(t *testing.T) {
+	// 1 referred 2, who referred 3 and 4; 5 and 6 referred each other
+	referredBy := map[int]int{2: 1, 3: 2, 4: 2, 5: 6, 6: 5}
+	for _, tc := range []struct {
+		user int
+		want []int
+	}{
+		{1, []int{1}},
+		{2, []int{1, 2}},
+		{3, []int{1, 2, 3}},
+		{4, []int{1, 2, 4}},
+		{5, []int{6, 5}},
+	} {
+		if got := Chain(referredBy, tc.user); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Chain(%d) = %v, want %v", tc.user, got, tc.want)
+		}
+	}
+}
@@ -68,7 +68,7 @@ func (s *EmailService) SendBookingConfirmation(to, guestName, castName string, b
                     <p><strong>キャスト:</strong> %sさん</p>
                     <p><strong>日時:</strong> %s</p>
                     <p><strong>場所:</strong> %s</p>
-                    <p><strong>料金:</strong> ¥%s</p>
+                    <p><strong>料金:</strong> %s</p>
                 </div>
                 
                 <p>当日は時間に余裕を持ってお越しください。</p>
@@ -159,6 +159,79 @@ func (s *EmailService) SendPasswordReset(to, name, resetToken string) error {
     return err
 }
 
+// SendBookingExpiredToGuest tells the guest their request expired unanswered
+func (s *EmailService) SendBookingExpiredToGuest(to, guestName, castName string, bookingDetails BookingDetails) error {
+    subject := "予約リクエストの期限切れ - uso"
+    html := fmt.Sprintf(`
+        <div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto;">
+            <div style="background-color: #0a0a0a; padding: 20px; text-align: center;">
+                <h1 style="color: #d4af37; margin: 0;">uso</h1>
+            </div>
+            <div style="background-color: #1a1a1a; color: #ffffff; padding: 30px;">
+                <h2>予約リクエストの期限が切れました</h2>
+                <p>%sさん、%sさんへの予約リクエストは期限内に回答がなかったため、キャンセルされました。</p>
+                
+                <div style="background-color: #2a2a2a; padding: 20px; border-radius: 8px; margin: 20px 0;">
+                    <h3 style="color: #d4af37;">予約詳細</h3>
+                    <p><strong>日時:</strong> %s</p>
+                    <p><strong>場所:</strong> %s</p>
+                    <p><strong>料金:</strong> %s</p>
+                </div>
+                
+                <p>カードの与信枠は解放され、料金は請求されません。</p>
+                
+                <div style="text-align: center; margin: 30px 0;">
+                    <a href="https://uso.app/search" style="background-color: #d4af37; color: #0a0a0a; padding: 15px 30px; text-decoration: none; border-radius: 8px; font-weight: bold;">他のキャストを探す</a>
+                </div>
+            </div>
+        </div>
+    `, guestName, castName, bookingDetails.DateTime, bookingDetails.Location, bookingDetails.Amount)
+
+    params := &resend.SendEmailRequest{
+        From:    s.from,
+        To:      []string{to},
+        Subject: subject,
+        Html:    html,
+    }
+
+    _, err := s.client.Emails.Send(params)
+    return err
+}
+
+// SendBookingExpiredToCast tells the cast a request expired before they responded
+func (s *EmailService) SendBookingExpiredToCast(to, castName, guestName string, bookingDetails BookingDetails) error {
+    subject := "予約リクエストの期限切れ - uso"
+    html := fmt.Sprintf(`
+        <div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto;">
+            <div style="background-color: #0a0a0a; padding: 20px; text-align: center;">
+                <h1 style="color: #d4af37; margin: 0;">uso</h1>
+            </div>
+            <div style="background-color: #1a1a1a; color: #ffffff; padding: 30px;">
+                <h2>予約リクエストの期限が切れました</h2>
+                <p>%sさん、%sさんからの予約リクエストは回答期限を過ぎたため、自動的にキャンセルされました。</p>
+                
+                <div style="background-color: #2a2a2a; padding: 20px; border-radius: 8px; margin: 20px 0;">
+                    <h3 style="color: #d4af37;">予約詳細</h3>
+                    <p><strong>日時:</strong> %s</p>
+                    <p><strong>場所:</strong> %s</p>
+                </div>
+                
+                <p style="color: #a0a0a0; font-size: 14px;">予約リクエストには24時間以内に回答してください。</p>
+            </div>
+        </div>
+    `, castName, guestName, bookingDetails.DateTime, bookingDetails.Location)
+
+    params := &resend.SendEmailRequest{
+        From:    s.from,
+        To:      []string{to},
+        Subject: subject,
+        Html:    html,
+    }
+
+    _, err := s.client.Emails.Send(params)
+    return err
+}
+
 // BookingDetails contains booking information for emails
 type BookingDetails struct {
     ID       string
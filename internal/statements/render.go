@@ -0,0 +1,272 @@
+package statements
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+	"github.com/uso/uso/internal/pdf"
+)
+
+// Statements are written in Japanese, for casts and the tax office. CSV
+// files start with a byte order mark so Excel opens them as UTF-8, and
+// amounts are written without symbols so they can be summed.
+const bom = "\uFEFF"
+
+func dateJP(t time.Time) string {
+	return t.In(booking.Tokyo).Format("2006/01/02")
+}
+
+func dateTimeJP(t time.Time) string {
+	return t.In(booking.Tokyo).Format("2006/01/02 15:04")
+}
+
+func monthJP(month string) string {
+	t, err := ParseMonth(month)
+	if err != nil {
+		return month
+	}
+	return fmt.Sprintf("%d年%d月", t.Year(), t.Month())
+}
+
+// referralLabel stands in for the booking on a referral bonus's line.
+const referralLabel = "紹介報酬"
+
+// WriteCSV writes the statement with one row per booking or referral bonus
+// and a total row per currency.
+func (s *Monthly) WriteCSV(w io.Writer) error {
+	if _, err := io.WriteString(w, bom); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"精算日", "予約番号", "ご利用日時", "時間", "状態", "通貨", "売上", "手数料", "源泉徴収税額", "差引支払額"})
+	for _, l := range s.Lines {
+		id, startsAt, hours, status := strconv.Itoa(l.BookingID), dateTimeJP(l.StartsAt), strconv.Itoa(l.DurationHours), string(l.Status)
+		if l.Referral {
+			id, startsAt, hours, status = referralLabel, "", "", ""
+		}
+		cw.Write([]string{
+			dateJP(l.SettledAt),
+			id,
+			startsAt,
+			hours,
+			status,
+			string(l.Gross.Currency),
+			l.Gross.Major(),
+			l.PlatformFee.Major(),
+			l.Withholding.Major(),
+			l.Net.Major(),
+		})
+	}
+	for _, t := range s.Totals {
+		cw.Write([]string{"合計", "", "", "", "", string(t.Currency),
+			t.Gross.Major(), t.PlatformFee.Major(), t.Withholding.Major(), t.Net.Major()})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteCSV writes the summary with one row per month and a total row per
+// currency.
+func (a *Annual) WriteCSV(w io.Writer) error {
+	if _, err := io.WriteString(w, bom); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"月", "通貨", "売上", "手数料", "支払金額", "源泉徴収税額", "差引支払額"})
+	row := func(label string, t Totals) {
+		cw.Write([]string{label, string(t.Currency), t.Gross.Major(), t.PlatformFee.Major(),
+			t.Payment().Major(), t.Withholding.Major(), t.Net.Major()})
+	}
+	for _, m := range a.Months {
+		for _, t := range m.Totals {
+			row(m.Month, t)
+		}
+	}
+	for _, t := range a.Totals {
+		row("合計", t)
+	}
+	for _, m := range a.Unpaid {
+		cw.Write([]string{"うち未払", string(m.Currency), "", "", m.Major()})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Layout of the PDF statements, in points
+const (
+	marginLeft   = 40.0
+	marginRight  = pdf.PageWidth - 40
+	marginBottom = pdf.PageHeight - 60
+	lineHeight   = 16.0
+)
+
+// header writes the title, the cast's name and the issuer's details, and
+// returns where the body starts.
+func header(p *pdf.Page, title, period string, issuer Issuer, cast Payee, generatedAt time.Time) float64 {
+	p.Text(marginLeft, 60, 18, title)
+	p.Text(marginLeft, 84, 11, period)
+	p.TextRight(marginRight, 60, 9, "発行日 "+dateJP(generatedAt))
+
+	p.Text(marginLeft, 120, 12, cast.Name+" 様")
+	p.Line(marginLeft, 126, marginLeft+200, 126)
+
+	y := 108.0
+	for _, s := range []string{issuer.Name, issuer.Address, issuer.Phone} {
+		if s != "" {
+			p.TextRight(marginRight, y, 9, s)
+			y += 12
+		}
+	}
+	if issuer.Number != "" {
+		p.TextRight(marginRight, y, 9, "法人番号 "+issuer.Number)
+	}
+	return 170
+}
+
+// table writes rows in columns whose right edges are at rights; the first
+// column is left-aligned at marginLeft instead. It starts new pages as
+// needed and returns the page and position it finished on.
+func table(d *pdf.Document, p *pdf.Page, y float64, rights []float64, head []string, rows [][]string) (*pdf.Page, float64) {
+	writeRow := func(cells []string, size float64) {
+		for i, cell := range cells {
+			if i == 0 {
+				p.Text(marginLeft, y, size, cell)
+			} else {
+				p.TextRight(rights[i], y, size, cell)
+			}
+		}
+	}
+
+	writeRow(head, 8)
+	p.Line(marginLeft, y+5, marginRight, y+5)
+	y += lineHeight + 2
+	for _, row := range rows {
+		if y > marginBottom {
+			p = d.AddPage()
+			y = 60
+			writeRow(head, 8)
+			p.Line(marginLeft, y+5, marginRight, y+5)
+			y += lineHeight + 2
+		}
+		writeRow(row, 9)
+		y += lineHeight
+	}
+	p.Line(marginLeft, y-lineHeight+5, marginRight, y-lineHeight+5)
+	return p, y
+}
+
+// PDF renders the statement.
+func (s *Monthly) PDF() []byte {
+	d := pdf.New("支払明細書 " + s.Month)
+	p := d.AddPage()
+	y := header(p, "支払明細書", monthJP(s.Month)+"分", s.Issuer, s.Cast, s.GeneratedAt)
+
+	rights := []float64{0, 150, 270, 335, 400, 470, marginRight}
+	head := []string{"精算日", "予約番号", "ご利用日時", "売上", "手数料", "源泉徴収税額", "差引支払額"}
+	var rows [][]string
+	for _, l := range s.Lines {
+		id, startsAt := "#"+strconv.Itoa(l.BookingID), dateTimeJP(l.StartsAt)
+		if l.Referral {
+			id, startsAt = referralLabel, ""
+		}
+		rows = append(rows, []string{
+			dateJP(l.SettledAt),
+			id,
+			startsAt,
+			l.Gross.String(),
+			l.PlatformFee.String(),
+			l.Withholding.String(),
+			l.Net.String(),
+		})
+	}
+	for _, t := range s.Totals {
+		rows = append(rows, []string{"合計", "", "", t.Gross.String(), t.PlatformFee.String(),
+			t.Withholding.String(), t.Net.String()})
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{"この月の精算はありません"})
+	}
+	table(d, p, y, rights, head, rows)
+
+	return d.Bytes()
+}
+
+// PDF renders the summary, laid out after the 支払調書 so its figures can
+// be copied across.
+func (a *Annual) PDF() []byte {
+	year := strconv.Itoa(a.Year)
+	d := pdf.New("支払調書集計 " + year)
+	p := d.AddPage()
+	y := header(p, "報酬の支払調書 集計表", year+"年分（1月1日〜12月31日）", a.Issuer, a.Cast, a.GeneratedAt)
+
+	// The 支払調書's fields, one per row
+	money := func(amounts []models.Money) string {
+		if len(amounts) == 0 {
+			return "0"
+		}
+		s := ""
+		for i, m := range amounts {
+			if i > 0 {
+				s += " / "
+			}
+			s += m.String()
+		}
+		return s
+	}
+	var payments, withheld []models.Money
+	for _, t := range a.Totals {
+		payments = append(payments, t.Payment())
+		withheld = append(withheld, t.Withholding)
+	}
+	fields := [][2]string{
+		{"支払を受ける者", a.Cast.Name},
+		{"区分", "報酬"},
+		{"細目", "接客業務報酬"},
+		{"支払金額", money(payments)},
+		{"うち未払金額", money(a.Unpaid)},
+		{"源泉徴収税額", money(withheld)},
+		{"支払者", a.Issuer.Name},
+		{"支払者所在地", a.Issuer.Address},
+		{"支払者法人番号", a.Issuer.Number},
+	}
+	for _, f := range fields {
+		p.Rect(marginLeft, y-12, 120, lineHeight+4)
+		p.Rect(marginLeft+120, y-12, marginRight-marginLeft-120, lineHeight+4)
+		p.Text(marginLeft+6, y, 9, f[0])
+		p.Text(marginLeft+126, y, 10, f[1])
+		y += lineHeight + 4
+	}
+	y += 24
+
+	p.Text(marginLeft, y, 11, "月別内訳")
+	y += 20
+	rights := []float64{0, 190, 260, 340, 420, marginRight}
+	head := []string{"月", "売上", "手数料", "支払金額", "源泉徴収税額", "差引支払額"}
+	var rows [][]string
+	for _, m := range a.Months {
+		for _, t := range m.Totals {
+			rows = append(rows, []string{monthJP(m.Month), t.Gross.String(), t.PlatformFee.String(),
+				t.Payment().String(), t.Withholding.String(), t.Net.String()})
+		}
+	}
+	for _, t := range a.Totals {
+		rows = append(rows, []string{"合計", t.Gross.String(), t.PlatformFee.String(),
+			t.Payment().String(), t.Withholding.String(), t.Net.String()})
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{"この年の精算はありません"})
+	}
+	p, y = table(d, p, y, rights, head, rows)
+
+	if y+40 > marginBottom {
+		p = d.AddPage()
+		y = 60
+	}
+	p.Text(marginLeft, y+24, 8, "支払金額は手数料を差し引いた源泉徴収前の報酬額です。確定申告の際は支払者から交付される支払調書の写しと照合してください。")
+	return d.Bytes()
+}
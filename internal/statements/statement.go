@@ -0,0 +1,325 @@
+// Package statements builds casts' earnings statements from the ledger: a
+// monthly statement of each booking settled, and an annual summary of what
+// the cast was paid and had withheld, for the 支払調書.
+package statements
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/database"
+	"github.com/uso/uso/internal/ledger"
+	"github.com/uso/uso/internal/models"
+)
+
+// Issuer is the platform operator, who pays the cast.
+type Issuer struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+	// Number is the 13-digit corporate number (法人番号).
+	Number string `json:"corporate_number,omitempty"`
+}
+
+// Payee is the cast a statement is for.
+type Payee struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Line is what one booking earned in the period. Refunds made after the
+// booking was settled reduce it. A referral bonus has a line of its own,
+// with no booking.
+type Line struct {
+	BookingID     int                  `json:"booking_id"`
+	Referral      bool                 `json:"referral,omitempty"`
+	SettledAt     time.Time            `json:"settled_at"`
+	StartsAt      time.Time            `json:"starts_at"`
+	DurationHours int                  `json:"duration_hours"`
+	Status        models.BookingStatus `json:"status"`
+	// Gross is what the guest paid, PlatformFee the commission and
+	// Withholding the income tax withheld, leaving Net for the cast.
+	Gross       models.Money `json:"gross"`
+	PlatformFee models.Money `json:"platform_fee"`
+	Withholding models.Money `json:"withholding_tax"`
+	Net         models.Money `json:"net"`
+}
+
+// Totals adds up lines in one currency.
+type Totals struct {
+	Currency    models.Currency `json:"currency"`
+	Gross       models.Money    `json:"gross"`
+	PlatformFee models.Money    `json:"platform_fee"`
+	Withholding models.Money    `json:"withholding_tax"`
+	Net         models.Money    `json:"net"`
+}
+
+// Payment is what the cast was paid before withholding, the 支払金額 on
+// the 支払調書.
+func (t Totals) Payment() models.Money {
+	return t.Net.Add(t.Withholding)
+}
+
+// Monthly is a cast's statement for a calendar month in Tokyo.
+type Monthly struct {
+	Issuer      Issuer    `json:"issuer"`
+	Cast        Payee     `json:"cast"`
+	Month       string    `json:"month"`
+	Lines       []Line    `json:"lines"`
+	Totals      []Totals  `json:"totals"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// MonthTotals is one month's row of an annual summary.
+type MonthTotals struct {
+	Month  string   `json:"month"`
+	Totals []Totals `json:"totals"`
+}
+
+// Annual sums up a calendar year for the cast's 支払調書.
+type Annual struct {
+	Issuer Issuer        `json:"issuer"`
+	Cast   Payee         `json:"cast"`
+	Year   int           `json:"year"`
+	Months []MonthTotals `json:"months"`
+	Totals []Totals      `json:"totals"`
+	// Unpaid is the part of the year's payments still owed to the cast at
+	// the end of it, shown as 未払金額.
+	Unpaid      []models.Money `json:"unpaid"`
+	GeneratedAt time.Time      `json:"generated_at"`
+}
+
+// ParseMonth reads a month such as "2026-10" and returns its first moment in
+// Tokyo.
+func ParseMonth(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01", s, booking.Tokyo)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid month %q, want YYYY-MM", s)
+	}
+	return t, nil
+}
+
+// BuildMonthly returns the cast's statement for the month starting at month.
+func BuildMonthly(db *database.DB, issuer Issuer, castID int, month time.Time) (*Monthly, error) {
+	cast, err := payee(db, castID)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := settledLines(db, castID, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &Monthly{
+		Issuer:      issuer,
+		Cast:        cast,
+		Month:       month.Format("2006-01"),
+		Lines:       lines,
+		Totals:      sumLines(lines),
+		GeneratedAt: time.Now(),
+	}, nil
+}
+
+// BuildAnnual returns the cast's summary for the calendar year.
+func BuildAnnual(db *database.DB, issuer Issuer, castID, year int) (*Annual, error) {
+	cast, err := payee(db, castID)
+	if err != nil {
+		return nil, err
+	}
+	a := &Annual{
+		Issuer:      issuer,
+		Cast:        cast,
+		Year:        year,
+		Months:      []MonthTotals{},
+		GeneratedAt: time.Now(),
+	}
+
+	// Month by month, so each row matches that month's statement
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, booking.Tokyo)
+	to := from.AddDate(1, 0, 0)
+	var all []Line
+	for month := from; month.Before(to); month = month.AddDate(0, 1, 0) {
+		lines, err := settledLines(db, castID, month, month.AddDate(0, 1, 0))
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) > 0 {
+			a.Months = append(a.Months, MonthTotals{Month: month.Format("2006-01"), Totals: sumLines(lines)})
+			all = append(all, lines...)
+		}
+	}
+	a.Totals = sumLines(all)
+
+	// What was still owed when the year ended, but no more than the year's
+	// own payments, as older earnings belong to older summaries
+	owed, err := payableAt(db, castID, to)
+	if err != nil {
+		return nil, err
+	}
+	a.Unpaid = []models.Money{}
+	for _, t := range a.Totals {
+		for _, m := range owed {
+			if m.Currency == t.Currency && m.IsPositive() {
+				a.Unpaid = append(a.Unpaid, m.Min(t.Payment()))
+			}
+		}
+	}
+	return a, nil
+}
+
+func payee(db *database.DB, castID int) (Payee, error) {
+	p := Payee{ID: castID}
+	err := db.QueryRow("SELECT name, email FROM users WHERE id = $1", castID).Scan(&p.Name, &p.Email)
+	if err != nil {
+		return p, fmt.Errorf("error getting cast %d: %w", castID, err)
+	}
+	return p, nil
+}
+
+// settledLines returns what each of the cast's bookings earned from
+// settlements, tips and refunds posted in [from, to), and their referral
+// bonuses, in the order they were first settled.
+func settledLines(db *database.DB, castID int, from, to time.Time) ([]Line, error) {
+	rows, err := db.Query(`
+		SELECT b.id, MIN(t.created_at), b.starts_at, b.duration_hours, b.status, e.currency,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.account_type = $5), 0),
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.account_type = $6), 0),
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.code = $2), 0)
+		FROM ledger_transactions t
+		JOIN ledger_entries e ON e.transaction_id = t.id
+		JOIN ledger_accounts a ON e.account_id = a.id
+		JOIN bookings b ON t.booking_id = b.id
+		WHERE b.cast_id = $1
+		AND t.kind IN ($7, $8, $9)
+		AND t.created_at >= $3 AND t.created_at < $4
+		AND (a.account_type IN ($5, $6) OR a.code = $2)
+		GROUP BY b.id, e.currency
+		ORDER BY MIN(t.created_at), b.id
+	`, castID, ledger.CastPayable(castID).Code, from, to,
+		ledger.TypePlatformFees, ledger.TypeWithholdingTax, ledger.KindEarning, ledger.KindRefund, ledger.KindTip)
+	if err != nil {
+		return nil, fmt.Errorf("error querying statement lines: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []Line{}
+	for rows.Next() {
+		var l Line
+		var currency models.Currency
+		var fee, tax, net int64
+		if err := rows.Scan(&l.BookingID, &l.SettledAt, &l.StartsAt, &l.DurationHours, &l.Status,
+			&currency, &fee, &tax, &net); err != nil {
+			return nil, fmt.Errorf("error scanning statement line: %w", err)
+		}
+		l.PlatformFee = models.NewMoney(fee, currency)
+		l.Withholding = models.NewMoney(tax, currency)
+		l.Net = models.NewMoney(net, currency)
+		l.Gross = l.PlatformFee.Add(l.Withholding).Add(l.Net)
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying statement lines: %w", err)
+	}
+
+	bonuses, err := bonusLines(db, castID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, bonuses...)
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].SettledAt.Before(lines[j].SettledAt) })
+	return lines, nil
+}
+
+// bonusLines returns the cast's referral bonuses posted in [from, to).
+func bonusLines(db *database.DB, castID int, from, to time.Time) ([]Line, error) {
+	rows, err := db.Query(`
+		SELECT t.created_at, e.currency,
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.account_type = $4), 0),
+		       COALESCE(-SUM(e.amount) FILTER (WHERE a.code = $1), 0)
+		FROM ledger_transactions t
+		JOIN ledger_entries e ON e.transaction_id = t.id
+		JOIN ledger_accounts a ON e.account_id = a.id
+		WHERE t.kind = $5
+		AND t.created_at >= $2 AND t.created_at < $3
+		AND (a.account_type = $4 OR a.code = $1)
+		AND EXISTS (
+			SELECT 1 FROM ledger_entries ce JOIN ledger_accounts ca ON ce.account_id = ca.id
+			WHERE ce.transaction_id = t.id AND ca.code = $1
+		)
+		GROUP BY t.id, e.currency
+		ORDER BY t.created_at, t.id
+	`, ledger.CastPayable(castID).Code, from, to, ledger.TypeWithholdingTax, ledger.KindReferral)
+	if err != nil {
+		return nil, fmt.Errorf("error querying referral bonuses: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []Line{}
+	for rows.Next() {
+		l := Line{Referral: true}
+		var currency models.Currency
+		var tax, net int64
+		if err := rows.Scan(&l.SettledAt, &currency, &tax, &net); err != nil {
+			return nil, fmt.Errorf("error scanning referral bonus: %w", err)
+		}
+		l.PlatformFee = models.NewMoney(0, currency)
+		l.Withholding = models.NewMoney(tax, currency)
+		l.Net = models.NewMoney(net, currency)
+		l.Gross = l.Withholding.Add(l.Net)
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// payableAt returns the cast's payable balance as it stood at t.
+func payableAt(db *database.DB, castID int, t time.Time) ([]models.Money, error) {
+	rows, err := db.Query(`
+		SELECT e.currency, -SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON e.account_id = a.id
+		WHERE a.code = $1 AND e.created_at < $2
+		GROUP BY e.currency
+		ORDER BY e.currency
+	`, ledger.CastPayable(castID).Code, t)
+	if err != nil {
+		return nil, fmt.Errorf("error querying payable balance: %w", err)
+	}
+	defer rows.Close()
+
+	var balances []models.Money
+	for rows.Next() {
+		var m models.Money
+		if err := rows.Scan(&m.Currency, &m.Amount); err != nil {
+			return nil, fmt.Errorf("error scanning payable balance: %w", err)
+		}
+		balances = append(balances, m)
+	}
+	return balances, rows.Err()
+}
+
+// sumLines totals the lines per currency, in currency order.
+func sumLines(lines []Line) []Totals {
+	byCurrency := map[models.Currency]*Totals{}
+	for _, l := range lines {
+		c := l.Gross.Currency
+		t, ok := byCurrency[c]
+		if !ok {
+			zero := models.NewMoney(0, c)
+			t = &Totals{Currency: c, Gross: zero, PlatformFee: zero, Withholding: zero, Net: zero}
+			byCurrency[c] = t
+		}
+		t.Gross = t.Gross.Add(l.Gross)
+		t.PlatformFee = t.PlatformFee.Add(l.PlatformFee)
+		t.Withholding = t.Withholding.Add(l.Withholding)
+		t.Net = t.Net.Add(l.Net)
+	}
+
+	totals := make([]Totals, 0, len(byCurrency))
+	for _, t := range byCurrency {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Currency < totals[j].Currency })
+	return totals
+}
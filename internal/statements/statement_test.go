@@ -0,0 +1,141 @@
+package statements
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uso/uso/internal/booking"
+	"github.com/uso/uso/internal/models"
+)
+
+func line(id int, fee, tax, net int64) Line {
+	l := Line{
+		BookingID:     id,
+		SettledAt:     time.Date(2026, 10, id, 23, 0, 0, 0, booking.Tokyo),
+		StartsAt:      time.Date(2026, 10, id, 19, 0, 0, 0, booking.Tokyo),
+		DurationHours: 2,
+		Status:        models.BookingStatusCompleted,
+		PlatformFee:   models.JPY(fee),
+		Withholding:   models.JPY(tax),
+		Net:           models.JPY(net),
+	}
+	l.Gross = l.PlatformFee.Add(l.Withholding).Add(l.Net)
+	return l
+}
+
+func TestSumLines(t *testing.T) {
+	usd := line(3, 300, 0, 700)
+	for _, m := range []*models.Money{&usd.Gross, &usd.PlatformFee, &usd.Withholding, &usd.Net} {
+		m.Currency = models.CurrencyUSD
+	}
+
+	totals := sumLines([]Line{line(1, 6000, 1429, 12571), usd, line(2, 3000, 714, 6286)})
+	if len(totals) != 2 || totals[0].Currency != models.CurrencyJPY || totals[1].Currency != models.CurrencyUSD {
+		t.Fatalf("totals = %+v, want JPY then USD", totals)
+	}
+	jpy := totals[0]
+	if jpy.Gross != models.JPY(30000) || jpy.PlatformFee != models.JPY(9000) ||
+		jpy.Withholding != models.JPY(2143) || jpy.Net != models.JPY(18857) {
+		t.Errorf("JPY totals = %+v", jpy)
+	}
+	if jpy.Payment() != models.JPY(21000) {
+		t.Errorf("Payment = %v, want ¥21,000 before withholding", jpy.Payment())
+	}
+
+	if got := sumLines(nil); len(got) != 0 {
+		t.Errorf("sumLines(nil) = %+v", got)
+	}
+}
+
+func TestParseMonth(t *testing.T) {
+	got, err := ParseMonth("2026-10")
+	if err != nil || !got.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, booking.Tokyo)) {
+		t.Fatalf("ParseMonth = %v, %v", got, err)
+	}
+	for _, s := range []string{"", "2026-13", "10/2026", "2026-1-1"} {
+		if _, err := ParseMonth(s); err == nil {
+			t.Errorf("ParseMonth(%q) succeeded", s)
+		}
+	}
+}
+
+func TestMonthlyCSV(t *testing.T) {
+	bonus := Line{
+		Referral:    true,
+		SettledAt:   time.Date(2026, 10, 2, 12, 0, 0, 0, booking.Tokyo),
+		PlatformFee: models.JPY(0),
+		Withholding: models.JPY(306),
+		Net:         models.JPY(2694),
+		Gross:       models.JPY(3000),
+	}
+	lines := []Line{line(1, 6000, 1429, 12571), bonus}
+	s := &Monthly{Month: "2026-10", Lines: lines, Totals: sumLines(lines)}
+
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, bom) {
+		t.Error("CSV has no byte order mark")
+	}
+	rows := strings.Split(strings.TrimSpace(strings.TrimPrefix(out, bom)), "\n")
+	want := []string{
+		"精算日,予約番号,ご利用日時,時間,状態,通貨,売上,手数料,源泉徴収税額,差引支払額",
+		"2026/10/01,1,2026/10/01 19:00,2,completed,JPY,20000,6000,1429,12571",
+		"2026/10/02,紹介報酬,,,,JPY,3000,0,306,2694",
+		"合計,,,,,JPY,23000,6000,1735,15265",
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("CSV has %d rows, want %d:\n%s", len(rows), len(want), out)
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestAnnualCSV(t *testing.T) {
+	oct := []Line{line(1, 6000, 1429, 12571)}
+	a := &Annual{
+		Year:   2026,
+		Months: []MonthTotals{{Month: "2026-10", Totals: sumLines(oct)}},
+		Totals: sumLines(oct),
+		Unpaid: []models.Money{models.JPY(12571)},
+	}
+
+	var buf bytes.Buffer
+	if err := a.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"2026-10,JPY,20000,6000,14000,1429,12571",
+		"合計,JPY,20000,6000,14000,1429,12571",
+		"うち未払,JPY,,,12571",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("CSV is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestPDFs(t *testing.T) {
+	var lines []Line
+	// Enough bookings to run onto a second page
+	for i := 1; i <= 40; i++ {
+		lines = append(lines, line(i%28+1, 6000, 1429, 12571))
+	}
+	s := &Monthly{Month: "2026-10", Lines: lines, Totals: sumLines(lines), Cast: Payee{Name: "さくら"}}
+	if out := s.PDF(); !bytes.HasPrefix(out, []byte("%PDF-")) || !bytes.Contains(out, []byte("/Count 2")) {
+		t.Error("monthly statement is not a two-page PDF")
+	}
+
+	a := &Annual{Year: 2026, Issuer: Issuer{Name: "Uso"}, Cast: Payee{Name: "さくら"}}
+	if out := a.PDF(); !bytes.HasPrefix(out, []byte("%PDF-")) {
+		t.Error("annual summary is not a PDF")
+	}
+}
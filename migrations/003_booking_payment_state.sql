@@ -0,0 +1,15 @@
+-- Payment state of the manual-capture PaymentIntent behind each booking
+CREATE TYPE payment_status AS ENUM ('authorized', 'captured', 'canceled', 'capture_failed');
+
+ALTER TABLE bookings
+    ADD COLUMN payment_status payment_status NOT NULL DEFAULT 'authorized',
+    ADD COLUMN payment_error TEXT,
+    ADD COLUMN captured_at TIMESTAMP WITH TIME ZONE;
+
+-- Backfill existing bookings from their booking status
+UPDATE bookings SET payment_status = 'captured', captured_at = accepted_at
+    WHERE status IN ('accepted', 'completed');
+UPDATE bookings SET payment_status = 'canceled'
+    WHERE status IN ('declined', 'cancelled');
+
+CREATE INDEX idx_bookings_payment_status ON bookings(payment_status);
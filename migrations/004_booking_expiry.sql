@@ -0,0 +1,7 @@
+-- Pending bookings the cast never answered are moved to 'expired'
+ALTER TYPE booking_status ADD VALUE IF NOT EXISTS 'expired';
+
+ALTER TABLE bookings ADD COLUMN expired_at TIMESTAMP WITH TIME ZONE;
+
+-- Supports the expiry job's scan of old pending bookings
+CREATE INDEX idx_bookings_pending_created_at ON bookings(created_at) WHERE status = 'pending';
@@ -0,0 +1,11 @@
+-- Audit trail of every booking status transition
+CREATE TABLE booking_status_log (
+    id SERIAL PRIMARY KEY,
+    booking_id INTEGER NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    from_status booking_status, -- NULL when the booking is created
+    to_status booking_status NOT NULL,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL, -- NULL for system jobs
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_booking_status_log_booking_id ON booking_status_log(booking_id);
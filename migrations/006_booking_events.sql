@@ -0,0 +1,20 @@
+-- booking_status_log becomes a general event history for bookings
+ALTER TABLE booking_status_log RENAME TO booking_events;
+ALTER SEQUENCE booking_status_log_id_seq RENAME TO booking_events_id_seq;
+ALTER INDEX idx_booking_status_log_booking_id RENAME TO idx_booking_events_booking_id;
+
+ALTER TABLE booking_events
+    ADD COLUMN event_type VARCHAR(50) NOT NULL DEFAULT 'status_changed',
+    ADD COLUMN actor_role VARCHAR(20) NOT NULL DEFAULT 'system', -- guest, cast, admin or system
+    ADD COLUMN reason TEXT,
+    ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+-- Not every event changes the status
+ALTER TABLE booking_events ALTER COLUMN to_status DROP NOT NULL;
+
+-- Backfill rows written before this migration
+UPDATE booking_events SET event_type = 'created' WHERE from_status IS NULL;
+UPDATE booking_events e SET actor_role = u.user_type::text
+    FROM users u WHERE e.actor_id = u.id;
+
+CREATE INDEX idx_booking_events_created_at ON booking_events(booking_id, created_at);
@@ -0,0 +1,7 @@
+-- Cancellation fees and refunds
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'partially_refunded';
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'refunded';
+
+ALTER TABLE bookings
+    ADD COLUMN cancellation_fee DECIMAL(10, 2),
+    ADD COLUMN refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0;
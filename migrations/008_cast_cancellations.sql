@@ -0,0 +1,31 @@
+-- Who cancelled a booking
+ALTER TABLE bookings ADD COLUMN cancelled_by VARCHAR(20); -- guest, cast, admin or system
+
+-- Every cancellation of an accepted booking by its cast
+CREATE TABLE cast_cancellations (
+    id SERIAL PRIMARY KEY,
+    cast_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    booking_id INTEGER NOT NULL UNIQUE REFERENCES bookings(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL,
+    notice_hours DECIMAL(8, 1) NOT NULL, -- hours between cancelling and the booking start
+    late BOOLEAN NOT NULL, -- counts as a strike
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Penalties applied automatically for repeated late cancellations
+CREATE TABLE cast_penalties (
+    id SERIAL PRIMARY KEY,
+    cast_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    action VARCHAR(20) NOT NULL, -- demoted or suspended
+    strike_count INTEGER NOT NULL,
+    from_rank cast_rank,
+    to_rank cast_rank,
+    suspended_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Suspended casts are hidden from search and cannot be booked
+ALTER TABLE cast_profiles ADD COLUMN suspended_until TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_cast_cancellations_cast_id ON cast_cancellations(cast_id, created_at);
+CREATE INDEX idx_cast_penalties_cast_id ON cast_penalties(cast_id);
@@ -0,0 +1,5 @@
+-- 'requires_payment' is the status of a PaymentIntent charged on top of a
+-- booking's main one, e.g. when a reschedule makes it longer after the main
+-- payment was captured, until the guest pays it. Added on its own because a
+-- new enum value can't be used in the transaction that adds it.
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'requires_payment';
@@ -0,0 +1,42 @@
+-- Proposed changes to a booking's date, start time or duration
+CREATE TABLE booking_reschedule_requests (
+    id SERIAL PRIMARY KEY,
+    booking_id INTEGER NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    requested_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, accepted, rejected, withdrawn
+    old_booking_date DATE NOT NULL,
+    old_start_time TIME NOT NULL,
+    old_duration_hours INTEGER NOT NULL,
+    new_booking_date DATE NOT NULL,
+    new_start_time TIME NOT NULL,
+    new_duration_hours INTEGER NOT NULL CHECK (new_duration_hours >= 1),
+    reason TEXT,
+    responded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Only one open proposal per booking
+CREATE UNIQUE INDEX idx_reschedule_requests_pending
+    ON booking_reschedule_requests(booking_id) WHERE status = 'pending';
+
+-- PaymentIntents charged on top of a booking's main one, e.g. when a
+-- reschedule makes it longer after the main payment was captured
+
+CREATE TABLE booking_payments (
+    id SERIAL PRIMARY KEY,
+    booking_id INTEGER NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL, -- reschedule
+    stripe_payment_intent_id VARCHAR(255) NOT NULL UNIQUE,
+    amount DECIMAL(10, 2) NOT NULL,
+    capture_method VARCHAR(20) NOT NULL, -- manual or automatic
+    status payment_status NOT NULL DEFAULT 'requires_payment',
+    refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_booking_payments_booking_id ON booking_payments(booking_id);
+
+CREATE TRIGGER update_booking_payments_updated_at BEFORE UPDATE ON booking_payments
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,18 @@
+-- Extra hours a guest asks to add to an accepted booking, held on a linked
+-- booking_payments PaymentIntent until the cast approves
+CREATE TABLE booking_extensions (
+    id SERIAL PRIMARY KEY,
+    booking_id INTEGER NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    requested_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    hours INTEGER NOT NULL CHECK (hours >= 1),
+    hourly_rate DECIMAL(10, 2) NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    booking_payment_id INTEGER REFERENCES booking_payments(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, approved, rejected, cancelled
+    responded_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Only one open extension per booking
+CREATE UNIQUE INDEX idx_booking_extensions_pending
+    ON booking_extensions(booking_id) WHERE status = 'pending';
@@ -0,0 +1,25 @@
+-- Recurring weekly working hours. weekday follows EXTRACT(DOW): 0 is Sunday.
+-- A shift past midnight is stored as one window ending at 24:00 and another
+-- starting at 00:00 the next day. Casts with no rows accept bookings at any
+-- time.
+CREATE TABLE cast_weekly_hours (
+    id SERIAL PRIMARY KEY,
+    cast_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    weekday SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (end_time > start_time)
+);
+
+CREATE INDEX idx_cast_weekly_hours_cast_id ON cast_weekly_hours(cast_id, weekday);
+
+-- One-off days off
+CREATE TABLE cast_blackout_dates (
+    id SERIAL PRIMARY KEY,
+    cast_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blackout_date DATE NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (cast_id, blackout_date)
+);
@@ -0,0 +1,49 @@
+-- Store bookings as an absolute [starts_at, ends_at) range instead of a local
+-- date and time, so bookings running past midnight compare correctly, and let
+-- the database reject overlapping bookings for the same cast.
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+ALTER TABLE bookings
+    ADD COLUMN starts_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN ends_at TIMESTAMP WITH TIME ZONE;
+
+-- Existing dates and times are Tokyo local time
+UPDATE bookings
+SET starts_at = (booking_date + start_time) AT TIME ZONE 'Asia/Tokyo',
+    ends_at = (booking_date + start_time) AT TIME ZONE 'Asia/Tokyo' + duration_hours * INTERVAL '1 hour';
+
+ALTER TABLE bookings
+    ALTER COLUMN starts_at SET NOT NULL,
+    ALTER COLUMN ends_at SET NOT NULL,
+    ADD CONSTRAINT bookings_period_check CHECK (ends_at > starts_at);
+
+-- Fails if live bookings already overlap; resolve those by hand first, e.g.
+--   SELECT a.id, b.id FROM bookings a JOIN bookings b
+--   ON a.cast_id = b.cast_id AND a.id < b.id
+--   AND tstzrange(a.starts_at, a.ends_at) && tstzrange(b.starts_at, b.ends_at)
+--   WHERE a.status IN ('pending', 'accepted') AND b.status IN ('pending', 'accepted');
+ALTER TABLE bookings ADD CONSTRAINT bookings_no_overlap
+    EXCLUDE USING gist (cast_id WITH =, tstzrange(starts_at, ends_at) WITH &&)
+    WHERE (status IN ('pending', 'accepted'));
+
+DROP INDEX IF EXISTS idx_bookings_date;
+CREATE INDEX idx_bookings_starts_at ON bookings(starts_at);
+
+ALTER TABLE bookings DROP COLUMN booking_date, DROP COLUMN start_time;
+
+-- Reschedule proposals move to absolute start times too
+ALTER TABLE booking_reschedule_requests
+    ADD COLUMN old_starts_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN new_starts_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE booking_reschedule_requests
+SET old_starts_at = (old_booking_date + old_start_time) AT TIME ZONE 'Asia/Tokyo',
+    new_starts_at = (new_booking_date + new_start_time) AT TIME ZONE 'Asia/Tokyo';
+
+ALTER TABLE booking_reschedule_requests
+    ALTER COLUMN old_starts_at SET NOT NULL,
+    ALTER COLUMN new_starts_at SET NOT NULL,
+    DROP COLUMN old_booking_date,
+    DROP COLUMN old_start_time,
+    DROP COLUMN new_booking_date,
+    DROP COLUMN new_start_time;
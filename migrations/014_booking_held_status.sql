@@ -0,0 +1,5 @@
+-- A 'held' booking reserves its slot while the guest confirms payment. It
+-- becomes 'pending' once the PaymentIntent is authorized, or 'expired' when
+-- the hold runs out. Added on its own because a new enum value can't be used
+-- in the transaction that adds it.
+ALTER TYPE booking_status ADD VALUE IF NOT EXISTS 'held' BEFORE 'pending';
@@ -0,0 +1,19 @@
+ALTER TABLE bookings
+    ADD COLUMN hold_expires_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN confirmed_at TIMESTAMP WITH TIME ZONE;
+
+-- Existing bookings were confirmed when created
+UPDATE bookings SET confirmed_at = created_at;
+
+-- Holds occupy their slot just like pending and accepted bookings
+ALTER TABLE bookings DROP CONSTRAINT bookings_no_overlap;
+ALTER TABLE bookings ADD CONSTRAINT bookings_no_overlap
+    EXCLUDE USING gist (cast_id WITH =, tstzrange(starts_at, ends_at) WITH &&)
+    WHERE (status IN ('held', 'pending', 'accepted'));
+
+-- Supports the sweep of expired holds
+CREATE INDEX idx_bookings_held_expires_at ON bookings(hold_expires_at) WHERE status = 'held';
+
+-- The expiry job now measures the response window from confirmation
+DROP INDEX IF EXISTS idx_bookings_pending_created_at;
+CREATE INDEX idx_bookings_pending_confirmed_at ON bookings(confirmed_at) WHERE status = 'pending';
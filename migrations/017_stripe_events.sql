@@ -0,0 +1,21 @@
+-- A chargeback opened against the guest's payment
+ALTER TYPE payment_status ADD VALUE IF NOT EXISTS 'disputed';
+
+CREATE TYPE stripe_event_status AS ENUM ('pending', 'processed', 'failed');
+
+-- Webhook events are stored here as received and applied by a background job,
+-- so the webhook can answer Stripe straight away. The event ID as primary key
+-- makes Stripe's retries no-ops.
+CREATE TABLE stripe_events (
+    id VARCHAR(255) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status stripe_event_status NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_stripe_events_pending ON stripe_events(next_attempt_at) WHERE status = 'pending';
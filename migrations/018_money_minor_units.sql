@@ -0,0 +1,30 @@
+-- Amounts are stored as integers in the currency's minor units (cents for USD,
+-- yen for JPY) next to the currency they are in. Everything charged so far was
+-- in USD, so existing amounts are converted to cents and keep that currency.
+
+ALTER TABLE bookings
+    ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * 100),
+    ALTER COLUMN cancellation_fee TYPE BIGINT USING ROUND(cancellation_fee * 100),
+    ALTER COLUMN refunded_amount TYPE BIGINT USING ROUND(refunded_amount * 100),
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE bookings ALTER COLUMN currency SET DEFAULT 'JPY';
+
+-- Extra payments and extensions are in their booking's currency
+ALTER TABLE booking_payments
+    ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * 100),
+    ALTER COLUMN refunded_amount TYPE BIGINT USING ROUND(refunded_amount * 100);
+
+ALTER TABLE booking_extensions
+    ALTER COLUMN hourly_rate TYPE BIGINT USING ROUND(hourly_rate * 100),
+    ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * 100);
+
+-- Casts are priced in yen from now on at the rank rates
+ALTER TABLE cast_profiles
+    ALTER COLUMN hourly_rate TYPE BIGINT USING ROUND(hourly_rate),
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'JPY';
+
+UPDATE cast_profiles SET hourly_rate = CASE rank
+    WHEN 'vip' THEN 15000
+    WHEN 'premium' THEN 10000
+    ELSE 6000
+END;
@@ -0,0 +1,100 @@
+-- The platform's cut of a booking, fixed when the booking is made so later
+-- changes to the commission rates don't rewrite past bookings
+ALTER TABLE bookings ADD COLUMN commission_percent SMALLINT NOT NULL DEFAULT 0
+    CHECK (commission_percent BETWEEN 0 AND 100);
+
+UPDATE bookings b SET commission_percent = CASE cp.rank
+    WHEN 'vip' THEN 20
+    WHEN 'premium' THEN 25
+    ELSE 30
+END
+FROM cast_profiles cp WHERE cp.user_id = b.cast_id;
+
+-- Double-entry ledger of the money that moves through the platform. Each
+-- transaction's entries sum to zero per currency: debits are positive and
+-- credits negative, in the currency's minor units.
+CREATE TABLE ledger_accounts (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(100) NOT NULL UNIQUE,
+    account_type VARCHAR(30) NOT NULL, -- stripe_clearing, guest_deposits, platform_fees or cast_payable
+    user_id INTEGER REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE ledger_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL, -- charge, refund, earning or payout
+    booking_id INTEGER REFERENCES bookings(id),
+    -- The Stripe object behind the transaction, so it is only booked once
+    reference VARCHAR(255),
+    description TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (kind, reference)
+);
+
+CREATE TABLE ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id BIGINT NOT NULL REFERENCES ledger_transactions(id),
+    account_id INTEGER NOT NULL REFERENCES ledger_accounts(id),
+    booking_id INTEGER REFERENCES bookings(id),
+    amount BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_ledger_transactions_booking_id ON ledger_transactions(booking_id);
+CREATE INDEX idx_ledger_entries_transaction_id ON ledger_entries(transaction_id);
+CREATE INDEX idx_ledger_entries_account_id ON ledger_entries(account_id, created_at);
+CREATE INDEX idx_ledger_entries_booking_id ON ledger_entries(booking_id);
+
+-- Checked at commit, once all of a transaction's entries are in
+CREATE OR REPLACE FUNCTION check_ledger_transaction_balanced()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM ledger_entries
+        WHERE transaction_id = NEW.transaction_id
+        GROUP BY currency
+        HAVING SUM(amount) <> 0
+    ) THEN
+        RAISE EXCEPTION 'ledger transaction % does not balance', NEW.transaction_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced AFTER INSERT ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_ledger_transaction_balanced();
+
+INSERT INTO ledger_accounts (code, account_type) VALUES
+    ('stripe_clearing', 'stripe_clearing'),
+    ('guest_deposits', 'guest_deposits'),
+    ('platform_fees', 'platform_fees');
+
+-- Bookings completed before the ledger existed are booked as earned in full,
+-- net of what was refunded
+INSERT INTO ledger_accounts (code, account_type, user_id)
+SELECT DISTINCT 'cast_payable:' || cast_id, 'cast_payable', cast_id
+FROM bookings WHERE status = 'completed';
+
+WITH earned AS (
+    SELECT id, cast_id, currency, amount - refunded_amount AS net,
+           ROUND((amount - refunded_amount) * commission_percent / 100.0)::BIGINT AS fee
+    FROM bookings
+    WHERE status = 'completed' AND amount > refunded_amount
+), txn AS (
+    INSERT INTO ledger_transactions (kind, booking_id, description)
+    SELECT 'earning', id, 'completed before the ledger' FROM earned
+    RETURNING id, booking_id
+)
+INSERT INTO ledger_entries (transaction_id, account_id, booking_id, amount, currency)
+SELECT t.id, a.id, e.id, x.amount, e.currency
+FROM txn t
+JOIN earned e ON e.id = t.booking_id
+CROSS JOIN LATERAL (VALUES
+    ('stripe_clearing', e.net),
+    ('platform_fees', -e.fee),
+    ('cast_payable:' || e.cast_id, e.fee - e.net)
+) AS x(code, amount)
+JOIN ledger_accounts a ON a.code = x.code;
@@ -0,0 +1,34 @@
+-- The cast's Stripe Connect Express account, which payouts are transferred to
+ALTER TABLE cast_profiles
+    ADD COLUMN stripe_account_id VARCHAR(255) UNIQUE,
+    ADD COLUMN payouts_details_submitted BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN payouts_enabled BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TYPE payout_status AS ENUM ('pending', 'paid', 'failed');
+
+-- A transfer of what a cast is owed to their connected account. The row is
+-- written before the transfer is made, and its ID is the transfer's
+-- idempotency key, so a payout interrupted halfway is retried rather than
+-- sent twice.
+CREATE TABLE payouts (
+    id SERIAL PRIMARY KEY,
+    cast_id INTEGER NOT NULL REFERENCES users(id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    status payout_status NOT NULL DEFAULT 'pending',
+    stripe_account_id VARCHAR(255) NOT NULL,
+    stripe_transfer_id VARCHAR(255) UNIQUE,
+    failure_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    paid_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_payouts_cast_id ON payouts(cast_id, created_at);
+CREATE INDEX idx_payouts_pending ON payouts(cast_id) WHERE status = 'pending';
+
+-- One row per weekly batch, so only the first run of the week pays out
+CREATE TABLE payout_batches (
+    week_of DATE PRIMARY KEY,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
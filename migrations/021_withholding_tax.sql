@@ -0,0 +1,16 @@
+-- Income tax withheld from the cast's share of a booking, in basis points,
+-- fixed when the booking is made like the commission
+ALTER TABLE bookings ADD COLUMN withholding_rate SMALLINT NOT NULL DEFAULT 0
+    CHECK (withholding_rate BETWEEN 0 AND 10000);
+
+-- Bookings not yet settled are withheld from at the standard 10.21%; earnings
+-- already booked stay as they were paid
+UPDATE bookings b SET withholding_rate = 1021
+WHERE NOT EXISTS (
+    SELECT 1 FROM ledger_transactions t WHERE t.booking_id = b.id AND t.kind = 'earning'
+);
+
+INSERT INTO ledger_accounts (code, account_type) VALUES ('withholding_tax', 'withholding_tax');
+
+-- Statements look up a cast's settled bookings by month
+CREATE INDEX idx_ledger_transactions_created_at ON ledger_transactions(kind, created_at);
@@ -0,0 +1,19 @@
+-- A receipt (領収書) issued to a guest for a booking. Each booking gets one,
+-- numbered in sequence without gaps; asking again re-issues the same receipt
+-- as a copy. What it says is fixed when it is first issued.
+CREATE TABLE receipts (
+    id SERIAL PRIMARY KEY,
+    number INTEGER NOT NULL UNIQUE,
+    booking_id INTEGER NOT NULL UNIQUE REFERENCES bookings(id),
+    recipient_name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    -- Consumption tax included in amount, at tax_rate percent
+    tax_rate SMALLINT NOT NULL,
+    tax BIGINT NOT NULL,
+    registration_number VARCHAR(14),
+    issued_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    copies INTEGER NOT NULL DEFAULT 0,
+    last_copied_at TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,21 @@
+-- A chargeback against one of a booking's payments, kept up to date from
+-- the charge.dispute.* webhooks. status is Stripe's, stored as it comes.
+CREATE TABLE disputes (
+    id SERIAL PRIMARY KEY,
+    stripe_dispute_id VARCHAR(255) NOT NULL UNIQUE,
+    booking_id INTEGER NOT NULL REFERENCES bookings(id),
+    stripe_payment_intent_id VARCHAR(255) NOT NULL,
+    amount BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    evidence_due_by TIMESTAMP WITH TIME ZONE,
+    evidence TEXT NOT NULL DEFAULT '',
+    evidence_submitted_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_disputes_booking_id ON disputes(booking_id);
+CREATE INDEX idx_disputes_open ON disputes(evidence_due_by) WHERE closed_at IS NULL;
@@ -0,0 +1,8 @@
+-- The Stripe customer a guest's cards are saved to, so later payments such
+-- as tips can be charged without the guest entering their card again
+ALTER TABLE users ADD COLUMN stripe_customer_id VARCHAR(255) UNIQUE;
+
+-- A tip's share that goes to the cast, fixed when it is paid. NULL for the
+-- other purposes, which are split at the booking's commission.
+ALTER TABLE booking_payments ADD COLUMN cast_percent SMALLINT
+    CHECK (cast_percent BETWEEN 0 AND 100);
@@ -0,0 +1,37 @@
+-- Discount codes guests enter when booking. discount_value is a percentage
+-- or, for fixed discounts, an amount in the minor units of currency.
+CREATE TABLE promo_codes (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    discount_type VARCHAR(10) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value BIGINT NOT NULL CHECK (discount_value > 0),
+    currency CHAR(3),
+    starts_at TIMESTAMP WITH TIME ZONE,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    max_uses INTEGER CHECK (max_uses > 0),
+    max_uses_per_user INTEGER CHECK (max_uses_per_user > 0),
+    first_booking_only BOOLEAN NOT NULL DEFAULT FALSE,
+    cast_ranks TEXT[] NOT NULL DEFAULT '{}', -- empty for any rank
+    service_areas TEXT[] NOT NULL DEFAULT '{}', -- empty for any area
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (discount_type = 'fixed' OR discount_value <= 100),
+    CHECK ((discount_type = 'fixed') = (currency IS NOT NULL))
+);
+
+-- Codes are matched case-insensitively
+CREATE UNIQUE INDEX idx_promo_codes_code ON promo_codes(UPPER(code));
+
+CREATE TRIGGER update_promo_codes_updated_at BEFORE UPDATE ON promo_codes
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- What the code took off the booking; amount is what the guest pays after it
+ALTER TABLE bookings ADD COLUMN promo_code_id INTEGER REFERENCES promo_codes(id);
+ALTER TABLE bookings ADD COLUMN discount BIGINT NOT NULL DEFAULT 0 CHECK (discount >= 0);
+
+CREATE INDEX idx_bookings_promo_code_id ON bookings(promo_code_id) WHERE promo_code_id IS NOT NULL;
+
+-- The platform's cost of discounts, paid to casts on the guest's behalf
+INSERT INTO ledger_accounts (code, account_type) VALUES ('promotions', 'promotions');
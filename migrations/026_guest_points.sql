@@ -0,0 +1,25 @@
+-- Loyalty points guests earn on completed bookings and spend as a discount on
+-- later ones, one point to the yen. Each row changes the guest's balance by
+-- points. Earned and restored rows are lots, spent first to expire first,
+-- with remaining what is left of them; redeemed and expired rows are
+-- negative.
+CREATE TABLE guest_points (
+    id SERIAL PRIMARY KEY,
+    guest_id INTEGER NOT NULL REFERENCES users(id),
+    booking_id INTEGER REFERENCES bookings(id),
+    kind VARCHAR(20) NOT NULL, -- earned, redeemed, restored or expired
+    points INTEGER NOT NULL,
+    remaining INTEGER NOT NULL DEFAULT 0 CHECK (remaining >= 0),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_guest_points_guest_id ON guest_points(guest_id, created_at);
+CREATE INDEX idx_guest_points_expiring ON guest_points(expires_at) WHERE remaining > 0;
+
+-- A booking earns points, spends them and gets them back at most once each
+CREATE UNIQUE INDEX idx_guest_points_booking ON guest_points(booking_id, kind)
+    WHERE kind IN ('earned', 'redeemed', 'restored');
+
+-- Points spent on the booking, included in its discount
+ALTER TABLE bookings ADD COLUMN points_redeemed INTEGER NOT NULL DEFAULT 0 CHECK (points_redeemed >= 0);
@@ -0,0 +1,42 @@
+-- Every user has a code others can sign up with. Signups are recorded with
+-- the device and address they came from, to spot users referring themselves.
+ALTER TABLE users ADD COLUMN referral_code VARCHAR(20) UNIQUE;
+ALTER TABLE users ADD COLUMN signup_device_id VARCHAR(255);
+ALTER TABLE users ADD COLUMN signup_ip VARCHAR(45);
+
+-- Existing users get a code of six random characters and their ID, which
+-- can't clash with each other
+UPDATE users SET referral_code = UPPER(SUBSTRING(MD5(RANDOM()::text) FROM 1 FOR 6)) || id
+WHERE referral_code IS NULL;
+
+CREATE INDEX idx_users_signup_device_id ON users(signup_device_id) WHERE signup_device_id IS NOT NULL;
+
+-- A user signed up with another's code. Both are rewarded once the referee
+-- qualifies: a guest by completing their first booking, a cast by being
+-- approved.
+CREATE TABLE referrals (
+    id SERIAL PRIMARY KEY,
+    referrer_id INTEGER NOT NULL REFERENCES users(id),
+    referee_id INTEGER NOT NULL UNIQUE REFERENCES users(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending or rewarded
+    rewarded_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (referrer_id <> referee_id)
+);
+
+CREATE INDEX idx_referrals_referrer_id ON referrals(referrer_id);
+
+-- What each side got: guests points, casts a bonus paid out with their
+-- earnings
+CREATE TABLE referral_rewards (
+    id SERIAL PRIMARY KEY,
+    referral_id INTEGER NOT NULL REFERENCES referrals(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    kind VARCHAR(20) NOT NULL, -- points or bonus
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3), -- for bonuses
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (referral_id, user_id)
+);
+
+CREATE INDEX idx_referral_rewards_user_id ON referral_rewards(user_id);
@@ -0,0 +1,5 @@
+-- Admins aren't users, so the Idempotency-Keys they send are kept without a
+-- user_id. A key is unique per user, and among admins.
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ALTER COLUMN user_id DROP NOT NULL;
+CREATE UNIQUE INDEX idx_idempotency_keys_user_key ON idempotency_keys ((COALESCE(user_id, 0)), key);
@@ -0,0 +1,7 @@
+-- A refund after a booking was receipted voids its receipt, as the amount on
+-- it no longer stands. The voided receipt keeps its number, so the sequence
+-- has no gaps, and the next one issued for the booking gets a new number.
+ALTER TABLE receipts ADD COLUMN voided_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE receipts DROP CONSTRAINT receipts_booking_id_key;
+CREATE UNIQUE INDEX idx_receipts_booking_id ON receipts(booking_id) WHERE voided_at IS NULL;